@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gigatar/file-encryptor/pkg/batch"
+	"github.com/gigatar/file-encryptor/pkg/encryption"
+	"github.com/gigatar/file-encryptor/pkg/kdf"
+	"golang.org/x/term"
+)
+
+// encryptCommand encrypts files, directory trees and stdin.
+var encryptCommand = &command{
+	name:    "encrypt",
+	args:    "[flags] <input>",
+	summary: "Encrypt a file, a directory tree or stdin",
+	help: `Encrypts the input into <input>.enc, or into -out. A directory is encrypted
+into a single file holding the whole tree. When data is piped in and no input
+is given, it is read from stdin and written to stdout unless -out is given.
+
+With -r, or when the input is a glob pattern, every matching file is
+encrypted into the -out directory after a single password prompt.
+
+-chunk-size selects the amount of plaintext sealed in each chunk. It is
+recorded in the file, so decrypting needs no flag. Chunks of 1M to 4M cut
+the overhead of large sequential backups, while chunks of 4K make reading
+small ranges cheaper.
+
+-parity adds Reed–Solomon parity, as a percentage of the data, so that
+chunks damaged by bad sectors or bit rot can be rebuilt when the file is
+decrypted or verified. With -parity 10%, any one damaged chunk in every
+ten can be repaired. Parity is only used when the file is read from disk,
+not from stdin, and files with parity cannot be appended to.
+
+-append extends the encrypted -out file in place instead of writing a
+temporary file: the new chunks are written after its end and synced before
+its final chunk is rewritten. A failed or interrupted append leaves the file
+as it was, except for a crash during that last write, which can leave it
+unreadable from its final chunk on; decrypt -salvage then recovers the
+chunks before it.`,
+	flags: func(fs *flag.FlagSet, o *options) {
+		o.inOutFlags(fs)
+		o.passwordFlag(fs)
+		o.batchFlags(fs)
+		o.quietFlag(fs)
+		fs.BoolVar(&o.xattrs, "xattrs", false, "Record extended attributes")
+		fs.Var(&o.chunkSize, "chunk-size", "Plaintext `size` of each chunk, a power of two from 4K to 16M (default 64K)")
+		fs.Var(&o.parity, "parity", "Add `N%` of Reed–Solomon parity to repair damaged chunks, from 1% to 100%")
+		fs.BoolVar(&o.appendOut, "append", false, "Append the input to the plaintext of the existing encrypted -out file")
+		fs.Var(&o.excludes, "exclude", "gitignore-style pattern of paths to skip when encrypting a directory (repeatable)")
+	},
+	run: runEncrypt,
+}
+
+// decryptCommand decrypts files, ranges of files and stdin.
+var decryptCommand = &command{
+	name:    "decrypt",
+	args:    "[flags] <input>",
+	summary: "Decrypt a file, a range of it or stdin",
+	help: `Decrypts the input into its name without the .enc suffix, or into -out. A
+directory tree is extracted into a new directory. When data is piped in and
+no input is given, it is read from stdin and written to stdout unless -out is
+given.
+
+With -offset, -length or -tail, only the requested range of the plaintext is
+decrypted, and only the chunks overlapping it are read and authenticated.
+
+Damaged chunks of files encrypted with -parity are rebuilt from the parity
+when the input is a file. The number of repaired chunks is reported.
+
+With -restore-meta, the original file or directory is recreated under its
+original name and attributes in the -out directory, or next to the input.
+
+With -r, or when the input is a glob pattern, every matching *.enc file is
+decrypted into the -out directory after a single password prompt.
+
+-salvage is UNSAFE and only meant for recovering what is left of a damaged
+file. Instead of stopping at the first chunk that fails authentication, it
+writes every chunk that still authenticates, finds the chunk framing again
+after damaged, lost or inserted bytes, and replaces what is lost with zeros
+(or leaves it out with -skip-damaged). The damaged byte ranges are listed,
+and written as JSON with -report. The output as a whole is not
+authenticated: the exit status is 4 whenever anything was lost.`,
+	flags: func(fs *flag.FlagSet, o *options) {
+		o.inOutFlags(fs)
+		o.passwordFlag(fs)
+		o.batchFlags(fs)
+		o.quietFlag(fs)
+		fs.BoolVar(&o.restoreMeta, "restore-meta", false, "Recreate the original file name and attributes in the -out directory")
+		fs.Var(&o.offset, "offset", "Plaintext offset at which decryption starts (accepts K, M, G and T suffixes)")
+		fs.Var(&o.length, "length", "Number of plaintext bytes to decrypt from -offset")
+		fs.Var(&o.tail, "tail", "Decrypt only the last N bytes of plaintext")
+		fs.BoolVar(&o.salvage, "salvage", false, "UNSAFE: recover what still authenticates from a damaged file, zero-filling the rest")
+		fs.BoolVar(&o.skipDamaged, "skip-damaged", false, "With -salvage, leave damaged chunks out instead of zero-filling them")
+		fs.StringVar(&o.report, "report", "", "With -salvage, write the damage report as JSON to this `file`")
+	},
+	run: runDecrypt,
+}
+
+// isPattern reports whether name is a glob pattern.
+func isPattern(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// streamInput sets the input and reads the password file for encrypt and
+// decrypt. Data piped into the tool is read from stdin.
+func (o *options) streamInput(args []string) error {
+	if err := o.inputArg(args); err != nil {
+		return err
+	}
+	if o.in == "" && !term.IsTerminal(int(os.Stdin.Fd())) {
+		o.in = "-"
+	}
+	if o.in == "" {
+		return usageError("no input given")
+	}
+
+	return o.readPasswordFile()
+}
+
+// defaultOutput derives -out from the input when it is not given: stdin
+// goes to stdout, encrypting adds the .enc suffix and decrypting strips it.
+func (o *options) defaultOutput(encrypt bool) error {
+	switch {
+	case o.out != "":
+	case o.in == "-":
+		o.out = "-"
+	case encrypt:
+		o.out = filepath.Clean(o.in) + ".enc"
+	case strings.HasSuffix(o.in, ".enc") && filepath.Base(o.in) != ".enc":
+		o.out = strings.TrimSuffix(o.in, ".enc")
+	default:
+		return usageError("cannot derive the output name from %s, which does not end in .enc; use -out", o.in)
+	}
+
+	return nil
+}
+
+// checkOutput refuses an output that is the input itself, or that already
+// exists unless overwriting is allowed.
+func checkOutput(in, out string, overwrite bool) error {
+	if out == "-" {
+		return nil
+	}
+	if in != "-" && sameFile(in, out) {
+		return usageError("the output %s is the input itself", out)
+	}
+	if _, err := os.Lstat(out); err == nil && !overwrite {
+		return usageError("%s already exists; use -force to replace it", out)
+	}
+
+	return nil
+}
+
+// runEncrypt implements the encrypt command.
+func runEncrypt(ctx context.Context, o *options, args []string) error {
+	if err := o.streamInput(args); err != nil {
+		return err
+	}
+	if err := o.checkChunkSize(); err != nil {
+		return err
+	}
+	if err := o.checkParity(); err != nil {
+		return err
+	}
+	if o.in != "-" && (o.recursive || isPattern(o.in)) {
+		return runBatch(ctx, "encrypt", o)
+	}
+
+	if err := o.defaultOutput(true); err != nil {
+		return err
+	}
+	// Appending modifies the existing output, so it need not be forced.
+	if err := checkOutput(o.in, o.out, o.force || o.appendOut); err != nil {
+		return err
+	}
+
+	if o.in == "-" || o.out == "-" {
+		return runStream(ctx, "encrypt", o)
+	}
+
+	info, err := os.Stat(o.in)
+	if err != nil {
+		return fmt.Errorf("encryption failed: %w", err)
+	}
+	e, err := o.encryptor(true)
+	if err != nil {
+		return err
+	}
+	if o.appendOut {
+		if err := e.AppendFile(ctx, o.in, o.out); err != nil {
+			return fmt.Errorf("append failed: %w", err)
+		}
+		status("✅ Appended successfully.")
+		return nil
+	}
+
+	encrypt := e.EncryptFile
+	if o.xattrs {
+		encrypt = e.EncryptFileWithXattrs
+	}
+	if info.IsDir() {
+		encrypt = func(ctx context.Context, inName, outName string) error {
+			return e.EncryptDir(ctx, inName, outName, o.excludes)
+		}
+	}
+	if err := encrypt(ctx, o.in, o.out); err != nil {
+		return fmt.Errorf("encryption failed: %w", err)
+	}
+	status("✅ Encrypted successfully to %s.", o.out)
+
+	return nil
+}
+
+// runDecrypt implements the decrypt command.
+func runDecrypt(ctx context.Context, o *options, args []string) error {
+	if err := o.streamInput(args); err != nil {
+		return err
+	}
+	if err := o.checkSalvage(); err != nil {
+		return err
+	}
+	if o.in != "-" && (o.recursive || isPattern(o.in)) {
+		return runBatch(ctx, "decrypt", o)
+	}
+
+	if o.restoreMeta {
+		dir := o.out
+		if dir == "" {
+			dir = filepath.Dir(o.in)
+		}
+		e, err := o.encryptor(true)
+		if err != nil {
+			return err
+		}
+		path, err := e.RestoreFile(ctx, o.in, dir)
+		if err != nil {
+			return fmt.Errorf("decryption failed: %w", err)
+		}
+		status("✅ Decrypted successfully to %s.", path)
+		o.reportRepairs()
+		return nil
+	}
+
+	if err := o.defaultOutput(false); err != nil {
+		return err
+	}
+	if err := checkOutput(o.in, o.out, o.force); err != nil {
+		return err
+	}
+
+	if o.salvage {
+		return runSalvage(ctx, o)
+	}
+	if o.offset.set || o.length.set || o.tail.set {
+		return decryptRange(ctx, o)
+	}
+	if o.in == "-" || o.out == "-" {
+		return runStream(ctx, "decrypt", o)
+	}
+
+	e, err := o.encryptor(true)
+	if err != nil {
+		return err
+	}
+	if err := e.DecryptFile(ctx, o.in, o.out); err != nil {
+		return fmt.Errorf("decryption failed: %w", err)
+	}
+	status("✅ Decrypted successfully to %s.", o.out)
+	o.reportRepairs()
+
+	return nil
+}
+
+// runStream encrypts or decrypts between stdin or stdout, given as "-", and
+// files. Only ciphertext or plaintext is written to stdout.
+func runStream(ctx context.Context, mode string, o *options) error {
+	in, out := o.in, o.out
+	src := os.Stdin
+	if in != "-" {
+		f, err := os.Open(in)
+		if err != nil {
+			return fmt.Errorf("opening input failed: %w", err)
+		}
+		defer f.Close()
+		src = f
+	}
+
+	e, err := o.encryptor(true)
+	if err != nil {
+		return err
+	}
+
+	failed, done := "decryption failed", "✅ Decrypted successfully."
+	if mode == "encrypt" {
+		failed, done = "encryption failed", "✅ Encrypted successfully."
+	}
+	switch {
+	case mode == "encrypt" && out == "-":
+		if term.IsTerminal(int(os.Stdout.Fd())) {
+			return usageError("refusing to write ciphertext to a terminal; redirect stdout or use -out")
+		}
+		err = e.EncryptStream(ctx, os.Stdout, src)
+	case mode == "encrypt":
+		err = e.EncryptReader(ctx, src, out)
+	case out == "-":
+		err = e.DecryptStream(ctx, os.Stdout, src)
+	default:
+		err = e.DecryptReader(ctx, src, out)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", failed, err)
+	}
+	status(done)
+
+	return nil
+}
+
+// decryptRange decrypts the plaintext range selected by -offset and -length,
+// or by -tail, into -out.
+func decryptRange(ctx context.Context, o *options) error {
+	in, out, offset, length, tail := o.in, o.out, o.offset, o.length, o.tail
+	if in == "-" {
+		return usageError("a range can only be decrypted from a file, not from stdin")
+	}
+	if tail.set && (offset.set || length.set) {
+		return usageError("-tail cannot be combined with -offset or -length")
+	}
+
+	start, n := offset.n, int64(-1)
+	if length.set {
+		n = length.n
+	}
+	if tail.set {
+		start, n = -tail.n, tail.n
+	}
+
+	e, err := o.encryptor(true)
+	if err != nil {
+		return err
+	}
+	decrypt := e.DecryptRange
+	if out == "-" {
+		decrypt = func(ctx context.Context, inName, _ string, offset, length int64) error {
+			return e.DecryptRangeStream(ctx, os.Stdout, inName, offset, length)
+		}
+	}
+	if err := decrypt(ctx, in, out, start, n); err != nil {
+		return fmt.Errorf("decryption failed: %w", err)
+	}
+	status("✅ Decrypted successfully.")
+	o.reportRepairs()
+
+	return nil
+}
+
+// runBatch encrypts or decrypts every file below the -in directory (with
+// -r) or matching the -in glob pattern into the -out directory. The
+// password is read once and Argon2id runs once per distinct salt; each file
+// still gets its own payload key. Per-file errors are reported in the
+// summary without stopping the batch, and existing outputs are only
+// replaced with -force. No progress bar is drawn.
+func runBatch(ctx context.Context, mode string, o *options) error {
+	if o.out == "" {
+		return usageError("-out must name the output directory in batch mode")
+	}
+
+	var rename func(string) string
+	switch mode {
+	case "encrypt":
+		rename = func(name string) string { return name + ".enc" }
+	case "decrypt":
+		rename = func(name string) string { return strings.TrimSuffix(name, ".enc") }
+	}
+
+	// Only files that look encrypted are decrypted.
+	list, err := listJobs(o.in, o.out, o.recursive, rename, mode == "decrypt")
+	if err != nil {
+		return err
+	}
+	e, err := o.batchEncryptor()
+	if err != nil {
+		return err
+	}
+
+	process := e.DecryptFile
+	if mode == "encrypt" {
+		process = e.EncryptFile
+		if o.xattrs {
+			process = e.EncryptFileWithXattrs
+		}
+	}
+
+	results := batch.Run(list, o.jobs, func(job batch.Job) error {
+		if err := checkOutput(job.Src, job.Dst, o.force); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(job.Dst), 0755); err != nil {
+			return err
+		}
+		return process(ctx, job.Src, job.Dst)
+	})
+
+	failed := batch.Failed(results)
+	code := 0
+	for _, r := range failed {
+		status("❌ %s: %v", r.Src, r.Err)
+		code = max(code, exitCode(r.Err))
+	}
+	status("✅ %d of %d files %sed successfully, %d failed.",
+		len(results)-len(failed), len(results), mode, len(failed))
+	o.reportRepairs()
+
+	if len(failed) > 0 {
+		return &exitError{code: code}
+	}
+	return nil
+}
+
+// listJobs lists the files below the in directory (with recursive) or
+// matching the in glob pattern, optionally keeping only *.enc files. It
+// fails if nothing matches.
+func listJobs(in, out string, recursive bool, rename func(string) string, encOnly bool) ([]batch.Job, error) {
+	var list []batch.Job
+	var err error
+	if recursive {
+		list, err = batch.Walk(in, out, rename)
+	} else {
+		list, err = batch.Glob(in, out, rename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing input files failed: %w", err)
+	}
+
+	if encOnly {
+		filtered := list[:0]
+		for _, job := range list {
+			if strings.HasSuffix(job.Src, ".enc") {
+				filtered = append(filtered, job)
+			}
+		}
+		list = filtered
+	}
+	if len(list) == 0 {
+		return nil, errors.New("no input files found")
+	}
+
+	return list, nil
+}
+
+// batchEncryptor reads the password once for a batch of files and returns
+// an Encryptor that derives every key from it, running Argon2id once per
+// distinct salt.
+func (o *options) batchEncryptor() (*encryption.Encryptor, error) {
+	password := o.password
+	if password == nil {
+		var err error
+		if password, err = kdf.ReadPassword(); err != nil {
+			return nil, fmt.Errorf("reading password failed: %w", err)
+		}
+	}
+
+	// Files are already processed in parallel, so each one is processed serially.
+	return encryption.NewEncryptor(&encryption.Options{
+		Password:        password,
+		Jobs:            1,
+		ChunkSize:       int(o.chunkSize.n),
+		Parity:          o.parity.n,
+		OnRepair:        func(int) { o.repaired.Add(1) },
+		UnsafeStreaming: o.unsafeStreaming,
+	})
+}
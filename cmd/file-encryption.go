@@ -1,72 +1,387 @@
 // Package main implements a command-line tool for file encryption and decryption.
-// It provides a simple interface to encrypt and decrypt files using AES-GCM-SIV
-// encryption with password-based key derivation.
+// It provides a simple interface to encrypt and decrypt files using AES-256-GCM
+// encryption, with per-file keys derived through HKDF from a password-based
+// Argon2id key.
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gigatar/file-encryptor/pkg/encryption"
+	"github.com/gigatar/file-encryptor/pkg/kdf"
+	"github.com/gigatar/file-encryptor/pkg/vault"
+	"golang.org/x/term"
 )
 
-// logFatal prints an error message and exits with status code 1.
-func logFatal(msg string) {
-	fmt.Println(msg)
-	os.Exit(1)
+// Exit statuses. Scripts can tell a mistyped command line, a wrong
+// password and a damaged file apart without parsing the error message.
+const (
+	// exitFailure reports an I/O error or any other failure.
+	exitFailure = 1
+
+	// exitUsage reports an invalid command line.
+	exitUsage = 2
+
+	// exitWrongKey reports a wrong password or key.
+	exitWrongKey = 3
+
+	// exitCorrupted reports an input that is damaged, truncated, written
+	// in an unsupported format version, not an encrypted file or asking
+	// for more key derivation work than is allowed.
+	exitCorrupted = 4
+
+	// exitInterrupted reports that the program was interrupted, following
+	// the shell convention of 128 plus SIGINT.
+	exitInterrupted = 130
+)
+
+// exitError is an error with a specific exit status. An exitError without
+// an underlying error exits silently, after a report has been printed.
+type exitError struct {
+	code int
+	err  error
+}
+
+// Error returns the message of the underlying error.
+func (e *exitError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("exit status %d", e.code)
+	}
+	return e.err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// usageError returns an error that exits with exitUsage.
+func usageError(format string, args ...any) error {
+	return &exitError{code: exitUsage, err: fmt.Errorf(format, args...)}
+}
+
+// exitCode returns the exit status for err.
+func exitCode(err error) int {
+	var exitErr *exitError
+	var corrupted *encryption.ErrCorrupted
+	switch {
+	case errors.As(err, &exitErr):
+		return exitErr.code
+	case errors.Is(err, encryption.ErrWrongKey):
+		return exitWrongKey
+	case errors.As(err, &corrupted), errors.Is(err, encryption.ErrTruncated),
+		errors.Is(err, encryption.ErrUnsupportedVersion), errors.Is(err, encryption.ErrNotEncrypted),
+		errors.Is(err, encryption.ErrKDFTooStrong), errors.Is(err, vault.ErrNotVault):
+		return exitCorrupted
+	default:
+		return exitFailure
+	}
+}
+
+// command is a subcommand of the tool.
+type command struct {
+	// name is the word that selects the command.
+	name string
+
+	// args is the synopsis of the arguments that follow the name.
+	args string
+
+	// summary is the one-line description shown in the command list.
+	summary string
+
+	// help is the longer description shown by "help <command>".
+	help string
+
+	// flags defines the command's flags, storing their values in o.
+	flags func(fs *flag.FlagSet, o *options)
+
+	// run performs the command. ctx is canceled when the program is
+	// interrupted.
+	run func(ctx context.Context, o *options, args []string) error
+}
+
+// commands lists every command in the order they are shown.
+var commands = []*command{
+	encryptCommand,
+	decryptCommand,
+	verifyCommand,
+	inspectCommand,
+	rekeyCommand,
+	migrateCommand,
+	vaultCommand,
+	serveCommand,
+	keygenCommand,
+}
+
+// findCommand returns the command called name, or nil.
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// newFlagSet returns the flag set of cmd, storing the values in o.
+func (cmd *command) newFlagSet(o *options) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	cmd.flags(fs, o)
+	return fs
+}
+
+// printHelp writes the usage, description and flags of cmd to w.
+func (cmd *command) printHelp(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s %s %s\n\n%s\n", programName(), cmd.name, cmd.args, cmd.help)
+
+	fs := cmd.newFlagSet(&options{})
+	fs.SetOutput(w)
+	fmt.Fprintln(w, "\nFlags:")
+	fs.PrintDefaults()
+}
+
+// printUsage writes the list of commands to w.
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s <command> [flags] [arguments]\n\nCommands:\n", programName())
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-8s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(w, "\nRun '%s help <command>' for the flags of a command.\n", programName())
+	fmt.Fprintln(w, "\nExit status: 0 on success, 1 on I/O and other errors, 2 for usage errors,")
+	fmt.Fprintln(w, "3 for a wrong password, 4 for a corrupted or truncated file and 130 when")
+	fmt.Fprintln(w, "interrupted.")
+}
+
+// programName returns the name the tool was run as.
+func programName() string {
+	if len(os.Args) == 0 {
+		return "file-encryptor"
+	}
+	return filepath.Base(os.Args[0])
+}
+
+// status prints a status message to stderr, so that stdout only ever
+// carries ciphertext, plaintext or the report that was asked for. The line
+// of a progress bar is ended first.
+func status(format string, args ...any) {
+	if activeBar != nil {
+		activeBar.finish()
+		activeBar = nil
+	}
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
 }
 
 // main is the entry point for the file encryption tool.
-// It parses command-line arguments and performs the requested operation:
-//   - encrypt: Encrypts a file using AES-GCM-SIV
-//   - decrypt: Decrypts a previously encrypted file
+// It dispatches to one of the commands:
+//   - encrypt: Encrypts a file, a directory tree or stdin
+//   - decrypt: Decrypts a previously encrypted file, or a range of it
+//   - verify: Authenticates an encrypted file without writing any plaintext
+//   - inspect: Prints the settings and layout of an encrypted file without a password
+//   - rekey: Re-encrypts a file under a new password
+//   - migrate: Converts files in the legacy headerless format to the current format
+//   - vault: Keeps many encrypted files in a single vault file
+//   - serve: Serves streaming encryption and decryption over local HTTP
+//   - keygen: Writes a random password file for -passfile
 //
 // Usage:
 //
-//	file-encryptor [encrypt|decrypt] -in <input> -out <output>
+//	file-encryptor <command> [flags] [input]
+//	file-encryptor help [command]
+//
+// Flags may appear before or after the input. The input may be given as an
+// argument or with -in. Without -out, encrypt writes <input>.enc and decrypt
+// strips the .enc suffix. An existing output is only replaced with -force,
+// and the output may never be the input itself.
+//
+// When data is piped in and no input is given, it is read from stdin, and
+// the result is written to stdout unless -out is given. The password prompt
+// then goes to the terminal (/dev/tty), and every status message and error
+// goes to stderr, so stdout carries nothing but ciphertext or plaintext:
 //
-// Flags:
+//	pg_dump mydb | file-encryptor encrypt -passfile pass.txt > dump.enc
+//	file-encryptor decrypt dump.enc -out - | psql mydb
 //
-//	-in:  Path to the input file
-//	-out: Path to the output file
+// The exit status is 0 on success, 1 for I/O and other errors, 2 for usage
+// errors, 3 for a wrong password, 4 for a corrupted, truncated or
+// unrecognised input and 130 when interrupted. On a terminal, a progress
+// bar is shown unless -quiet is given.
 func main() {
-	// Check for at least one positional argument
-	if len(os.Args) < 4 {
-		logFatal(fmt.Sprintf("Usage: %s [encrypt|decrypt] -in <input> -out <output>", os.Args[0]))
+	if len(os.Args) < 2 {
+		printUsage(os.Stderr)
+		os.Exit(exitUsage)
 	}
 
-	// First arg is the mode
-	mode := os.Args[1]
-
-	// Define flags *after* the mode argument
-	fs := flag.NewFlagSet("file-encryptor", flag.ExitOnError)
-	inFile := fs.String("in", "", "Input file path")
-	outFile := fs.String("out", "", "Output file path")
+	name, args := os.Args[1], os.Args[2:]
+	switch name {
+	case "help", "-h", "-help", "--help":
+		os.Exit(runHelp(args))
+	}
 
-	// Parse remaining args after mode
-	if err := fs.Parse(os.Args[2:]); err != nil {
-		logFatal(fmt.Sprintf("Error parsing flags: %v", err))
+	cmd := findCommand(name)
+	if cmd == nil {
+		status("Unknown command: %s", name)
+		printUsage(os.Stderr)
+		os.Exit(exitUsage)
 	}
 
-	// Validate flags
-	if *inFile == "" || *outFile == "" {
-		logFatal("Both -in and -out must be specified")
+	o := &options{}
+	fs := cmd.newFlagSet(o)
+	positional, err := parseArgs(fs, args)
+	if errors.Is(err, flag.ErrHelp) {
+		cmd.printHelp(os.Stdout)
+		return
+	}
+	if err != nil {
+		status("%v", err)
+		status("Run '%s help %s' for usage.", programName(), cmd.name)
+		os.Exit(exitUsage)
 	}
 
-	// Handle mode
-	switch mode {
-	case "encrypt":
-		if err := encryption.EncryptFile(*inFile, *outFile); err != nil {
-			logFatal(fmt.Sprintf("Encryption failed: %v", err))
+	ctx := cancelOnInterrupt()
+
+	if err := cmd.run(ctx, o, positional); err != nil {
+		if ctx.Err() != nil {
+			status("Interrupted.")
+			os.Exit(exitInterrupted)
 		}
-		fmt.Println("✅ Encrypted successfully.")
-	case "decrypt":
-		if err := encryption.DecryptFile(*inFile, *outFile); err != nil {
-			logFatal(fmt.Sprintf("Decryption failed: %v", err))
+		code := exitCode(err)
+		var exitErr *exitError
+		if !errors.As(err, &exitErr) || exitErr.err != nil {
+			status("❌ %v", err)
 		}
-		fmt.Println("✅ Decrypted successfully.")
-	default:
-		logFatal(fmt.Sprintf("Unknown mode: %s (must be 'encrypt' or 'decrypt')", mode))
+		if code == exitUsage {
+			status("Run '%s help %s' for usage.", programName(), cmd.name)
+		}
+		os.Exit(code)
+	}
+}
+
+// runHelp prints the list of commands, or the help of the command named by
+// the first argument, and returns the exit status.
+func runHelp(args []string) int {
+	if len(args) == 0 {
+		printUsage(os.Stdout)
+		return 0
+	}
+
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		status("Unknown command: %s", args[0])
+		printUsage(os.Stderr)
+		return exitUsage
+	}
+	cmd.printHelp(os.Stdout)
+
+	return 0
+}
+
+// readPasswordFile reads the password from the -passfile file, if one was
+// given.
+func (o *options) readPasswordFile() error {
+	if o.passFile == "" {
+		return nil
+	}
+
+	password, err := kdf.ReadPasswordFile(o.passFile)
+	if err != nil {
+		return fmt.Errorf("reading password failed: %w", err)
+	}
+	o.password = password
+
+	return nil
+}
+
+// getKey derives a key with the default Argon2id parameters, prompting for
+// the password when a key is first needed.
+func (o *options) getKey(salt []byte) ([]byte, error) {
+	if o.password == nil {
+		password, err := kdf.ReadPassword()
+		if err != nil {
+			return nil, err
+		}
+		o.password = password
 	}
+
+	return kdf.DeriveKey(o.password, salt), nil
+}
+
+// encryptor returns an Encryptor that derives keys from the password read
+// so far, or prompts for it when a key is first needed. With progress, a
+// progress bar is drawn on stderr unless -quiet is given or stderr is not a
+// terminal.
+func (o *options) encryptor(progress bool) (*encryption.Encryptor, error) {
+	opts := &encryption.Options{
+		Jobs:            o.jobs,
+		ChunkSize:       int(o.chunkSize.n),
+		Parity:          o.parity.n,
+		OnRepair:        func(int) { o.repaired.Add(1) },
+		UnsafeStreaming: o.unsafeStreaming,
+	}
+	if o.password != nil {
+		opts.Password = o.password
+	} else {
+		opts.GetKey = o.getKey
+	}
+	if progress && !o.quiet && term.IsTerminal(int(os.Stderr.Fd())) {
+		activeBar = newProgressBar(os.Stderr)
+		opts.Progress = activeBar.update
+	}
+
+	return encryption.NewEncryptor(opts)
+}
+
+// inputArg sets -in from the positional arguments, which may hold at most
+// the input.
+func (o *options) inputArg(args []string) error {
+	switch {
+	case len(args) > 1:
+		return usageError("too many arguments: %s", strings.Join(args, " "))
+	case len(args) == 1 && o.in != "":
+		return usageError("the input is given both as an argument and with -in")
+	case len(args) == 1:
+		o.in = args[0]
+	}
+
+	return nil
+}
+
+// interruptGrace is how long an interrupted operation has to stop and
+// remove its partial output before the program exits regardless.
+const interruptGrace = 2 * time.Second
+
+// cancelOnInterrupt returns a context that is canceled when the program is
+// interrupted. Operations in progress then stop before their next chunk and
+// remove their partial output. If they have not returned within
+// interruptGrace, or a second interrupt arrives, for example while the
+// program waits for a password, the temporary outputs are removed and the
+// program exits.
+func cancelOnInterrupt() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+		select {
+		case <-signals:
+		case <-time.After(interruptGrace):
+		}
+		encryption.RemoveTempFiles()
+		status("Interrupted.")
+		os.Exit(exitInterrupted)
+	}()
+
+	return ctx
 }
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gigatar/file-encryptor/pkg/encryption"
+)
+
+// stringList is a flag.Value that collects every occurrence of a repeatable flag.
+type stringList []string
+
+// String returns the collected values separated by commas.
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+// Set appends a value to the list.
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// byteSize is a flag.Value holding a byte count with an optional binary
+// suffix, such as 512, 64K, 10M or 1G.
+type byteSize struct {
+	n   int64
+	set bool
+}
+
+// String returns the byte count in decimal.
+func (b *byteSize) String() string {
+	return strconv.FormatInt(b.n, 10)
+}
+
+// Set parses a byte count with an optional K, M, G or T suffix.
+func (b *byteSize) Set(value string) error {
+	digits, shift := value, 0
+	if len(value) > 0 {
+		if i := strings.IndexByte("KMGT", strings.ToUpper(value)[len(value)-1]); i >= 0 {
+			digits, shift = value[:len(value)-1], 10*(i+1)
+		}
+	}
+
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64>>shift {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	b.n, b.set = n<<shift, true
+
+	return nil
+}
+
+// percent is a flag.Value holding a whole percentage with an optional %
+// suffix, such as 10 or 10%.
+type percent struct {
+	n   int
+	set bool
+}
+
+// String returns the percentage in decimal.
+func (p *percent) String() string {
+	return strconv.Itoa(p.n)
+}
+
+// Set parses a percentage with an optional % suffix.
+func (p *percent) Set(value string) error {
+	n, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid percentage %q", value)
+	}
+	p.n, p.set = n, true
+
+	return nil
+}
+
+// options holds the values of every flag. Each command defines only the
+// flags it uses.
+type options struct {
+	in, out         string
+	force           bool
+	passFile        string
+	newPassFile     string
+	xattrs          bool
+	appendOut       bool
+	excludes        stringList
+	unsafeStreaming bool
+	restoreMeta     bool
+	recursive       bool
+	jobs            int
+	json            bool
+	offset, length  byteSize
+	tail            byteSize
+	chunkSize       byteSize
+	parity          percent
+	salvage         bool
+	skipDamaged     bool
+	report          string
+	quiet           bool
+	listen          string
+	keys            stringList
+	tokenFile       string
+
+	// password is the password read from -passfile or a prompt, or nil
+	// until one has been read.
+	password []byte
+
+	// repaired counts the chunks rebuilt from parity.
+	repaired atomic.Int64
+}
+
+// inOutFlags defines the input and output flags.
+func (o *options) inOutFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.in, "in", "", "Input file path, or - for stdin (may also be given as an argument)")
+	fs.StringVar(&o.out, "out", "", "Output file path, or - for stdout")
+	fs.BoolVar(&o.force, "force", false, "Overwrite the output if it already exists")
+	fs.BoolVar(&o.unsafeStreaming, "unsafe-streaming", false, "Write output directly instead of renaming a temporary file into place (for pipes and devices)")
+}
+
+// passwordFlag defines the -passfile flag.
+func (o *options) passwordFlag(fs *flag.FlagSet) {
+	fs.StringVar(&o.passFile, "passfile", "", "Read the password from the first line of this file instead of prompting")
+}
+
+// batchFlags defines the flags that select and parallelise a batch of files.
+func (o *options) batchFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&o.recursive, "r", false, "Process every file below the -in directory into the -out directory")
+	fs.IntVar(&o.jobs, "jobs", runtime.NumCPU(), "Number of chunks (or, in batch mode, files) processed concurrently")
+}
+
+// quietFlag defines the -quiet flag.
+func (o *options) quietFlag(fs *flag.FlagSet) {
+	fs.BoolVar(&o.quiet, "quiet", false, "Do not show a progress bar")
+}
+
+// checkChunkSize returns a usage error if -chunk-size was given with a size
+// that the encryption package does not accept, before a password is asked for.
+func (o *options) checkChunkSize() error {
+	if !o.chunkSize.set {
+		return nil
+	}
+	if o.appendOut {
+		return usageError("-chunk-size cannot be combined with -append, which keeps the chunk size of the file")
+	}
+	if _, err := encryption.NewEncryptor(&encryption.Options{ChunkSize: int(o.chunkSize.n)}); err != nil {
+		return usageError("invalid -chunk-size: %v", err)
+	}
+
+	return nil
+}
+
+// checkParity returns a usage error if -parity was given with a percentage
+// that the encryption package does not accept, before a password is asked for.
+func (o *options) checkParity() error {
+	if !o.parity.set {
+		return nil
+	}
+	if o.appendOut {
+		return usageError("-parity cannot be combined with -append")
+	}
+	if _, err := encryption.NewEncryptor(&encryption.Options{Parity: o.parity.n}); err != nil || o.parity.n == 0 {
+		return usageError("invalid -parity: must be from 1%% to 100%%")
+	}
+
+	return nil
+}
+
+// reportRepairs tells how many damaged chunks were rebuilt from parity, if
+// any. The data was recovered, but the file should be replaced before more
+// damage accumulates.
+func (o *options) reportRepairs() {
+	if n := o.repaired.Load(); n > 0 {
+		status("⚠️  Repaired %d damaged chunk(s) from parity; re-encrypt the file to restore its protection.", n)
+	}
+}
+
+// parseArgs parses args with fs, allowing flags to follow positional
+// arguments, and returns the positional arguments. Everything after "--"
+// is positional.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := fs.Args()
+		if len(rest) == 0 {
+			return positional, nil
+		}
+		if n := len(args) - len(rest); n > 0 && args[n-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
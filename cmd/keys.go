@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/gigatar/file-encryptor/pkg/encryption"
+	"github.com/gigatar/file-encryptor/pkg/kdf"
+)
+
+// rekeyCommand re-encrypts a file under a new password.
+var rekeyCommand = &command{
+	name:    "rekey",
+	args:    "[flags] <input>",
+	summary: "Re-encrypt a file under a new password",
+	help: `Decrypts the input with the current password and encrypts it again under a
+new one, keeping its contents and metadata. The file is replaced in place
+once the new version has been written completely, unless -out is given.`,
+	flags: func(fs *flag.FlagSet, o *options) {
+		fs.StringVar(&o.in, "in", "", "Input file path (may also be given as an argument)")
+		fs.StringVar(&o.out, "out", "", "Write the rekeyed file here instead of replacing the input")
+		fs.BoolVar(&o.force, "force", false, "Overwrite -out if it already exists")
+		fs.StringVar(&o.passFile, "passfile", "", "Read the current password from the first line of this file")
+		fs.StringVar(&o.newPassFile, "new-passfile", "", "Read the new password from the first line of this file")
+		o.quietFlag(fs)
+	},
+	run: runRekey,
+}
+
+// keygenCommand writes a random password file.
+var keygenCommand = &command{
+	name:    "keygen",
+	args:    "[flags] [output]",
+	summary: "Write a random password file for -passfile",
+	help: `Writes a random 256-bit password, encoded on a single line, to the output
+file, or to stdout if none is given. The file is created readable by its owner
+only, and can be passed to -passfile for unattended use.`,
+	flags: func(fs *flag.FlagSet, o *options) {
+		fs.StringVar(&o.out, "out", "", "Output file path, or - for stdout (may also be given as an argument)")
+		fs.BoolVar(&o.force, "force", false, "Overwrite the output if it already exists")
+	},
+	run: runKeygen,
+}
+
+// runRekey implements the rekey command.
+func runRekey(ctx context.Context, o *options, args []string) error {
+	if err := o.inputArg(args); err != nil {
+		return err
+	}
+	switch o.in {
+	case "":
+		return usageError("no input given")
+	case "-":
+		return usageError("rekey works on files, not on stdin")
+	}
+
+	// Rekeying in place is the default, so -out may name the input.
+	if o.out == "" || sameFile(o.in, o.out) {
+		o.out = o.in
+	} else if err := checkOutput(o.in, o.out, o.force); err != nil {
+		return err
+	}
+
+	if o.passFile != "" {
+		if err := o.readPasswordFile(); err != nil {
+			return err
+		}
+	} else {
+		password, err := kdf.PromptPassword("Current password: ")
+		if err != nil {
+			return fmt.Errorf("reading password failed: %w", err)
+		}
+		o.password = password
+	}
+
+	password, err := o.newPassword()
+	if err != nil {
+		return err
+	}
+	key, err := encryption.NewKeyFromPassword(password)
+	if err != nil {
+		return fmt.Errorf("deriving key failed: %w", err)
+	}
+
+	e, err := o.encryptor(true)
+	if err != nil {
+		return err
+	}
+	if err := e.RekeyFile(ctx, o.in, o.out, key); err != nil {
+		return fmt.Errorf("rekey failed: %w", err)
+	}
+	status("✅ Rekeyed successfully.")
+
+	return nil
+}
+
+// newPassword reads the new password for rekey from -new-passfile, or
+// prompts for it twice.
+func (o *options) newPassword() ([]byte, error) {
+	if o.newPassFile != "" {
+		password, err := kdf.ReadPasswordFile(o.newPassFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading new password failed: %w", err)
+		}
+		return password, nil
+	}
+
+	password, err := kdf.PromptPassword("New password: ")
+	if err != nil {
+		return nil, fmt.Errorf("reading new password failed: %w", err)
+	}
+	confirm, err := kdf.PromptPassword("Confirm new password: ")
+	if err != nil {
+		return nil, fmt.Errorf("reading new password failed: %w", err)
+	}
+	if !bytes.Equal(password, confirm) {
+		return nil, errors.New("the new passwords do not match")
+	}
+	if len(password) == 0 {
+		return nil, errors.New("the new password is empty")
+	}
+
+	return password, nil
+}
+
+// sameFile reports whether a and b name the same existing file.
+func sameFile(a, b string) bool {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(aInfo, bInfo)
+}
+
+// runKeygen implements the keygen command.
+func runKeygen(_ context.Context, o *options, args []string) error {
+	switch {
+	case len(args) > 1:
+		return usageError("too many arguments")
+	case len(args) == 1 && o.out != "":
+		return usageError("the output is given both as an argument and with -out")
+	case len(args) == 1:
+		o.out = args[0]
+	case o.out == "":
+		o.out = "-"
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return fmt.Errorf("generating password failed: %w", err)
+	}
+	line := base64.RawURLEncoding.EncodeToString(secret) + "\n"
+
+	if o.out == "-" {
+		fmt.Print(line)
+		return nil
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if o.force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(o.out, flags, 0600)
+	if os.IsExist(err) {
+		return usageError("%s already exists; use -force to replace it", o.out)
+	}
+	if err != nil {
+		return fmt.Errorf("writing password file failed: %w", err)
+	}
+	if _, err := f.WriteString(line); err != nil {
+		f.Close()
+		return fmt.Errorf("writing password file failed: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("writing password file failed: %w", err)
+	}
+	status("✅ Password written to %s.", o.out)
+
+	return nil
+}
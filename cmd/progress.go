@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// progressInterval is the minimum time between two redraws of the bar.
+const progressInterval = 100 * time.Millisecond
+
+// progressWidth is the number of cells in the bar.
+const progressWidth = 30
+
+// activeBar is the progress bar of the operation in progress, if any.
+var activeBar *progressBar
+
+// progressBar draws the progress of an operation on a single terminal line,
+// with the throughput and, when the total is known, the estimated time left.
+type progressBar struct {
+	w     io.Writer
+	drawn time.Time
+
+	// start and base are the time and progress of the first report. The
+	// throughput is measured from there, so that the time spent deriving
+	// the key does not count.
+	start time.Time
+	base  int64
+
+	// done and total are the values of the last report.
+	done, total int64
+}
+
+// newProgressBar returns a bar that draws on w, which should be a terminal.
+func newProgressBar(w io.Writer) *progressBar {
+	return &progressBar{w: w, total: -1}
+}
+
+// update records a progress report and redraws the bar, at most once per
+// progressInterval unless the operation has completed. It is passed to
+// encryption.Options as the Progress callback.
+func (p *progressBar) update(done, total int64) {
+	p.done, p.total = done, total
+
+	now := time.Now()
+	if p.start.IsZero() {
+		p.start, p.base = now, done
+	}
+	if now.Sub(p.drawn) < progressInterval && (total < 0 || done < total) {
+		return
+	}
+	p.drawn = now
+	p.draw(now)
+}
+
+// finish ends the line of the bar if it was drawn.
+func (p *progressBar) finish() {
+	if !p.drawn.IsZero() {
+		fmt.Fprintln(p.w)
+	}
+}
+
+// draw writes the current state over the previous one.
+func (p *progressBar) draw(now time.Time) {
+	elapsed := now.Sub(p.start).Seconds()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(p.done-p.base) / elapsed
+	}
+
+	var line string
+	if p.total > 0 {
+		fraction := min(float64(p.done)/float64(p.total), 1)
+		filled := int(fraction * progressWidth)
+		line = fmt.Sprintf("%3.0f%% [%s%s] %s / %s  %s/s",
+			fraction*100, strings.Repeat("=", filled), strings.Repeat(" ", progressWidth-filled),
+			formatBytes(p.done), formatBytes(p.total), formatBytes(int64(rate)))
+		if rate > 0 && p.done < p.total {
+			line += "  ETA " + formatDuration(time.Duration(float64(p.total-p.done)/rate*float64(time.Second)))
+		}
+	} else {
+		line = fmt.Sprintf("%s  %s/s", formatBytes(p.done), formatBytes(int64(rate)))
+	}
+
+	// Clear the rest of the line in case the previous one was longer.
+	fmt.Fprintf(p.w, "\r%s\033[K", line)
+}
+
+// formatBytes formats n with a binary unit, such as 12.3 MiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	value, exp := float64(n)/unit, 0
+	for value >= unit && exp < 4 {
+		value /= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTP"[exp])
+}
+
+// formatDuration formats d as minutes and seconds, or hours, minutes and
+// seconds once it exceeds an hour.
+func formatDuration(d time.Duration) string {
+	s := int64(d.Round(time.Second) / time.Second)
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
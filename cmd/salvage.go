@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/gigatar/file-encryptor/pkg/encryption"
+)
+
+// checkSalvage returns a usage error if the salvage flags are combined with
+// anything salvaging does not support.
+func (o *options) checkSalvage() error {
+	if !o.salvage {
+		if o.skipDamaged || o.report != "" {
+			return usageError("-skip-damaged and -report can only be used with -salvage")
+		}
+		return nil
+	}
+
+	switch {
+	case o.in == "-":
+		return usageError("-salvage needs the damaged file itself, not stdin")
+	case o.recursive || isPattern(o.in):
+		return usageError("-salvage works on a single file")
+	case o.restoreMeta, o.offset.set, o.length.set, o.tail.set:
+		return usageError("-salvage cannot be combined with -restore-meta, -offset, -length or -tail")
+	}
+
+	return nil
+}
+
+// runSalvage decrypts whatever still authenticates in the damaged -in file
+// into -out and prints the damage report. It fails with the corrupted exit
+// status if anything was lost, even though the output is kept.
+func runSalvage(ctx context.Context, o *options) error {
+	if o.out == "-" {
+		return usageError("-salvage writes to a file, not to stdout")
+	}
+
+	e, err := o.encryptor(true)
+	if err != nil {
+		return err
+	}
+	report, err := e.SalvageFile(ctx, o.in, o.out, o.skipDamaged)
+	if err != nil {
+		return fmt.Errorf("salvage failed: %w", err)
+	}
+
+	if o.report != "" {
+		out, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return fmt.Errorf("writing the report failed: %w", err)
+		}
+		if err := os.WriteFile(o.report, append(out, '\n'), 0600); err != nil {
+			return fmt.Errorf("writing the report failed: %w", err)
+		}
+	}
+
+	lost := len(report.Damaged) > 0 || report.MetadataDamaged || !report.Complete
+	if !lost {
+		status("✅ Salvaged %s without loss.", o.out)
+		o.reportRepairs()
+		return nil
+	}
+
+	fill := "zero-filled"
+	if o.skipDamaged {
+		fill = "left out"
+	}
+	status("⚠️  SALVAGED OUTPUT IS INCOMPLETE: %s holds %d authenticated chunk(s) and %d bytes; damaged ranges are %s.",
+		o.out, report.Chunks, report.Written, fill)
+	if report.Repaired > 0 {
+		status("   %d chunk(s) were repaired from parity.", report.Repaired)
+	}
+	if report.MetadataDamaged {
+		status("   The metadata record is damaged; the original name and attributes are lost.")
+	}
+	for _, r := range report.Damaged {
+		status("   %s", describeDamage(r))
+	}
+	if !report.Complete {
+		status("   The final chunk was not found; the end of the file may be missing.")
+	}
+
+	return &exitError{code: exitCorrupted}
+}
+
+// describeDamage describes a damaged range of the file and the plaintext it
+// held.
+func describeDamage(r encryption.DamagedRange) string {
+	where := fmt.Sprintf("file bytes %d-%d", r.FileOffset, r.FileOffset+r.FileLength-1)
+	switch {
+	case r.Chunks == 0:
+		return where + ": no data lost"
+	case r.PlaintextLength < 0:
+		return fmt.Sprintf("%s: chunks from %d on lost, plaintext from byte %d on", where, r.FirstChunk, r.PlaintextOffset)
+	default:
+		return fmt.Sprintf("%s: %d chunk(s) from %d lost, plaintext bytes %d-%d",
+			where, r.Chunks, r.FirstChunk, r.PlaintextOffset, r.PlaintextOffset+r.PlaintextLength-1)
+	}
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gigatar/file-encryptor/pkg/encryption"
+	"github.com/gigatar/file-encryptor/pkg/kdf"
+)
+
+// serveCommand runs a local HTTP service that encrypts and decrypts streams.
+var serveCommand = &command{
+	name:    "serve",
+	args:    "[flags] -listen <unix:path|127.0.0.1:port> [-token-file <file>] -key <id>=<passfile>...",
+	summary: "Serve streaming encryption and decryption over local HTTP",
+	help: `Runs an HTTP service for programs that cannot link the Go package:
+
+  POST /encrypt?key=<id>  Encrypts the request body and streams back the
+                          encrypted file
+  POST /decrypt?key=<id>  Decrypts the request body, an encrypted file, and
+                          streams back the plaintext
+  GET  /healthz           Reports that the service is up
+
+Keys are configured with -key, which names a password file for a key ID;
+requests only refer to keys by ID, and no password or key ever crosses the
+connection. With a single -key, ?key may be omitted. The password files are
+read and every key is derived once at startup; decryption derives the key
+of each distinct salt once, keeps the 256 most recently used keys of each
+ID and runs at most two derivations at once. Files whose Argon2id
+parameters ask for more than the defaults are refused (422) before any key
+is derived.
+
+Request and response bodies are streamed, so files of any size are handled
+in constant memory. Errors found before the response starts, such as an
+unknown key ID, a wrong password (403) or a body that is not an encrypted
+file (422), are reported with a status code. Decrypted plaintext is sent as
+each chunk authenticates; if a later chunk is damaged or the file is
+truncated, the connection is aborted without ending the response, so a
+client never mistakes partial output for a complete one.
+
+The service only listens on a Unix socket, which is created readable and
+writable by its owner only, or on a loopback address. Every local user can
+connect to a loopback address and would otherwise be able to encrypt and
+decrypt with the configured keys, reading back plaintext, so listening on
+one requires -token-file: its first line is a token of at least 16 bytes
+that requests to /encrypt and /decrypt must present as
+"Authorization: Bearer <token>", or be refused (401). The token is sent in
+the clear over the loopback connection; prefer a Unix socket where the
+client supports one. A token may also be required on a socket. The service
+stops on Ctrl-C or SIGTERM, letting requests in progress finish for a
+moment.`,
+	flags: func(fs *flag.FlagSet, o *options) {
+		fs.StringVar(&o.listen, "listen", "", "Address to listen on: unix:<path> or <loopback address>:<port>")
+		fs.Var(&o.keys, "key", "Key ID and the password file it reads, as <id>=<passfile> (repeatable)")
+		fs.StringVar(&o.tokenFile, "token-file", "", "Read the bearer token that requests must present from the first line of this file (required on a loopback address)")
+		fs.Var(&o.chunkSize, "chunk-size", "Plaintext bytes per chunk of encrypted files, a power of two from 4K to 16M")
+		fs.Var(&o.parity, "parity", "Add Reed–Solomon parity to encrypted files, as a percentage of the data (1% to 100%)")
+		fs.IntVar(&o.jobs, "jobs", 1, "Number of chunks processed concurrently for each request")
+	},
+	run: runServe,
+}
+
+// keyIDPattern matches valid key IDs, which appear in request URLs.
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// minTokenLen is the shortest bearer token accepted by -token-file.
+const minTokenLen = 16
+
+// shutdownGrace is how long requests in progress may run once the service
+// is stopped. It is shorter than interruptGrace so that the service stops
+// before the program is made to exit.
+const shutdownGrace = time.Second
+
+// Bounds on the key derivations that clients can cause: every file sent to
+// /decrypt names its own salt and Argon2id parameters.
+const (
+	// keyCacheSize is the number of derived keys kept for each key ID.
+	keyCacheSize = 256
+
+	// maxDerivations is the number of key derivations that run at once
+	// across all keys, each taking 64 MiB with the default parameters.
+	maxDerivations = 2
+)
+
+// server holds the Encryptors of the configured keys.
+type server struct {
+	keys map[string]*encryption.Encryptor
+
+	// params are the Argon2id parameters of new files and the most that
+	// the service derives a key with.
+	params kdf.Params
+
+	// derivations holds a token for every key derivation running.
+	derivations chan struct{}
+
+	// token, if set, is the bearer token that requests to /encrypt and
+	// /decrypt must present.
+	token []byte
+}
+
+// runServe implements the serve command.
+func runServe(ctx context.Context, o *options, args []string) error {
+	if len(args) > 0 {
+		return usageError("too many arguments: %s", strings.Join(args, " "))
+	}
+	if o.listen == "" {
+		return usageError("no -listen address given")
+	}
+	if len(o.keys) == 0 {
+		return usageError("no -key given")
+	}
+	if o.tokenFile == "" && !strings.HasPrefix(o.listen, "unix:") {
+		return usageError("-token-file is required on a loopback address, which every local user can connect to")
+	}
+	if err := o.checkChunkSize(); err != nil {
+		return err
+	}
+	if err := o.checkParity(); err != nil {
+		return err
+	}
+
+	ln, err := listen(o.listen)
+	if err != nil {
+		return err
+	}
+	srv, err := o.newServer()
+	if err != nil {
+		ln.Close()
+		return err
+	}
+
+	httpServer := &http.Server{Handler: srv.handler(), ReadHeaderTimeout: 10 * time.Second}
+	done := make(chan error, 1)
+	go func() { done <- httpServer.Serve(ln) }()
+	status("Listening on %s with key(s) %s.", o.listen, strings.Join(srv.ids(), ", "))
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		httpServer.Close()
+	}
+	status("Stopped.")
+
+	return nil
+}
+
+// newServer reads the password file of every -key and derives the key that
+// new files are encrypted under, so that a bad key fails at startup.
+func (o *options) newServer() (*server, error) {
+	srv := newServer(kdf.DefaultParams)
+	if o.tokenFile != "" {
+		token, err := kdf.ReadPasswordFile(o.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading token failed: %w", err)
+		}
+		if len(token) < minTokenLen {
+			return nil, fmt.Errorf("the token in %s is shorter than %d bytes", o.tokenFile, minTokenLen)
+		}
+		srv.token = token
+	}
+	for _, spec := range o.keys {
+		id, passFile, ok := strings.Cut(spec, "=")
+		if !ok || passFile == "" || !keyIDPattern.MatchString(id) {
+			return nil, usageError("invalid -key %q: want <id>=<passfile>, with an ID of letters, digits, '.', '_' and '-'", spec)
+		}
+		if _, dup := srv.keys[id]; dup {
+			return nil, usageError("key ID %q is given more than once", id)
+		}
+
+		password, err := kdf.ReadPasswordFile(passFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading password of key %s failed: %w", id, err)
+		}
+		if err := srv.addKey(id, password, encryption.Options{
+			Jobs:      o.jobs,
+			ChunkSize: int(o.chunkSize.n),
+			Parity:    o.parity.n,
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return srv, nil
+}
+
+// newServer returns a server without keys that encrypts new files with the
+// given Argon2id parameters.
+func newServer(params kdf.Params) *server {
+	return &server{
+		keys:        make(map[string]*encryption.Encryptor),
+		params:      params,
+		derivations: make(chan struct{}, maxDerivations),
+	}
+}
+
+// addKey configures the key with the given ID, deriving keys from password
+// with the settings in opts, and derives the key that new files are
+// encrypted under.
+func (srv *server) addKey(id string, password []byte, opts encryption.Options) error {
+	cache := &keyCache{srv: srv, password: password, entries: make(map[cacheKey]*list.Element), lru: list.New()}
+	opts.DeriveKey = cache.derive
+	opts.KDF = srv.params
+	opts.MaxKDF = srv.params
+	e, err := encryption.NewEncryptor(&opts)
+	if err != nil {
+		return err
+	}
+
+	// Deriving the key now, with an empty stream, keeps the first request
+	// from paying for it.
+	if err := e.EncryptStream(context.Background(), io.Discard, strings.NewReader("")); err != nil {
+		return fmt.Errorf("deriving key %s failed: %w", id, err)
+	}
+	srv.keys[id] = e
+
+	return nil
+}
+
+// cacheKey identifies a derived key.
+type cacheKey struct {
+	salt   string
+	params kdf.Params
+}
+
+// cacheEntry holds a key being derived or derived.
+type cacheEntry struct {
+	id   cacheKey
+	once sync.Once
+	key  []byte
+}
+
+// keyCache derives the keys of one password, keeping the keyCacheSize most
+// recently used ones. Parameters stronger than those of the service are
+// refused before anything is derived, and derivations wait for one of the
+// maxDerivations tokens of the server.
+type keyCache struct {
+	srv      *server
+	password []byte
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List // of *cacheEntry, most recently used first
+}
+
+// derive returns the key for salt and p, deriving it if it is not cached.
+func (c *keyCache) derive(salt []byte, p kdf.Params) ([]byte, error) {
+	if p.Exceeds(c.srv.params) {
+		return nil, fmt.Errorf("%w (time=%d, memory=%d KiB, threads=%d)", encryption.ErrKDFTooStrong, p.Time, p.Memory, p.Threads)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	id := cacheKey{salt: string(salt), params: p}
+	elem, ok := c.entries[id]
+	if ok {
+		c.lru.MoveToFront(elem)
+	} else {
+		elem = c.lru.PushFront(&cacheEntry{id: id})
+		c.entries[id] = elem
+		if c.lru.Len() > keyCacheSize {
+			oldest := c.lru.Remove(c.lru.Back()).(*cacheEntry)
+			delete(c.entries, oldest.id)
+		}
+	}
+	e := elem.Value.(*cacheEntry)
+	c.mu.Unlock()
+
+	e.once.Do(func() {
+		c.srv.derivations <- struct{}{}
+		defer func() { <-c.srv.derivations }()
+		e.key = kdf.DeriveKeyWithParams(c.password, salt, p)
+	})
+
+	return e.key, nil
+}
+
+// ids returns the configured key IDs, sorted.
+func (srv *server) ids() []string {
+	ids := make([]string, 0, len(srv.keys))
+	for id := range srv.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// listen opens the listener for a -listen address: a Unix socket, which only
+// its owner may connect to, or a TCP address on a loopback interface.
+func listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		if path == "" {
+			return nil, usageError("no socket path given in -listen")
+		}
+		// A socket left behind by a service that did not stop cleanly is
+		// replaced; any other file is not.
+		if info, err := os.Lstat(path); err == nil && info.Mode()&fs.ModeSocket != 0 {
+			if conn, err := net.Dial("unix", path); err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("%s is in use by another service", path)
+			}
+			os.Remove(path)
+		}
+
+		return listenUnix(path)
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, usageError("invalid -listen address %q: %v", addr, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, usageError("-listen must be a Unix socket or a loopback address, not %q", addr)
+	}
+
+	return net.Listen("tcp", addr)
+}
+
+// handler returns the routes of the service.
+func (srv *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /encrypt", srv.authorize(srv.handleEncrypt))
+	mux.HandleFunc("POST /decrypt", srv.authorize(srv.handleDecrypt))
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "ok")
+	})
+
+	return mux
+}
+
+// authorize returns h, refusing requests without the bearer token of the
+// server if it has one.
+func (srv *server) authorize(h http.HandlerFunc) http.HandlerFunc {
+	if srv.token == nil {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), srv.token) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "missing or wrong bearer token", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// encryptor returns the Encryptor of the key named by the request, or
+// writes an error response and returns nil.
+func (srv *server) encryptor(w http.ResponseWriter, r *http.Request) *encryption.Encryptor {
+	id := r.URL.Query().Get("key")
+	if id == "" && len(srv.keys) == 1 {
+		for _, e := range srv.keys {
+			return e
+		}
+	}
+
+	e, ok := srv.keys[id]
+	switch {
+	case id == "":
+		http.Error(w, "no key ID given", http.StatusBadRequest)
+	case !ok:
+		http.Error(w, fmt.Sprintf("unknown key ID %q", id), http.StatusBadRequest)
+	}
+
+	return e
+}
+
+// handleEncrypt streams the encryption of the request body back to the
+// client.
+func (srv *server) handleEncrypt(w http.ResponseWriter, r *http.Request) {
+	e := srv.encryptor(w, r)
+	if e == nil {
+		return
+	}
+
+	// The body is read before the header is written: a client that sent
+	// "Expect: 100-continue" only gets to send it if the response has not
+	// started.
+	body := bufio.NewReader(r.Body)
+	sw := startStream(w)
+	if _, err := body.Peek(1); err != nil && err != io.EOF {
+		sw.finish(r, err)
+		return
+	}
+
+	enc, err := e.NewWriter(r.Context(), sw, nil)
+	if err == nil {
+		if _, err = io.Copy(enc, body); err == nil {
+			err = enc.Close()
+		}
+	}
+	sw.finish(r, err)
+}
+
+// handleDecrypt streams the decryption of the request body back to the
+// client.
+func (srv *server) handleDecrypt(w http.ResponseWriter, r *http.Request) {
+	e := srv.encryptor(w, r)
+	if e == nil {
+		return
+	}
+
+	sw := startStream(w)
+	dec, err := e.NewReader(r.Context(), r.Body)
+	if err == nil {
+		_, err = io.Copy(sw, dec)
+	}
+	sw.finish(r, err)
+}
+
+// streamWriter writes a streamed response body, flushing every write so
+// that the client receives each chunk as soon as it is ready.
+type streamWriter struct {
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	started bool
+}
+
+// startStream prepares w for a streamed response. The request body is read
+// while the response is written, which HTTP/1 servers do not allow by
+// default.
+func startStream(w http.ResponseWriter) *streamWriter {
+	rc := http.NewResponseController(w)
+	rc.EnableFullDuplex()
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	return &streamWriter{w: w, rc: rc}
+}
+
+// Write writes p to the response and flushes it.
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	sw.started = true
+	n, err := sw.w.Write(p)
+	if err == nil {
+		err = sw.rc.Flush()
+	}
+
+	return n, err
+}
+
+// finish ends the response. An error before the response started is sent
+// as a status code; after it, the connection is aborted so that the client
+// sees an incomplete response instead of a complete but truncated one.
+func (sw *streamWriter) finish(r *http.Request, err error) {
+	if err == nil {
+		return
+	}
+	if r.Context().Err() == nil {
+		status("%s %s: %v", r.Method, r.URL.Path, err)
+	}
+	if sw.started {
+		panic(http.ErrAbortHandler)
+	}
+
+	code := http.StatusInternalServerError
+	switch {
+	case exitCode(err) == exitCorrupted:
+		code = http.StatusUnprocessableEntity
+	case exitCode(err) == exitWrongKey:
+		code = http.StatusForbidden
+	}
+	http.Error(sw.w, err.Error(), code)
+}
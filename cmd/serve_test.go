@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gigatar/file-encryptor/pkg/encryption"
+	"github.com/gigatar/file-encryptor/pkg/kdf"
+)
+
+// fastKDF keeps Argon2id cheap in tests.
+var fastKDF = kdf.Params{Time: 1, Memory: 64, Threads: 1}
+
+// newTestServer starts the service over HTTP with a key for every ID in
+// passwords.
+func newTestServer(t *testing.T, passwords map[string]string) *httptest.Server {
+	t.Helper()
+	srv := newServer(fastKDF)
+	for id, password := range passwords {
+		if err := srv.addKey(id, []byte(password), encryption.Options{Jobs: 1}); err != nil {
+			t.Fatalf("addKey(%q) failed: %v", id, err)
+		}
+	}
+	ts := httptest.NewServer(srv.handler())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// post sends body to the given path of ts and returns the status and the
+// response body, or the error that ended reading it.
+func post(t *testing.T, ts *httptest.Server, path string, body []byte) (int, []byte, error) {
+	t.Helper()
+	resp, err := ts.Client().Post(ts.URL+path, "application/octet-stream", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST %s failed: %v", path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, data, err
+}
+
+// encryptWith encrypts plaintext under password with the given Argon2id
+// parameters, as a client holding the password would.
+func encryptWith(t *testing.T, password string, params kdf.Params, plaintext []byte) []byte {
+	t.Helper()
+	e, err := encryption.NewEncryptor(&encryption.Options{Password: []byte(password), KDF: params})
+	if err != nil {
+		t.Fatalf("NewEncryptor() failed: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := e.EncryptStream(context.Background(), &buf, bytes.NewReader(plaintext)); err != nil {
+		t.Fatalf("EncryptStream() failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// TestServeRoundTrip verifies that a body encrypted by /encrypt is restored
+// by /decrypt, with the key named by ID or, for a single key, implied.
+func TestServeRoundTrip(t *testing.T) {
+	plaintext := bytes.Repeat([]byte("streamed over http "), 20000)
+
+	for _, path := range []string{"?key=backups", ""} {
+		ts := newTestServer(t, map[string]string{"backups": "pw"})
+
+		code, encrypted, err := post(t, ts, "/encrypt"+path, plaintext)
+		if err != nil || code != http.StatusOK {
+			t.Fatalf("POST /encrypt%s = %d, %v", path, code, err)
+		}
+		if bytes.Contains(encrypted, plaintext[:100]) {
+			t.Fatal("encrypted body contains the plaintext")
+		}
+
+		code, decrypted, err := post(t, ts, "/decrypt"+path, encrypted)
+		if err != nil || code != http.StatusOK || !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("POST /decrypt%s = %d, %d bytes, %v; want the plaintext", path, code, len(decrypted), err)
+		}
+	}
+}
+
+// TestServeErrors verifies the status codes of requests that fail before
+// the response starts.
+func TestServeErrors(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"a": "pw", "b": "other"})
+	plaintext := []byte("secret")
+
+	tests := []struct {
+		name string
+		path string
+		body []byte
+		want int
+	}{
+		{"unknown key ID", "/encrypt?key=c", plaintext, http.StatusBadRequest},
+		{"no key ID with several keys", "/decrypt", plaintext, http.StatusBadRequest},
+		{"wrong password", "/decrypt?key=a", encryptWith(t, "wrong", fastKDF, plaintext), http.StatusForbidden},
+		{"not encrypted", "/decrypt?key=a", plaintext, http.StatusUnprocessableEntity},
+		{"stronger KDF", "/decrypt?key=a", encryptWith(t, "pw", kdf.Params{Time: 2, Memory: 64, Threads: 1}, plaintext), http.StatusUnprocessableEntity},
+		{"other key", "/decrypt?key=b", encryptWith(t, "other", fastKDF, plaintext), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body, err := post(t, ts, tt.path, tt.body)
+			if err != nil || code != tt.want {
+				t.Errorf("POST %s = %d %q, %v; want %d", tt.path, code, body, err, tt.want)
+			}
+		})
+	}
+}
+
+// TestServeToken verifies that a server with a token refuses requests
+// without it, and that a loopback address cannot be served without one.
+func TestServeToken(t *testing.T) {
+	srv := newServer(fastKDF)
+	if err := srv.addKey("a", []byte("pw"), encryption.Options{Jobs: 1}); err != nil {
+		t.Fatalf("addKey() failed: %v", err)
+	}
+	srv.token = []byte("0123456789abcdef-token")
+	ts := httptest.NewServer(srv.handler())
+	defer ts.Close()
+
+	request := func(method, path, auth string) int {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	tests := []struct {
+		method, path, auth string
+		want               int
+	}{
+		{"POST", "/encrypt", "", http.StatusUnauthorized},
+		{"POST", "/decrypt", "", http.StatusUnauthorized},
+		{"POST", "/encrypt", "Bearer 0123456789abcdef-wrong", http.StatusUnauthorized},
+		{"POST", "/encrypt", "Basic 0123456789abcdef-token", http.StatusUnauthorized},
+		{"POST", "/encrypt", "Bearer 0123456789abcdef-token", http.StatusOK},
+		{"GET", "/healthz", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if code := request(tt.method, tt.path, tt.auth); code != tt.want {
+			t.Errorf("%s %s with %q = %d, want %d", tt.method, tt.path, tt.auth, code, tt.want)
+		}
+	}
+
+	dir := t.TempDir()
+	passFile := filepath.Join(dir, "pass")
+	if err := os.WriteFile(passFile, []byte("pw\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	o := &options{listen: "127.0.0.1:0", keys: stringList{"a=" + passFile}}
+	if err := runServe(t.Context(), o, nil); exitCode(err) != exitUsage {
+		t.Errorf("runServe() on a loopback address without -token-file = %v, want a usage error", err)
+	}
+
+	o.tokenFile = filepath.Join(dir, "token")
+	if err := os.WriteFile(o.tokenFile, []byte("short\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.newServer(); err == nil {
+		t.Error("newServer() with a short token succeeded")
+	}
+}
+
+// TestServeTruncated verifies that a file that turns out to be truncated
+// after plaintext was sent aborts the response instead of ending it.
+func TestServeTruncated(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"a": "pw"})
+	plaintext := bytes.Repeat([]byte("x"), 300*1024)
+
+	code, encrypted, err := post(t, ts, "/encrypt", plaintext)
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("POST /encrypt = %d, %v", code, err)
+	}
+
+	code, decrypted, err := post(t, ts, "/decrypt", encrypted[:len(encrypted)-1000])
+	if code != http.StatusOK || err == nil {
+		t.Errorf("POST /decrypt of a truncated file = %d, %d bytes, %v; want an aborted response", code, len(decrypted), err)
+	}
+	if !bytes.Equal(decrypted, plaintext[:len(decrypted)]) {
+		t.Error("partial plaintext does not match")
+	}
+}
+
+// TestKeyCache verifies that the key cache keeps only the most recently
+// used keys and refuses parameters stronger than those of the server.
+func TestKeyCache(t *testing.T) {
+	srv := newServer(fastKDF)
+	c := &keyCache{srv: srv, password: []byte("pw"), entries: make(map[cacheKey]*list.Element), lru: list.New()}
+
+	first, err := c.derive([]byte("salt-0"), fastKDF)
+	if err != nil {
+		t.Fatalf("derive() failed: %v", err)
+	}
+	for i := 1; i <= keyCacheSize; i++ {
+		if _, err := c.derive([]byte("salt-"+strings.Repeat("x", i)), fastKDF); err != nil {
+			t.Fatalf("derive() failed: %v", err)
+		}
+	}
+	if n := c.lru.Len(); n != keyCacheSize || len(c.entries) != keyCacheSize {
+		t.Errorf("cache holds %d keys, want %d", n, keyCacheSize)
+	}
+	if _, ok := c.entries[cacheKey{salt: "salt-0", params: fastKDF}]; ok {
+		t.Error("least recently used key was not evicted")
+	}
+	again, err := c.derive([]byte("salt-0"), fastKDF)
+	if err != nil || !bytes.Equal(again, first) {
+		t.Errorf("derive() after eviction = %x, %v; want %x", again, err, first)
+	}
+
+	for _, p := range []kdf.Params{
+		{Time: 2, Memory: 64, Threads: 1},
+		{Time: 1, Memory: 4 << 20, Threads: 1},
+		{Time: 1, Memory: 64, Threads: 2},
+	} {
+		if _, err := c.derive([]byte("salt"), p); !errors.Is(err, encryption.ErrKDFTooStrong) {
+			t.Errorf("derive() with %+v error = %v, want ErrKDFTooStrong", p, err)
+		}
+	}
+}
+
+// TestListen verifies that only Unix sockets and loopback addresses are
+// listened on, and that a socket is only accessible to its owner.
+func TestListen(t *testing.T) {
+	for _, addr := range []string{"0.0.0.0:0", "192.0.2.1:8420", ":8420", "example.com:80", "unix:", "127.0.0.1"} {
+		if ln, err := listen(addr); err == nil {
+			ln.Close()
+			t.Errorf("listen(%q) succeeded", addr)
+		}
+	}
+	for _, addr := range []string{"127.0.0.1:0", "localhost:0"} {
+		ln, err := listen(addr)
+		if err != nil {
+			t.Errorf("listen(%q) failed: %v", addr, err)
+			continue
+		}
+		ln.Close()
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "fe.sock")
+	ln, err := listen("unix:" + path)
+	if err != nil {
+		t.Fatalf("listen() on a socket failed: %v", err)
+	}
+	defer ln.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		t.Errorf("socket mode = %v, want no group or other access", perm)
+	}
+	if other, err := listen("unix:" + path); err == nil {
+		other.Close()
+		t.Error("listen() on a socket in use succeeded")
+	}
+
+	// A file that is not a socket is never replaced.
+	regular := filepath.Join(dir, "file")
+	if err := os.WriteFile(regular, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if other, err := listen("unix:" + regular); err == nil {
+		other.Close()
+		t.Error("listen() replaced a regular file")
+	}
+
+	go http.Serve(ln, newServer(fastKDF).handler())
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://fe/healthz")
+	if err != nil {
+		t.Fatalf("GET /healthz over the socket failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /healthz = %d, want 200", resp.StatusCode)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenUnix listens on a Unix socket at path that only its owner may
+// connect to. The socket is created under a umask that clears every group
+// and other permission, so it is never accessible to anyone else, not even
+// for a moment.
+func listenUnix(path string) (net.Listener, error) {
+	old := unix.Umask(0o077)
+	defer unix.Umask(old)
+
+	return net.Listen("unix", path)
+}
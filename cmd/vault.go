@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gigatar/file-encryptor/pkg/vault"
+)
+
+// vaultCommand manages single-file containers of encrypted files.
+var vaultCommand = &command{
+	name:    "vault",
+	args:    "<create|add|ls|extract|rm|compact> [flags] <vault> [files]",
+	summary: "Keep many encrypted files in a single vault file",
+	help: `Manages a vault: a single file holding many encrypted files and an encrypted
+index of their names, sizes, modes and modification times. Every entry and
+the index are encrypted under one key, derived from the password once per
+command.
+
+  create <vault>             Create an empty vault
+  add <vault> <path>...      Add files; directories are added recursively
+  ls <vault>                 List the entries, reading only the index
+  extract <vault> [name]...  Extract every entry, or the named entries and
+                             directories, below -out (default: .)
+  rm <vault> <name>...       Remove entries or directories of entries
+  compact <vault>            Reclaim the space of removed entries
+
+Entries are named by their path relative to the current directory, or to
+the parent of the given path if it lies outside. Adding a file never
+rewrites the other entries, and the changes of a command become visible
+all at once when it finishes, so an interrupted add leaves the vault as it
+was. Removed entries keep taking space until compact rewrites the vault.
+
+A vault is locked while a command uses it: commands that modify it fail
+while any other command has it open, and ls and extract fail while it is
+being modified.`,
+	flags: func(fs *flag.FlagSet, o *options) {
+		fs.StringVar(&o.out, "out", "", "Directory to extract into (extract)")
+		fs.BoolVar(&o.force, "force", false, "Replace existing entries (add) or files (extract)")
+		o.passwordFlag(fs)
+		fs.Var(&o.chunkSize, "chunk-size", "Plaintext bytes per chunk of new entries, a power of two from 4K to 16M (add)")
+		fs.IntVar(&o.jobs, "jobs", 1, "Number of chunks encrypted concurrently (add)")
+		fs.BoolVar(&o.json, "json", false, "Print the entries as JSON (ls)")
+	},
+	run: runVault,
+}
+
+// runVault dispatches to the vault subcommand named by the first argument.
+func runVault(ctx context.Context, o *options, args []string) error {
+	if len(args) == 0 {
+		return usageError("no vault command given")
+	}
+	if len(args) < 2 {
+		return usageError("no vault given")
+	}
+	sub, name, args := args[0], args[1], args[2:]
+
+	var run func(context.Context, *options, string, []string) error
+	switch sub {
+	case "create":
+		run = runVaultCreate
+	case "add":
+		run = runVaultAdd
+	case "ls":
+		run = runVaultList
+	case "extract":
+		run = runVaultExtract
+	case "rm":
+		run = runVaultRemove
+	case "compact":
+		run = runVaultCompact
+	default:
+		return usageError("unknown vault command %q", sub)
+	}
+	if err := o.checkChunkSize(); err != nil {
+		return err
+	}
+	if err := o.readPasswordFile(); err != nil {
+		return err
+	}
+
+	return run(ctx, o, name, args)
+}
+
+// openVault reads the password and opens the vault name, for writing if
+// writable is set.
+func (o *options) openVault(name string, writable bool) (*vault.Vault, error) {
+	e, err := o.batchEncryptor()
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := vault.Open(name, e, vault.Options{Writable: writable, ChunkSize: int(o.chunkSize.n), Jobs: o.jobs})
+	if err != nil {
+		return nil, fmt.Errorf("opening vault failed: %w", err)
+	}
+
+	return v, nil
+}
+
+// runVaultCreate creates an empty vault.
+func runVaultCreate(_ context.Context, o *options, name string, args []string) error {
+	if len(args) > 0 {
+		return usageError("too many arguments: %s", strings.Join(args, " "))
+	}
+	if _, err := os.Lstat(name); err == nil {
+		return fmt.Errorf("%s already exists", name)
+	}
+
+	e, err := o.batchEncryptor()
+	if err != nil {
+		return err
+	}
+	if err := vault.Create(name, e); err != nil {
+		return fmt.Errorf("creating vault failed: %w", err)
+	}
+	status("✅ Created %s.", name)
+
+	return nil
+}
+
+// runVaultAdd adds the given files and directory trees to a vault and
+// commits them together.
+func runVaultAdd(ctx context.Context, o *options, name string, args []string) error {
+	if len(args) == 0 {
+		return usageError("no files given")
+	}
+
+	// Collect every file first, so that a missing path fails before the
+	// password is asked for.
+	type file struct{ path, name string }
+	var files []file
+	for _, arg := range args {
+		root := "."
+		if !filepath.IsLocal(arg) {
+			root = filepath.Dir(filepath.Clean(arg))
+		}
+		err := filepath.WalkDir(arg, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				status("⚠️  Skipping %s: not a regular file", path)
+				return nil
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, file{path: path, name: filepath.ToSlash(rel)})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	v, err := o.openVault(name, true)
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	for _, f := range files {
+		if o.force {
+			if err := v.Remove(f.name); err != nil && !errors.Is(err, vault.ErrNotFound) {
+				return err
+			}
+		}
+		if err := v.AddFile(ctx, f.path, f.name); err != nil {
+			return fmt.Errorf("adding %s failed: %w", f.path, err)
+		}
+		status("added     %s", f.name)
+	}
+	if err := v.Commit(); err != nil {
+		return fmt.Errorf("saving vault failed: %w", err)
+	}
+	status("✅ Added %d file(s).", len(files))
+
+	return nil
+}
+
+// runVaultList prints the entries of a vault, as text or as JSON. Only the
+// index is read.
+func runVaultList(_ context.Context, o *options, name string, args []string) error {
+	if len(args) > 0 {
+		return usageError("too many arguments: %s", strings.Join(args, " "))
+	}
+
+	v, err := o.openVault(name, false)
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	entries := v.Entries()
+	if o.json {
+		if entries == nil {
+			entries = []vault.Entry{}
+		}
+		out, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	var total int64
+	for _, e := range entries {
+		total += e.Size
+		fmt.Printf("%s %12d %s %s\n", e.Mode, e.Size, e.ModTime.Local().Format("2006-01-02 15:04"), e.Name)
+	}
+	status("%d entries, %d bytes; %d bytes reclaimable by compact.", len(entries), total, v.Garbage())
+
+	return nil
+}
+
+// selectEntries returns the entries of v named by names, where a name also
+// selects every entry below it as a directory. Without names, every entry
+// is selected.
+func selectEntries(v *vault.Vault, names []string) ([]string, error) {
+	var selected []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name = strings.TrimSuffix(name, "/")
+		found := false
+		for _, e := range v.Entries() {
+			if e.Name == name || strings.HasPrefix(e.Name, name+"/") {
+				found = true
+				if !seen[e.Name] {
+					seen[e.Name] = true
+					selected = append(selected, e.Name)
+				}
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s: %w", name, vault.ErrNotFound)
+		}
+	}
+	if len(names) == 0 {
+		for _, e := range v.Entries() {
+			selected = append(selected, e.Name)
+		}
+	}
+
+	return selected, nil
+}
+
+// runVaultExtract extracts the selected entries of a vault below -out.
+func runVaultExtract(ctx context.Context, o *options, name string, args []string) error {
+	dir := o.out
+	if dir == "" {
+		dir = "."
+	}
+
+	v, err := o.openVault(name, false)
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	selected, err := selectEntries(v, args)
+	if err != nil {
+		return err
+	}
+	for _, entry := range selected {
+		path, err := v.Extract(ctx, entry, dir, o.force)
+		if err != nil {
+			return fmt.Errorf("extracting %s failed: %w", entry, err)
+		}
+		status("extracted %s", path)
+	}
+	status("✅ Extracted %d file(s).", len(selected))
+
+	return nil
+}
+
+// runVaultRemove removes the selected entries from a vault.
+func runVaultRemove(_ context.Context, o *options, name string, args []string) error {
+	if len(args) == 0 {
+		return usageError("no entries given")
+	}
+
+	v, err := o.openVault(name, true)
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	selected, err := selectEntries(v, args)
+	if err != nil {
+		return err
+	}
+	if err := v.Remove(selected...); err != nil {
+		return err
+	}
+	if err := v.Commit(); err != nil {
+		return fmt.Errorf("saving vault failed: %w", err)
+	}
+	status("✅ Removed %d file(s); %d bytes reclaimable by compact.", len(selected), v.Garbage())
+
+	return nil
+}
+
+// runVaultCompact rewrites a vault without the space of removed entries.
+func runVaultCompact(ctx context.Context, o *options, name string, args []string) error {
+	if len(args) > 0 {
+		return usageError("too many arguments: %s", strings.Join(args, " "))
+	}
+
+	v, err := o.openVault(name, true)
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	reclaimed, err := v.Compact(ctx)
+	if err != nil {
+		return fmt.Errorf("compacting vault failed: %w", err)
+	}
+	status("✅ Compacted; reclaimed %d bytes.", reclaimed)
+
+	return nil
+}
@@ -4,7 +4,6 @@ go 1.24.2
 
 require (
 	golang.org/x/crypto v0.37.0
+	golang.org/x/sys v0.32.0
 	golang.org/x/term v0.31.0
 )
-
-require golang.org/x/sys v0.32.0 // indirect
@@ -0,0 +1,310 @@
+// Package archive streams directory trees to and from a tar archive.
+//
+// It is used to encrypt a whole directory as a single file: Write walks the
+// tree and emits the archive directly into the encryptor, so no plaintext
+// tar is ever written to disk, and Extract recreates the tree from the
+// decrypted stream.
+//
+// Only regular files, directories and symbolic links are archived, along
+// with their permission bits. Ownership is not recorded.
+//
+// Security Considerations:
+//   - Entry names must be local, slash-separated paths; absolute names and
+//     names containing ".." elements are rejected
+//   - Symbolic link targets must be relative and must resolve inside the
+//     extraction directory
+//   - Nothing is ever created through an existing symbolic link, and
+//     existing files are never overwritten
+//   - Files and directories are created through an os.Root, so even a race
+//     with another process cannot place them outside the extraction
+//     directory. Symbolic links are created by path once their parents have
+//     been checked, so a process that concurrently replaces one of those
+//     parents with a link can still redirect where a symbolic link is
+//     created, though never what is written through it
+package archive
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Write streams the tree rooted at dir to w as a tar archive. Paths matched
+// by exclude are skipped; a nil Matcher excludes nothing.
+//
+// Args:
+//   - w: Destination of the archive
+//   - dir: Root of the tree to archive
+//   - exclude: Patterns of paths to leave out
+//
+// Returns:
+//   - error: Any error that occurred while walking or archiving the tree
+func Write(w io.Writer, dir string, exclude *Matcher) error {
+	tw := tar.NewWriter(w)
+
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		name := filepath.ToSlash(rel)
+
+		if exclude.Match(name, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		return writeEntry(tw, p, name, d)
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// writeEntry adds a single file, directory or symbolic link to the archive.
+func writeEntry(tw *tar.Writer, p, name string, d fs.DirEntry) error {
+	info, err := d.Info()
+	if err != nil {
+		return err
+	}
+
+	var link string
+	switch {
+	case info.Mode().IsRegular(), info.IsDir():
+	case info.Mode()&fs.ModeSymlink != 0:
+		if link, err = os.Readlink(p); err != nil {
+			return err
+		}
+	default:
+		// Devices, sockets and pipes cannot be archived meaningfully.
+		return nil
+	}
+
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.Uid, hdr.Gid = 0, 0
+	hdr.Uname, hdr.Gname = "", ""
+	hdr.Format = tar.FormatPAX
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Copy exactly the size recorded in the header even if the file
+	// changed while it was being archived.
+	if _, err := io.CopyN(tw, f, hdr.Size); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("%s: file shrank while archiving", p)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Extract recreates the tree stored in the tar archive read from r inside
+// dir, which must already exist. The archive is read to its end so that a
+// wrapping decryptor authenticates the whole stream.
+//
+// Args:
+//   - r: Source of the archive
+//   - dir: Directory in which the tree is recreated
+//
+// Returns:
+//   - error: Any error that occurred, including unsafe entries
+func Extract(r io.Reader, dir string) error {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	// Directory permissions are applied last so that read-only directories
+	// can still be populated.
+	dirModes := make(map[string]fs.FileMode)
+	var dirOrder []string
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name, err := entryName(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if err := checkParents(root, name); err != nil {
+			return err
+		}
+
+		mode := fs.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := root.Mkdir(name, 0700); err != nil && !errors.Is(err, fs.ErrExist) {
+				return err
+			}
+			if info, err := root.Lstat(name); err != nil {
+				return err
+			} else if !info.IsDir() {
+				return fmt.Errorf("%s: not a directory", name)
+			}
+			if _, seen := dirModes[name]; !seen {
+				dirOrder = append(dirOrder, name)
+			}
+			dirModes[name] = mode
+		case tar.TypeReg:
+			if err := extractFile(root, name, mode, tr); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := checkLink(name, hdr.Linkname); err != nil {
+				return err
+			}
+			// os.Root cannot create symbolic links before Go 1.25, so the
+			// link is created by path, right after its parents were checked.
+			if err := os.Symlink(hdr.Linkname, filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%s: unsupported entry type %q", name, hdr.Typeflag)
+		}
+	}
+
+	// Drain any trailing padding so the whole stream is consumed.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return err
+	}
+
+	// Apply the deepest directories first so that parents stay writable.
+	for i := len(dirOrder) - 1; i >= 0; i-- {
+		f, err := root.Open(dirOrder[i])
+		if err != nil {
+			return err
+		}
+		err = f.Chmod(dirModes[dirOrder[i]])
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// extractFile creates a regular file and copies its contents from r.
+func extractFile(root *os.Root, name string, mode fs.FileMode, r io.Reader) error {
+	f, err := root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// entryName validates an archive entry name and returns it in clean,
+// slash-separated form.
+func entryName(name string) (string, error) {
+	clean := strings.TrimSuffix(name, "/")
+	if clean == "" || strings.Contains(clean, `\`) || !fs.ValidPath(clean) ||
+		!filepath.IsLocal(filepath.FromSlash(clean)) {
+		return "", fmt.Errorf("unsafe path %q in archive", name)
+	}
+
+	return clean, nil
+}
+
+// checkParents ensures that every parent of name inside root is a real
+// directory, so that nothing is ever created through a symbolic link.
+func checkParents(root *os.Root, name string) error {
+	parts := strings.Split(name, "/")
+	for i := 1; i < len(parts); i++ {
+		parent := path.Join(parts[:i]...)
+		info, err := root.Lstat(parent)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s: parent %s is not a directory", name, parent)
+		}
+	}
+
+	return nil
+}
+
+// checkLink ensures that a symbolic link named name with the given target
+// stays inside the extraction directory.
+//
+// ".." elements are only accepted at the start of the target. Lexical
+// cleaning of a target such as "link/.." would otherwise hide that it
+// climbs out of wherever another symbolic link points.
+func checkLink(name, target string) error {
+	if target == "" || path.IsAbs(target) || filepath.IsAbs(target) || strings.Contains(target, `\`) {
+		return fmt.Errorf("%s: symbolic link target %q escapes the archive", name, target)
+	}
+
+	descending := false
+	for _, elem := range strings.Split(target, "/") {
+		switch elem {
+		case "..":
+			if descending {
+				return fmt.Errorf("%s: symbolic link target %q escapes the archive", name, target)
+			}
+		case "", ".":
+		default:
+			descending = true
+		}
+	}
+
+	resolved := path.Join(path.Dir(name), filepath.ToSlash(target))
+	if !filepath.IsLocal(filepath.FromSlash(resolved)) {
+		return fmt.Errorf("%s: symbolic link target %q escapes the archive", name, target)
+	}
+
+	return nil
+}
@@ -0,0 +1,162 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestWriteExtract verifies that a tree survives a round trip through an
+// archive, including modes, symbolic links and exclusions.
+func TestWriteExtract(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+
+	mustWrite(t, filepath.Join(src, "a.txt"), "alpha", 0644)
+	mustWrite(t, filepath.Join(src, "run.sh"), "#!/bin/sh", 0755)
+	if err := os.MkdirAll(filepath.Join(src, "sub", "deep"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mustWrite(t, filepath.Join(src, "sub", "deep", "b.txt"), "beta", 0600)
+	mustWrite(t, filepath.Join(src, "sub", "debug.log"), "noise", 0644)
+	if err := os.Mkdir(filepath.Join(src, "node_modules"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mustWrite(t, filepath.Join(src, "node_modules", "c.js"), "gamma", 0644)
+	if err := os.Symlink("deep/b.txt", filepath.Join(src, "sub", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	exclude, err := NewMatcher([]string{"*.log", "node_modules/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, src, exclude); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := Extract(&buf, dst); err != nil {
+		t.Fatalf("Extract() error = %v", err)
+	}
+
+	checkFile(t, filepath.Join(dst, "a.txt"), "alpha", 0644)
+	checkFile(t, filepath.Join(dst, "run.sh"), "#!/bin/sh", 0755)
+	checkFile(t, filepath.Join(dst, "sub", "deep", "b.txt"), "beta", 0600)
+
+	target, err := os.Readlink(filepath.Join(dst, "sub", "link"))
+	if err != nil || target != "deep/b.txt" {
+		t.Errorf("Readlink() = %q, %v, want %q", target, err, "deep/b.txt")
+	}
+
+	for _, excluded := range []string{"sub/debug.log", "node_modules"} {
+		if _, err := os.Lstat(filepath.Join(dst, excluded)); !os.IsNotExist(err) {
+			t.Errorf("%s was not excluded", excluded)
+		}
+	}
+}
+
+// TestExtractRejectsUnsafeEntries verifies that archives trying to escape
+// the extraction directory are rejected.
+func TestExtractRejectsUnsafeEntries(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tar.Header
+	}{
+		{
+			name:    "parent traversal",
+			entries: []tar.Header{{Name: "../evil", Typeflag: tar.TypeReg}},
+		},
+		{
+			name:    "absolute path",
+			entries: []tar.Header{{Name: "/tmp/evil", Typeflag: tar.TypeReg}},
+		},
+		{
+			name:    "absolute symlink",
+			entries: []tar.Header{{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc"}},
+		},
+		{
+			name:    "escaping symlink",
+			entries: []tar.Header{{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../outside"}},
+		},
+		{
+			name: "symlink climbing through another symlink",
+			entries: []tar.Header{
+				{Name: "self", Typeflag: tar.TypeSymlink, Linkname: "."},
+				{Name: "up", Typeflag: tar.TypeSymlink, Linkname: "self/.."},
+			},
+		},
+		{
+			name: "write through symlink",
+			entries: []tar.Header{
+				{Name: "dir", Typeflag: tar.TypeSymlink, Linkname: "."},
+				{Name: "dir/file", Typeflag: tar.TypeReg},
+			},
+		},
+		{
+			name: "overwrite existing file",
+			entries: []tar.Header{
+				{Name: "file", Typeflag: tar.TypeReg},
+				{Name: "file", Typeflag: tar.TypeReg},
+			},
+		},
+		{
+			name:    "device",
+			entries: []tar.Header{{Name: "dev", Typeflag: tar.TypeChar}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			for _, hdr := range tt.entries {
+				hdr.Mode = 0644
+				if err := tw.WriteHeader(&hdr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := Extract(&buf, t.TempDir()); err == nil {
+				t.Error("Extract() accepted an unsafe archive")
+			}
+		})
+	}
+}
+
+// mustWrite creates a file with the given contents and mode.
+func mustWrite(t *testing.T, path, data string, mode os.FileMode) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), mode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkFile verifies the contents and mode of an extracted file.
+func checkFile(t *testing.T, path, data string, mode os.FileMode) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Errorf("ReadFile(%s) error = %v", path, err)
+		return
+	}
+	if string(got) != data {
+		t.Errorf("%s = %q, want %q", path, got, data)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Errorf("Stat(%s) error = %v", path, err)
+		return
+	}
+	if info.Mode().Perm() != mode {
+		t.Errorf("%s mode = %v, want %v", path, info.Mode().Perm(), mode)
+	}
+}
@@ -0,0 +1,128 @@
+package archive
+
+import (
+	"path"
+	"strings"
+)
+
+// pattern is a single compiled gitignore-style pattern.
+type pattern struct {
+	segments []string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// Matcher decides whether a path inside an archived tree is excluded.
+// It follows the gitignore rules:
+//   - Blank lines and lines starting with '#' are ignored
+//   - A leading '!' re-includes paths excluded by an earlier pattern
+//   - A trailing '/' only matches directories
+//   - A pattern containing a '/' other than a trailing one is matched
+//     relative to the root of the tree; otherwise it matches at any depth
+//   - '*', '?' and '[...]' match within a path element and '**' matches
+//     any number of path elements
+//
+// The last pattern that matches a path decides its fate. As in git, a path
+// inside an excluded directory cannot be re-included because the directory
+// is never descended into.
+type Matcher struct {
+	patterns []pattern
+}
+
+// NewMatcher compiles the given gitignore-style patterns.
+func NewMatcher(patterns []string) (*Matcher, error) {
+	m := &Matcher{}
+	for _, line := range patterns {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var p pattern
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			p.anchored = true
+			line = strings.TrimLeft(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+
+		p.segments = strings.Split(line, "/")
+		for _, seg := range p.segments {
+			if seg == "**" {
+				continue
+			}
+			// Reject malformed character classes up front.
+			if _, err := path.Match(seg, ""); err != nil {
+				return nil, err
+			}
+		}
+		m.patterns = append(m.patterns, p)
+	}
+
+	return m, nil
+}
+
+// Match reports whether the slash-separated path name, relative to the root
+// of the tree, is excluded. isDir tells whether the path is a directory.
+func (m *Matcher) Match(name string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+
+	parts := strings.Split(name, "/")
+	excluded := false
+	for _, p := range m.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+
+		var ok bool
+		if p.anchored {
+			ok = matchSegments(p.segments, parts)
+		} else {
+			ok = matchSegments(p.segments, parts[len(parts)-1:])
+		}
+		if ok {
+			excluded = !p.negate
+		}
+	}
+
+	return excluded
+}
+
+// matchSegments matches path elements against pattern elements, where a
+// "**" element matches zero or more path elements.
+func matchSegments(pat, parts []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			for i := 0; i <= len(parts); i++ {
+				if matchSegments(pat[1:], parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], parts[0]); !ok {
+			return false
+		}
+		pat, parts = pat[1:], parts[1:]
+	}
+
+	return len(parts) == 0
+}
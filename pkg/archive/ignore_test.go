@@ -0,0 +1,63 @@
+package archive
+
+import "testing"
+
+// TestMatcher verifies the gitignore-style matching rules.
+func TestMatcher(t *testing.T) {
+	m, err := NewMatcher([]string{
+		"# comment",
+		"",
+		"*.log",
+		"!keep.log",
+		"build/",
+		"/top.txt",
+		"docs/**/*.tmp",
+		"cache/*",
+	})
+	if err != nil {
+		t.Fatalf("NewMatcher() error = %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		isDir bool
+		want  bool
+	}{
+		{name: "app.log", want: true},
+		{name: "sub/deep/app.log", want: true},
+		{name: "keep.log", want: false},
+		{name: "sub/keep.log", want: false},
+		{name: "build", isDir: true, want: true},
+		{name: "sub/build", isDir: true, want: true},
+		{name: "build", isDir: false, want: false},
+		{name: "top.txt", want: true},
+		{name: "sub/top.txt", want: false},
+		{name: "docs/a.tmp", want: true},
+		{name: "docs/x/y/a.tmp", want: true},
+		{name: "other/a.tmp", want: false},
+		{name: "cache/item", want: true},
+		{name: "cache/sub/item", want: false},
+		{name: "main.go", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := m.Match(tt.name, tt.isDir); got != tt.want {
+			t.Errorf("Match(%q, %v) = %v, want %v", tt.name, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+// TestMatcherInvalidPattern verifies that malformed patterns are rejected.
+func TestMatcherInvalidPattern(t *testing.T) {
+	if _, err := NewMatcher([]string{"[unterminated"}); err == nil {
+		t.Error("NewMatcher() accepted a malformed pattern")
+	}
+}
+
+// TestNilMatcher verifies that a nil Matcher excludes nothing.
+func TestNilMatcher(t *testing.T) {
+	var m *Matcher
+	if m.Match("anything", false) {
+		t.Error("nil Matcher excluded a path")
+	}
+}
@@ -0,0 +1,155 @@
+// Package batch runs file operations over many files on a bounded pool of
+// worker goroutines.
+//
+// It is used by the command-line tool to encrypt or decrypt whole trees or
+// glob matches after a single password prompt. A failure on one file is
+// recorded in its Result and never stops the rest of the batch.
+package batch
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Job is a single file to process.
+type Job struct {
+	// Src is the path of the input file.
+	Src string
+
+	// Dst is the path of the output file.
+	Dst string
+}
+
+// Result records the outcome of a Job.
+type Result struct {
+	Job
+
+	// Err is the error returned for the job, or nil if it succeeded.
+	Err error
+}
+
+// Walk returns a job for every regular file below root. Each output path
+// mirrors the file's path relative to root inside outDir, with its base
+// name passed through rename.
+//
+// Args:
+//   - root: Directory to walk recursively
+//   - outDir: Directory that receives the outputs
+//   - rename: Maps an input base name to an output base name
+//
+// Returns:
+//   - []Job: The jobs in lexical order of their input paths
+//   - error: Any error that occurred while walking root
+func Walk(root, outDir string, rename func(string) string) ([]Job, error) {
+	var jobs []Job
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(outDir, filepath.Dir(rel), rename(d.Name()))
+		jobs = append(jobs, Job{Src: p, Dst: dst})
+
+		return nil
+	})
+
+	return jobs, err
+}
+
+// Glob returns a job for every regular file matching pattern. The outputs
+// are placed directly in outDir, with their base names passed through rename.
+//
+// Args:
+//   - pattern: A filepath.Match pattern
+//   - outDir: Directory that receives the outputs
+//   - rename: Maps an input base name to an output base name
+//
+// Returns:
+//   - []Job: The jobs in lexical order of their input paths
+//   - error: Any error that occurred, including duplicate output names
+func Glob(pattern, outDir string, rename func(string) string) ([]Job, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+
+	var jobs []Job
+	seen := make(map[string]string)
+	for _, p := range matches {
+		if info, err := os.Stat(p); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		dst := filepath.Join(outDir, rename(filepath.Base(p)))
+		if prev, ok := seen[dst]; ok {
+			return nil, fmt.Errorf("%s and %s would both be written to %s", prev, p, dst)
+		}
+		seen[dst] = p
+		jobs = append(jobs, Job{Src: p, Dst: dst})
+	}
+
+	return jobs, nil
+}
+
+// Run calls fn for every job on at most workers goroutines and returns the
+// results in the same order as jobs. A workers value below one runs the
+// jobs one at a time.
+//
+// Args:
+//   - jobs: The jobs to process
+//   - workers: The maximum number of jobs processed concurrently
+//   - fn: The operation to perform; it must be safe for concurrent use
+//
+// Returns:
+//   - []Result: The outcome of every job
+func Run(jobs []Job, workers int, fn func(Job) error) []Result {
+	if workers < 1 {
+		workers = 1
+	}
+
+	results := make([]Result, len(jobs))
+	next := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = Result{Job: jobs[i], Err: fn(jobs[i])}
+			}
+		}()
+	}
+
+	for i := range jobs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	return results
+}
+
+// Failed returns the results whose jobs failed.
+func Failed(results []Result) []Result {
+	var failed []Result
+	for _, r := range results {
+		if r.Err != nil {
+			failed = append(failed, r)
+		}
+	}
+
+	return failed
+}
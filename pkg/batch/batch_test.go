@@ -0,0 +1,112 @@
+package batch
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+// addSuffix is a rename function used by the tests.
+func addSuffix(name string) string {
+	return name + ".enc"
+}
+
+// TestWalk verifies that Walk mirrors the tree below root in outDir.
+func TestWalk(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"top.txt", "a/mid.txt", "a/b/deep.txt"} {
+		if err := os.WriteFile(filepath.Join(root, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	jobs, err := Walk(root, "out", addSuffix)
+	if err != nil {
+		t.Fatalf("Walk() error = %v", err)
+	}
+
+	want := []Job{
+		{Src: filepath.Join(root, "a", "b", "deep.txt"), Dst: filepath.Join("out", "a", "b", "deep.txt.enc")},
+		{Src: filepath.Join(root, "a", "mid.txt"), Dst: filepath.Join("out", "a", "mid.txt.enc")},
+		{Src: filepath.Join(root, "top.txt"), Dst: filepath.Join("out", "top.txt.enc")},
+	}
+	if !reflect.DeepEqual(jobs, want) {
+		t.Errorf("Walk() = %v, want %v", jobs, want)
+	}
+}
+
+// TestGlob verifies that Glob only returns regular files.
+func TestGlob(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "dir.log"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.log", "b.log", "c.txt"} {
+		if err := os.WriteFile(filepath.Join(root, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	jobs, err := Glob(filepath.Join(root, "*.log"), "out", addSuffix)
+	if err != nil {
+		t.Fatalf("Glob() error = %v", err)
+	}
+
+	want := []Job{
+		{Src: filepath.Join(root, "a.log"), Dst: filepath.Join("out", "a.log.enc")},
+		{Src: filepath.Join(root, "b.log"), Dst: filepath.Join("out", "b.log.enc")},
+	}
+	if !reflect.DeepEqual(jobs, want) {
+		t.Errorf("Glob() = %v, want %v", jobs, want)
+	}
+}
+
+// TestRun verifies that every job runs once, that failures do not stop the
+// batch and that concurrency is bounded.
+func TestRun(t *testing.T) {
+	jobs := make([]Job, 50)
+	for i := range jobs {
+		jobs[i] = Job{Src: filepath.Join("in", string(rune('a'+i%26))), Dst: "out"}
+	}
+
+	var running, peak, calls atomic.Int32
+	errOdd := errors.New("odd job")
+	results := Run(jobs, 4, func(j Job) error {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		if calls.Add(1)%2 == 0 {
+			return errOdd
+		}
+		return nil
+	})
+
+	if int(calls.Load()) != len(jobs) {
+		t.Errorf("fn called %d times, want %d", calls.Load(), len(jobs))
+	}
+	if peak.Load() > 4 {
+		t.Errorf("peak concurrency = %d, want <= 4", peak.Load())
+	}
+	if len(results) != len(jobs) {
+		t.Fatalf("Run() returned %d results, want %d", len(results), len(jobs))
+	}
+	for i, r := range results {
+		if r.Job != jobs[i] {
+			t.Errorf("result %d is for %v, want %v", i, r.Job, jobs[i])
+		}
+	}
+	if got := len(Failed(results)); got != len(jobs)/2 {
+		t.Errorf("Failed() returned %d results, want %d", got, len(jobs)/2)
+	}
+}
@@ -0,0 +1,228 @@
+package encryption
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// OpenAppender returns a Writer that continues the encrypted file f after
+// its current contents, without decrypting anything but the final chunk.
+//
+// The final chunk is read and authenticated, and the Writer resumes with
+// its plaintext buffered and with the following chunk index, so the result
+// is the same as if everything had been written in one go.
+//
+// The chunks after the final one are written past the end of the file as
+// they are sealed. Only Close replaces the final chunk: it syncs the new
+// chunks first, then rewrites the final chunk in place and syncs again.
+// Until then the file keeps its old contents followed by the new chunks,
+// so it does not decrypt, but truncating it to its previous size restores
+// it and SalvageFile recovers its old contents. A crash while the final
+// chunk itself is rewritten can leave the file unreadable from that chunk
+// on; SalvageFile then recovers the chunks before it.
+//
+// Directory archives and files written through File cannot be appended to.
+//
+// Args:
+//   - f: The encrypted file, opened for reading and writing
+//   - key: Master key of the file, or nil to use the key source in opts,
+//     which is kdf.GetKey by default
+//   - opts: Optional settings; nil selects the defaults. Metadata is ignored.
+//
+// Returns:
+//   - *Writer: The plaintext writer; Close must be called when done
+//   - error: Any error that occurred while authenticating the final chunk
+func OpenAppender(f *os.File, key *Key, opts *Options) (*Writer, error) {
+	cfg, err := opts.config()
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		cfg.keys = keySource{key: key}
+	}
+
+	w, _, err := openAppender(f, cfg)
+
+	return w, err
+}
+
+// openAppender implements OpenAppender with the key source of cfg and also
+// returns the target the Writer writes to. The re-sealed final chunk is
+// counted towards the progress total.
+func openAppender(f *os.File, cfg streamConfig) (*Writer, *appendTarget, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r, err := openReaderAt(f, info.Size(), cfg.keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	if r.header.flags&flagArchive != 0 {
+		return nil, nil, errors.New("cannot append to a directory archive")
+	}
+	if r.header.flags&flagIntegrity != 0 {
+		return nil, nil, errors.New("cannot append to a file written through File; use OpenFile instead")
+	}
+	if r.parityShards > 0 {
+		return nil, nil, errors.New("cannot append to a file with parity")
+	}
+
+	final := r.chunks - 1
+	tail, err := r.chunk(final)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if cfg.jobs < 1 {
+		cfg.jobs = 1
+	}
+	if cfg.total >= 0 {
+		cfg.total += int64(len(tail))
+	}
+	cfg.chunkSize = int(r.chunkSize)
+
+	target := &appendTarget{
+		f:          f,
+		size:       info.Size(),
+		pos:        r.dataStart + final*r.recordSize(),
+		recordSize: r.recordSize(),
+	}
+	buf := make([]byte, 0, cfg.jobs*cfg.chunkSize)
+	w := &Writer{
+		streamConfig: cfg,
+		w:            target,
+		sealer:       r.sealer,
+		index:        uint64(final),
+		buf:          append(buf, tail...),
+		commit:       target.commit,
+	}
+
+	return w, target, nil
+}
+
+// appendTarget receives the records of an append, starting with the one
+// that replaces the old final chunk. That record is held back until commit,
+// so the file keeps its complete old contents until then; the records after
+// it go to their positions past the old end of the file.
+type appendTarget struct {
+	f *os.File
+
+	// size is the size of the file before the append, and pos the offset
+	// of its final record.
+	size, pos  int64
+	recordSize int64
+
+	// first holds the record that replaces the old final chunk, and n
+	// counts the bytes received.
+	first []byte
+	n     int64
+
+	// committing is set once the old final chunk is being overwritten.
+	committing bool
+}
+
+// Write holds back the bytes of the first record and writes the rest at
+// their positions in the file.
+func (t *appendTarget) Write(p []byte) (int, error) {
+	written := len(p)
+	if held := min(int64(len(p)), t.recordSize-int64(len(t.first))); held > 0 {
+		t.first = append(t.first, p[:held]...)
+		p = p[held:]
+		t.n += held
+	}
+	if len(p) > 0 {
+		if _, err := t.f.WriteAt(p, t.pos+t.n); err != nil {
+			return 0, err
+		}
+		t.n += int64(len(p))
+	}
+
+	return written, nil
+}
+
+// commit syncs the records written past the old end of the file, then
+// replaces the old final chunk and syncs again.
+func (t *appendTarget) commit() error {
+	if err := t.f.Sync(); err != nil {
+		return err
+	}
+
+	t.committing = true
+	if _, err := t.f.WriteAt(t.first, t.pos); err != nil {
+		return err
+	}
+
+	return t.f.Sync()
+}
+
+// abort restores the file to its size before the append, unless the old
+// final chunk was already being overwritten.
+func (t *appendTarget) abort() {
+	if !t.committing {
+		t.f.Truncate(t.size)
+	}
+}
+
+// AppendFile encrypts the input file and appends it to the plaintext of an
+// existing encrypted file. Only the final chunk of the existing file is
+// decrypted; the recorded metadata is left unchanged.
+//
+// The file is extended in place, not through a temporary file. An append
+// that fails leaves it as it was. The new chunks are synced before the old
+// final chunk is rewritten, as described for OpenAppender, so only a crash
+// during that last write can leave the file unreadable from that chunk on.
+//
+// Args:
+//   - inName: Path to the file whose contents are appended
+//   - outName: Path to the encrypted file to extend
+//
+// Returns:
+//   - error: Any error that occurred during authentication or encryption
+func AppendFile(inName, outName string) error {
+	return appendFile(defaultConfig(), inName, outName)
+}
+
+// appendFile implements AppendFile.
+func appendFile(cfg streamConfig, inName, outName string) (err error) {
+	inFile, err := os.Open(inName)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+
+	if cfg.progress != nil {
+		info, err := inFile.Stat()
+		if err != nil {
+			return err
+		}
+		cfg.total = info.Size()
+	}
+
+	outFile, err := os.OpenFile(outName, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	w, target, err := openAppender(outFile, cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			target.abort()
+		}
+	}()
+
+	if _, err := io.Copy(w, inFile); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return outFile.Close()
+}
@@ -0,0 +1,179 @@
+package encryption_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gigatar/file-encryptor/pkg/encryption"
+	"github.com/gigatar/file-encryptor/pkg/kdf"
+)
+
+// TestAppendFile verifies that repeated appends of various sizes, including
+// empty ones and ones that cross chunk boundaries, decrypt to the
+// concatenation of everything written.
+func TestAppendFile(t *testing.T) {
+	// Save original GetKey function and restore it after the test
+	originalGetKey := kdf.GetKey
+	kdf.GetKey = mockGetKey
+	defer func() { kdf.GetKey = originalGetKey }()
+
+	tempDir := t.TempDir()
+	archivePath := filepath.Join(tempDir, "archive.enc")
+	decryptedPath := filepath.Join(tempDir, "archive.log")
+
+	var want []byte
+	for i, size := range []int{1000, 0, 64*1024 - 1000, 1, 200 * 1024, 64 * 1024} {
+		data := bytes.Repeat([]byte(fmt.Sprintf("day %d\n", i)), size/6+1)[:size]
+		logPath := filepath.Join(tempDir, fmt.Sprintf("day%d.log", i))
+		if err := os.WriteFile(logPath, data, 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+
+		if i == 0 {
+			err := encryption.EncryptFile(logPath, archivePath)
+			if err != nil {
+				t.Fatalf("Encryption failed: %v", err)
+			}
+		} else if err := encryption.AppendFile(logPath, archivePath); err != nil {
+			t.Fatalf("Append %d failed: %v", i, err)
+		}
+		want = append(want, data...)
+
+		if err := encryption.DecryptFile(archivePath, decryptedPath); err != nil {
+			t.Fatalf("Decryption after append %d failed: %v", i, err)
+		}
+		got, err := os.ReadFile(decryptedPath)
+		if err != nil {
+			t.Fatalf("Failed to read decrypted file: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("After append %d got %d bytes, want %d", i, len(got), len(want))
+		}
+	}
+}
+
+// TestOpenAppenderRejectsArchive verifies that a directory archive cannot
+// be appended to.
+func TestOpenAppenderRejectsArchive(t *testing.T) {
+	// Save original GetKey function and restore it after the test
+	originalGetKey := kdf.GetKey
+	kdf.GetKey = mockGetKey
+	defer func() { kdf.GetKey = originalGetKey }()
+
+	tempDir := t.TempDir()
+	srcDir := filepath.Join(tempDir, "src")
+	if err := os.Mkdir(srcDir, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	archivePath := filepath.Join(tempDir, "src.enc")
+	if err := encryption.EncryptDir(srcDir, archivePath, nil); err != nil {
+		t.Fatalf("EncryptDir() failed: %v", err)
+	}
+
+	f, err := os.OpenFile(archivePath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Failed to open archive: %v", err)
+	}
+	defer f.Close()
+	if _, err := encryption.OpenAppender(f, nil, nil); err == nil {
+		t.Error("OpenAppender() accepted a directory archive")
+	}
+}
+
+// TestAppendInterrupted verifies that an append that fails leaves the file
+// as it was, and that one abandoned before Close leaves the old contents
+// recoverable by truncation and by SalvageFile.
+func TestAppendInterrupted(t *testing.T) {
+	key := newTestKey(t)
+	tempDir := t.TempDir()
+	archivePath := filepath.Join(tempDir, "archive.enc")
+	logPath := filepath.Join(tempDir, "day.log")
+	want := bytes.Repeat([]byte("old line\n"), 5000)
+	more := bytes.Repeat([]byte("new line\n"), 20000)
+	if err := os.WriteFile(logPath, more, 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	e, err := encryption.NewEncryptor(&encryption.Options{Key: key, ChunkSize: 4096})
+	if err != nil {
+		t.Fatalf("NewEncryptor() failed: %v", err)
+	}
+	var encrypted bytes.Buffer
+	if err := e.EncryptStream(t.Context(), &encrypted, bytes.NewReader(want)); err != nil {
+		t.Fatalf("EncryptStream() failed: %v", err)
+	}
+	original := encrypted.Bytes()
+	if err := os.WriteFile(archivePath, original, 0600); err != nil {
+		t.Fatalf("Failed to write archive: %v", err)
+	}
+
+	// An append canceled part way leaves the file unchanged.
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	c, err := encryption.NewEncryptor(&encryption.Options{
+		Key: key,
+		Progress: func(done, _ int64) {
+			if done > 50000 {
+				cancel()
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewEncryptor() failed: %v", err)
+	}
+	if err := c.AppendFile(ctx, logPath, archivePath); err == nil {
+		t.Fatal("canceled AppendFile() succeeded")
+	}
+	if got, _ := os.ReadFile(archivePath); !bytes.Equal(got, original) {
+		t.Fatal("failed append changed the file")
+	}
+
+	// An appender abandoned before Close leaves the new chunks after the
+	// intact old contents.
+	f, err := os.OpenFile(archivePath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Failed to open archive: %v", err)
+	}
+	w, err := encryption.OpenAppender(f, key, &encryption.Options{Jobs: 1})
+	if err != nil {
+		t.Fatalf("OpenAppender() failed: %v", err)
+	}
+	if _, err := w.Write(more); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	f.Close()
+
+	if err := e.DecryptFile(t.Context(), archivePath, filepath.Join(tempDir, "out")); err == nil {
+		t.Error("DecryptFile() of an unfinished append succeeded")
+	}
+	salvaged := filepath.Join(tempDir, "salvaged")
+	report, err := e.SalvageFile(t.Context(), archivePath, salvaged, false)
+	if err != nil {
+		t.Fatalf("SalvageFile() failed: %v", err)
+	}
+	if got, _ := os.ReadFile(salvaged); !report.Complete || !bytes.Equal(got, want) {
+		t.Errorf("SalvageFile() recovered %d bytes (complete: %v), want the %d old ones", len(got), report.Complete, len(want))
+	}
+	if err := os.Truncate(archivePath, int64(len(original))); err != nil {
+		t.Fatalf("Truncate() failed: %v", err)
+	}
+	if got, _ := os.ReadFile(archivePath); !bytes.Equal(got, original) {
+		t.Error("truncating an unfinished append did not restore the file")
+	}
+
+	// The file can then be appended to as usual.
+	if err := e.AppendFile(t.Context(), logPath, archivePath); err != nil {
+		t.Fatalf("AppendFile() failed: %v", err)
+	}
+	decryptedPath := filepath.Join(tempDir, "archive.log")
+	if err := e.DecryptFile(t.Context(), archivePath, decryptedPath); err != nil {
+		t.Fatalf("DecryptFile() failed: %v", err)
+	}
+	if got, _ := os.ReadFile(decryptedPath); !bytes.Equal(got, append(want, more...)) {
+		t.Error("decrypted contents do not match after the append")
+	}
+}
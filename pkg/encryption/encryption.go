@@ -1,51 +1,68 @@
-// Package encryption provides file encryption and decryption functionality using AES-GCM-SIV.
+// Package encryption provides file encryption and decryption functionality using AES-256-GCM.
 // It implements secure file encryption with password-based key derivation and supports
 // chunked processing for large files.
 //
-// The package uses AES-GCM-SIV (Galois/Counter Mode with Synthetic Initialization Vector)
-// for authenticated encryption, which provides both confidentiality and authenticity.
+// The package uses AES-GCM (Galois/Counter Mode) for authenticated encryption,
+// which provides both confidentiality and authenticity.
 // The encryption process includes:
 //   - Password-based key derivation using Argon2id
 //   - Random salt generation for each file
-//   - Synthetic IV generation for nonce reuse protection
+//   - A per-file payload key derived from the password key with HKDF-SHA256
 //   - Chunked processing for handling large files
 //   - Authenticated encryption with associated data (AEAD)
 //
 // Security features:
 //   - Each file uses a unique salt to prevent rainbow table attacks
-//   - Synthetic IVs prevent nonce reuse vulnerabilities
-//   - Chunked processing with length prefixes prevents truncation attacks
+//   - Each chunk is sealed under a fresh random nonce
+//   - Every chunk is bound to the header, its position and whether it is the
+//     last chunk, which prevents reordering, splicing and truncation attacks
 //   - AEAD ensures data integrity and authenticity
 //
 // File Format:
 // The encrypted file format is structured as follows:
 //
-//	[salt (16 bytes)][chunk1][chunk2]...[chunkN]
+//	[header][metadata record][chunk1][chunk2]...[chunkN]
 //
-// Each chunk has the format:
+// The header is stored in plaintext and has the format:
+//
+//	[magic "FENC"][version (1 byte)][flags (1 byte)][fields length (2 bytes)][fields]
+//
+// Its fields record the KDF, its parameters and salt, the per-file HKDF
+// salt, the chunk size when it differs from the default, the parity shard
+// counts of files with parity, and a key check value derived from the
+// master key, which tells a wrong password apart from a damaged file
+// before anything is decrypted.
+// The metadata record and every chunk have the format:
 //
 //	[nonce (12 bytes)][length (4 bytes)][encrypted data]
 //
+// The metadata record holds the original file name, permissions, modification
+// time and, optionally, extended attributes. Every chunk except the last holds
+// exactly one chunk size of plaintext, 64KiB by default; the last chunk is
+// always shorter, and may be empty. In files with parity, every group of
+// chunks is followed by Reed–Solomon parity shards; see parity.go.
+//
 // Security Considerations:
 //
 //  1. Key Derivation:
 //     - Uses Argon2id for memory-hard key derivation
 //     - Each file has a unique salt to prevent rainbow table attacks
-//     - Salt is stored with the encrypted file
+//     - Salt and KDF parameters are stored in the file header
 //
 //  2. Encryption:
-//     - AES-GCM-SIV provides authenticated encryption
-//     - Synthetic IVs prevent nonce reuse vulnerabilities
-//     - Each chunk has a unique nonce (incremented counter)
+//     - AES-256-GCM provides authenticated encryption
+//     - Each record has its own random nonce under a per-file key
+//     - The header hash, record type, chunk index and a final-chunk flag
+//     are authenticated as associated data
 //
 //  3. File Processing:
 //     - Chunked processing allows handling of large files
-//     - Length prefixes prevent truncation attacks
+//     - A missing final chunk is detected as truncation
 //     - AEAD ensures data integrity for each chunk
 //
 //  4. Memory Safety:
 //     - No sensitive data is kept in memory longer than necessary
-//     - Chunk size is fixed to prevent memory exhaustion
+//     - Chunk size is fixed and record lengths are bounded to prevent memory exhaustion
 //     - File handles are properly closed using defer
 //
 // Usage Example:
@@ -60,30 +77,97 @@
 //	    log.Fatal(err)
 //	}
 //
+//	// Recreate input.txt with its original attributes in the restore directory
+//	path, err := encryption.RestoreFile("output.enc", "restore")
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//
+// Streams that never touch the file system, such as an HTTP body or a
+// database dump pipe, use the same format through Writer and Reader:
+//
+//	key, err := encryption.NewKey()
+//	w, err := encryption.NewWriter(dst, key, nil)
+//	_, err = io.Copy(w, src)
+//	err = w.Close()
+//
+//	r, err := encryption.NewReader(src, nil)
+//	_, err = io.Copy(dst, r)
+//
+// Parts of a large file can be read without decrypting the rest of it.
+// OpenReaderAt returns an io.ReaderAt and io.ReadSeeker over the plaintext
+// that only reads and authenticates the chunks a read touches:
+//
+//	r, err := encryption.OpenReaderAt(f, info.Size(), nil)
+//	_, err = r.ReadAt(buf, 1<<30)
+//
+// EncryptStream and DecryptStream work on pipes such as os.Stdin and
+// os.Stdout, and EncryptReader and DecryptReader read from a pipe into an
+// output file.
+//
+// An existing file can be extended with OpenAppender or AppendFile, which
+// only decrypt and re-seal its final chunk.
+//
+// Files created with CreateFile can also be written at arbitrary offsets
+// through File, which re-seals only the chunks a write touches. Such files
+// carry an integrity record after the metadata record that detects
+// individual chunks being rolled back to an earlier version:
+//
+//	f, err := encryption.CreateFile("disk.img.enc", key)
+//	_, err = f.WriteAt(block, 4096)
+//	err = f.Close()
+//
+// The package-level functions share the kdf.GetKey hook and the Jobs and
+// UnsafeStreaming settings, which are deprecated. An Encryptor carries its
+// own key source, Argon2id parameters, random source and progress callback
+// instead, so several can be used at once with different keys. Its methods
+// take a context and stop between chunks once it is done:
+//
+//	e, err := encryption.NewEncryptor(&encryption.Options{Password: password})
+//	err = e.EncryptFile(ctx, "input.txt", "output.enc")
+//	err = e.DecryptFile(ctx, "output.enc", "decrypted.txt")
+//
+// Files in the legacy headerless format, [salt][nonce|length|ciphertext]...,
+// are detected by the missing magic and decrypted sequentially with their
+// fixed Argon2id parameters. MigrateFile converts them to the current format.
+//
+// Decryption errors can be told apart with errors.Is and errors.As:
+// ErrWrongKey, ErrTruncated, ErrUnsupportedVersion and ErrNotEncrypted are
+// sentinels, and *ErrCorrupted reports the chunk that was damaged.
+//
 // Dependencies:
 //   - crypto/aes: For AES encryption
-//   - crypto/cipher: For GCM-SIV mode
+//   - crypto/cipher: For GCM mode
+//   - crypto/hkdf: For per-file key derivation
 //   - crypto/rand: For secure random number generation
 //   - pkg/kdf: For password-based key derivation
 package encryption
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/rand"
-	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"runtime"
 
-	"github.com/gigatar/file-encryptor/pkg/kdf"
+	"github.com/gigatar/file-encryptor/pkg/archive"
 )
 
 // Constants for encryption configuration
 const (
-	// chunkSize defines the size of chunks for processing large files.
+	// defaultChunkSize defines the size of chunks for processing large files.
 	// The value of 64KB provides a good balance between memory usage
-	// and performance for most file sizes.
-	chunkSize = 64 * 1024 // 64KB
+	// and performance for most file sizes. Other sizes can be selected
+	// with Options.ChunkSize and are recorded in the header.
+	defaultChunkSize = 64 * 1024 // 64KB
+
+	// minChunkSize and maxChunkSize bound the chunk sizes that can be
+	// written or read. Chunk sizes must also be powers of two.
+	minChunkSize = 4 * 1024         // 4KB
+	maxChunkSize = 16 * 1024 * 1024 // 16MB
 
 	// saltSize defines the length of the random salt used for key derivation.
 	// A 16-byte (128-bit) salt provides sufficient entropy to prevent
@@ -91,6 +175,15 @@ const (
 	saltSize = 16
 )
 
+// Jobs is the number of chunks sealed or opened concurrently while a single
+// file is encrypted or decrypted. Values below 2 process chunks one after
+// another on the calling goroutine. The output is byte-for-byte the same
+// either way; at most about Jobs chunks are held in memory at once.
+//
+// Deprecated: Set Options.Jobs on an Encryptor instead, which does not
+// affect other users of the package.
+var Jobs = runtime.GOMAXPROCS(0)
+
 // generateSalt creates a new random salt for key derivation.
 // The salt is used to prevent rainbow table attacks and ensure
 // that the same password produces different keys for different files.
@@ -107,55 +200,39 @@ func generateSalt() ([]byte, error) {
 	return salt, nil
 }
 
-// generateSyntheticIV creates a synthetic initialization vector (IV) for AES-GCM-SIV.
-// The IV is generated by encrypting a zero block and XORing it with the plaintext.
-// This ensures that the IV is unique for each encryption operation and
-// provides additional security against nonce reuse.
+// EncryptFile encrypts a file using AES-256-GCM encryption.
+// It reads the input file, encrypts its contents using a password-derived key,
+// and writes the encrypted data to the output file.
+//
+// The output is written to a temporary file in the same directory, which
+// is flushed to stable storage and renamed to outName only once encryption
+// has succeeded, so a failure never leaves a truncated file behind. Set
+// UnsafeStreaming to write to pipes and devices directly.
+//
+// The encryption process:
+//  1. Generates a random KDF salt and per-file salt and writes the header
+//  2. Derives an encryption key from the user's password and salt
+//  3. Encrypts the file name, permissions and modification time into the
+//     metadata record
+//  4. Encrypts the file contents chunk by chunk, each under a fresh nonce
 //
 // Args:
-//   - key: The encryption key to use
-//   - plainText: The plaintext data to be encrypted
+//   - inName: Path to the file to encrypt
+//   - outName: Path where the encrypted file will be written
 //
 // Returns:
-//   - []byte: A 12-byte synthetic IV
-//   - error: Any error that occurred during IV generation
-func generateSyntheticIV(key []byte, plainText []byte) ([]byte, error) {
-	// Create Zero block
-	zeroBlock := make([]byte, 16)
-
-	// Encrypt Zeroblock to create initial block
-	block, err := aes.NewCipher(key)
+//   - error: Any error that occurred during encryption
+func EncryptFile(inName, outName string) error {
+	key, err := NewKey()
 	if err != nil {
-		return nil, err
-	}
-
-	blockCipherText := make([]byte, 16)
-	block.Encrypt(blockCipherText, zeroBlock)
-
-	// XOR the result of encryption with the plaintext to create the IV
-	syntheticIV := make([]byte, 12)
-	copy(syntheticIV, blockCipherText[:12]) // Only need first 12 bytes for IV
-	for i := 0; i < len(plainText) && i < len(syntheticIV); i++ {
-		syntheticIV[i] ^= plainText[i]
+		return err
 	}
 
-	return syntheticIV, nil
+	return key.EncryptFile(inName, outName)
 }
 
-// EncryptFile encrypts a file using AES-GCM-SIV encryption.
-// It reads the input file, encrypts its contents using a password-derived key,
-// and writes the encrypted data to the output file.
-//
-// The encryption process:
-//  1. Generates a random salt and writes it to the output file
-//  2. Derives an encryption key from the user's password and salt
-//  3. Reads the first chunk of data and generates a synthetic IV
-//  4. Encrypts the first chunk and writes it to the output file
-//  5. Processes remaining chunks with incrementing nonce values
-//
-// The output file format is:
-//
-//	[salt (16 bytes)][nonce (12 bytes)][length (4 bytes)][encrypted chunk][...]
+// EncryptFileWithXattrs behaves like EncryptFile but also records the
+// extended attributes of the input file in the metadata record.
 //
 // Args:
 //   - inName: Path to the file to encrypt
@@ -163,115 +240,194 @@ func generateSyntheticIV(key []byte, plainText []byte) ([]byte, error) {
 //
 // Returns:
 //   - error: Any error that occurred during encryption
-func EncryptFile(inName, outName string) error {
+func EncryptFileWithXattrs(inName, outName string) error {
+	key, err := NewKey()
+	if err != nil {
+		return err
+	}
+
+	return key.EncryptFileWithXattrs(inName, outName)
+}
+
+// encryptFile implements EncryptFile and EncryptFileWithXattrs.
+func encryptFile(cfg streamConfig, key *Key, inName, outName string, withXattrs bool) error {
 	inFile, err := os.Open(inName)
 	if err != nil {
 		return err
 	}
 	defer inFile.Close()
 
-	outFile, err := os.Create(outName)
+	meta, err := statMetadata(inFile, withXattrs)
 	if err != nil {
 		return err
 	}
-	defer outFile.Close()
+	if cfg.progress != nil {
+		if info, err := inFile.Stat(); err == nil {
+			cfg.total = info.Size()
+		}
+	}
+
+	return encryptTo(cfg, key, inFile, meta, outName)
+}
 
-	salt, err := generateSalt()
+// encryptTo encrypts src with meta into the output file outName.
+func encryptTo(cfg streamConfig, key *Key, src io.Reader, meta *Metadata, outName string) error {
+	outFile, err := cfg.createOutput(outName)
 	if err != nil {
 		return err
 	}
+	defer outFile.abort()
 
-	key, err := kdf.GetKey(salt)
+	w, err := newWriter(outFile, key, meta, 0, cfg)
 	if err != nil {
 		return err
 	}
 
-	if _, err := outFile.Write(salt); err != nil {
+	if _, err := io.Copy(w, src); err != nil {
 		return err
 	}
-
-	firstChunk := make([]byte, chunkSize)
-	n, err := inFile.Read(firstChunk)
-	if err != nil && err != io.EOF {
+	if err := w.Close(); err != nil {
 		return err
 	}
-	nonce, err := generateSyntheticIV(key, firstChunk[:n])
+
+	return outFile.commit()
+}
+
+// EncryptReader encrypts everything read from src into the output file,
+// which is written like the output of EncryptFile. Since src has no file
+// name or attributes, no metadata record is written.
+//
+// Args:
+//   - src: Source of the plaintext, such as os.Stdin
+//   - outName: Path where the encrypted file will be written
+//
+// Returns:
+//   - error: Any error that occurred during encryption
+func EncryptReader(src io.Reader, outName string) error {
+	key, err := NewKey()
 	if err != nil {
 		return err
 	}
 
-	// write nonce to output file
-	if _, err := outFile.Write(nonce); err != nil {
+	return encryptTo(defaultConfig(), key, src, nil, outName)
+}
+
+// EncryptStream encrypts everything read from src and writes the encrypted
+// file to dst as it is produced, for pipes such as os.Stdout. No metadata
+// record is written.
+//
+// Args:
+//   - dst: Destination of the encrypted file
+//   - src: Source of the plaintext
+//
+// Returns:
+//   - error: Any error that occurred during encryption
+func EncryptStream(dst io.Writer, src io.Reader) error {
+	key, err := NewKey()
+	if err != nil {
 		return err
 	}
 
-	// Encrypt and write first chunk
-	block, err := aes.NewCipher(key)
+	return encryptStream(defaultConfig(), key, dst, src)
+}
+
+// encryptStream implements EncryptStream.
+func encryptStream(cfg streamConfig, key *Key, dst io.Writer, src io.Reader) error {
+	w, err := newWriter(dst, key, nil, 0, cfg)
 	if err != nil {
 		return err
 	}
 
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
+	if _, err := io.Copy(w, src); err != nil {
 		return err
 	}
 
-	ct := gcm.Seal(nil, nonce, firstChunk[:n], nil)
+	return w.Close()
+}
 
-	// Write length
-	lenBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(lenBuf, uint32(len(ct)))
-	if _, err := outFile.Write(lenBuf); err != nil {
+// EncryptDir encrypts a whole directory tree into a single file.
+// The tree is streamed as a tar archive of its regular files, directories and
+// symbolic links straight into the encryptor, so no plaintext archive is
+// ever written to disk. The name, permissions and modification time of the
+// directory itself are kept in the metadata record.
+//
+// Args:
+//   - inDir: Path to the directory to encrypt
+//   - outName: Path where the encrypted file will be written
+//   - exclude: gitignore-style patterns of paths to leave out
+//
+// Returns:
+//   - error: Any error that occurred during archiving or encryption
+func EncryptDir(inDir, outName string, exclude []string) error {
+	key, err := NewKey()
+	if err != nil {
 		return err
 	}
 
-	if _, err := outFile.Write(ct); err != nil {
+	return key.EncryptDir(inDir, outName, exclude)
+}
+
+// encryptDir implements EncryptDir.
+func encryptDir(cfg streamConfig, key *Key, inDir, outName string, exclude []string) error {
+	matcher, err := archive.NewMatcher(exclude)
+	if err != nil {
+		return fmt.Errorf("invalid exclude pattern: %w", err)
+	}
+
+	dir, err := os.Open(inDir)
+	if err != nil {
 		return err
 	}
+	defer dir.Close()
 
-	nonceCounter := uint64(0)
-	// Process rest of file
-	for {
-		n, err := inFile.Read(firstChunk)
-		if err != nil && err != io.EOF {
-			return err
-		}
-		if n == 0 {
-			break
-		}
+	meta, err := statMetadata(dir, false)
+	if err != nil {
+		return err
+	}
 
-		binary.BigEndian.PutUint64(nonce[4:], nonceCounter)
-		nonceCounter++
+	outFile, err := cfg.createOutput(outName)
+	if err != nil {
+		return err
+	}
+	defer outFile.abort()
 
-		if _, err := outFile.Write(nonce); err != nil {
-			return err
-		}
-		ct := gcm.Seal(nil, nonce, firstChunk[:n], nil)
-		lenBuf := make([]byte, 4)
-		binary.BigEndian.PutUint32(lenBuf, uint32(len(ct)))
-		if _, err := outFile.Write(lenBuf); err != nil {
-			return err
-		}
+	w, err := newWriter(outFile, key, meta, flagArchive, cfg)
+	if err != nil {
+		return err
+	}
 
-		if _, err := outFile.Write(ct); err != nil {
-			return err
-		}
+	if err := archive.Write(w, inDir, matcher); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
 	}
 
-	return nil
+	return outFile.commit()
 }
 
 // DecryptFile decrypts a previously encrypted file.
 // It reads the encrypted file, decrypts its contents using the provided password,
-// and writes the decrypted data to the output file.
+// and writes the decrypted data to the output file. The metadata record is
+// authenticated but not applied; use RestoreFile to recreate the original file.
+//
+// Like EncryptFile, the output is written under a temporary name and only
+// renamed to outName once every chunk has been authenticated, so a corrupted
+// file never leaves partial plaintext behind.
+//
+// If the file holds a directory tree written by EncryptDir, the tree is
+// extracted into outName instead, which must not exist or must be an empty
+// directory.
 //
 // The decryption process:
-//  1. Reads the salt from the start of the encrypted file
+//  1. Reads and validates the header at the start of the encrypted file
 //  2. Derives the decryption key from the user's password and salt
-//  3. For each chunk:
+//  3. Decrypts the metadata record, if present
+//  4. For each chunk:
 //     a. Reads the nonce and chunk length
 //     b. Reads the encrypted chunk
 //     c. Decrypts the chunk and writes it to the output file
+//  5. Checks that the last chunk was marked as final and nothing follows it
 //
 // Args:
 //   - inName: Path to the encrypted file
@@ -280,71 +436,441 @@ func EncryptFile(inName, outName string) error {
 // Returns:
 //   - error: Any error that occurred during decryption
 func DecryptFile(inName, outName string) error {
+	return decryptFile(defaultConfig(), inName, outName)
+}
+
+// decryptFile implements DecryptFile.
+func decryptFile(cfg streamConfig, inName, outName string) error {
 	inFile, err := os.Open(inName)
 	if err != nil {
 		return err
 	}
 	defer inFile.Close()
 
-	outFile, err := os.Create(outName)
+	dec, err := openFileReader(inFile, cfg)
 	if err != nil {
 		return err
 	}
-	defer outFile.Close()
 
-	salt := make([]byte, saltSize)
-	if _, err := io.ReadFull(inFile, salt); err != nil {
-		return err
+	return decryptTo(dec, outName)
+}
+
+// openFileReader returns a Reader for the encrypted file f. If progress is
+// reported, its total is the plaintext size implied by the size of f. The
+// records of files with parity are read at their positions in f, so that
+// damaged ones can be repaired.
+func openFileReader(f *os.File, cfg streamConfig) (*Reader, error) {
+	dec, err := newReader(f, cfg)
+	if err != nil || (dec.progress == nil && dec.header.parityShards == 0) {
+		return dec, err
 	}
 
-	key, err := kdf.GetKey(salt)
+	info, err := f.Stat()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	dataStart, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	if dec.header.parityShards > 0 {
+		head := &streamHead{header: dec.header, sealer: dec.sealer, meta: dec.meta}
+		if dec.ra, err = newReaderAt(f, info.Size(), head, dataStart); err != nil {
+			return nil, err
+		}
+		dec.ra.onRepair = cfg.onRepair
+		dec.total = dec.ra.size
+		return dec, nil
 	}
 
-	// Create GCM Cipher
-	block, err := aes.NewCipher(key)
+	body := info.Size() - dataStart
+	l := dec.header.layout()
+	dec.total = body/l.recordSize()*l.chunkSize + max(body%l.recordSize()-recordHeaderSize-tagSize, 0)
+
+	return dec, nil
+}
+
+// DecryptReader decrypts an encrypted file read from src, such as os.Stdin,
+// into the output file exactly as DecryptFile does.
+//
+// Args:
+//   - src: Source of the encrypted file
+//   - outName: Path where the decrypted file will be written
+//
+// Returns:
+//   - error: Any error that occurred during decryption
+func DecryptReader(src io.Reader, outName string) error {
+	return decryptReader(defaultConfig(), src, outName)
+}
+
+// decryptReader implements DecryptReader.
+func decryptReader(cfg streamConfig, src io.Reader, outName string) error {
+	dec, err := newReader(src, cfg)
 	if err != nil {
 		return err
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	return decryptTo(dec, outName)
+}
+
+// DecryptStream decrypts an encrypted file read from src and writes the
+// plaintext to dst as it is authenticated, for pipes such as os.Stdout. A
+// directory tree is written as the tar archive it was encrypted from.
+//
+// Since the plaintext is streamed, dst may have received the contents of
+// earlier chunks by the time a damaged chunk is found. The error must be
+// checked before anything written to dst is trusted.
+//
+// Args:
+//   - dst: Destination of the plaintext
+//   - src: Source of the encrypted file
+//
+// Returns:
+//   - error: Any error that occurred during decryption
+func DecryptStream(dst io.Writer, src io.Reader) error {
+	return decryptStream(defaultConfig(), dst, src)
+}
+
+// decryptStream implements DecryptStream.
+func decryptStream(cfg streamConfig, dst io.Writer, src io.Reader) error {
+	dec, err := newReader(src, cfg)
 	if err != nil {
-		return nil
+		return err
 	}
 
-	nonce := make([]byte, 12)
-	lenBuf := make([]byte, 4)
-	for {
-		// Read Nonce
-		if _, err := io.ReadFull(inFile, nonce); err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				return err
-			}
+	_, err = io.Copy(dst, dec)
+	return err
+}
+
+// decryptTo decrypts the stream of dec into the output file outName, or
+// extracts it into the directory outName if it holds a directory tree.
+func decryptTo(dec *Reader, outName string) error {
+	if dec.isArchive() {
+		dir, err := dec.createOutputDir(outName)
+		if err != nil {
+			return err
 		}
-		if _, err := io.ReadFull(inFile, lenBuf); err != nil {
+		if err := dec.extract(dir); err != nil {
+			if dir != outName {
+				removeTemp(dir)
+			}
 			return err
 		}
+		return commitDir(dir, outName)
+	}
 
-		ctLen := binary.BigEndian.Uint32(lenBuf)
-		ct := make([]byte, ctLen)
+	outFile, err := dec.createOutput(outName)
+	if err != nil {
+		return err
+	}
+	defer outFile.abort()
 
-		if _, err := io.ReadFull(inFile, ct); err != nil {
-			return err
-		}
+	if _, err := io.Copy(outFile, dec); err != nil {
+		return err
+	}
 
-		// Decrypt
-		pt, err := gcm.Open(nil, nonce, ct, nil)
-		if err != nil {
-			return err
-		}
+	return outFile.commit()
+}
 
-		if _, err := outFile.Write(pt); err != nil {
-			return err
-		}
+// VerifyFile authenticates an encrypted file exactly as DecryptFile does,
+// including the final chunk and truncation checks, but discards the
+// plaintext instead of writing it anywhere.
+//
+// Args:
+//   - name: Path to the encrypted file
+//
+// Returns:
+//   - error: nil if the file is intact; ErrWrongKey if the key does not
+//     match; *ErrCorrupted, ErrTruncated, ErrUnsupportedVersion or
+//     ErrNotEncrypted if the file is damaged or not an encrypted file; any
+//     other error if it is unreadable
+func VerifyFile(name string) error {
+	return verifyFile(defaultConfig(), name)
+}
+
+// verifyFile implements VerifyFile.
+func verifyFile(cfg streamConfig, name string) error {
+	inFile, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+
+	dec, err := openFileReader(inFile, cfg)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(io.Discard, dec)
+	return err
+}
+
+// RekeyFile re-encrypts an encrypted file under key, so that it opens with
+// a new password. The current key is derived with kdf.GetKey. The contents
+// and metadata are authenticated as they are read and written to a fresh
+// file with a new salt, file key and nonces; the old password cannot open
+// the result. The chunk size and parity of the file are kept.
+//
+// outName may be the same as inName, in which case the file is replaced
+// only once the new one has been written completely. Files written through
+// File cannot be rekeyed.
+//
+// Args:
+//   - inName: Path to the encrypted file
+//   - outName: Path where the rekeyed file will be written
+//   - key: Master key to encrypt the result with
+//
+// Returns:
+//   - error: ErrWrongKey if the current key does not open the file; any
+//     other error that occurred during decryption or encryption
+func RekeyFile(inName, outName string, key *Key) error {
+	return rekeyFile(defaultConfig(), inName, outName, key)
+}
+
+// rekeyFile implements RekeyFile. Progress is reported as the input is read.
+func rekeyFile(cfg streamConfig, inName, outName string, key *Key) error {
+	inFile, err := os.Open(inName)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+
+	dec, err := openFileReader(inFile, cfg)
+	if err != nil {
+		return err
+	}
+	if dec.integrity != nil {
+		return errors.New("files written through File cannot be rekeyed")
+	}
+
+	outFile, err := cfg.createOutput(outName)
+	if err != nil {
+		return err
+	}
+	defer outFile.abort()
+
+	cfg.progress = nil
+	cfg.chunkSize = dec.header.chunkSize
+	cfg.dataShards, cfg.parityShards = dec.header.dataShards, dec.header.parityShards
+	w, err := newWriter(outFile, key, dec.meta, dec.header.flags&flagArchive, cfg)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, dec); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return outFile.commit()
+}
+
+// DecryptRange decrypts only the given range of an encrypted file's
+// plaintext and writes it to the output file. Only the chunks overlapping
+// the range are read, and each of them is authenticated before any of its
+// plaintext is written, so the cost does not depend on the size of the file.
+//
+// A negative offset counts back from the end of the plaintext, so an offset
+// of -n selects the last n bytes. The range is clipped to the plaintext.
+//
+// Args:
+//   - inName: Path to the encrypted file
+//   - outName: Path where the decrypted range will be written
+//   - offset: Plaintext offset of the range, or a negative offset from the end
+//   - length: Number of bytes to decrypt, or a negative value for the rest of the file
+//
+// Returns:
+//   - error: Any error that occurred during decryption
+func DecryptRange(inName, outName string, offset, length int64) error {
+	return decryptRange(defaultConfig(), inName, outName, offset, length)
+}
+
+// decryptRange implements DecryptRange.
+func decryptRange(cfg streamConfig, inName, outName string, offset, length int64) error {
+	outFile, err := cfg.createOutput(outName)
+	if err != nil {
+		return err
+	}
+	defer outFile.abort()
+
+	if err := decryptRangeStream(cfg, outFile, inName, offset, length); err != nil {
+		return err
+	}
+
+	return outFile.commit()
+}
+
+// DecryptRangeStream behaves like DecryptRange but writes the range to dst,
+// such as os.Stdout.
+//
+// Args:
+//   - dst: Destination of the decrypted range
+//   - inName: Path to the encrypted file
+//   - offset: Plaintext offset of the range, or a negative offset from the end
+//   - length: Number of bytes to decrypt, or a negative value for the rest of the file
+//
+// Returns:
+//   - error: Any error that occurred during decryption
+func DecryptRangeStream(dst io.Writer, inName string, offset, length int64) error {
+	return decryptRangeStream(defaultConfig(), dst, inName, offset, length)
+}
+
+// decryptRangeStream implements DecryptRangeStream. The context and
+// progress are checked and reported as the range is written to dst.
+func decryptRangeStream(cfg streamConfig, dst io.Writer, inName string, offset, length int64) error {
+	inFile, err := os.Open(inName)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+
+	info, err := inFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	dec, err := openReaderAt(inFile, info.Size(), cfg.keys)
+	if err != nil {
+		return err
+	}
+	dec.onRepair = cfg.onRepair
+
+	if offset < 0 {
+		offset = max(dec.Size()+offset, 0)
+	}
+	offset = min(offset, dec.Size())
+	if length < 0 || length > dec.Size()-offset {
+		length = dec.Size() - offset
+	}
+
+	cfg.total = length
+	_, err = io.Copy(&progressWriter{w: dst, cfg: &cfg}, io.NewSectionReader(dec, offset, length))
+	return err
+}
+
+// RestoreFile decrypts a previously encrypted file into dir, recreating it
+// under its original name with its original permissions, modification time
+// and any recorded extended attributes. A directory tree written by
+// EncryptDir is recreated as a subdirectory of dir.
+//
+// The name is taken from the encrypted metadata record. Only a single path
+// element is accepted and the file is created through an os.Root opened on
+// dir, so a crafted name can never place the file outside dir. An existing
+// file is never overwritten, and nothing is created unless the whole file
+// authenticates.
+//
+// Args:
+//   - inName: Path to the encrypted file
+//   - dir: Directory in which the original file is recreated
+//
+// Returns:
+//   - string: Path of the restored file
+//   - error: Any error that occurred during decryption or restoration
+func RestoreFile(inName, dir string) (string, error) {
+	return restoreFile(defaultConfig(), inName, dir)
+}
+
+// restoreFile implements RestoreFile.
+func restoreFile(cfg streamConfig, inName, dir string) (string, error) {
+	inFile, err := os.Open(inName)
+	if err != nil {
+		return "", err
+	}
+	defer inFile.Close()
+
+	dec, err := openFileReader(inFile, cfg)
+	if err != nil {
+		return "", err
+	}
+	if dec.meta == nil {
+		return "", fmt.Errorf("%s has no metadata to restore", inName)
+	}
+	if err := safeName(dec.meta.Name); err != nil {
+		return "", err
+	}
+
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return "", err
+	}
+	defer root.Close()
+
+	if dec.isArchive() {
+		return restoreDir(dec, root, dir)
+	}
+
+	if _, err := root.Lstat(dec.meta.Name); err == nil {
+		return "", &fs.PathError{Op: "open", Path: filepath.Join(dir, dec.meta.Name), Err: fs.ErrExist}
+	}
+
+	// The file is written under a temporary name and only moved into
+	// place once it has been fully authenticated.
+	tmp, err := tempName(dec.meta.Name)
+	if err != nil {
+		return "", err
+	}
+	outFile, err := root.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	addTemp(filepath.Join(dir, tmp))
+	defer removeTemp(filepath.Join(dir, tmp))
+	defer outFile.Close()
+
+	if _, err := io.Copy(outFile, dec); err != nil {
+		return "", err
+	}
+
+	if err := applyMetadata(outFile, dec.meta); err != nil {
+		return "", err
+	}
+
+	if err := outFile.Sync(); err != nil {
+		return "", err
+	}
+	if err := outFile.Close(); err != nil {
+		return "", err
+	}
+
+	if err := placeNew(dir, tmp, dec.meta.Name); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, dec.meta.Name)
+
+	return path, os.Chtimes(path, dec.meta.ModTime, dec.meta.ModTime)
+}
+
+// restoreDir recreates a directory tree written by EncryptDir inside root.
+// The tree is extracted under a temporary name and only moved into place
+// once the whole archive has been authenticated.
+func restoreDir(dec *Reader, root *os.Root, dir string) (string, error) {
+	if _, err := root.Lstat(dec.meta.Name); err == nil {
+		return "", &fs.PathError{Op: "mkdir", Path: filepath.Join(dir, dec.meta.Name), Err: fs.ErrExist}
+	}
+
+	tmp, err := tempName(dec.meta.Name)
+	if err != nil {
+		return "", err
+	}
+	if err := root.Mkdir(tmp, 0700); err != nil {
+		return "", err
+	}
+	addTemp(filepath.Join(dir, tmp))
+	defer removeTemp(filepath.Join(dir, tmp))
+
+	if err := dec.extract(filepath.Join(dir, tmp)); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(filepath.Join(dir, tmp), dec.meta.Mode); err != nil {
+		return "", err
+	}
+
+	if err := placeNew(dir, tmp, dec.meta.Name); err != nil {
+		return "", err
 	}
+	path := filepath.Join(dir, dec.meta.Name)
 
-	return nil
+	return path, os.Chtimes(path, dec.meta.ModTime, dec.meta.ModTime)
 }
@@ -6,9 +6,11 @@ package encryption_test
 import (
 	"bytes"
 	"crypto/rand"
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/gigatar/file-encryptor/pkg/encryption"
 	"github.com/gigatar/file-encryptor/pkg/kdf"
@@ -203,3 +205,441 @@ func TestErrorHandling(t *testing.T) {
 		})
 	}
 }
+
+// TestRestoreFile verifies that RestoreFile recreates the original file name,
+// permissions and modification time inside the target directory.
+func TestRestoreFile(t *testing.T) {
+	// Save original GetKey function and restore it after the test
+	originalGetKey := kdf.GetKey
+	kdf.GetKey = mockGetKey
+	defer func() { kdf.GetKey = originalGetKey }()
+
+	tempDir := t.TempDir()
+	restoreDir := filepath.Join(tempDir, "restore")
+	if err := os.Mkdir(restoreDir, 0755); err != nil {
+		t.Fatalf("Failed to create restore dir: %v", err)
+	}
+
+	inputPath := filepath.Join(tempDir, "report.txt")
+	outputPath := filepath.Join(tempDir, "blob.enc")
+	testData := []byte("quarterly numbers")
+	if err := os.WriteFile(inputPath, testData, 0640); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	if err := os.Chmod(inputPath, 0640); err != nil {
+		t.Fatalf("Failed to chmod test file: %v", err)
+	}
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(inputPath, modTime, modTime); err != nil {
+		t.Fatalf("Failed to set test file times: %v", err)
+	}
+
+	if err := encryption.EncryptFile(inputPath, outputPath); err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+
+	path, err := encryption.RestoreFile(outputPath, restoreDir)
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if want := filepath.Join(restoreDir, "report.txt"); path != want {
+		t.Errorf("RestoreFile() path = %q, want %q", path, want)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read restored file: %v", err)
+	}
+	if !bytes.Equal(data, testData) {
+		t.Error("Restored file does not match original")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat restored file: %v", err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("Restored mode = %v, want %v", info.Mode().Perm(), os.FileMode(0640))
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Errorf("Restored mtime = %v, want %v", info.ModTime(), modTime)
+	}
+
+	// Restoring again must not overwrite the existing file
+	if _, err := encryption.RestoreFile(outputPath, restoreDir); err == nil {
+		t.Error("RestoreFile() overwrote an existing file")
+	}
+}
+
+// TestTamperDetection verifies that truncated, extended and modified files
+// are rejected instead of silently producing partial plaintext.
+func TestTamperDetection(t *testing.T) {
+	// Save original GetKey function and restore it after the test
+	originalGetKey := kdf.GetKey
+	kdf.GetKey = mockGetKey
+	defer func() { kdf.GetKey = originalGetKey }()
+
+	tempDir := t.TempDir()
+	inputPath := filepath.Join(tempDir, "input.bin")
+	outputPath := filepath.Join(tempDir, "output.enc")
+
+	// Exactly two chunks, so the stream ends with an empty final chunk
+	testData := make([]byte, 2*64*1024)
+	if _, err := rand.Read(testData); err != nil {
+		t.Fatalf("Failed to generate test data: %v", err)
+	}
+	if err := os.WriteFile(inputPath, testData, 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	if err := encryption.EncryptFile(inputPath, outputPath); err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	encrypted, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatalf("Failed to read encrypted file: %v", err)
+	}
+
+	// The empty final chunk is 12+4+16 bytes long
+	finalLen := 12 + 4 + 16
+
+	testCases := []struct {
+		name   string
+		mutate func([]byte) []byte
+	}{
+		{
+			name:   "Dropped final chunk",
+			mutate: func(b []byte) []byte { return b[:len(b)-finalLen] },
+		},
+		{
+			name:   "Truncated mid-chunk",
+			mutate: func(b []byte) []byte { return b[:len(b)-finalLen-100] },
+		},
+		{
+			name:   "Trailing data",
+			mutate: func(b []byte) []byte { return append(b, 0) },
+		},
+		{
+			name: "Flipped header bit",
+			mutate: func(b []byte) []byte {
+				b[10] ^= 1
+				return b
+			},
+		},
+		{
+			name: "Flipped ciphertext bit",
+			mutate: func(b []byte) []byte {
+				b[len(b)/2] ^= 1
+				return b
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tamperedPath := filepath.Join(tempDir, "tampered.enc")
+			tampered := tc.mutate(append([]byte(nil), encrypted...))
+			if err := os.WriteFile(tamperedPath, tampered, 0644); err != nil {
+				t.Fatalf("Failed to write tampered file: %v", err)
+			}
+
+			err := encryption.DecryptFile(tamperedPath, filepath.Join(tempDir, "decrypted.bin"))
+			if err == nil {
+				t.Error("DecryptFile() accepted a tampered file")
+			}
+		})
+	}
+}
+
+// TestEncryptDir verifies that a directory tree can be encrypted into a
+// single file and recreated, with excluded paths left out.
+func TestEncryptDir(t *testing.T) {
+	// Save original GetKey function and restore it after the test
+	originalGetKey := kdf.GetKey
+	kdf.GetKey = mockGetKey
+	defer func() { kdf.GetKey = originalGetKey }()
+
+	tempDir := t.TempDir()
+	srcDir := filepath.Join(tempDir, "project")
+	if err := os.MkdirAll(filepath.Join(srcDir, "src"), 0755); err != nil {
+		t.Fatalf("Failed to create source tree: %v", err)
+	}
+
+	// Larger than one chunk so the archive spans several chunks
+	bigData := make([]byte, 3*64*1024+7)
+	if _, err := rand.Read(bigData); err != nil {
+		t.Fatalf("Failed to generate test data: %v", err)
+	}
+	files := map[string][]byte{
+		"README":       []byte("hello"),
+		"src/main.go":  []byte("package main"),
+		"src/data.bin": bigData,
+		"src/out.tmp":  []byte("excluded"),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(srcDir, name), data, 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	outputPath := filepath.Join(tempDir, "project.enc")
+	if err := encryption.EncryptDir(srcDir, outputPath, []string{"*.tmp"}); err != nil {
+		t.Fatalf("EncryptDir() failed: %v", err)
+	}
+
+	restoreDir := filepath.Join(tempDir, "restore")
+	if err := os.Mkdir(restoreDir, 0755); err != nil {
+		t.Fatalf("Failed to create restore dir: %v", err)
+	}
+	path, err := encryption.RestoreFile(outputPath, restoreDir)
+	if err != nil {
+		t.Fatalf("RestoreFile() failed: %v", err)
+	}
+	if want := filepath.Join(restoreDir, "project"); path != want {
+		t.Errorf("RestoreFile() path = %q, want %q", path, want)
+	}
+
+	for name, data := range files {
+		got, err := os.ReadFile(filepath.Join(path, name))
+		if name == "src/out.tmp" {
+			if !os.IsNotExist(err) {
+				t.Errorf("%s was not excluded", name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Failed to read %s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s does not match original", name)
+		}
+	}
+
+	// DecryptFile extracts into the output path
+	extractDir := filepath.Join(tempDir, "extract")
+	if err := encryption.DecryptFile(outputPath, extractDir); err != nil {
+		t.Fatalf("DecryptFile() failed: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(extractDir, "README")); err != nil || string(got) != "hello" {
+		t.Errorf("README = %q, %v, want %q", got, err, "hello")
+	}
+}
+
+// TestKeyReuse verifies that a single Key can encrypt many files with one
+// key derivation while each file still decrypts independently.
+func TestKeyReuse(t *testing.T) {
+	// Count key derivations made through kdf.GetKey
+	calls := 0
+	originalGetKey := kdf.GetKey
+	kdf.GetKey = func(salt []byte) ([]byte, error) {
+		calls++
+		return mockGetKey(salt)
+	}
+	defer func() { kdf.GetKey = originalGetKey }()
+
+	tempDir := t.TempDir()
+	key, err := encryption.NewKey()
+	if err != nil {
+		t.Fatalf("NewKey() failed: %v", err)
+	}
+
+	var encrypted [][]byte
+	for _, name := range []string{"one", "two"} {
+		inputPath := filepath.Join(tempDir, name)
+		outputPath := inputPath + ".enc"
+		if err := os.WriteFile(inputPath, []byte("same contents"), 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+		if err := key.EncryptFile(inputPath, outputPath); err != nil {
+			t.Fatalf("Key.EncryptFile() failed: %v", err)
+		}
+
+		data, err := os.ReadFile(outputPath)
+		if err != nil {
+			t.Fatalf("Failed to read encrypted file: %v", err)
+		}
+		encrypted = append(encrypted, data)
+	}
+	if calls != 1 {
+		t.Errorf("kdf.GetKey called %d times, want 1", calls)
+	}
+	if bytes.Equal(encrypted[0], encrypted[1]) {
+		t.Error("Two files encrypted with the same Key are identical")
+	}
+
+	for _, name := range []string{"one", "two"} {
+		decryptedPath := filepath.Join(tempDir, name+".dec")
+		if err := encryption.DecryptFile(filepath.Join(tempDir, name+".enc"), decryptedPath); err != nil {
+			t.Fatalf("DecryptFile() failed: %v", err)
+		}
+		if data, _ := os.ReadFile(decryptedPath); string(data) != "same contents" {
+			t.Errorf("%s decrypted to %q", name, data)
+		}
+	}
+}
+
+// TestAtomicOutput verifies that a failed decryption leaves neither partial
+// plaintext nor temporary files behind, and does not touch an existing output.
+func TestAtomicOutput(t *testing.T) {
+	// Save original GetKey function and restore it after the test
+	originalGetKey := kdf.GetKey
+	kdf.GetKey = mockGetKey
+	defer func() { kdf.GetKey = originalGetKey }()
+
+	tempDir := t.TempDir()
+	inputPath := filepath.Join(tempDir, "input.txt")
+	encryptedPath := filepath.Join(tempDir, "input.enc")
+	outDir := filepath.Join(tempDir, "out")
+	if err := os.Mkdir(outDir, 0755); err != nil {
+		t.Fatalf("Failed to create output directory: %v", err)
+	}
+
+	testData := make([]byte, 500*1024)
+	if err := os.WriteFile(inputPath, testData, 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	if err := encryption.EncryptFile(inputPath, encryptedPath); err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+
+	// Damage a chunk near the end so that earlier chunks decrypt fine.
+	encrypted, err := os.ReadFile(encryptedPath)
+	if err != nil {
+		t.Fatalf("Failed to read encrypted file: %v", err)
+	}
+	encrypted[len(encrypted)-100*1024] ^= 1
+	if err := os.WriteFile(encryptedPath, encrypted, 0644); err != nil {
+		t.Fatalf("Failed to write damaged file: %v", err)
+	}
+
+	newPath := filepath.Join(outDir, "new.txt")
+	if err := encryption.DecryptFile(encryptedPath, newPath); err == nil {
+		t.Fatal("Decryption of a damaged file succeeded")
+	}
+	if _, err := os.Stat(newPath); !os.IsNotExist(err) {
+		t.Errorf("Failed decryption created %s", newPath)
+	}
+
+	existingPath := filepath.Join(outDir, "existing.txt")
+	if err := os.WriteFile(existingPath, []byte("keep me"), 0644); err != nil {
+		t.Fatalf("Failed to write existing file: %v", err)
+	}
+	if err := encryption.DecryptFile(encryptedPath, existingPath); err == nil {
+		t.Fatal("Decryption of a damaged file succeeded")
+	}
+	if got, _ := os.ReadFile(existingPath); string(got) != "keep me" {
+		t.Errorf("Failed decryption changed %s to %q", existingPath, got)
+	}
+
+	entries, err := os.ReadDir(outDir)
+	if err != nil {
+		t.Fatalf("Failed to list output directory: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Output directory holds %d entries, want only existing.txt", len(entries))
+	}
+}
+
+// TestVerifyFile verifies that VerifyFile accepts an intact file and tells a
+// wrong key apart from a damaged file.
+func TestVerifyFile(t *testing.T) {
+	// Save original GetKey function and restore it after the test
+	originalGetKey := kdf.GetKey
+	kdf.GetKey = mockGetKey
+	defer func() { kdf.GetKey = originalGetKey }()
+
+	tempDir := t.TempDir()
+	inputPath := filepath.Join(tempDir, "backup.tar")
+	encryptedPath := filepath.Join(tempDir, "backup.tar.enc")
+	if err := os.WriteFile(inputPath, make([]byte, 200*1024), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	if err := encryption.EncryptFile(inputPath, encryptedPath); err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+
+	if err := encryption.VerifyFile(encryptedPath); err != nil {
+		t.Errorf("VerifyFile() of an intact file failed: %v", err)
+	}
+
+	kdf.GetKey = func(salt []byte) ([]byte, error) {
+		return bytes.Repeat([]byte{1}, 32), nil
+	}
+	if err := encryption.VerifyFile(encryptedPath); !errors.Is(err, encryption.ErrWrongKey) {
+		t.Errorf("VerifyFile() with the wrong key returned %v, want ErrWrongKey", err)
+	}
+	kdf.GetKey = mockGetKey
+
+	encrypted, err := os.ReadFile(encryptedPath)
+	if err != nil {
+		t.Fatalf("Failed to read encrypted file: %v", err)
+	}
+	damaged := bytes.Clone(encrypted)
+	damaged[len(damaged)-1000] ^= 1
+	for name, data := range map[string][]byte{
+		"damaged":   damaged,
+		"truncated": encrypted[:len(encrypted)-1000],
+	} {
+		if err := os.WriteFile(encryptedPath, data, 0644); err != nil {
+			t.Fatalf("Failed to write %s file: %v", name, err)
+		}
+		err := encryption.VerifyFile(encryptedPath)
+		if err == nil || errors.Is(err, encryption.ErrWrongKey) {
+			t.Errorf("VerifyFile() of a %s file returned %v", name, err)
+		}
+	}
+}
+
+// TestRekeyFile verifies that a rekeyed file keeps its contents and metadata,
+// opens with the new key and no longer opens with the old one.
+func TestRekeyFile(t *testing.T) {
+	// Save original GetKey function and restore it after the test
+	originalGetKey := kdf.GetKey
+	kdf.GetKey = mockGetKey
+	defer func() { kdf.GetKey = originalGetKey }()
+
+	tempDir := t.TempDir()
+	inputPath := filepath.Join(tempDir, "notes.txt")
+	encryptedPath := filepath.Join(tempDir, "notes.txt.enc")
+	content := bytes.Repeat([]byte("rekey me "), 20000)
+	if err := os.WriteFile(inputPath, content, 0640); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	if err := encryption.EncryptFile(inputPath, encryptedPath); err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+
+	key, err := encryption.NewKeyFromPassword([]byte("new password"))
+	if err != nil {
+		t.Fatalf("NewKeyFromPassword() failed: %v", err)
+	}
+	if err := encryption.RekeyFile(encryptedPath, encryptedPath, key); err != nil {
+		t.Fatalf("RekeyFile() failed: %v", err)
+	}
+
+	if err := encryption.VerifyFile(encryptedPath); !errors.Is(err, encryption.ErrWrongKey) {
+		t.Errorf("VerifyFile() with the old key returned %v, want ErrWrongKey", err)
+	}
+
+	kdf.GetKey = func(salt []byte) ([]byte, error) {
+		return kdf.DeriveKey([]byte("new password"), salt), nil
+	}
+	restoreDir := filepath.Join(tempDir, "restored")
+	if err := os.Mkdir(restoreDir, 0755); err != nil {
+		t.Fatalf("Failed to create restore directory: %v", err)
+	}
+	path, err := encryption.RestoreFile(encryptedPath, restoreDir)
+	if err != nil {
+		t.Fatalf("RestoreFile() with the new key failed: %v", err)
+	}
+	if filepath.Base(path) != "notes.txt" {
+		t.Errorf("Restored name = %s, want notes.txt", filepath.Base(path))
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read restored file: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("Rekeyed contents do not match")
+	}
+}
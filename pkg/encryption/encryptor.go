@@ -0,0 +1,262 @@
+package encryption
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"sync"
+)
+
+// Encryptor encrypts and decrypts files with the settings of the Options it
+// was built from. Unlike the package-level functions, which share the
+// kdf.GetKey hook and the Jobs and UnsafeStreaming settings, every Encryptor
+// carries its own key source, so callers with different passwords or keys
+// can work side by side.
+//
+// Every file an Encryptor encrypts is sealed under the same master key,
+// which is derived on first use, and still gets its own file salt and
+// payload key. Decryption derives the key of each file from its header,
+// running the KDF only once per distinct salt. An Encryptor is safe for
+// concurrent use.
+type Encryptor struct {
+	cfg streamConfig
+
+	// once guards the derivation of key, which encrypts every file.
+	once   sync.Once
+	key    *Key
+	keyErr error
+}
+
+// NewEncryptor returns an Encryptor configured by opts. No key is derived
+// until it is needed.
+//
+// Args:
+//   - opts: The key source and settings; Metadata is ignored, and nil
+//     selects the defaults
+//
+// Returns:
+//   - *Encryptor: The configured Encryptor
+//   - error: An error if opts asks for a setting that is not supported
+func NewEncryptor(opts *Options) (*Encryptor, error) {
+	cfg, err := opts.config()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Encryptor{cfg: cfg}, nil
+}
+
+// config returns the configuration for one operation under ctx.
+func (e *Encryptor) config(ctx context.Context) streamConfig {
+	cfg := e.cfg
+	cfg.ctx = ctx
+
+	return cfg
+}
+
+// Key returns the master key that e encrypts new files under, deriving it
+// on first use. The Key works with NewWriter and the other functions that
+// take one, without kdf.GetKey.
+//
+// Returns:
+//   - *Key: The master key of e
+//   - error: Any error that occurred while deriving the key
+func (e *Encryptor) Key() (*Key, error) {
+	return e.newKey()
+}
+
+// newKey returns the master key new files are encrypted under.
+func (e *Encryptor) newKey() (*Key, error) {
+	e.once.Do(func() {
+		e.key, e.keyErr = e.cfg.keys.newKey(e.cfg.rand)
+	})
+
+	return e.key, e.keyErr
+}
+
+// EncryptFile behaves like the package-level EncryptFile. It stops between
+// chunks once ctx is done, leaving no output behind.
+func (e *Encryptor) EncryptFile(ctx context.Context, inName, outName string) error {
+	key, err := e.newKey()
+	if err != nil {
+		return err
+	}
+
+	return encryptFile(e.config(ctx), key, inName, outName, false)
+}
+
+// EncryptFileWithXattrs behaves like the package-level
+// EncryptFileWithXattrs. It stops between chunks once ctx is done, leaving
+// no output behind.
+func (e *Encryptor) EncryptFileWithXattrs(ctx context.Context, inName, outName string) error {
+	key, err := e.newKey()
+	if err != nil {
+		return err
+	}
+
+	return encryptFile(e.config(ctx), key, inName, outName, true)
+}
+
+// EncryptDir behaves like the package-level EncryptDir. It stops between
+// chunks once ctx is done, leaving no output behind.
+func (e *Encryptor) EncryptDir(ctx context.Context, inDir, outName string, exclude []string) error {
+	key, err := e.newKey()
+	if err != nil {
+		return err
+	}
+
+	return encryptDir(e.config(ctx), key, inDir, outName, exclude)
+}
+
+// EncryptStream behaves like the package-level EncryptStream. It stops
+// between chunks once ctx is done; dst is then left with a truncated
+// stream.
+func (e *Encryptor) EncryptStream(ctx context.Context, dst io.Writer, src io.Reader) error {
+	key, err := e.newKey()
+	if err != nil {
+		return err
+	}
+
+	return encryptStream(e.config(ctx), key, dst, src)
+}
+
+// DecryptFile behaves like the package-level DecryptFile. It stops between
+// chunks once ctx is done, leaving no output behind.
+func (e *Encryptor) DecryptFile(ctx context.Context, inName, outName string) error {
+	return decryptFile(e.config(ctx), inName, outName)
+}
+
+// DecryptStream behaves like the package-level DecryptStream. It stops
+// between chunks once ctx is done.
+func (e *Encryptor) DecryptStream(ctx context.Context, dst io.Writer, src io.Reader) error {
+	return decryptStream(e.config(ctx), dst, src)
+}
+
+// VerifyFile behaves like the package-level VerifyFile. It stops between
+// chunks once ctx is done.
+func (e *Encryptor) VerifyFile(ctx context.Context, name string) error {
+	return verifyFile(e.config(ctx), name)
+}
+
+// EncryptReader behaves like the package-level EncryptReader. It stops
+// between chunks once ctx is done, leaving no output behind.
+func (e *Encryptor) EncryptReader(ctx context.Context, src io.Reader, outName string) error {
+	key, err := e.newKey()
+	if err != nil {
+		return err
+	}
+
+	return encryptTo(e.config(ctx), key, src, nil, outName)
+}
+
+// DecryptReader behaves like the package-level DecryptReader. It stops
+// between chunks once ctx is done, leaving no output behind.
+func (e *Encryptor) DecryptReader(ctx context.Context, src io.Reader, outName string) error {
+	return decryptReader(e.config(ctx), src, outName)
+}
+
+// DecryptRange behaves like the package-level DecryptRange. It stops once
+// ctx is done, leaving no output behind.
+func (e *Encryptor) DecryptRange(ctx context.Context, inName, outName string, offset, length int64) error {
+	return decryptRange(e.config(ctx), inName, outName, offset, length)
+}
+
+// DecryptRangeStream behaves like the package-level DecryptRangeStream. It
+// stops once ctx is done.
+func (e *Encryptor) DecryptRangeStream(ctx context.Context, dst io.Writer, inName string, offset, length int64) error {
+	return decryptRangeStream(e.config(ctx), dst, inName, offset, length)
+}
+
+// RestoreFile behaves like the package-level RestoreFile. It stops between
+// chunks once ctx is done, leaving nothing behind in dir.
+func (e *Encryptor) RestoreFile(ctx context.Context, inName, dir string) (string, error) {
+	return restoreFile(e.config(ctx), inName, dir)
+}
+
+// SalvageFile behaves like the package-level SalvageFile. It stops
+// between chunks once ctx is done, leaving no output behind.
+func (e *Encryptor) SalvageFile(ctx context.Context, inName, outName string, skipDamaged bool) (*SalvageReport, error) {
+	return salvageFile(e.config(ctx), inName, outName, skipDamaged)
+}
+
+// RekeyFile behaves like the package-level RekeyFile, opening the file with
+// the key source of e and encrypting it again under key. It stops between
+// chunks once ctx is done, leaving the input untouched.
+func (e *Encryptor) RekeyFile(ctx context.Context, inName, outName string, key *Key) error {
+	return rekeyFile(e.config(ctx), inName, outName, key)
+}
+
+// AppendFile behaves like the package-level AppendFile. It stops between
+// chunks once ctx is done; like any failed append, that leaves the
+// encrypted file as it was.
+func (e *Encryptor) AppendFile(ctx context.Context, inName, outName string) error {
+	return appendFile(e.config(ctx), inName, outName)
+}
+
+// NewWriter behaves like the package-level NewWriter with the settings and
+// key of e. The Writer fails once ctx is done.
+func (e *Encryptor) NewWriter(ctx context.Context, w io.Writer, meta *Metadata) (*Writer, error) {
+	key, err := e.newKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return newWriter(w, key, meta, 0, e.config(ctx))
+}
+
+// CreateFile behaves like the package-level CreateFile with the key, chunk
+// size and random source of e. Files with parity cannot be written at
+// random offsets, so it fails if e adds parity.
+func (e *Encryptor) CreateFile(name string) (*File, error) {
+	key, err := e.newKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return createFile(e.cfg, name, key)
+}
+
+// OpenFile behaves like the package-level OpenFile with the key source and
+// random source of e. Rewritten chunks keep the chunk size of the file.
+func (e *Encryptor) OpenFile(name string) (*File, error) {
+	return openFileNamed(e.cfg, name)
+}
+
+// RecoverFile behaves like the package-level RecoverFile with the key
+// source and random source of e.
+func (e *Encryptor) RecoverFile(name string) (*File, error) {
+	return recoverFileNamed(e.cfg, name)
+}
+
+// NewReader behaves like the package-level NewReader with the settings and
+// key source of e. The Reader fails once ctx is done.
+func (e *Encryptor) NewReader(ctx context.Context, r io.Reader) (*Reader, error) {
+	return newReader(r, e.config(ctx))
+}
+
+// OpenReaderAt behaves like the package-level OpenReaderAt with the key
+// source of e. Chunks repaired from parity are reported to OnRepair.
+func (e *Encryptor) OpenReaderAt(f io.ReaderAt, size int64) (*ReaderAt, error) {
+	r, err := openReaderAt(f, size, e.cfg.keys)
+	if err != nil {
+		return nil, err
+	}
+	r.onRepair = e.cfg.onRepair
+
+	return r, nil
+}
+
+// NewFS behaves like the package-level NewFS with the key source of e, so
+// files encrypted under different salts, such as by separate runs of the
+// tool with the same password, open with one password and one key
+// derivation per salt.
+func (e *Encryptor) NewFS(dir fs.FS) *FS {
+	return &FS{dir: dir, keys: e.cfg.keys}
+}
+
+// MigrateFile behaves like the package-level MigrateFile with the key
+// source of e. It stops between chunks once ctx is done, leaving the input
+// untouched.
+func (e *Encryptor) MigrateFile(ctx context.Context, inName, outName string) error {
+	return migrateFile(e.config(ctx), inName, outName)
+}
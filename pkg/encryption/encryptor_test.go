@@ -0,0 +1,725 @@
+package encryption_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gigatar/file-encryptor/pkg/encryption"
+	"github.com/gigatar/file-encryptor/pkg/kdf"
+)
+
+// fastKDF keeps Argon2id cheap in tests.
+var fastKDF = kdf.Params{Time: 1, Memory: 64, Threads: 1}
+
+// newTestKey returns a master key under a fresh salt, derived cheaply from
+// a password through an Encryptor rather than kdf.GetKey.
+func newTestKey(t *testing.T) *encryption.Key {
+	t.Helper()
+	e, err := encryption.NewEncryptor(&encryption.Options{Password: []byte("pw"), KDF: fastKDF})
+	if err != nil {
+		t.Fatalf("NewEncryptor() failed: %v", err)
+	}
+	key, err := e.Key()
+	if err != nil {
+		t.Fatalf("Key() failed: %v", err)
+	}
+	return key
+}
+
+// TestEncryptorConcurrentKeys verifies that Encryptors with different
+// passwords can be used concurrently, without kdf.GetKey, and that each
+// only opens its own files.
+func TestEncryptorConcurrentKeys(t *testing.T) {
+	originalGetKey := kdf.GetKey
+	kdf.GetKey = func(salt []byte) ([]byte, error) {
+		t.Error("kdf.GetKey was called")
+		return nil, errors.New("unexpected call")
+	}
+	defer func() { kdf.GetKey = originalGetKey }()
+
+	dir := t.TempDir()
+	passwords := []string{"first", "second", "third"}
+	encryptors := make([]*encryption.Encryptor, len(passwords))
+	for i, pw := range passwords {
+		e, err := encryption.NewEncryptor(&encryption.Options{Password: []byte(pw), KDF: fastKDF})
+		if err != nil {
+			t.Fatalf("NewEncryptor() failed: %v", err)
+		}
+		encryptors[i] = e
+	}
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i, e := range encryptors {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			plaintext := bytes.Repeat([]byte(passwords[i]), 50000)
+			var encrypted, decrypted bytes.Buffer
+			if err := e.EncryptStream(ctx, &encrypted, bytes.NewReader(plaintext)); err != nil {
+				t.Errorf("EncryptStream() failed: %v", err)
+				return
+			}
+			name := filepath.Join(dir, passwords[i]+".enc")
+			if err := os.WriteFile(name, encrypted.Bytes(), 0600); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := e.DecryptStream(ctx, &decrypted, bytes.NewReader(encrypted.Bytes())); err != nil {
+				t.Errorf("DecryptStream() failed: %v", err)
+				return
+			}
+			if !bytes.Equal(decrypted.Bytes(), plaintext) {
+				t.Errorf("Decrypted content does not match for password %q", passwords[i])
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, e := range encryptors {
+		other := filepath.Join(dir, passwords[(i+1)%len(passwords)]+".enc")
+		if err := e.VerifyFile(ctx, other); !errors.Is(err, encryption.ErrWrongKey) {
+			t.Errorf("VerifyFile() of another password's file returned %v, want ErrWrongKey", err)
+		}
+	}
+}
+
+// TestEncryptorKDFParams verifies that the KDF parameters of an Encryptor
+// are recorded in the header and used to open the file again.
+func TestEncryptorKDFParams(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "plain.txt")
+	out := filepath.Join(dir, "plain.txt.enc")
+	if err := os.WriteFile(in, []byte("custom parameters"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	params := kdf.Params{Time: 2, Memory: 128, Threads: 1}
+	e, err := encryption.NewEncryptor(&encryption.Options{Password: []byte("pw"), KDF: params})
+	if err != nil {
+		t.Fatalf("NewEncryptor() failed: %v", err)
+	}
+	if err := e.EncryptFile(context.Background(), in, out); err != nil {
+		t.Fatalf("EncryptFile() failed: %v", err)
+	}
+
+	info, err := encryption.InspectFile(out)
+	if err != nil {
+		t.Fatalf("InspectFile() failed: %v", err)
+	}
+	if info.KDF.Time != params.Time || info.KDF.MemoryKiB != params.Memory || info.KDF.Threads != params.Threads {
+		t.Errorf("InspectFile() KDF = %+v, want %+v", info.KDF, params)
+	}
+
+	// A different Encryptor with the same password but default parameters
+	// must still open the file with the recorded ones, which are within
+	// its default limit.
+	d, err := encryption.NewEncryptor(&encryption.Options{Password: []byte("pw")})
+	if err != nil {
+		t.Fatalf("NewEncryptor() failed: %v", err)
+	}
+	if err := d.VerifyFile(context.Background(), out); err != nil {
+		t.Errorf("VerifyFile() failed: %v", err)
+	}
+}
+
+// TestEncryptorMaxKDF verifies that a file asking for Argon2id parameters
+// above the limit of the reader is refused without deriving a key, unless
+// the reader raises its limit, and that parameters above kdf.MaxParams are
+// refused whatever the limit.
+func TestEncryptorMaxKDF(t *testing.T) {
+	ctx := context.Background()
+	var derived int
+	derive := func(salt []byte, p kdf.Params) ([]byte, error) {
+		derived++
+		return bytes.Repeat([]byte{7}, 32), nil
+	}
+
+	w, err := encryption.NewEncryptor(&encryption.Options{DeriveKey: derive, KDF: kdf.MaxParams, MaxKDF: kdf.MaxParams})
+	if err != nil {
+		t.Fatalf("NewEncryptor() failed: %v", err)
+	}
+	var encrypted bytes.Buffer
+	if err := w.EncryptStream(ctx, &encrypted, bytes.NewReader([]byte("expensive"))); err != nil {
+		t.Fatalf("EncryptStream() failed: %v", err)
+	}
+
+	open := func(data []byte, maxKDF kdf.Params) error {
+		r, err := encryption.NewEncryptor(&encryption.Options{DeriveKey: derive, KDF: fastKDF, MaxKDF: maxKDF})
+		if err != nil {
+			t.Fatalf("NewEncryptor() failed: %v", err)
+		}
+		derived = 0
+		return r.DecryptStream(ctx, io.Discard, bytes.NewReader(data))
+	}
+
+	if err := open(encrypted.Bytes(), kdf.Params{}); !errors.Is(err, encryption.ErrKDFTooStrong) || derived != 0 {
+		t.Errorf("DecryptStream() with the default limit = %v after %d derivations, want ErrKDFTooStrong after none", err, derived)
+	}
+	if err := open(encrypted.Bytes(), kdf.MaxParams); err != nil || derived != 1 {
+		t.Errorf("DecryptStream() with MaxKDF = kdf.MaxParams = %v after %d derivations, want success after one", err, derived)
+	}
+
+	// Raise the time cost recorded in the header past kdf.MaxParams.
+	var field []byte
+	field = binary.BigEndian.AppendUint32(field, kdf.MaxParams.Time)
+	field = binary.BigEndian.AppendUint32(field, kdf.MaxParams.Memory)
+	field = append(field, kdf.MaxParams.Threads)
+	crafted := bytes.Clone(encrypted.Bytes())
+	i := bytes.Index(crafted, field)
+	if i < 0 {
+		t.Fatal("KDF parameters not found in the header")
+	}
+	binary.BigEndian.PutUint32(crafted[i:], kdf.MaxParams.Time+1)
+	if err := open(crafted, kdf.MaxParams); !errors.Is(err, encryption.ErrUnsupportedVersion) || derived != 0 {
+		t.Errorf("DecryptStream() of parameters above kdf.MaxParams = %v after %d derivations, want ErrUnsupportedVersion after none", err, derived)
+	}
+}
+
+// TestEncryptorOptions verifies that unsupported settings are rejected.
+func TestEncryptorOptions(t *testing.T) {
+	tests := []encryption.Options{
+		{Cipher: "ChaCha20-Poly1305"},
+		{ChunkSize: 1024},
+		{ChunkSize: 3 * 4096},
+		{ChunkSize: 32 << 20},
+		{Password: []byte("pw"), KDF: kdf.Params{Time: 1, Memory: 1, Threads: 1}},
+		{Password: []byte("pw"), MaxKDF: kdf.Params{Time: kdf.MaxParams.Time + 1, Memory: 64, Threads: 1}},
+		{Password: []byte("pw"), KDF: kdf.Params{Time: 2, Memory: 64, Threads: 1}, MaxKDF: fastKDF},
+	}
+	for _, opts := range tests {
+		if _, err := encryption.NewEncryptor(&opts); err == nil {
+			t.Errorf("NewEncryptor(%+v) succeeded, want an error", opts)
+		}
+	}
+
+	if _, err := encryption.NewEncryptor(&encryption.Options{Cipher: encryption.CipherAES256GCM, ChunkSize: 64 * 1024}); err != nil {
+		t.Errorf("NewEncryptor() with the defaults spelled out failed: %v", err)
+	}
+}
+
+// TestEncryptorUnsafeStreaming verifies that only an Encryptor with
+// UnsafeStreaming writes to a path that is not a regular file.
+func TestEncryptorUnsafeStreaming(t *testing.T) {
+	if info, err := os.Stat(os.DevNull); err != nil || info.Mode().IsRegular() {
+		t.Skipf("%s is not a device", os.DevNull)
+	}
+	in := filepath.Join(t.TempDir(), "plain.txt")
+	if err := os.WriteFile(in, []byte("streamed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, unsafe := range []bool{false, true} {
+		e, err := encryption.NewEncryptor(&encryption.Options{Key: newTestKey(t), UnsafeStreaming: unsafe})
+		if err != nil {
+			t.Fatalf("NewEncryptor() failed: %v", err)
+		}
+		err = e.EncryptFile(context.Background(), in, os.DevNull)
+		if unsafe && err != nil {
+			t.Errorf("EncryptFile() to %s with UnsafeStreaming failed: %v", os.DevNull, err)
+		}
+		if !unsafe && err == nil {
+			t.Errorf("EncryptFile() to %s without UnsafeStreaming succeeded", os.DevNull)
+		}
+	}
+}
+
+// TestEncryptorChunkSize verifies that the chunk size of an Encryptor is
+// recorded in the header and honoured by every way of reading the file, and
+// that rekeying keeps it.
+func TestEncryptorChunkSize(t *testing.T) {
+	dir := t.TempDir()
+	plaintext := make([]byte, 300000)
+	for i := range plaintext {
+		plaintext[i] = byte(i * 7)
+	}
+	in := filepath.Join(dir, "plain.bin")
+	if err := os.WriteFile(in, plaintext, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, size := range []int{4096, 1 << 20} {
+		key := newTestKey(t)
+
+		e, err := encryption.NewEncryptor(&encryption.Options{Key: key, ChunkSize: size, Jobs: 4})
+		if err != nil {
+			t.Fatalf("NewEncryptor() failed: %v", err)
+		}
+		out := filepath.Join(dir, "plain.bin.enc")
+		os.Remove(out)
+		if err := e.EncryptFile(ctx, in, out); err != nil {
+			t.Fatalf("EncryptFile() with %d-byte chunks failed: %v", size, err)
+		}
+
+		info, err := encryption.InspectFile(out)
+		if err != nil {
+			t.Fatalf("InspectFile() failed: %v", err)
+		}
+		if info.ChunkSize != size || info.PlaintextSize != int64(len(plaintext)) || !info.Complete {
+			t.Errorf("InspectFile() = %+v, want %d-byte chunks", info, size)
+		}
+
+		// A reader with the default chunk size must honour the header.
+		d, err := encryption.NewEncryptor(&encryption.Options{Key: key})
+		if err != nil {
+			t.Fatalf("NewEncryptor() failed: %v", err)
+		}
+		var decrypted bytes.Buffer
+		f, err := os.Open(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = d.DecryptStream(ctx, &decrypted, f)
+		f.Close()
+		if err != nil || !bytes.Equal(decrypted.Bytes(), plaintext) {
+			t.Fatalf("DecryptStream() of %d-byte chunks: error %v, content matches %v", size, err, bytes.Equal(decrypted.Bytes(), plaintext))
+		}
+
+		rangeOut := filepath.Join(dir, "range.bin")
+		os.Remove(rangeOut)
+		if err := d.DecryptRange(ctx, out, rangeOut, 5000, 10000); err != nil {
+			t.Fatalf("DecryptRange() failed: %v", err)
+		}
+		if got, _ := os.ReadFile(rangeOut); !bytes.Equal(got, plaintext[5000:15000]) {
+			t.Errorf("DecryptRange() of %d-byte chunks returned the wrong bytes", size)
+		}
+
+		// Appending continues with the chunk size of the file.
+		if err := d.AppendFile(ctx, in, out); err != nil {
+			t.Fatalf("AppendFile() failed: %v", err)
+		}
+		if err := d.VerifyFile(ctx, out); err != nil {
+			t.Errorf("VerifyFile() after AppendFile() failed: %v", err)
+		}
+
+		newKey := newTestKey(t)
+		if err := d.RekeyFile(ctx, out, out, newKey); err != nil {
+			t.Fatalf("RekeyFile() failed: %v", err)
+		}
+		info, err = encryption.InspectFile(out)
+		if err != nil || info.ChunkSize != size || info.PlaintextSize != 2*int64(len(plaintext)) {
+			t.Errorf("Rekeyed file: %+v, error %v; want %d-byte chunks", info, err, size)
+		}
+	}
+}
+
+// TestEncryptorParity verifies that damaged chunks of a file with parity
+// are rebuilt when it is decrypted, verified or read at random offsets, and
+// that damage beyond what the parity covers is still reported.
+func TestEncryptorParity(t *testing.T) {
+	dir := t.TempDir()
+	plaintext := make([]byte, 24*4096+1696)
+	for i := range plaintext {
+		plaintext[i] = byte(i * 13)
+	}
+	in := filepath.Join(dir, "plain.bin")
+	if err := os.WriteFile(in, plaintext, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	key := newTestKey(t)
+	var mu sync.Mutex
+	var repaired []int
+	e, err := encryption.NewEncryptor(&encryption.Options{
+		Key:       key,
+		ChunkSize: 4096,
+		Parity:    20,
+		Jobs:      4,
+		OnRepair: func(chunk int) {
+			mu.Lock()
+			repaired = append(repaired, chunk)
+			mu.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewEncryptor() failed: %v", err)
+	}
+	repairs := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		n := len(repaired)
+		repaired = nil
+		return n
+	}
+
+	ctx := context.Background()
+	out := filepath.Join(dir, "plain.bin.enc")
+	if err := e.EncryptFile(ctx, in, out); err != nil {
+		t.Fatalf("EncryptFile() failed: %v", err)
+	}
+
+	info, err := encryption.InspectFile(out)
+	if err != nil {
+		t.Fatalf("InspectFile() failed: %v", err)
+	}
+	if info.DataShards != 5 || info.ParityShards != 1 || info.Chunks != 25 || info.PlaintextSize != int64(len(plaintext)) || !info.Complete {
+		t.Errorf("InspectFile() = %+v, want 25 chunks with 5+1 shards", info)
+	}
+
+	// An undamaged file can also be read sequentially.
+	var decrypted bytes.Buffer
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.DecryptStream(ctx, &decrypted, struct{ io.Reader }{f})
+	f.Close()
+	if err != nil || !bytes.Equal(decrypted.Bytes(), plaintext) {
+		t.Fatalf("DecryptStream() error %v, content matches %v", err, bytes.Equal(decrypted.Bytes(), plaintext))
+	}
+
+	if err := e.AppendFile(ctx, in, out); err == nil {
+		t.Error("AppendFile() to a file with parity succeeded")
+	}
+
+	// Full records take 4128 bytes and are grouped five at a time with one
+	// shard each; the final group holds four full records and a short one.
+	encrypted, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const record = 4128
+	dataStart := len(encrypted) - (4*6*record + 5*record + 1728)
+	recordPos := func(i int) int { return dataStart + i/5*6*record + i%5*record }
+
+	damage := func(positions ...int) string {
+		damaged := bytes.Clone(encrypted)
+		for _, pos := range positions {
+			damaged[pos] ^= 0xff
+		}
+		name := filepath.Join(dir, "damaged.bin.enc")
+		if err := os.WriteFile(name, damaged, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+
+	// Damage the ciphertext of chunk 7, the length prefix of chunk 13 and
+	// the final chunk, each in a different group.
+	damaged := damage(recordPos(7)+100, recordPos(13)+13, recordPos(24)+50)
+
+	decryptedName := filepath.Join(dir, "decrypted.bin")
+	if err := e.DecryptFile(ctx, damaged, decryptedName); err != nil {
+		t.Fatalf("DecryptFile() of a damaged file failed: %v", err)
+	}
+	if got, _ := os.ReadFile(decryptedName); !bytes.Equal(got, plaintext) {
+		t.Error("DecryptFile() of a damaged file returned the wrong plaintext")
+	}
+	if n := repairs(); n != 3 {
+		t.Errorf("DecryptFile() repaired %d chunks, want 3", n)
+	}
+
+	if err := e.VerifyFile(ctx, damaged); err != nil {
+		t.Errorf("VerifyFile() of a damaged file failed: %v", err)
+	}
+	if n := repairs(); n != 3 {
+		t.Errorf("VerifyFile() repaired %d chunks, want 3", n)
+	}
+
+	var rangeOut bytes.Buffer
+	if err := e.DecryptRangeStream(ctx, &rangeOut, damaged, 7*4096+10, 100); err != nil {
+		t.Fatalf("DecryptRangeStream() of a damaged chunk failed: %v", err)
+	}
+	if !bytes.Equal(rangeOut.Bytes(), plaintext[7*4096+10:7*4096+110]) {
+		t.Error("DecryptRangeStream() of a damaged chunk returned the wrong bytes")
+	}
+	if n := repairs(); n != 1 {
+		t.Errorf("DecryptRangeStream() repaired %d chunks, want 1", n)
+	}
+
+	// Two damaged records in a group with one shard cannot be rebuilt.
+	damaged = damage(recordPos(1)+100, recordPos(3)+100)
+	var corrupted *encryption.ErrCorrupted
+	if err := e.VerifyFile(ctx, damaged); !errors.As(err, &corrupted) || corrupted.Chunk != 1 {
+		t.Errorf("VerifyFile() with too much damage returned %v, want ErrCorrupted for chunk 1", err)
+	}
+
+	// A damaged shard only matters to its own group.
+	damaged = damage(recordPos(5)-record+20, recordPos(8)+100)
+	if err := e.VerifyFile(ctx, damaged); err != nil {
+		t.Errorf("VerifyFile() with a damaged shard failed: %v", err)
+	}
+	if n := repairs(); n != 1 {
+		t.Errorf("VerifyFile() with a damaged shard repaired %d chunks, want 1", n)
+	}
+
+	// Rekeying keeps the parity.
+	newKey := newTestKey(t)
+	if err := e.RekeyFile(ctx, out, out, newKey); err != nil {
+		t.Fatalf("RekeyFile() failed: %v", err)
+	}
+	info, err = encryption.InspectFile(out)
+	if err != nil || info.DataShards != 5 || info.ParityShards != 1 || info.PlaintextSize != int64(len(plaintext)) {
+		t.Errorf("Rekeyed file: %+v, error %v; want 5+1 shards", info, err)
+	}
+}
+
+// TestEncryptorParityDamagedShard verifies that a group is repaired from
+// any combination of its shards, not only from consecutive ones, when some
+// of them are damaged.
+func TestEncryptorParityDamagedShard(t *testing.T) {
+	e, err := encryption.NewEncryptor(&encryption.Options{Password: []byte("pw"), KDF: fastKDF, ChunkSize: 4096, Parity: 60})
+	if err != nil {
+		t.Fatalf("NewEncryptor() failed: %v", err)
+	}
+
+	plaintext := bytes.Repeat([]byte("shards "), 5*4096/7)
+	var encrypted bytes.Buffer
+	ctx := context.Background()
+	if err := e.EncryptStream(ctx, &encrypted, bytes.NewReader(plaintext)); err != nil {
+		t.Fatalf("EncryptStream() failed: %v", err)
+	}
+
+	// The single group holds five records, the final one short, followed
+	// by three shards as long as a full record. Damage records 1 and 3 and
+	// the middle shard, so that only shards 0 and 2 rebuild the records.
+	const record = 4128
+	data := encrypted.Bytes()
+	shardStart := len(data) - 3*record
+	recordStart := shardStart - (4*record + len(plaintext) - 4*4096 + 16 + 16)
+	for _, pos := range []int{recordStart + record + 100, recordStart + 3*record + 100, shardStart + record + 100} {
+		data[pos] ^= 0xff
+	}
+
+	r, err := e.OpenReaderAt(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("OpenReaderAt() failed: %v", err)
+	}
+	decrypted, err := io.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+	if err != nil || !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("ReadAt() of the damaged group = %d bytes, %v; want the plaintext", len(decrypted), err)
+	}
+}
+
+// shardReads counts the reads of an encrypted file that start inside the
+// parity shards at [from, to).
+type shardReads struct {
+	io.ReaderAt
+	from, to int64
+	n        atomic.Int64
+}
+
+// ReadAt counts the read if it starts inside the shards and passes it on.
+func (r *shardReads) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.from && off < r.to {
+		r.n.Add(1)
+	}
+	return r.ReaderAt.ReadAt(p, off)
+}
+
+// TestEncryptorParityRepairOnce verifies that a group with several damaged
+// chunks is decoded once, rather than once for every chunk.
+func TestEncryptorParityRepairOnce(t *testing.T) {
+	var repaired atomic.Int64
+	e, err := encryption.NewEncryptor(&encryption.Options{
+		Key:       newTestKey(t),
+		ChunkSize: 4096,
+		Parity:    40,
+		OnRepair:  func(int) { repaired.Add(1) },
+	})
+	if err != nil {
+		t.Fatalf("NewEncryptor() failed: %v", err)
+	}
+
+	plaintext := bytes.Repeat([]byte("group "), 12*4096/6+20)
+	var encrypted bytes.Buffer
+	if err := e.EncryptStream(context.Background(), &encrypted, bytes.NewReader(plaintext)); err != nil {
+		t.Fatalf("EncryptStream() failed: %v", err)
+	}
+
+	// Groups hold five records and two shards as long as a full record; the
+	// final group holds two full records and a short one.
+	const record = 4128
+	data := encrypted.Bytes()
+	final := len(plaintext) - 12*4096 + 32
+	dataStart := len(data) - (2*7*record + 2*record + final + 2*record)
+	data[dataStart+record+100] ^= 0xff
+	data[dataStart+3*record+100] ^= 0xff
+
+	f := &shardReads{ReaderAt: bytes.NewReader(data), from: int64(dataStart + 5*record), to: int64(dataStart + 7*record)}
+	r, err := e.OpenReaderAt(f, int64(len(data)))
+	if err != nil {
+		t.Fatalf("OpenReaderAt() failed: %v", err)
+	}
+	decrypted, err := io.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+	if err != nil || !bytes.Equal(decrypted, plaintext) {
+		t.Fatalf("ReadAt() of the damaged group = %d bytes, %v; want the plaintext", len(decrypted), err)
+	}
+	if n := repaired.Load(); n != 2 {
+		t.Errorf("repaired %d chunks, want 2", n)
+	}
+	if n := f.n.Load(); n != 2 {
+		t.Errorf("read the shards of the group %d times, want once each", n)
+	}
+}
+
+// TestEncryptorParityTruncated verifies that a file with parity cut inside
+// its parity shards is reported as truncated rather than corrupted.
+func TestEncryptorParityTruncated(t *testing.T) {
+	dir := t.TempDir()
+	e, err := encryption.NewEncryptor(&encryption.Options{Key: newTestKey(t), ChunkSize: 4096, Parity: 20})
+	if err != nil {
+		t.Fatalf("NewEncryptor() failed: %v", err)
+	}
+
+	plaintext := bytes.Repeat([]byte("truncated "), 24*4096/10)
+	var encrypted bytes.Buffer
+	ctx := context.Background()
+	if err := e.EncryptStream(ctx, &encrypted, bytes.NewReader(plaintext)); err != nil {
+		t.Fatalf("EncryptStream() failed: %v", err)
+	}
+
+	// The final group holds three full records and a short one, followed
+	// by a shard as long as a full record. Cut inside that shard, at its
+	// start, and inside the shard of the group before it.
+	const record = 4128
+	data := encrypted.Bytes()
+	finalGroup := 3*record + len(plaintext) - 23*4096 + 32 + record
+	for _, cut := range []int{1, 100, record - 1, record, finalGroup + 10} {
+		name := filepath.Join(dir, "truncated.enc")
+		if err := os.WriteFile(name, data[:len(data)-cut], 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.VerifyFile(ctx, name); !errors.Is(err, encryption.ErrTruncated) {
+			t.Errorf("VerifyFile() of a file cut %d bytes short = %v, want ErrTruncated", cut, err)
+		}
+		if err := e.DecryptFile(ctx, name, filepath.Join(dir, "plain.bin")); !errors.Is(err, encryption.ErrTruncated) {
+			t.Errorf("DecryptFile() of a file cut %d bytes short = %v, want ErrTruncated", cut, err)
+		}
+	}
+}
+
+// TestEncryptorCancel verifies that a canceled context stops encryption and
+// leaves no output behind, and that progress reaches the file size.
+func TestEncryptorCancel(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "plain.bin")
+	out := filepath.Join(dir, "plain.bin.enc")
+	plaintext := bytes.Repeat([]byte("progress"), 100000)
+	if err := os.WriteFile(in, plaintext, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	e, err := encryption.NewEncryptor(&encryption.Options{
+		Password: []byte("pw"),
+		KDF:      fastKDF,
+		Jobs:     1,
+		Progress: func(done, total int64) {
+			if done > 0 {
+				cancel()
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewEncryptor() failed: %v", err)
+	}
+	if err := e.EncryptFile(ctx, in, out); !errors.Is(err, context.Canceled) {
+		t.Errorf("EncryptFile() returned %v, want context.Canceled", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Canceled encryption left %d files behind", len(entries)-1)
+	}
+
+	var last, total int64
+	e, err = encryption.NewEncryptor(&encryption.Options{
+		Password: []byte("pw"),
+		KDF:      fastKDF,
+		Progress: func(done, t int64) { last, total = done, t },
+	})
+	if err != nil {
+		t.Fatalf("NewEncryptor() failed: %v", err)
+	}
+	if err := e.EncryptFile(context.Background(), in, out); err != nil {
+		t.Fatalf("EncryptFile() failed: %v", err)
+	}
+	if last != int64(len(plaintext)) || total != int64(len(plaintext)) {
+		t.Errorf("Encryption progress ended at %d of %d, want %d", last, total, len(plaintext))
+	}
+
+	last, total = 0, 0
+	if err := e.DecryptFile(context.Background(), out, filepath.Join(dir, "decrypted.bin")); err != nil {
+		t.Fatalf("DecryptFile() failed: %v", err)
+	}
+	if last != int64(len(plaintext)) || total != int64(len(plaintext)) {
+		t.Errorf("Decryption progress ended at %d of %d, want %d", last, total, len(plaintext))
+	}
+}
+
+// TestEncryptorCancelDecrypt verifies that canceling decryption, rekeying
+// and range decryption leaves no output behind and the input untouched.
+func TestEncryptorCancelDecrypt(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "plain.bin")
+	enc := filepath.Join(dir, "plain.bin.enc")
+	if err := os.WriteFile(in, bytes.Repeat([]byte("cancel"), 100000), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := encryption.NewEncryptor(&encryption.Options{Password: []byte("pw"), KDF: fastKDF})
+	if err != nil {
+		t.Fatalf("NewEncryptor() failed: %v", err)
+	}
+	if err := e.EncryptFile(context.Background(), in, enc); err != nil {
+		t.Fatalf("EncryptFile() failed: %v", err)
+	}
+	original, err := os.ReadFile(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cancel context.CancelFunc
+	var totals []int64
+	c, err := encryption.NewEncryptor(&encryption.Options{
+		Password: []byte("pw"),
+		Jobs:     1,
+		Progress: func(done, total int64) {
+			totals = append(totals, total)
+			cancel()
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewEncryptor() failed: %v", err)
+	}
+
+	out := filepath.Join(dir, "out.bin")
+	key, err := encryption.NewKeyFromPassword([]byte("new"))
+	if err != nil {
+		t.Fatalf("NewKeyFromPassword() failed: %v", err)
+	}
+	ops := map[string]func(ctx context.Context) error{
+		"DecryptFile":  func(ctx context.Context) error { return c.DecryptFile(ctx, enc, out) },
+		"DecryptRange": func(ctx context.Context) error { return c.DecryptRange(ctx, enc, out, 1000, 200000) },
+		"RekeyFile":    func(ctx context.Context) error { return c.RekeyFile(ctx, enc, enc, key) },
+	}
+	for name, op := range ops {
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		totals = nil
+		err := op(ctx)
+		cancel()
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("%s() returned %v, want context.Canceled", name, err)
+		}
+		if len(totals) == 0 || totals[0] <= 0 {
+			t.Errorf("%s() reported totals %v, want a known total", name, totals)
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+			t.Errorf("Canceled %s() left %d extra files behind", name, len(entries)-2)
+		}
+		if got, _ := os.ReadFile(enc); !bytes.Equal(got, original) {
+			t.Errorf("Canceled %s() modified the encrypted file", name)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package encryption
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Errors returned when a file cannot be decrypted. They can be told apart
+// with errors.Is, and corruption with errors.As and *ErrCorrupted.
+var (
+	// ErrWrongKey is returned when the password or key does not match the
+	// file. Files carry a key check in their header, so this is detected
+	// before any record is decrypted. For files written by earlier
+	// versions without one, a first record that does not authenticate is
+	// reported as ErrWrongKey, since that almost always means the password
+	// is wrong.
+	ErrWrongKey = errors.New("wrong password or key")
+
+	// ErrTruncated is returned when a file ends before its final chunk.
+	ErrTruncated = errors.New("encrypted file is truncated")
+
+	// ErrUnsupportedVersion is returned for a file written in a format
+	// version, or with a required header field, that this version of the
+	// package does not understand.
+	ErrUnsupportedVersion = errors.New("unsupported format version")
+
+	// ErrNotEncrypted is returned for input that does not start with the
+	// header of an encrypted file.
+	ErrNotEncrypted = errors.New("not an encrypted file")
+
+	// ErrKDFTooStrong is returned for a file whose Argon2id parameters ask
+	// for more work or memory than Options.MaxKDF allows. It is returned
+	// before any key is derived for the file.
+	ErrKDFTooStrong = errors.New("Argon2id parameters of the file exceed the limit")
+)
+
+// ErrCorrupted is returned when part of a file has been modified: a record
+// does not authenticate, has an impossible length or does not match the
+// integrity record, or data follows the final chunk.
+type ErrCorrupted struct {
+	// Chunk is the index of the damaged data chunk, or -1 when the damage
+	// is in the header, the metadata record or the integrity record, or
+	// cannot be attributed to a single chunk.
+	Chunk int
+
+	// Err describes the damage.
+	Err error
+}
+
+// Error describes the damage and where it was found.
+func (e *ErrCorrupted) Error() string {
+	if e.Chunk < 0 {
+		return fmt.Sprintf("encrypted file is corrupted: %v", e.Err)
+	}
+	return fmt.Sprintf("chunk %d is corrupted: %v", e.Chunk, e.Err)
+}
+
+// Unwrap returns the description of the damage.
+func (e *ErrCorrupted) Unwrap() error {
+	return e.Err
+}
+
+// Descriptions of the damage wrapped by ErrCorrupted.
+var (
+	// errOpen reports a record that fails to authenticate.
+	errOpen = errors.New("record does not authenticate")
+
+	// errRecordLength reports a record whose length prefix is impossible.
+	errRecordLength = errors.New("invalid record length")
+
+	// errIntegrity reports data records that do not match the integrity record.
+	errIntegrity = errors.New("integrity check failed: chunks were modified, rolled back or not committed")
+
+	// errTrailing reports data after the final chunk.
+	errTrailing = errors.New("unexpected data after final chunk")
+
+	// errEmptyChunk reports an empty record that is not the only record of
+	// a legacy file.
+	errEmptyChunk = errors.New("empty chunk before the end of the file")
+
+	// errMalformedHeader reports a header that cannot be parsed.
+	errMalformedHeader = errors.New("malformed header")
+)
+
+// recordError classifies an error from reading or opening the record of the
+// data chunk with the given index, or of the metadata or integrity record
+// when index is -1. Errors that are neither truncation nor damage, such as
+// I/O errors, are returned unchanged.
+func recordError(index int, err error) error {
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return ErrTruncated
+	case errors.Is(err, errOpen), errors.Is(err, errRecordLength),
+		errors.Is(err, errIntegrity), errors.Is(err, errTrailing),
+		errors.Is(err, errEmptyChunk):
+		return &ErrCorrupted{Chunk: index, Err: err}
+	}
+
+	return err
+}
@@ -0,0 +1,81 @@
+package encryption_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/gigatar/file-encryptor/pkg/encryption"
+	"github.com/gigatar/file-encryptor/pkg/kdf"
+)
+
+// TestTypedErrors verifies that a wrong key, a damaged chunk, a truncated
+// file, a newer format version and unencrypted input each produce their own
+// error, and that damage to the first chunk is not mistaken for a wrong key.
+func TestTypedErrors(t *testing.T) {
+	// Save original GetKey function and restore it after the test
+	originalGetKey := kdf.GetKey
+	kdf.GetKey = mockGetKey
+	defer func() { kdf.GetKey = originalGetKey }()
+
+	plaintext := bytes.Repeat([]byte("typed errors "), 20000)
+	var encrypted bytes.Buffer
+	if err := encryption.EncryptStream(&encrypted, bytes.NewReader(plaintext)); err != nil {
+		t.Fatalf("EncryptStream() failed: %v", err)
+	}
+	ct := encrypted.Bytes()
+
+	// The header is all that precedes the empty final chunk of an empty file.
+	var empty bytes.Buffer
+	if err := encryption.EncryptStream(&empty, bytes.NewReader(nil)); err != nil {
+		t.Fatalf("EncryptStream() failed: %v", err)
+	}
+	dataStart := empty.Len() - (16 + 16)
+	recordSize := 16 + 64*1024 + 16
+
+	decrypt := func(data []byte) error {
+		return encryption.DecryptStream(io.Discard, bytes.NewReader(data))
+	}
+
+	kdf.GetKey = func(salt []byte) ([]byte, error) {
+		return bytes.Repeat([]byte{1}, 32), nil
+	}
+	if err := decrypt(ct); !errors.Is(err, encryption.ErrWrongKey) {
+		t.Errorf("Wrong key returned %v, want ErrWrongKey", err)
+	}
+	kdf.GetKey = mockGetKey
+
+	firstChunk := bytes.Clone(ct)
+	firstChunk[dataStart+100] ^= 1
+	var corrupted *encryption.ErrCorrupted
+	if err := decrypt(firstChunk); !errors.As(err, &corrupted) || corrupted.Chunk != 0 {
+		t.Errorf("Damaged chunk 0 returned %v, want ErrCorrupted for chunk 0", err)
+	}
+
+	thirdChunk := bytes.Clone(ct)
+	thirdChunk[dataStart+2*recordSize+100] ^= 1
+	if err := decrypt(thirdChunk); !errors.As(err, &corrupted) || corrupted.Chunk != 2 {
+		t.Errorf("Damaged chunk 2 returned %v, want ErrCorrupted for chunk 2", err)
+	}
+
+	cut := len(ct) - (16 + len(plaintext)%(64*1024) + 16)
+	if err := decrypt(ct[:cut]); !errors.Is(err, encryption.ErrTruncated) {
+		t.Errorf("Truncated file returned %v, want ErrTruncated", err)
+	}
+	if err := decrypt(ct[:10]); !errors.Is(err, encryption.ErrTruncated) {
+		t.Errorf("Truncated header returned %v, want ErrTruncated", err)
+	}
+
+	newer := bytes.Clone(ct)
+	newer[4] = 99
+	if err := decrypt(newer); !errors.Is(err, encryption.ErrUnsupportedVersion) {
+		t.Errorf("Newer version returned %v, want ErrUnsupportedVersion", err)
+	}
+
+	for _, data := range [][]byte{plaintext, nil, []byte("FE")} {
+		if err := decrypt(data); !errors.Is(err, encryption.ErrNotEncrypted) {
+			t.Errorf("Plaintext input %q returned %v, want ErrNotEncrypted", data[:min(len(data), 8)], err)
+		}
+	}
+}
@@ -0,0 +1,688 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+)
+
+// integritySize is the plaintext size of the integrity record.
+const integritySize = 8 + 8 + sha256.Size
+
+// integrityRecordSize is the encoded size of the integrity record.
+const integrityRecordSize = recordHeaderSize + integritySize + tagSize
+
+// tagEntrySize is the size of the nonce and tag that identify one version
+// of a data record.
+const tagEntrySize = nonceSize + tagSize
+
+// integrity is the integrity record of a file written through File.
+//
+// Layout:
+//
+//	[generation u64][chunks u64][root (32 bytes)]
+//
+// root is the SHA-256 digest of the nonce and tag of every data record in
+// order. Every rewrite of a chunk draws a fresh nonce and produces a new
+// tag, so a chunk replaced by an earlier version of itself no longer
+// matches the root, even though it still authenticates on its own.
+type integrity struct {
+	generation uint64
+	chunks     uint64
+	root       [sha256.Size]byte
+}
+
+// marshal encodes the integrity record.
+func (in *integrity) marshal() []byte {
+	buf := make([]byte, 0, integritySize)
+	buf = binary.BigEndian.AppendUint64(buf, in.generation)
+	buf = binary.BigEndian.AppendUint64(buf, in.chunks)
+
+	return append(buf, in.root[:]...)
+}
+
+// unmarshalIntegrity decodes an integrity record.
+func unmarshalIntegrity(b []byte) (*integrity, error) {
+	if len(b) != integritySize {
+		return nil, errors.New("malformed integrity record")
+	}
+
+	in := &integrity{
+		generation: binary.BigEndian.Uint64(b[0:8]),
+		chunks:     binary.BigEndian.Uint64(b[8:16]),
+	}
+	copy(in.root[:], b[16:])
+
+	return in, nil
+}
+
+// matches reports whether chunks records whose nonces and tags were written
+// to h match the integrity record.
+func (in *integrity) matches(chunks uint64, h hash.Hash) bool {
+	return in.chunks == chunks && bytes.Equal(h.Sum(nil), in.root[:])
+}
+
+// File is an encrypted file that can be read and written at arbitrary
+// offsets, so that it can back a mutable store such as a disk image or a
+// database without being rewritten as a whole.
+//
+// A write re-seals only the chunks it touches, each under a fresh nonce.
+// An integrity record kept between the header and the data records holds a
+// digest over the nonce and tag of every chunk, which detects individual
+// chunks being rolled back to an earlier version, and a generation counter
+// that grows with every commit. Replacing the whole file with an older copy
+// can only be detected by comparing Generation with a value kept elsewhere.
+//
+// Changes are committed to the integrity record by Sync and Close. A file
+// whose writer stopped between a write and the next commit fails the
+// integrity check when it is opened again; RecoverFile opens it anyway.
+// A write or truncation that fails part way leaves the File unusable: every
+// later write, Sync and Close returns the error without committing, so the
+// integrity record never covers a half-applied change.
+//
+// The methods of File are safe for concurrent use.
+type File struct {
+	layout
+
+	mu sync.Mutex
+
+	f      *os.File
+	rand   io.Reader
+	sealer *sealer
+	meta   *Metadata
+
+	// integrityOff and dataStart are the file offsets of the integrity
+	// record and of the first data record.
+	integrityOff int64
+	dataStart    int64
+
+	// size is the plaintext size.
+	size int64
+
+	// tags holds the nonce and tag of every data record, in order.
+	tags []byte
+
+	generation uint64
+	dirty      bool
+
+	// err, once set, is returned by every write and commit, as a failed
+	// update left the records, tags and size out of step.
+	err error
+}
+
+// CreateFile creates a new, empty encrypted file that supports
+// random-access writes. An existing file is never overwritten.
+//
+// Args:
+//   - name: Path of the file to create
+//   - key: Master key to derive the payload key from
+//
+// Returns:
+//   - *File: The open file; Close must be called when done
+//   - error: Any error that occurred while creating the file
+func CreateFile(name string, key *Key) (*File, error) {
+	cfg := defaultConfig()
+	cfg.keys = keySource{key: key}
+
+	return createFile(cfg, name, key)
+}
+
+// createFile implements CreateFile, writing chunks of the size in cfg and
+// opening the file again with the key source in cfg.
+func createFile(cfg streamConfig, name string, key *Key) (*File, error) {
+	if cfg.parityShards > 0 {
+		return nil, errors.New("files with parity do not support random-access writes")
+	}
+
+	h, err := newHeader(cfg.rand, key, flagIntegrity, layout{chunkSize: int64(cfg.chunkSize), dataShards: 1})
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := newSealer(key.key, h)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &File{
+		layout:       h.layout(),
+		f:            f,
+		rand:         cfg.rand,
+		sealer:       s,
+		integrityOff: int64(len(h.raw)),
+		dataStart:    int64(len(h.raw)) + integrityRecordSize,
+	}
+
+	_, err = f.WriteAt(h.raw, 0)
+	if err == nil {
+		// Seal the empty final chunk and commit the first generation.
+		err = file.update(0, 0, 0, nil, 0)
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(name)
+		return nil, err
+	}
+
+	return openFileNamed(cfg, name)
+}
+
+// OpenFile opens an encrypted file created by CreateFile for reading and
+// writing. The nonce and tag of every chunk are read and checked against
+// the integrity record, which costs two small reads per chunk.
+//
+// Args:
+//   - name: Path of the file to open
+//   - key: Master key of the file, or nil to derive it with kdf.GetKey
+//
+// Returns:
+//   - *File: The open file; Close must be called when done
+//   - error: Any error that occurred while opening the file, including a
+//     failed integrity check
+func OpenFile(name string, key *Key) (*File, error) {
+	cfg := defaultConfig()
+	cfg.keys = keySource{key: key}
+
+	return openFileNamed(cfg, name)
+}
+
+// openFileNamed implements OpenFile with the key source and random source
+// in cfg.
+func openFileNamed(cfg streamConfig, name string) (*File, error) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := openFile(f, cfg)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// openFile implements OpenFile on an open file.
+func openFile(f *os.File, cfg streamConfig) (*File, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := rejectLegacy(f, info.Size()); err != nil {
+		return nil, err
+	}
+
+	sr := io.NewSectionReader(f, 0, info.Size())
+	head, err := openStream(sr, cfg.keys)
+	if err != nil {
+		return nil, err
+	}
+	if head.integrity == nil || head.header.parityShards > 0 {
+		return nil, errors.New("file does not support random-access writes")
+	}
+
+	dataStart, err := sr.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	l := head.header.layout()
+	chunks, size, err := l.records(info.Size() - dataStart)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &File{
+		layout:       l,
+		f:            f,
+		rand:         cfg.rand,
+		sealer:       head.sealer,
+		meta:         head.meta,
+		integrityOff: dataStart - integrityRecordSize,
+		dataStart:    dataStart,
+		size:         size,
+		tags:         make([]byte, 0, chunks*tagEntrySize),
+		generation:   head.integrity.generation,
+	}
+
+	var prefix [recordHeaderSize]byte
+	var tag [tagSize]byte
+	for i := int64(0); i < chunks; i++ {
+		pos := dataStart + i*l.recordSize()
+		ctLen := l.chunkLen(file.size, i) + tagSize
+		if _, err := f.ReadAt(prefix[:], pos); err != nil {
+			return nil, err
+		}
+		if got := binary.BigEndian.Uint32(prefix[nonceSize:]); int64(got) != ctLen {
+			return nil, recordError(int(i), fmt.Errorf("%w %d", errRecordLength, got))
+		}
+		if _, err := f.ReadAt(tag[:], pos+recordHeaderSize+ctLen-tagSize); err != nil {
+			return nil, err
+		}
+		file.tags = append(file.tags, prefix[:nonceSize]...)
+		file.tags = append(file.tags, tag[:]...)
+	}
+
+	h := sha256.New()
+	h.Write(file.tags)
+	if !head.integrity.matches(uint64(chunks), h) {
+		return nil, recordError(-1, errIntegrity)
+	}
+
+	return file, nil
+}
+
+// RecoverFile opens an encrypted file created by CreateFile that fails the
+// integrity check, because its writer stopped between a write and the
+// next commit or after a failed write, and commits the chunks that still
+// authenticate.
+//
+// Chunks are kept from the start of the file up to the first one that does
+// not authenticate, which is cut off along with everything after it; if no
+// final chunk was kept, an empty one is added. Each kept chunk is the
+// latest version written to disk, so the plaintext may mix chunks from
+// before and after the interrupted writes, and it ends early if a write
+// was torn. A new integrity record is committed over the result, with the
+// generation after that of the old record, or 1 if the old record itself
+// does not authenticate.
+//
+// Args:
+//   - name: Path of the file to recover
+//   - key: Master key of the file, or nil to derive it with kdf.GetKey
+//
+// Returns:
+//   - *File: The recovered file; Close must be called when done
+//   - error: Any error that occurred while recovering the file
+func RecoverFile(name string, key *Key) (*File, error) {
+	cfg := defaultConfig()
+	cfg.keys = keySource{key: key}
+
+	return recoverFileNamed(cfg, name)
+}
+
+// recoverFileNamed implements RecoverFile with the key source and random
+// source in cfg.
+func recoverFileNamed(cfg streamConfig, name string) (*File, error) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := recoverFile(f, cfg)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// recoverFile implements RecoverFile on an open file.
+func recoverFile(f *os.File, cfg streamConfig) (*File, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := rejectLegacy(f, info.Size()); err != nil {
+		return nil, err
+	}
+
+	// The header and metadata are read as by openStream, but an integrity
+	// record that does not authenticate only loses the generation.
+	sr := io.NewSectionReader(f, 0, info.Size())
+	h, err := readHeader(sr)
+	if err != nil {
+		return nil, err
+	}
+	if h.flags&flagIntegrity == 0 || h.parityShards > 0 {
+		return nil, errors.New("file does not support random-access writes")
+	}
+	masterKey, err := cfg.keys.forHeader(h)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.checkKey(masterKey); err != nil {
+		return nil, err
+	}
+	s, err := newSealer(masterKey, h)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &File{
+		layout: h.layout(),
+		f:      f,
+		rand:   cfg.rand,
+		sealer: s,
+	}
+	if h.flags&flagMetadata != 0 {
+		pt, err := readSealed(sr, s, recordMetadata, maxMetadataSize)
+		if err != nil {
+			return nil, fmt.Errorf("metadata: %w", recordError(-1, err))
+		}
+		if file.meta, err = unmarshalMetadata(pt); err != nil {
+			return nil, err
+		}
+	}
+	if file.integrityOff, err = sr.Seek(0, io.SeekCurrent); err != nil {
+		return nil, err
+	}
+	file.dataStart = file.integrityOff + integrityRecordSize
+	if pt, err := readSealed(sr, s, recordIntegrity, integritySize+tagSize); err == nil {
+		if in, err := unmarshalIntegrity(pt); err == nil {
+			file.generation = in.generation
+		}
+	}
+
+	// Keep every record that authenticates, up to the final chunk. Full
+	// records are never final and short ones always are.
+	end, final := file.dataStart, false
+	for i := int64(0); !final; i++ {
+		pos := file.dataStart + i*file.recordSize()
+		nonce, ct, err := readRecord(io.NewSectionReader(f, pos, info.Size()-pos), int(file.chunkSize+tagSize))
+		if err != nil {
+			break
+		}
+		final = int64(len(ct)-tagSize) < file.chunkSize
+		if _, err := s.open(recordData, uint64(i), final, nonce, bytes.Clone(ct)); err != nil {
+			final = false
+			break
+		}
+		file.tags = append(file.tags, nonce...)
+		file.tags = append(file.tags, ct[len(ct)-tagSize:]...)
+		file.size += int64(len(ct) - tagSize)
+		end = pos + recordHeaderSize + int64(len(ct))
+	}
+
+	if err := f.Truncate(end); err != nil {
+		return nil, err
+	}
+	if !final {
+		// Every kept chunk is full: seal an empty final chunk after them.
+		n := file.size / file.chunkSize
+		if err := file.update(n, n, file.size, nil, 0); err != nil {
+			return nil, err
+		}
+	}
+	file.dirty = true
+	if err := file.commit(); err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// Metadata returns the decrypted metadata record, or nil if the file has none.
+func (f *File) Metadata() *Metadata {
+	return f.meta
+}
+
+// Size returns the size of the plaintext in bytes.
+func (f *File) Size() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.size
+}
+
+// Generation returns the number of times the integrity record has been
+// committed. Callers that need to detect the whole file being replaced by
+// an older copy can store it elsewhere and compare it after opening.
+func (f *File) Generation() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.generation
+}
+
+// ReadAt decrypts len(p) bytes of plaintext starting at off into p. It
+// returns io.EOF when it reads fewer than len(p) bytes because the
+// plaintext ends.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := 0
+	for n < len(p) {
+		if off >= f.size {
+			return n, io.EOF
+		}
+
+		pt, err := f.readChunk(off / f.chunkSize)
+		if err != nil {
+			return n, err
+		}
+
+		m := copy(p[n:], pt[off%f.chunkSize:])
+		n += m
+		off += int64(m)
+	}
+
+	return n, nil
+}
+
+// WriteAt encrypts p into the file at off, re-sealing only the chunks it
+// touches. Writing past the end extends the file, and any gap reads as
+// zeros.
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return 0, f.err
+	}
+
+	end := off + int64(len(p))
+	newSize := max(f.size, end)
+	first := min(off, f.size) / f.chunkSize
+	last := (end - 1) / f.chunkSize
+	if newSize > f.size {
+		last = newSize / f.chunkSize
+	}
+
+	if err := f.update(first, last, newSize, p, off); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Truncate changes the size of the plaintext. Growing the file fills it
+// with zeros.
+func (f *File) Truncate(size int64) error {
+	if size < 0 {
+		return errors.New("negative size")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return f.err
+	}
+
+	switch {
+	case size > f.size:
+		return f.update(f.size/f.chunkSize, size/f.chunkSize, size, nil, 0)
+	case size < f.size:
+		return f.update(size/f.chunkSize, size/f.chunkSize, size, nil, 0)
+	}
+
+	return nil
+}
+
+// Sync commits the changes made since the last commit to the integrity
+// record and flushes the file to stable storage.
+func (f *File) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return f.err
+	}
+
+	return f.commit()
+}
+
+// Close commits any pending changes and closes the file. After a failed
+// write nothing is committed, and the error of the write is returned.
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		f.f.Close()
+		return f.err
+	}
+	if err := f.commit(); err != nil {
+		f.f.Close()
+		return err
+	}
+
+	return f.f.Close()
+}
+
+// readChunk reads and authenticates the chunk with the given index and
+// checks that it is the version recorded in the integrity record.
+func (f *File) readChunk(index int64) ([]byte, error) {
+	nonce, ct, err := f.readRecordAt(f.f, f.dataStart, index, f.chunkLen(f.size, index))
+	if err != nil {
+		return nil, recordError(int(index), err)
+	}
+
+	entry := f.tags[index*tagEntrySize : (index+1)*tagEntrySize]
+	if !bytes.Equal(nonce, entry[:nonceSize]) || !bytes.Equal(ct[len(ct)-tagSize:], entry[nonceSize:]) {
+		return nil, recordError(int(index), errIntegrity)
+	}
+
+	final := index == f.size/f.chunkSize
+	pt, err := f.sealer.open(recordData, uint64(index), final, nonce, ct)
+	if err != nil {
+		return nil, recordError(int(index), err)
+	}
+
+	return pt, nil
+}
+
+// update re-seals chunks first through last for a plaintext of newSize
+// bytes, overlaying p at off on their current contents. The chunk at
+// newSize/f.chunkSize becomes the final chunk; when the file shrinks, the
+// records after it are cut off. If it fails, the File is left unusable.
+func (f *File) update(first, last, newSize int64, p []byte, off int64) (err error) {
+	defer func() {
+		if err != nil {
+			f.err = fmt.Errorf("file is unusable after a failed write; reopen it with RecoverFile: %w", err)
+		}
+	}()
+
+	finalIndex := newSize / f.chunkSize
+	if need := (finalIndex + 1) * tagEntrySize; int64(len(f.tags)) < need {
+		f.tags = append(f.tags, make([]byte, need-int64(len(f.tags)))...)
+	}
+
+	end := off + int64(len(p))
+	for i := first; i <= last; i++ {
+		start := i * f.chunkSize
+		pt := make([]byte, f.chunkLen(newSize, i))
+
+		// Keep the current contents unless p covers the whole chunk.
+		covered := off <= start && end >= start+int64(len(pt))
+		if start < f.size && !covered {
+			old, err := f.readChunk(i)
+			if err != nil {
+				return err
+			}
+			copy(pt, old)
+		}
+		if lo, hi := max(off, start), min(end, start+int64(len(pt))); lo < hi {
+			copy(pt[lo-start:hi-start], p[lo-off:hi-off])
+		}
+
+		nonce, err := newNonce(f.rand)
+		if err != nil {
+			return err
+		}
+		ct := f.sealer.seal(recordData, uint64(i), i == finalIndex, nonce, pt)
+		if err := writeRecord(io.NewOffsetWriter(f.f, f.dataStart+i*f.recordSize()), nonce, ct); err != nil {
+			return err
+		}
+
+		entry := f.tags[i*tagEntrySize : (i+1)*tagEntrySize]
+		copy(entry, nonce)
+		copy(entry[nonceSize:], ct[len(ct)-tagSize:])
+		f.dirty = true
+	}
+
+	if newSize < f.size {
+		f.tags = f.tags[:(finalIndex+1)*tagEntrySize]
+		end := f.dataStart + finalIndex*f.recordSize() + recordHeaderSize + f.chunkLen(newSize, finalIndex) + tagSize
+		if err := f.f.Truncate(end); err != nil {
+			return err
+		}
+	}
+	f.size = newSize
+
+	return nil
+}
+
+// commit writes a new integrity record covering the current chunks. The
+// data records are flushed to stable storage first so that the record
+// never describes chunks that were lost in a crash.
+func (f *File) commit() error {
+	if !f.dirty {
+		return nil
+	}
+	if err := f.f.Sync(); err != nil {
+		return err
+	}
+
+	in := &integrity{
+		generation: f.generation + 1,
+		chunks:     uint64(len(f.tags) / tagEntrySize),
+		root:       sha256.Sum256(f.tags),
+	}
+
+	nonce, err := newNonce(f.rand)
+	if err != nil {
+		return err
+	}
+	ct := f.sealer.seal(recordIntegrity, 0, true, nonce, in.marshal())
+	if err := writeRecord(io.NewOffsetWriter(f.f, f.integrityOff), nonce, ct); err != nil {
+		return err
+	}
+	if err := f.f.Sync(); err != nil {
+		return err
+	}
+
+	f.generation = in.generation
+	f.dirty = false
+
+	return nil
+}
@@ -0,0 +1,377 @@
+package encryption_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gigatar/file-encryptor/pkg/encryption"
+	"github.com/gigatar/file-encryptor/pkg/kdf"
+)
+
+// TestFileWriteAt verifies that random writes and truncations through File
+// match the same operations on a plain byte slice, both before and after
+// the file is reopened and when it is read through the streaming API.
+func TestFileWriteAt(t *testing.T) {
+	// Save original GetKey function and restore it after the test
+	originalGetKey := kdf.GetKey
+	kdf.GetKey = mockGetKey
+	defer func() { kdf.GetKey = originalGetKey }()
+
+	key, err := encryption.NewKey()
+	if err != nil {
+		t.Fatalf("NewKey() failed: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "disk.img.enc")
+	f, err := encryption.CreateFile(path, key)
+	if err != nil {
+		t.Fatalf("CreateFile() failed: %v", err)
+	}
+
+	var want []byte
+	rng := rand.New(rand.NewPCG(3, 4))
+	for i := 0; i < 40; i++ {
+		if i%10 == 9 {
+			size := rng.IntN(400 * 1024)
+			if err := f.Truncate(int64(size)); err != nil {
+				t.Fatalf("Truncate(%d) failed: %v", size, err)
+			}
+			if size <= len(want) {
+				want = want[:size]
+			} else {
+				want = append(want, make([]byte, size-len(want))...)
+			}
+			continue
+		}
+
+		off := rng.IntN(300 * 1024)
+		p := make([]byte, 1+rng.IntN(150*1024))
+		for j := range p {
+			p[j] = byte(rng.Uint32())
+		}
+		if _, err := f.WriteAt(p, int64(off)); err != nil {
+			t.Fatalf("WriteAt(%d, %d) failed: %v", len(p), off, err)
+		}
+		if end := off + len(p); end > len(want) {
+			want = append(want, make([]byte, end-len(want))...)
+		}
+		copy(want[off:], p)
+	}
+
+	check := func(f *encryption.File) {
+		t.Helper()
+		if f.Size() != int64(len(want)) {
+			t.Fatalf("Size() = %d, want %d", f.Size(), len(want))
+		}
+		got := make([]byte, len(want))
+		if _, err := f.ReadAt(got, 0); err != nil {
+			t.Fatalf("ReadAt() failed: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatal("File contents do not match")
+		}
+	}
+	check(f)
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	f, err = encryption.OpenFile(path, key)
+	if err != nil {
+		t.Fatalf("OpenFile() failed: %v", err)
+	}
+	check(f)
+	if f.Generation() < 2 {
+		t.Errorf("Generation() = %d, want at least 2", f.Generation())
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open encrypted file: %v", err)
+	}
+	defer in.Close()
+	r, err := encryption.NewReader(in, nil)
+	if err != nil {
+		t.Fatalf("NewReader() failed: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll() failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("Streamed contents do not match")
+	}
+}
+
+// TestFileRollback verifies that replacing a chunk with an earlier version
+// of itself, which still authenticates on its own, is detected.
+func TestFileRollback(t *testing.T) {
+	// Save original GetKey function and restore it after the test
+	originalGetKey := kdf.GetKey
+	kdf.GetKey = mockGetKey
+	defer func() { kdf.GetKey = originalGetKey }()
+
+	key, err := encryption.NewKey()
+	if err != nil {
+		t.Fatalf("NewKey() failed: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "db.enc")
+	f, err := encryption.CreateFile(path, key)
+	if err != nil {
+		t.Fatalf("CreateFile() failed: %v", err)
+	}
+	if _, err := f.WriteAt(bytes.Repeat([]byte("a"), 200*1024), 0); err != nil {
+		t.Fatalf("WriteAt() failed: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read encrypted file: %v", err)
+	}
+
+	f, err = encryption.OpenFile(path, key)
+	if err != nil {
+		t.Fatalf("OpenFile() failed: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("b"), 70*1024); err != nil {
+		t.Fatalf("WriteAt() failed: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read encrypted file: %v", err)
+	}
+	if len(before) != len(after) {
+		t.Fatalf("Rewrite changed the file size from %d to %d", len(before), len(after))
+	}
+
+	// Only the integrity record and the second chunk may have changed.
+	// Restoring the old second chunk alone must be detected.
+	var diff []int
+	for i := range before {
+		if before[i] != after[i] {
+			diff = append(diff, i)
+		}
+	}
+	rolledBack := bytes.Clone(after)
+	last := diff[len(diff)-1]
+	for _, i := range diff {
+		if last-i < 64*1024+32 {
+			rolledBack[i] = before[i]
+		}
+	}
+	if err := os.WriteFile(path, rolledBack, 0600); err != nil {
+		t.Fatalf("Failed to write rolled back file: %v", err)
+	}
+
+	if _, err := encryption.OpenFile(path, key); err == nil {
+		t.Error("OpenFile() accepted a rolled back chunk")
+	}
+	r, err := encryption.NewReader(bytes.NewReader(rolledBack), nil)
+	if err != nil {
+		t.Fatalf("NewReader() failed: %v", err)
+	}
+	if _, err := io.ReadAll(r); err == nil {
+		t.Error("Reader accepted a rolled back chunk")
+	}
+}
+
+// TestFileRecover verifies that a failed write leaves a File unusable
+// without committing, and that RecoverFile commits the chunks that still
+// authenticate, both after a failed write and after a writer stopped
+// before committing.
+func TestFileRecover(t *testing.T) {
+	key := newTestKey(t)
+
+	// Three full chunks of 64 KiB and a short final one of 8 KiB, each
+	// record 32 bytes longer than its plaintext.
+	const chunk, record = 64 * 1024, 64*1024 + 32
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db.enc")
+	f, err := encryption.CreateFile(path, key)
+	if err != nil {
+		t.Fatalf("CreateFile() failed: %v", err)
+	}
+	want := bytes.Repeat([]byte("a"), 200*1024)
+	if _, err := f.WriteAt(want, 0); err != nil {
+		t.Fatalf("WriteAt() failed: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk2 := info.Size() - (8*1024 + 32) - record
+
+	// A writer that stops before committing leaves a file that fails the
+	// integrity check but holds its latest chunks.
+	f, err = encryption.OpenFile(path, key)
+	if err != nil {
+		t.Fatalf("OpenFile() failed: %v", err)
+	}
+	generation := f.Generation()
+	if _, err := f.WriteAt([]byte("bbbb"), chunk+10); err != nil {
+		t.Fatalf("WriteAt() failed: %v", err)
+	}
+	copy(want[chunk+10:], "bbbb")
+	crashed, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	crashPath := filepath.Join(dir, "crashed.enc")
+	if err := os.WriteFile(crashPath, crashed, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encryption.OpenFile(crashPath, key); err == nil {
+		t.Fatal("OpenFile() accepted uncommitted chunks")
+	}
+	f, err = encryption.RecoverFile(crashPath, key)
+	if err != nil {
+		t.Fatalf("RecoverFile() failed: %v", err)
+	}
+	got := make([]byte, len(want))
+	if _, err := f.ReadAt(got, 0); err != nil || !bytes.Equal(got, want) || f.Generation() != generation+1 {
+		t.Errorf("recovered file: error %v, contents match %v, generation %d; want generation %d",
+			err, bytes.Equal(got, want), f.Generation(), generation+1)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	if f, err := encryption.OpenFile(crashPath, key); err != nil {
+		t.Errorf("OpenFile() after RecoverFile() failed: %v", err)
+	} else {
+		f.Close()
+	}
+
+	// A write that fails part way, here on a damaged third chunk after the
+	// second was re-sealed, makes every later write and commit fail.
+	f, err = encryption.OpenFile(path, key)
+	if err != nil {
+		t.Fatalf("OpenFile() failed: %v", err)
+	}
+	damage, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = damage.WriteAt([]byte{0xff}, chunk2+100)
+	damage.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("cccc"), 2*chunk-2); err == nil {
+		t.Fatal("WriteAt() over a damaged chunk succeeded")
+	}
+	if _, err := f.WriteAt([]byte("d"), 0); err == nil {
+		t.Error("WriteAt() after a failed write succeeded")
+	}
+	if err := f.Sync(); err == nil {
+		t.Error("Sync() after a failed write succeeded")
+	}
+	if err := f.Close(); err == nil {
+		t.Error("Close() after a failed write succeeded")
+	}
+
+	// Recovery keeps the chunks before the damaged one, including the
+	// re-sealed second chunk, and seals an empty final chunk after them.
+	f, err = encryption.RecoverFile(path, key)
+	if err != nil {
+		t.Fatalf("RecoverFile() failed: %v", err)
+	}
+	defer f.Close()
+	want = want[:2*chunk]
+	copy(want[2*chunk-2:], "cc")
+	got = make([]byte, f.Size())
+	if _, err := f.ReadAt(got, 0); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("recovered file: %d bytes, error %v; want the first two chunks", len(got), err)
+	}
+}
+
+// TestEncryptorFile verifies that files created through an Encryptor use
+// its chunk size, are opened again with its password by another Encryptor
+// and decrypt like any other file, and that parity is refused.
+func TestEncryptorFile(t *testing.T) {
+	for _, size := range []int{4096, 1 << 20} {
+		e, err := encryption.NewEncryptor(&encryption.Options{Password: []byte("pw"), KDF: fastKDF, ChunkSize: size})
+		if err != nil {
+			t.Fatalf("NewEncryptor() failed: %v", err)
+		}
+
+		path := filepath.Join(t.TempDir(), "disk.img.enc")
+		f, err := e.CreateFile(path)
+		if err != nil {
+			t.Fatalf("CreateFile() failed: %v", err)
+		}
+		want := make([]byte, 3*size+123)
+		for i := range want {
+			want[i] = byte(i * 7)
+		}
+		if _, err := f.WriteAt(want[size/2:], int64(size/2)); err != nil {
+			t.Fatalf("WriteAt() failed: %v", err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("Close() failed: %v", err)
+		}
+		clear(want[:size/2])
+
+		info, err := encryption.InspectFile(path)
+		if err != nil {
+			t.Fatalf("InspectFile() failed: %v", err)
+		}
+		if info.ChunkSize != size || info.Chunks != 4 {
+			t.Errorf("chunk size %d: file has %d chunks of %d bytes, want 4 of %d", size, info.Chunks, info.ChunkSize, size)
+		}
+
+		// Another Encryptor with the same password and the default chunk
+		// size rewrites chunks at the size recorded in the file.
+		d, err := encryption.NewEncryptor(&encryption.Options{Password: []byte("pw")})
+		if err != nil {
+			t.Fatalf("NewEncryptor() failed: %v", err)
+		}
+		f, err = d.OpenFile(path)
+		if err != nil {
+			t.Fatalf("OpenFile() failed: %v", err)
+		}
+		patch := bytes.Repeat([]byte("patched"), 100)
+		if _, err := f.WriteAt(patch, int64(size-300)); err != nil {
+			t.Fatalf("WriteAt() failed: %v", err)
+		}
+		copy(want[size-300:], patch)
+		if err := f.Close(); err != nil {
+			t.Fatalf("Close() failed: %v", err)
+		}
+
+		out := filepath.Join(t.TempDir(), "disk.img")
+		if err := d.DecryptFile(t.Context(), path, out); err != nil {
+			t.Fatalf("DecryptFile() failed: %v", err)
+		}
+		if got, err := os.ReadFile(out); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("chunk size %d: decrypted contents do not match (%v)", size, err)
+		}
+	}
+
+	p, err := encryption.NewEncryptor(&encryption.Options{Key: newTestKey(t), Parity: 20})
+	if err != nil {
+		t.Fatalf("NewEncryptor() failed: %v", err)
+	}
+	if f, err := p.CreateFile(filepath.Join(t.TempDir(), "parity.enc")); err == nil {
+		f.Close()
+		t.Error("CreateFile() with parity succeeded")
+	}
+}
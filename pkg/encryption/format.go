@@ -0,0 +1,594 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/gigatar/file-encryptor/pkg/kdf"
+)
+
+// Constants describing the on-disk format.
+const (
+	// magic identifies a file written in the versioned format.
+	magic = "FENC"
+
+	// formatVersion is the header version written by this package.
+	formatVersion = 1
+
+	// fixedHeaderSize is the size of the magic, version, flags and
+	// field-length prefix that start every header.
+	fixedHeaderSize = len(magic) + 1 + 1 + 2
+
+	// fileSaltSize is the length of the per-file salt used to derive the
+	// payload key from the password-derived master key.
+	fileSaltSize = 32
+
+	// keyCheckSize is the length of the key check value.
+	keyCheckSize = 32
+
+	// nonceSize is the length of the random nonce stored with every record.
+	nonceSize = 12
+
+	// tagSize is the length of the AEAD authentication tag.
+	tagSize = 16
+
+	// recordHeaderSize is the length of the nonce and length prefix that
+	// precede every record's ciphertext.
+	recordHeaderSize = nonceSize + 4
+
+	// maxMetadataSize bounds the ciphertext length of the metadata record.
+	maxMetadataSize = 1 << 20
+)
+
+// Header flags.
+const (
+	// flagMetadata marks files whose first record is an encrypted Metadata block.
+	flagMetadata = 1 << 0
+
+	// flagArchive marks files whose plaintext is a tar archive of a directory tree.
+	flagArchive = 1 << 1
+
+	// flagIntegrity marks files written through File, which carry an
+	// integrity record between the metadata record and the data records.
+	flagIntegrity = 1 << 2
+
+	// knownFlags holds every flag this version understands. Files with
+	// other flags set are rejected as an unsupported version.
+	knownFlags = flagMetadata | flagArchive | flagIntegrity
+)
+
+// Header field tags. Tags with the high bit set are optional and are
+// skipped by readers that do not understand them; any other unknown tag
+// makes the file unreadable.
+const (
+	// tagKDF holds the KDF algorithm, its parameters and its salt.
+	tagKDF = 0x01
+
+	// tagFileSalt holds the per-file HKDF salt.
+	tagFileSalt = 0x02
+
+	// tagChunkSize holds the plaintext size of every chunk but the final
+	// one as a u32. It is only written for sizes other than
+	// defaultChunkSize, so that files with the default size stay readable
+	// by versions that predate it, while versions that cannot honour it
+	// refuse the file.
+	tagChunkSize = 0x03
+
+	// tagParity holds the number of data and parity shards per group of
+	// chunks, as two u8 values, for files with Reed–Solomon parity.
+	tagParity = 0x04
+
+	tagOptional = 0x80
+
+	// tagKeyCheck holds a value derived from the master key and file salt,
+	// which tells a wrong key apart from a damaged record. It is optional
+	// so that earlier versions, which lack it, can still read the file.
+	tagKeyCheck = tagOptional | 0x01
+)
+
+// kdfArgon2id identifies Argon2id in the tagKDF field.
+const kdfArgon2id = 1
+
+// Record types mixed into the associated data so that a record of one kind
+// can never be accepted in place of another.
+const (
+	recordMetadata  = 0
+	recordData      = 1
+	recordIntegrity = 2
+)
+
+// header is the plaintext header at the start of every encrypted file.
+//
+// Layout:
+//
+//	[magic "FENC"][version u8][flags u8][fields length u16][fields...]
+//
+// Each field is encoded as [tag u8][length u16][value].
+type header struct {
+	version  uint8
+	flags    uint8
+	kdfSalt  []byte
+	fileSalt []byte
+
+	// kdfParams are the Argon2id parameters the master key was derived with.
+	kdfParams kdf.Params
+
+	// chunkSize is the plaintext size of every data chunk but the final one.
+	chunkSize int
+
+	// dataShards and parityShards are the number of data records per group
+	// and of parity shards that follow each group, or zero for files
+	// without parity.
+	dataShards, parityShards int
+
+	// keyCheck is the key check value, or nil for files written by
+	// versions that did not record one.
+	keyCheck []byte
+
+	// optional holds the optional fields that this version does not
+	// interpret, in the order they appear.
+	optional []field
+
+	// raw holds the encoded header exactly as it appears in the file.
+	raw []byte
+
+	// legacy is set for files in the legacy headerless format. readAhead
+	// then holds the bytes of the first record that were read to detect it.
+	legacy    bool
+	readAhead []byte
+}
+
+// field is a single tag-length-value header field.
+type field struct {
+	tag   uint8
+	value []byte
+}
+
+// newHeader creates a header for a file encrypted under key with the chunk
+// size and parity of l, with a fresh file salt read from rnd.
+func newHeader(rnd io.Reader, key *Key, flags uint8, l layout) (*header, error) {
+	fileSalt := make([]byte, fileSaltSize)
+	if _, err := io.ReadFull(rnd, fileSalt); err != nil {
+		return nil, err
+	}
+
+	keyCheck, err := deriveKeyCheck(key.key, fileSalt)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &header{
+		version:   formatVersion,
+		flags:     flags,
+		kdfSalt:   key.salt,
+		fileSalt:  fileSalt,
+		kdfParams: key.params,
+		chunkSize: int(l.chunkSize),
+		keyCheck:  keyCheck,
+	}
+	if l.parityShards > 0 {
+		h.dataShards, h.parityShards = int(l.dataShards), int(l.parityShards)
+	}
+	h.raw = h.marshal()
+
+	return h, nil
+}
+
+// marshal encodes the header.
+func (h *header) marshal() []byte {
+	var fields []byte
+
+	kdfField := []byte{kdfArgon2id}
+	kdfField = binary.BigEndian.AppendUint32(kdfField, h.kdfParams.Time)
+	kdfField = binary.BigEndian.AppendUint32(kdfField, h.kdfParams.Memory)
+	kdfField = append(kdfField, h.kdfParams.Threads)
+	kdfField = append(kdfField, h.kdfSalt...)
+	fields = appendField(fields, tagKDF, kdfField)
+	fields = appendField(fields, tagFileSalt, h.fileSalt)
+	if h.chunkSize != defaultChunkSize {
+		fields = appendField(fields, tagChunkSize, binary.BigEndian.AppendUint32(nil, uint32(h.chunkSize)))
+	}
+	if h.parityShards > 0 {
+		fields = appendField(fields, tagParity, []byte{uint8(h.dataShards), uint8(h.parityShards)})
+	}
+	if h.keyCheck != nil {
+		fields = appendField(fields, tagKeyCheck, h.keyCheck)
+	}
+
+	buf := make([]byte, 0, fixedHeaderSize+len(fields))
+	buf = append(buf, magic...)
+	buf = append(buf, h.version, h.flags)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(fields)))
+	buf = append(buf, fields...)
+
+	return buf
+}
+
+// appendField appends a single tag-length-value field to buf.
+func appendField(buf []byte, tag uint8, value []byte) []byte {
+	buf = append(buf, tag)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(value)))
+	return append(buf, value...)
+}
+
+// readHeader reads and validates a header from r.
+func readHeader(r io.Reader) (*header, error) {
+	fixed := make([]byte, fixedHeaderSize)
+	n, err := io.ReadFull(r, fixed)
+	if n < len(magic) || !bytes.Equal(fixed[:len(magic)], []byte(magic)) {
+		if err == nil {
+			return readLegacyHeader(fixed, r)
+		}
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("reading header: %w", err)
+		}
+		return nil, ErrNotEncrypted
+	}
+	if err != nil {
+		return nil, headerReadError(err)
+	}
+
+	h := &header{
+		version:   fixed[len(magic)],
+		flags:     fixed[len(magic)+1],
+		chunkSize: defaultChunkSize,
+	}
+	if h.version != formatVersion {
+		return nil, fmt.Errorf("%w %d", ErrUnsupportedVersion, h.version)
+	}
+	if h.flags&^knownFlags != 0 {
+		return nil, fmt.Errorf("%w: flags 0x%02x", ErrUnsupportedVersion, h.flags)
+	}
+
+	fields := make([]byte, binary.BigEndian.Uint16(fixed[len(magic)+2:]))
+	if _, err := io.ReadFull(r, fields); err != nil {
+		return nil, headerReadError(err)
+	}
+	h.raw = append(fixed, fields...)
+
+	// Each field this version interprets may appear only once, so that a
+	// later copy cannot silently replace the one checked first.
+	seen := make(map[uint8]bool)
+	for len(fields) > 0 {
+		if len(fields) < 3 {
+			return nil, malformedHeader("truncated field")
+		}
+		tag := fields[0]
+		n := int(binary.BigEndian.Uint16(fields[1:3]))
+		if len(fields) < 3+n {
+			return nil, malformedHeader("truncated field")
+		}
+		value := fields[3 : 3+n]
+		fields = fields[3+n:]
+
+		if seen[tag] && (tag == tagKDF || tag == tagFileSalt || tag == tagChunkSize || tag == tagParity || tag == tagKeyCheck) {
+			return nil, malformedHeader(fmt.Sprintf("duplicate field 0x%02x", tag))
+		}
+		seen[tag] = true
+
+		switch tag {
+		case tagKDF:
+			if err := h.parseKDF(value); err != nil {
+				return nil, err
+			}
+		case tagFileSalt:
+			if len(value) != fileSaltSize {
+				return nil, malformedHeader("file salt")
+			}
+			h.fileSalt = value
+		case tagChunkSize:
+			if len(value) != 4 {
+				return nil, malformedHeader("chunk size")
+			}
+			size := binary.BigEndian.Uint32(value)
+			if err := validateChunkSize(int64(size)); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrUnsupportedVersion, err)
+			}
+			h.chunkSize = int(size)
+		case tagParity:
+			if len(value) != 2 {
+				return nil, malformedHeader("parity")
+			}
+			h.dataShards, h.parityShards = int(value[0]), int(value[1])
+			if h.dataShards < 1 || h.parityShards < 1 || h.dataShards+h.parityShards > 256 {
+				return nil, malformedHeader("parity")
+			}
+		case tagKeyCheck:
+			if len(value) != keyCheckSize {
+				return nil, malformedHeader("key check")
+			}
+			h.keyCheck = value
+		default:
+			if tag&tagOptional == 0 {
+				return nil, fmt.Errorf("%w: header field 0x%02x", ErrUnsupportedVersion, tag)
+			}
+			h.optional = append(h.optional, field{tag: tag, value: value})
+		}
+	}
+
+	if h.kdfSalt == nil || h.fileSalt == nil {
+		return nil, malformedHeader("missing required fields")
+	}
+
+	return h, nil
+}
+
+// validateChunkSize returns an error unless size is a power of two between
+// minChunkSize and maxChunkSize.
+func validateChunkSize(size int64) error {
+	if size < minChunkSize || size > maxChunkSize || size&(size-1) != 0 {
+		return fmt.Errorf("chunk size %d is not a power of two between %d and %d", size, minChunkSize, maxChunkSize)
+	}
+
+	return nil
+}
+
+// layout returns the layout of the data records of the file.
+func (h *header) layout() layout {
+	if h.parityShards == 0 {
+		return layout{chunkSize: int64(h.chunkSize), dataShards: 1}
+	}
+
+	return layout{
+		chunkSize:    int64(h.chunkSize),
+		dataShards:   int64(h.dataShards),
+		parityShards: int64(h.parityShards),
+	}
+}
+
+// layout locates the data records of a file. Every record but the final
+// one holds exactly chunkSize bytes of plaintext, and the records form
+// groups of dataShards records, each followed by parityShards parity
+// shards, so the position of any record follows from its index. Files
+// without parity have groups of one record and no shards.
+//
+// The parity shards of a group are as long as its first record, which is
+// full unless it is the final record.
+type layout struct {
+	chunkSize    int64
+	dataShards   int64
+	parityShards int64
+}
+
+// recordSize returns the encoded size of every data record but the final one.
+func (l layout) recordSize() int64 {
+	return recordHeaderSize + l.chunkSize + tagSize
+}
+
+// groupSize returns the encoded size of a group of full records and its
+// parity shards.
+func (l layout) groupSize() int64 {
+	return (l.dataShards + l.parityShards) * l.recordSize()
+}
+
+// recordPos returns the offset of the record with the given index from the
+// start of the data records.
+func (l layout) recordPos(index int64) int64 {
+	return index/l.dataShards*l.groupSize() + index%l.dataShards*l.recordSize()
+}
+
+// chunkLen returns the plaintext length of the chunk with the given index
+// in a file whose plaintext is size bytes long.
+func (l layout) chunkLen(size, index int64) int64 {
+	return min(l.chunkSize, size-index*l.chunkSize)
+}
+
+// records returns the number of data records and the plaintext size of a
+// file whose data records and parity shards take up body bytes. It returns
+// ErrTruncated if no complete file has that size.
+func (l layout) records(body int64) (chunks, size int64, err error) {
+	groups, tail := body/l.groupSize(), body%l.groupSize()
+
+	// The final group holds n records, all full but the last, which is
+	// last bytes long, followed by its parity shards. They are as long as
+	// the final record if it is alone in its group and full otherwise.
+	var n, last int64
+	if m := l.parityShards; tail < (1+m)*l.recordSize() {
+		if tail%(1+m) != 0 {
+			return 0, 0, ErrTruncated
+		}
+		n, last = 1, tail/(1+m)
+	} else {
+		rest := tail - m*l.recordSize()
+		n, last = 1+rest/l.recordSize(), rest%l.recordSize()
+	}
+	if last < recordHeaderSize+tagSize {
+		return 0, 0, ErrTruncated
+	}
+
+	chunks = groups*l.dataShards + n
+	return chunks, (chunks-1)*l.chunkSize + last - recordHeaderSize - tagSize, nil
+}
+
+// headerReadError classifies an error from reading the header after its magic.
+func headerReadError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncated
+	}
+	return fmt.Errorf("reading header: %w", err)
+}
+
+// malformedHeader reports a header that cannot be parsed.
+func malformedHeader(what string) error {
+	return &ErrCorrupted{Chunk: -1, Err: fmt.Errorf("%w: %s", errMalformedHeader, what)}
+}
+
+// parseKDF decodes the tagKDF field. Parameters beyond kdf.MaxParams are
+// rejected here, before anything in the file is authenticated; readers
+// that derive keys refuse anything stronger than Options.MaxKDF as well.
+func (h *header) parseKDF(value []byte) error {
+	if len(value) != 1+4+4+1+saltSize {
+		return malformedHeader("KDF field")
+	}
+	if value[0] != kdfArgon2id {
+		return fmt.Errorf("%w: KDF %d", ErrUnsupportedVersion, value[0])
+	}
+	h.kdfParams = kdf.Params{
+		Time:    binary.BigEndian.Uint32(value[1:5]),
+		Memory:  binary.BigEndian.Uint32(value[5:9]),
+		Threads: value[9],
+	}
+	if err := h.kdfParams.Validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrUnsupportedVersion, err)
+	}
+	h.kdfSalt = value[10:]
+
+	return nil
+}
+
+// deriveKeyCheck derives the key check value for a file from its master key
+// and file salt. It is independent of the payload key, and lets a reader
+// reject a wrong key without decrypting anything.
+func deriveKeyCheck(masterKey, fileSalt []byte) ([]byte, error) {
+	return hkdf.Key(sha256.New, masterKey, fileSalt, "file-encryptor key check", keyCheckSize)
+}
+
+// checkKey verifies masterKey against the key check value in the header.
+// Headers without one accept any key.
+func (h *header) checkKey(masterKey []byte) error {
+	if h.keyCheck == nil {
+		return nil
+	}
+
+	want, err := deriveKeyCheck(masterKey, h.fileSalt)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(h.keyCheck, want) {
+		return ErrWrongKey
+	}
+
+	return nil
+}
+
+// hash returns the SHA-256 digest of the encoded header. It is bound into
+// every record's associated data so that the header cannot be altered.
+func (h *header) hash() [sha256.Size]byte {
+	return sha256.Sum256(h.raw)
+}
+
+// sealer encrypts and decrypts the records of a single file.
+type sealer struct {
+	aead    cipher.AEAD
+	hdrHash [sha256.Size]byte
+
+	// legacy is set for legacy files, whose records have no associated data.
+	legacy bool
+}
+
+// newSealer derives the payload key for a file from its master key and
+// header and returns a sealer bound to that header. Legacy files are
+// sealed under the master key itself.
+func newSealer(masterKey []byte, h *header) (*sealer, error) {
+	key := masterKey
+	if !h.legacy {
+		var err error
+		key, err = hkdf.Key(sha256.New, masterKey, h.fileSalt, "file-encryptor payload", 32)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sealer{aead: gcm, hdrHash: h.hash(), legacy: h.legacy}, nil
+}
+
+// additionalData builds the associated data for a record. It binds the
+// record to the header, its type, its position and whether it ends the stream.
+func (s *sealer) additionalData(kind uint8, index uint64, final bool) []byte {
+	if s.legacy {
+		return nil
+	}
+
+	ad := make([]byte, 0, len(s.hdrHash)+1+8+1)
+	ad = append(ad, s.hdrHash[:]...)
+	ad = append(ad, kind)
+	ad = binary.BigEndian.AppendUint64(ad, index)
+	if final {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
+
+// newNonce reads a fresh random nonce from rnd.
+func newNonce(rnd io.Reader) ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(rnd, nonce); err != nil {
+		return nil, err
+	}
+
+	return nonce, nil
+}
+
+// seal encrypts pt under nonce, which must never be reused, and returns the ciphertext.
+func (s *sealer) seal(kind uint8, index uint64, final bool, nonce, pt []byte) []byte {
+	return s.aead.Seal(nil, nonce, pt, s.additionalData(kind, index, final))
+}
+
+// open authenticates and decrypts a record. It returns errOpen if the
+// record does not authenticate.
+func (s *sealer) open(kind uint8, index uint64, final bool, nonce, ct []byte) ([]byte, error) {
+	pt, err := s.aead.Open(ct[:0], nonce, ct, s.additionalData(kind, index, final))
+	if err != nil {
+		return nil, errOpen
+	}
+
+	return pt, nil
+}
+
+// writeRecord writes a record as [nonce][length u32][ciphertext].
+func writeRecord(w io.Writer, nonce, ct []byte) error {
+	_, err := w.Write(encodeRecord(nonce, ct))
+	return err
+}
+
+// encodeRecord encodes a record as [nonce][length u32][ciphertext].
+func encodeRecord(nonce, ct []byte) []byte {
+	buf := make([]byte, 0, recordHeaderSize+len(ct))
+	buf = append(buf, nonce...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(ct)))
+	return append(buf, ct...)
+}
+
+// readRecord reads a single record whose ciphertext is at most maxLen
+// bytes long. The length prefix is checked before the ciphertext buffer is
+// allocated, so a damaged or crafted prefix can never make it allocate more
+// than maxLen bytes. It returns io.EOF only when no bytes of the record were
+// read, and io.ErrUnexpectedEOF when the record is cut short.
+func readRecord(r io.Reader, maxLen int) (nonce, ct []byte, err error) {
+	prefix := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, nil, err
+	}
+
+	ctLen := binary.BigEndian.Uint32(prefix[nonceSize:])
+	if ctLen < tagSize || ctLen > uint32(maxLen) {
+		return nil, nil, fmt.Errorf("%w %d", errRecordLength, ctLen)
+	}
+
+	ct = make([]byte, ctLen)
+	if _, err := io.ReadFull(r, ct); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, nil, err
+	}
+
+	return prefix[:nonceSize], ct, nil
+}
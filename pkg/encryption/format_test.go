@@ -0,0 +1,193 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// legacyBytes encodes plaintext chunks as a legacy file under testKey. Unlike
+// the legacy writer, it encodes the chunks exactly as given, empty ones
+// included.
+func legacyBytes(t testing.TB, chunks ...[]byte) []byte {
+	t.Helper()
+	s, err := newSealer(testKey.key, &header{legacy: true})
+	if err != nil {
+		t.Fatalf("newSealer() error = %v", err)
+	}
+
+	out := append([]byte{}, testKey.salt...)
+	for i, pt := range chunks {
+		nonce := make([]byte, nonceSize)
+		nonce[0] = byte(i)
+		ct := s.seal(recordData, uint64(i), false, nonce, pt)
+		out = append(out, nonce...)
+		out = binary.BigEndian.AppendUint32(out, uint32(len(ct)))
+		out = append(out, ct...)
+	}
+
+	return out
+}
+
+// legacyConfig returns a configuration that opens files under testKey.
+func legacyConfig(jobs int) streamConfig {
+	cfg := seededConfig(jobs)
+	cfg.keys = keySource{key: testKey}
+	return cfg
+}
+
+// TestReadHeaderStrict verifies that headers with unknown flags or repeated
+// fields are rejected.
+func TestReadHeaderStrict(t *testing.T) {
+	h, err := newHeader(bytes.NewReader(make([]byte, fileSaltSize)), testKey, 0, layout{chunkSize: defaultChunkSize, dataShards: 1})
+	if err != nil {
+		t.Fatalf("newHeader() error = %v", err)
+	}
+
+	flagged := append([]byte{}, h.raw...)
+	flagged[len(magic)+1] = 0x80
+	if _, err := readHeader(bytes.NewReader(flagged)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("readHeader() with unknown flags returned %v, want ErrUnsupportedVersion", err)
+	}
+
+	fields := appendField(h.raw[fixedHeaderSize:], tagFileSalt, h.fileSalt)
+	repeated := append([]byte{}, h.raw[:fixedHeaderSize]...)
+	binary.BigEndian.PutUint16(repeated[len(magic)+2:], uint16(len(fields)))
+	repeated = append(repeated, fields...)
+	var corrupted *ErrCorrupted
+	if _, err := readHeader(bytes.NewReader(repeated)); !errors.As(err, &corrupted) {
+		t.Errorf("readHeader() with a repeated field returned %v, want *ErrCorrupted", err)
+	}
+}
+
+// TestLegacyEmptyChunk verifies that an empty legacy record is accepted
+// only as the record of an empty file.
+func TestLegacyEmptyChunk(t *testing.T) {
+	full := bytes.Repeat([]byte{7}, defaultChunkSize)
+
+	if got, err := decryptBytes(legacyBytes(t, nil), legacyConfig(1)); err != nil || len(got) != 0 {
+		t.Errorf("empty legacy file: got %d bytes, error %v", len(got), err)
+	}
+
+	for name, ct := range map[string][]byte{
+		"middle":  legacyBytes(t, full, nil, full),
+		"last":    legacyBytes(t, full, nil),
+		"leading": legacyBytes(t, nil, full),
+	} {
+		for _, jobs := range []int{1, 4} {
+			_, err := decryptBytes(ct, legacyConfig(jobs))
+			var corrupted *ErrCorrupted
+			if !errors.As(err, &corrupted) || !errors.Is(err, errEmptyChunk) {
+				t.Errorf("%s, jobs=%d: error = %v, want an empty chunk error", name, jobs, err)
+			}
+		}
+	}
+}
+
+// FuzzReadHeader checks that readHeader never panics, and that any header
+// it accepts is consistent with the input it was read from.
+func FuzzReadHeader(f *testing.F) {
+	h, err := newHeader(bytes.NewReader(make([]byte, fileSaltSize)), testKey, flagMetadata, layout{chunkSize: defaultChunkSize, dataShards: 1})
+	if err != nil {
+		f.Fatalf("newHeader() error = %v", err)
+	}
+	f.Add(h.raw)
+	f.Add(h.raw[:len(h.raw)-1])
+	if h, err := newHeader(bytes.NewReader(make([]byte, fileSaltSize)), testKey, 0, layout{chunkSize: minChunkSize, dataShards: 1}); err == nil {
+		f.Add(h.raw)
+	}
+	if h, err := newHeader(bytes.NewReader(make([]byte, fileSaltSize)), testKey, 0, layout{chunkSize: defaultChunkSize, dataShards: 10, parityShards: 1}); err == nil {
+		f.Add(h.raw)
+	}
+	f.Add([]byte(magic))
+	f.Add(legacyBytes(f, []byte("legacy")))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h, err := readHeader(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+
+		if h.legacy {
+			if len(h.kdfSalt) != saltSize || len(h.readAhead) != recordHeaderSize {
+				t.Fatalf("legacy header with salt %d and read-ahead %d bytes", len(h.kdfSalt), len(h.readAhead))
+			}
+			return
+		}
+		if !bytes.HasPrefix(data, h.raw) {
+			t.Fatal("raw header is not a prefix of the input")
+		}
+		if len(h.kdfSalt) != saltSize || len(h.fileSalt) != fileSaltSize {
+			t.Fatalf("header with salts of %d and %d bytes", len(h.kdfSalt), len(h.fileSalt))
+		}
+		if err := h.kdfParams.Validate(); err != nil {
+			t.Fatalf("header with invalid KDF parameters: %v", err)
+		}
+		if err := validateChunkSize(int64(h.chunkSize)); err != nil {
+			t.Fatalf("header with invalid chunk size: %v", err)
+		}
+		if h.parityShards > 0 && (h.dataShards < 1 || h.dataShards+h.parityShards > 256) {
+			t.Fatalf("header with %d data and %d parity shards", h.dataShards, h.parityShards)
+		}
+	})
+}
+
+// FuzzReadRecord checks that readRecord never allocates more than its bound
+// and that it only succeeds on input that holds the whole record.
+func FuzzReadRecord(f *testing.F) {
+	record := make([]byte, recordHeaderSize+tagSize+5)
+	binary.BigEndian.PutUint32(record[nonceSize:], tagSize+5)
+	f.Add(record)
+	f.Add(record[:recordHeaderSize])
+	f.Add(record[:recordHeaderSize-1])
+	f.Add([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		const maxLen = defaultChunkSize + tagSize
+		nonce, ct, err := readRecord(bytes.NewReader(data), maxLen)
+		switch {
+		case err == io.EOF:
+			if len(data) != 0 {
+				t.Fatalf("io.EOF after %d bytes of input", len(data))
+			}
+		case err != nil:
+			if cap(ct) > maxLen {
+				t.Fatalf("allocated %d bytes for a rejected record", cap(ct))
+			}
+		default:
+			if len(nonce) != nonceSize || len(ct) < tagSize || len(ct) > maxLen {
+				t.Fatalf("record with a %d-byte nonce and %d-byte ciphertext", len(nonce), len(ct))
+			}
+			if recordHeaderSize+len(ct) > len(data) {
+				t.Fatalf("record of %d bytes read from %d bytes of input", recordHeaderSize+len(ct), len(data))
+			}
+		}
+	})
+}
+
+// FuzzDecrypt checks that decrypting arbitrary input never panics, and that
+// the serial and parallel decoders agree on what they accept.
+func FuzzDecrypt(f *testing.F) {
+	for _, size := range []int{0, 10, defaultChunkSize, defaultChunkSize + 1} {
+		ct := encryptBytes(f, make([]byte, size), seededConfig(1))
+		f.Add(ct)
+		f.Add(ct[:len(ct)-1])
+	}
+	f.Add(legacyBytes(f, []byte("legacy"), nil))
+	f.Add(legacyBytes(f, nil))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		serial, serialErr := decryptBytes(data, legacyConfig(1))
+		parallel, parallelErr := decryptBytes(data, legacyConfig(4))
+		if (serialErr == nil) != (parallelErr == nil) {
+			t.Fatalf("serial error = %v, parallel error = %v", serialErr, parallelErr)
+		}
+		if serialErr == nil && !bytes.Equal(serial, parallel) {
+			t.Fatal("serial and parallel plaintexts differ")
+		}
+	})
+}
@@ -0,0 +1,410 @@
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gigatar/file-encryptor/pkg/kdf"
+)
+
+// encSuffix is the suffix of the encrypted files that an FS presents
+// decrypted.
+const encSuffix = ".enc"
+
+// FS presents the encrypted files of a directory tree decrypted. A file
+// called name.enc in the underlying tree appears as name, with its
+// plaintext size; directories appear as they are and every other file is
+// hidden, so nothing that is not encrypted is served by mistake. An
+// encrypted file hides a directory of the same name.
+//
+// Files that the underlying tree opens as an io.ReaderAt, such as those of
+// os.DirFS, embed.FS and fstest.MapFS, are opened with OpenReaderAt: they
+// implement io.Seeker and io.ReaderAt, and only the chunks a read touches
+// are decrypted. Other files, and files in the legacy format, can only be
+// read from start to end, and their Seek fails.
+//
+// FS implements fs.ReadDirFS and fs.StatFS, so it can be passed to
+// http.FS, template.ParseFS, fs.WalkDir and the like. Stat and the Info of
+// directory entries compute the plaintext size from the header and the
+// size of the encrypted file, without a key.
+type FS struct {
+	dir  fs.FS
+	keys keySource
+}
+
+// NewFS returns an FS presenting the encrypted files of dir decrypted with
+// key.
+//
+// Args:
+//   - dir: The tree holding the encrypted files
+//   - key: Master key of the files, or nil to derive the key of each
+//     distinct salt with kdf.GetKey the first time a file with that salt
+//     is opened; Encryptor.NewFS suits files from many runs better
+//
+// Returns:
+//   - *FS: The decrypted view of dir
+func NewFS(dir fs.FS, key *Key) *FS {
+	keys := keySource{key: key}
+	if key == nil {
+		keys.getKey = cacheGetKey()
+	}
+
+	return &FS{dir: dir, keys: keys}
+}
+
+// cacheGetKey returns a GetKeyFunc that calls kdf.GetKey once per distinct
+// salt and remembers the keys it returns, so that a password is not asked
+// for again every time a file is opened. Failures are not remembered.
+func cacheGetKey() kdf.GetKeyFunc {
+	var mu sync.Mutex
+	keys := make(map[string][]byte)
+
+	return func(salt []byte) ([]byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if key, ok := keys[string(salt)]; ok {
+			return key, nil
+		}
+		key, err := kdf.GetKey(salt)
+		if err != nil {
+			return nil, err
+		}
+		keys[string(salt)] = key
+
+		return key, nil
+	}
+}
+
+var (
+	_ fs.ReadDirFS = (*FS)(nil)
+	_ fs.StatFS    = (*FS)(nil)
+)
+
+// Open opens the file or directory called name. An encrypted file is
+// authenticated up to its metadata when it is opened, so a wrong key is
+// reported by Open rather than by the first Read.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if name != "." {
+		f, err := fsys.dir.Open(name + encSuffix)
+		if err == nil {
+			info, err := f.Stat()
+			if err == nil && info.Mode().IsRegular() {
+				return fsys.openEncrypted(name, f, info)
+			}
+			f.Close()
+		}
+	}
+
+	f, err := fsys.dir.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !info.IsDir() {
+		f.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return &dirFile{File: f, fsys: fsys, name: name}, nil
+}
+
+// openEncrypted returns the decrypted file called name, whose encrypted
+// form f has the given info.
+func (fsys *FS) openEncrypted(name string, f fs.File, info fs.FileInfo) (fs.File, error) {
+	fail := func(err error) (fs.File, error) {
+		f.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	if ra, ok := f.(io.ReaderAt); ok {
+		r, err := openReaderAt(ra, info.Size(), fsys.keys)
+		if err == nil {
+			return &seekableFile{ReaderAt: r, f: f, info: &plainInfo{FileInfo: info, name: path.Base(name), size: r.Size()}}, nil
+		}
+		if !errors.Is(err, errLegacyAccess) {
+			return fail(err)
+		}
+	}
+
+	size, err := plaintextSize(f, info.Size())
+	if err != nil {
+		return fail(err)
+	}
+	f.Close()
+
+	// The size was computed by reading past the header, so the file is
+	// opened again to decrypt it from the start.
+	if f, err = fsys.dir.Open(name + encSuffix); err != nil {
+		return nil, err
+	}
+	cfg := defaultConfig()
+	cfg.keys = fsys.keys
+	r, err := newReader(f, cfg)
+	if err != nil {
+		return fail(err)
+	}
+
+	return &streamFile{Reader: r, f: f, info: &plainInfo{FileInfo: info, name: path.Base(name), size: size}}, nil
+}
+
+// Stat returns the FileInfo of the file or directory called name. The size
+// of an encrypted file is its plaintext size.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if name != "." {
+		info, err := fs.Stat(fsys.dir, name+encSuffix)
+		if err == nil && info.Mode().IsRegular() {
+			return fsys.statEncrypted(name, info)
+		}
+	}
+
+	info, err := fs.Stat(fsys.dir, name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return info, nil
+}
+
+// statEncrypted returns the FileInfo of the decrypted file called name,
+// whose encrypted form has the given info.
+func (fsys *FS) statEncrypted(name string, info fs.FileInfo) (fs.FileInfo, error) {
+	f, err := fsys.dir.Open(name + encSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	size, err := plaintextSize(f, info.Size())
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	return &plainInfo{FileInfo: info, name: path.Base(name), size: size}, nil
+}
+
+// ReadDir reads the directory called name and returns its subdirectories
+// and decrypted files, sorted by name.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	entries, err := fs.ReadDir(fsys.dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs, files []fs.DirEntry
+	for _, e := range entries {
+		plain, ok := strings.CutSuffix(e.Name(), encSuffix)
+		switch {
+		case e.IsDir():
+			dirs = append(dirs, e)
+		case ok && plain != "" && e.Type().IsRegular():
+			files = append(files, &dirEntry{DirEntry: e, fsys: fsys, name: plain, path: path.Join(name, plain)})
+		}
+	}
+
+	// An encrypted file hides a directory of the same name, as in Open.
+	dirs = slices.DeleteFunc(dirs, func(d fs.DirEntry) bool {
+		return slices.ContainsFunc(files, func(f fs.DirEntry) bool { return f.Name() == d.Name() })
+	})
+	list := append(dirs, files...)
+	slices.SortFunc(list, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+
+	return list, nil
+}
+
+// plaintextSize returns the plaintext size of the encrypted file f of the
+// given size without its key. Only the header and the records before the
+// data are read, as the data records follow from the size of the file;
+// the records of legacy files, whose final chunk is not marked, are walked.
+func plaintextSize(f fs.File, size int64) (int64, error) {
+	var r io.Reader = f
+	ra, ok := f.(io.ReaderAt)
+	if ok {
+		r = io.NewSectionReader(ra, 0, size)
+	}
+
+	cr := &countingReader{r: r}
+	h, err := readHeader(cr)
+	if err != nil {
+		return 0, err
+	}
+
+	if h.legacy {
+		if ok {
+			info, err := inspect(ra, size)
+			if err != nil {
+				return 0, err
+			}
+			return info.PlaintextSize, nil
+		}
+
+		var total int64
+		records := io.MultiReader(bytes.NewReader(h.readAhead), r)
+		for {
+			_, ct, err := readRecord(records, h.chunkSize+tagSize)
+			if err == io.EOF {
+				return total, nil
+			}
+			if err != nil {
+				return 0, recordError(-1, err)
+			}
+			total += int64(len(ct) - tagSize)
+		}
+	}
+
+	if h.flags&flagMetadata != 0 {
+		if _, _, err := readRecord(cr, maxMetadataSize); err != nil {
+			return 0, recordError(-1, err)
+		}
+	}
+	if h.flags&flagIntegrity != 0 {
+		if _, _, err := readRecord(cr, integritySize+tagSize); err != nil {
+			return 0, recordError(-1, err)
+		}
+	}
+	_, plaintext, err := h.layout().records(size - cr.n)
+
+	return plaintext, err
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read reads from the underlying reader and counts the bytes read.
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// plainInfo is the FileInfo of a decrypted file: that of the encrypted file
+// under the plaintext name and size.
+type plainInfo struct {
+	fs.FileInfo
+	name string
+	size int64
+}
+
+// Name returns the name of the decrypted file.
+func (fi *plainInfo) Name() string { return fi.name }
+
+// Size returns the plaintext size.
+func (fi *plainInfo) Size() int64 { return fi.size }
+
+// seekableFile is a decrypted file with random access.
+type seekableFile struct {
+	*ReaderAt
+	f    fs.File
+	info fs.FileInfo
+}
+
+// Stat returns the FileInfo of the decrypted file.
+func (sf *seekableFile) Stat() (fs.FileInfo, error) { return sf.info, nil }
+
+// Close closes the encrypted file.
+func (sf *seekableFile) Close() error { return sf.f.Close() }
+
+// streamFile is a decrypted file that can only be read sequentially.
+type streamFile struct {
+	*Reader
+	f    fs.File
+	info fs.FileInfo
+}
+
+// Stat returns the FileInfo of the decrypted file.
+func (sf *streamFile) Stat() (fs.FileInfo, error) { return sf.info, nil }
+
+// Close closes the encrypted file.
+func (sf *streamFile) Close() error { return sf.f.Close() }
+
+// dirEntry is the directory entry of a decrypted file. Its Info is computed
+// when it is asked for.
+type dirEntry struct {
+	fs.DirEntry
+	fsys       *FS
+	name, path string
+}
+
+// Name returns the name of the decrypted file.
+func (e *dirEntry) Name() string { return e.name }
+
+// Info returns the FileInfo of the decrypted file, with its plaintext size.
+func (e *dirEntry) Info() (fs.FileInfo, error) {
+	info, err := e.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+
+	return e.fsys.statEncrypted(e.path, info)
+}
+
+// dirFile is an open directory, listing the decrypted files.
+type dirFile struct {
+	fs.File
+	fsys *FS
+	name string
+
+	// entries holds the entries not yet returned by ReadDir, and is read
+	// on the first call.
+	entries []fs.DirEntry
+	read    bool
+}
+
+// Read fails, as for any directory.
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir returns the next n entries of the directory, or all remaining
+// ones if n <= 0, like fs.ReadDirFile.
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.fsys.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.read = entries, true
+	}
+
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+
+	return entries, nil
+}
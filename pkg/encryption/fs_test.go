@@ -0,0 +1,192 @@
+package encryption_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/gigatar/file-encryptor/pkg/encryption"
+	"github.com/gigatar/file-encryptor/pkg/kdf"
+)
+
+// sequentialFS hides every method of the files of an fs.FS except those
+// of fs.File, as for files that can only be read sequentially.
+type sequentialFS struct{ fs.FS }
+
+// Open opens name with only the methods of fs.File.
+func (s sequentialFS) Open(name string) (fs.File, error) {
+	f, err := s.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := f.(fs.ReadDirFile); ok {
+		return f, nil
+	}
+	return struct{ fs.File }{f}, nil
+}
+
+// TestFS verifies that NewFS presents encrypted files decrypted under their
+// plaintext names and sizes, hides everything else and passes the checks of
+// fstest.TestFS, which include seeking and ReadAt.
+func TestFS(t *testing.T) {
+	key := newTestKey(t)
+
+	big := bytes.Repeat([]byte("0123456789abcdef"), 20000)
+	dir := fstest.MapFS{
+		"index.html.enc":      {Data: encryptForReaderAt(t, key, []byte("<h1>hi</h1>")), Mode: 0644},
+		"assets/app.js.enc":   {Data: encryptForReaderAt(t, key, big), Mode: 0644},
+		"assets/empty.enc":    {Data: encryptForReaderAt(t, key, nil), Mode: 0644},
+		"assets/plain.txt":    {Data: []byte("not encrypted"), Mode: 0644},
+		"assets/nested/x.enc": {Data: encryptForReaderAt(t, key, []byte("x")), Mode: 0600},
+	}
+	fsys := encryption.NewFS(dir, key)
+
+	if err := fstest.TestFS(fsys, "index.html", "assets/app.js", "assets/empty", "assets/nested/x"); err != nil {
+		t.Fatalf("fstest.TestFS() failed: %v", err)
+	}
+
+	data, err := fs.ReadFile(fsys, "assets/app.js")
+	if err != nil || !bytes.Equal(data, big) {
+		t.Fatalf("ReadFile() = %d bytes, %v; want the plaintext", len(data), err)
+	}
+	info, err := fs.Stat(fsys, "assets/app.js")
+	if err != nil || info.Size() != int64(len(big)) || info.Name() != "app.js" {
+		t.Errorf("Stat() = %v, %v; want app.js with %d bytes", info, err, len(big))
+	}
+
+	f, err := fsys.Open("assets/app.js")
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer f.Close()
+	seeker, ok := f.(io.ReadSeeker)
+	if !ok {
+		t.Fatal("Open() did not return an io.Seeker")
+	}
+	if _, err := seeker.Seek(-10, io.SeekEnd); err != nil {
+		t.Fatalf("Seek() failed: %v", err)
+	}
+	tail, err := io.ReadAll(seeker)
+	if err != nil || !bytes.Equal(tail, big[len(big)-10:]) {
+		t.Errorf("read after Seek() = %q, %v", tail, err)
+	}
+
+	for _, hidden := range []string{"assets/plain.txt", "index.html.enc", "missing"} {
+		if _, err := fsys.Open(hidden); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Open(%q) error = %v, want ErrNotExist", hidden, err)
+		}
+	}
+
+	other := newTestKey(t)
+	if _, err := encryption.NewFS(dir, other).Open("index.html"); !errors.Is(err, encryption.ErrWrongKey) {
+		t.Errorf("Open() with another key error = %v, want ErrWrongKey", err)
+	}
+}
+
+// TestFSSequential verifies that files that cannot be read at an offset,
+// and legacy files, are decrypted sequentially and still report their
+// plaintext size, and that an FS without a Key asks kdf.GetKey for the key
+// of a salt only once.
+func TestFSSequential(t *testing.T) {
+	// Save original GetKey function and restore it after the test
+	originalGetKey := kdf.GetKey
+	calls := 0
+	kdf.GetKey = func(salt []byte) ([]byte, error) {
+		calls++
+		return mockGetKey(salt)
+	}
+	defer func() { kdf.GetKey = originalGetKey }()
+
+	key, err := encryption.NewKey()
+	if err != nil {
+		t.Fatalf("NewKey() failed: %v", err)
+	}
+
+	data := bytes.Repeat([]byte("sequential "), 10000)
+	legacyPath := filepath.Join(t.TempDir(), "old.enc")
+	writeLegacyFile(t, legacyPath, data)
+	legacy, err := os.ReadFile(legacyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		dir  fs.FS
+		key  *encryption.Key
+	}{
+		{"sequential", sequentialFS{fstest.MapFS{"f.enc": {Data: encryptForReaderAt(t, key, data)}}}, key},
+		{"legacy", fstest.MapFS{"f.enc": {Data: legacy}}, nil},
+		{"sequential legacy", sequentialFS{fstest.MapFS{"f.enc": {Data: legacy}}}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = 0
+			fsys := encryption.NewFS(tt.dir, tt.key)
+
+			info, err := fsys.Stat("f")
+			if err != nil || info.Size() != int64(len(data)) {
+				t.Fatalf("Stat() = %v, %v; want %d bytes", info, err, len(data))
+			}
+			entries, err := fsys.ReadDir(".")
+			if err != nil || len(entries) != 1 || entries[0].Name() != "f" {
+				t.Fatalf("ReadDir() = %v, %v", entries, err)
+			}
+			if info, err := entries[0].Info(); err != nil || info.Size() != int64(len(data)) {
+				t.Errorf("Info() = %v, %v; want %d bytes", info, err, len(data))
+			}
+
+			for range 2 {
+				got, err := fs.ReadFile(fsys, "f")
+				if err != nil || !bytes.Equal(got, data) {
+					t.Errorf("ReadFile() = %d bytes, %v; want the plaintext", len(got), err)
+				}
+			}
+			want := 0
+			if tt.key == nil {
+				want = 1
+			}
+			if calls != want {
+				t.Errorf("kdf.GetKey called %d times, want %d", calls, want)
+			}
+		})
+	}
+}
+
+// TestEncryptorFS verifies that an FS built from an Encryptor with a
+// password opens files encrypted under different salts.
+func TestEncryptorFS(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "plain")
+	if err := os.WriteFile(src, []byte("served"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.enc", "b.enc"} {
+		e, err := encryption.NewEncryptor(&encryption.Options{Password: []byte("pw"), KDF: fastKDF})
+		if err != nil {
+			t.Fatalf("NewEncryptor() failed: %v", err)
+		}
+		if err := e.EncryptFile(context.Background(), src, filepath.Join(dir, name)); err != nil {
+			t.Fatalf("EncryptFile() failed: %v", err)
+		}
+	}
+
+	e, err := encryption.NewEncryptor(&encryption.Options{Password: []byte("pw")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := e.NewFS(os.DirFS(dir))
+	for _, name := range []string{"a", "b"} {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil || string(data) != "served" {
+			t.Errorf("ReadFile(%q) = %q, %v", name, data, err)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package encryption
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Info describes an encrypted file as far as it can be known without its
+// key. Nothing in it is authenticated: the header is only authenticated
+// together with the records, which requires the key.
+type Info struct {
+	// Version is the file format version, or 0 for the legacy headerless
+	// format.
+	Version int `json:"version"`
+
+	// Legacy reports whether the file is in the legacy headerless format,
+	// which MigrateFile converts to the current one.
+	Legacy bool `json:"legacy"`
+
+	// Cipher names the AEAD that seals the records.
+	Cipher string `json:"cipher"`
+
+	// KDF describes how the master key is derived from the password.
+	KDF KDFInfo `json:"kdf"`
+
+	// ChunkSize is the plaintext size of every chunk except the last.
+	ChunkSize int `json:"chunk_size"`
+
+	// Chunks is the number of data records, including the final one.
+	Chunks int64 `json:"chunks"`
+
+	// PlaintextSize is the sum of the plaintext lengths implied by the
+	// record lengths.
+	PlaintextSize int64 `json:"plaintext_size"`
+
+	// Metadata, Archive and Integrity report whether the file has an
+	// encrypted metadata record, holds a directory archive and carries the
+	// integrity record of files written through File.
+	Metadata  bool `json:"metadata"`
+	Archive   bool `json:"archive"`
+	Integrity bool `json:"integrity"`
+
+	// DataShards and ParityShards are the number of data records in each
+	// group and the number of parity shards that follow it, or zero if
+	// the file has no parity.
+	DataShards   int `json:"data_shards,omitempty"`
+	ParityShards int `json:"parity_shards,omitempty"`
+
+	// KeyCheck reports whether the header carries a key check value, which
+	// lets a wrong password be told apart from a damaged file.
+	KeyCheck bool `json:"key_check"`
+
+	// Stanzas lists the optional header fields that this version does not
+	// interpret, such as recipient or key slot stanzas written by newer
+	// versions.
+	Stanzas []Stanza `json:"stanzas"`
+
+	// Complete reports whether the records end with a final, short chunk
+	// exactly at the end of the file. A file without one is truncated.
+	Complete bool `json:"complete"`
+}
+
+// KDFInfo describes the password-based key derivation of a file.
+type KDFInfo struct {
+	Algorithm string `json:"algorithm"`
+	Time      uint32 `json:"time"`
+	MemoryKiB uint32 `json:"memory_kib"`
+	Threads   uint8  `json:"threads"`
+
+	// Salt is the hex-encoded KDF salt.
+	Salt string `json:"salt"`
+}
+
+// Stanza is an optional header field.
+type Stanza struct {
+	Tag    uint8 `json:"tag"`
+	Length int   `json:"length"`
+}
+
+// InspectFile parses the header and record layout of an encrypted file
+// without deriving a key. Only the header, the length prefix of every
+// record and the records before the data are read.
+//
+// Args:
+//   - name: Path to the encrypted file
+//
+// Returns:
+//   - *Info: The settings and layout of the file
+//   - error: Any error that occurred while parsing the file
+func InspectFile(name string) (*Info, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return inspect(f, info.Size())
+}
+
+// inspect implements InspectFile on a file of the given size.
+func inspect(f io.ReaderAt, size int64) (*Info, error) {
+	sr := io.NewSectionReader(f, 0, size)
+	h, err := readHeader(sr)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &Info{
+		Version:   int(h.version),
+		Legacy:    h.legacy,
+		Cipher:    CipherAES256GCM,
+		ChunkSize: h.chunkSize,
+		KDF: KDFInfo{
+			Algorithm: "argon2id",
+			Time:      h.kdfParams.Time,
+			MemoryKiB: h.kdfParams.Memory,
+			Threads:   h.kdfParams.Threads,
+			Salt:      hex.EncodeToString(h.kdfSalt),
+		},
+		Metadata:  h.flags&flagMetadata != 0,
+		Archive:   h.flags&flagArchive != 0,
+		Integrity: h.flags&flagIntegrity != 0,
+		KeyCheck:  h.keyCheck != nil,
+		Stanzas:   []Stanza{},
+	}
+	if h.parityShards > 0 {
+		info.DataShards, info.ParityShards = h.dataShards, h.parityShards
+	}
+	for _, f := range h.optional {
+		info.Stanzas = append(info.Stanzas, Stanza{Tag: f.tag, Length: len(f.value)})
+	}
+
+	if info.Metadata {
+		if _, _, err := readRecord(sr, maxMetadataSize); err != nil {
+			return nil, fmt.Errorf("metadata: %w", recordError(-1, err))
+		}
+	}
+	if info.Integrity {
+		if _, _, err := readRecord(sr, integritySize+tagSize); err != nil {
+			return nil, fmt.Errorf("integrity record: %w", recordError(-1, err))
+		}
+	}
+
+	pos, err := sr.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	if h.legacy {
+		pos = saltSize
+	}
+
+	// The records of files with parity are interleaved with shards, so
+	// their layout follows from the size of the file alone; the length
+	// prefixes may be damaged beyond what the walk below can step over.
+	if h.parityShards > 0 {
+		chunks, plaintextSize, err := h.layout().records(size - pos)
+		if err == nil {
+			info.Chunks, info.PlaintextSize, info.Complete = chunks, plaintextSize, true
+		}
+		return info, nil
+	}
+
+	// Walk the length prefixes of the data records up to the first short
+	// chunk, which ends the stream.
+	var prefix [recordHeaderSize]byte
+	legacyValid := true
+	for pos < size {
+		if _, err := f.ReadAt(prefix[:], pos); err != nil {
+			break
+		}
+		ctLen := int64(binary.BigEndian.Uint32(prefix[nonceSize:]))
+		if ctLen < tagSize || ctLen > int64(h.chunkSize)+tagSize || pos+recordHeaderSize+ctLen > size {
+			break
+		}
+
+		info.Chunks++
+		info.PlaintextSize += ctLen - tagSize
+		pos += recordHeaderSize + ctLen
+		if ctLen-tagSize < int64(h.chunkSize) && !h.legacy {
+			info.Complete = pos == size
+			break
+		}
+		if ctLen == tagSize && h.legacy {
+			// Only an empty legacy file has an empty record, and
+			// nothing may follow it.
+			legacyValid = info.Chunks == 1
+			break
+		}
+	}
+
+	// Legacy files have no final chunk, so the best that can be said is
+	// that the records end exactly at the end of the file.
+	if h.legacy {
+		info.Complete = legacyValid && pos == size
+	}
+
+	return info, nil
+}
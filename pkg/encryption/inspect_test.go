@@ -0,0 +1,62 @@
+package encryption_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gigatar/file-encryptor/pkg/encryption"
+	"github.com/gigatar/file-encryptor/pkg/kdf"
+)
+
+// TestInspectFile verifies that InspectFile reports the layout of a file
+// without deriving a key, and notices a truncated file.
+func TestInspectFile(t *testing.T) {
+	// Save original GetKey function and restore it after the test
+	originalGetKey := kdf.GetKey
+	kdf.GetKey = mockGetKey
+	defer func() { kdf.GetKey = originalGetKey }()
+
+	tempDir := t.TempDir()
+	inputPath := filepath.Join(tempDir, "input.bin")
+	encryptedPath := filepath.Join(tempDir, "input.bin.enc")
+	if err := os.WriteFile(inputPath, make([]byte, 200*1024), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	if err := encryption.EncryptFile(inputPath, encryptedPath); err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+
+	// Inspecting must never ask for the password.
+	kdf.GetKey = func(salt []byte) ([]byte, error) {
+		return nil, errors.New("key derivation attempted")
+	}
+
+	info, err := encryption.InspectFile(encryptedPath)
+	if err != nil {
+		t.Fatalf("InspectFile() failed: %v", err)
+	}
+	if info.Version != 1 || info.KDF.Algorithm != "argon2id" || !info.Metadata || info.Archive || !info.KeyCheck {
+		t.Errorf("InspectFile() = %+v", info)
+	}
+	if info.Chunks != 4 || info.PlaintextSize != 200*1024 || !info.Complete {
+		t.Errorf("Chunks = %d, PlaintextSize = %d, Complete = %v; want 4, %d, true",
+			info.Chunks, info.PlaintextSize, info.Complete, 200*1024)
+	}
+
+	encrypted, err := os.ReadFile(encryptedPath)
+	if err != nil {
+		t.Fatalf("Failed to read encrypted file: %v", err)
+	}
+	if err := os.WriteFile(encryptedPath, encrypted[:len(encrypted)-9*1024], 0644); err != nil {
+		t.Fatalf("Failed to write truncated file: %v", err)
+	}
+	info, err = encryption.InspectFile(encryptedPath)
+	if err != nil {
+		t.Fatalf("InspectFile() of a truncated file failed: %v", err)
+	}
+	if info.Complete {
+		t.Error("InspectFile() reported a truncated file as complete")
+	}
+}
@@ -0,0 +1,154 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	"github.com/gigatar/file-encryptor/pkg/kdf"
+)
+
+// Key is a master key derived from a password, together with the Argon2id
+// salt it was derived with. It lets many files be encrypted after a single
+// password prompt and key derivation.
+//
+// Every file encrypted with a Key still gets its own random file salt, from
+// which a distinct payload key is derived with HKDF, so no two files share a
+// payload key. A Key is safe for concurrent use.
+type Key struct {
+	salt   []byte
+	key    []byte
+	params kdf.Params
+}
+
+// NewKey generates a fresh salt and derives a master key from it using
+// kdf.GetKey, which normally prompts for the password.
+//
+// Returns:
+//   - *Key: The derived master key
+//   - error: Any error that occurred during salt generation or key derivation
+func NewKey() (*Key, error) {
+	return keySource{}.newKey(rand.Reader)
+}
+
+// NewKeyFromPassword generates a fresh salt and derives a master key from
+// password, without consulting kdf.GetKey. It is used where a second
+// password is involved, such as when a file is rekeyed.
+//
+// Args:
+//   - password: The password to derive the master key from
+//
+// Returns:
+//   - *Key: The derived master key
+//   - error: Any error that occurred during salt generation
+func NewKeyFromPassword(password []byte) (*Key, error) {
+	salt, err := generateSalt()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Key{salt: salt, key: kdf.DeriveKey(password, salt), params: kdf.DefaultParams}, nil
+}
+
+// EncryptFile behaves like the package-level EncryptFile but uses k instead
+// of deriving a new key.
+func (k *Key) EncryptFile(inName, outName string) error {
+	return encryptFile(defaultConfig(), k, inName, outName, false)
+}
+
+// EncryptFileWithXattrs behaves like the package-level EncryptFileWithXattrs
+// but uses k instead of deriving a new key.
+func (k *Key) EncryptFileWithXattrs(inName, outName string) error {
+	return encryptFile(defaultConfig(), k, inName, outName, true)
+}
+
+// EncryptDir behaves like the package-level EncryptDir but uses k instead of
+// deriving a new key.
+func (k *Key) EncryptDir(inDir, outName string, exclude []string) error {
+	return encryptDir(defaultConfig(), k, inDir, outName, exclude)
+}
+
+// forHeader returns k if the file with header h was encrypted under it.
+func (k *Key) forHeader(h *header) ([]byte, error) {
+	if !bytes.Equal(k.salt, h.kdfSalt) || k.params != h.kdfParams {
+		return nil, fmt.Errorf("%w: file was not encrypted with this key", ErrWrongKey)
+	}
+
+	return k.key, nil
+}
+
+// keySource supplies the master keys of the files being encrypted and
+// decrypted. The zero value derives them with kdf.GetKey.
+type keySource struct {
+	// key, if set, encrypts every file and is the only key files are
+	// opened with.
+	key *Key
+
+	// derive, if set, derives keys from a password, using params for new
+	// files and the parameters recorded in the header of existing ones,
+	// as long as they do not exceed maxParams.
+	derive    kdf.DeriveKeyFunc
+	params    kdf.Params
+	maxParams kdf.Params
+
+	// getKey, if set, is used instead of kdf.GetKey.
+	getKey kdf.GetKeyFunc
+}
+
+// getKeyFunc returns the function that derives keys with the default
+// parameters. kdf.GetKey is read on every call so that replacing it takes
+// effect immediately.
+func (ks keySource) getKeyFunc() kdf.GetKeyFunc {
+	if ks.getKey != nil {
+		return ks.getKey
+	}
+
+	return kdf.GetKey
+}
+
+// newKey returns the key new files are encrypted under, deriving it from a
+// fresh salt read from rnd unless the source holds a Key.
+func (ks keySource) newKey(rnd io.Reader) (*Key, error) {
+	if ks.key != nil {
+		return ks.key, nil
+	}
+
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rnd, salt); err != nil {
+		return nil, err
+	}
+
+	if ks.derive != nil {
+		key, err := ks.derive(salt, ks.params)
+		if err != nil {
+			return nil, err
+		}
+		return &Key{salt: salt, key: key, params: ks.params}, nil
+	}
+
+	key, err := ks.getKeyFunc()(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Key{salt: salt, key: key, params: kdf.DefaultParams}, nil
+}
+
+// forHeader returns the master key for a file with header h.
+func (ks keySource) forHeader(h *header) ([]byte, error) {
+	switch {
+	case ks.key != nil:
+		return ks.key.forHeader(h)
+	case ks.derive != nil:
+		if p := h.kdfParams; p.Exceeds(ks.maxParams) {
+			return nil, fmt.Errorf("%w (time=%d, memory=%d KiB, threads=%d); raise Options.MaxKDF to open it", ErrKDFTooStrong, p.Time, p.Memory, p.Threads)
+		}
+		return ks.derive(h.kdfSalt, h.kdfParams)
+	case h.kdfParams != kdf.DefaultParams:
+		p := h.kdfParams
+		return nil, fmt.Errorf("file uses custom KDF parameters (time=%d, memory=%d KiB, threads=%d); open it with Options.Password", p.Time, p.Memory, p.Threads)
+	}
+
+	return ks.getKeyFunc()(h.kdfSalt)
+}
@@ -0,0 +1,207 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gigatar/file-encryptor/pkg/kdf"
+)
+
+// The legacy format is the headerless layout written before the versioned
+// header was introduced:
+//
+//	[salt (16 bytes)][nonce (12 bytes)][length (4 bytes)][ciphertext]...
+//
+// The AES-256-GCM key is derived from the password and salt with Argon2id
+// and used directly, and the records carry no associated data. Nothing marks
+// the last record, so a legacy file that was cut off at a record boundary
+// cannot be told apart from a complete one. Legacy files can be decrypted
+// and verified as a whole, and MigrateFile converts them to the current
+// format; they cannot be read at random offsets or appended to.
+
+// legacyParams are the Argon2id parameters that legacy files were written
+// with. They are fixed, since the legacy layout does not record them.
+var legacyParams = kdf.Params{Time: 3, Memory: 64 * 1024, Threads: 1}
+
+// legacyVersion is the format version reported for legacy files.
+const legacyVersion = 0
+
+// errLegacyAccess reports an attempt to use a legacy file other than by
+// reading it from start to end.
+var errLegacyAccess = errors.New("files in the legacy format can only be decrypted as a whole; migrate them first")
+
+// readLegacyHeader parses the start of a file that lacks the magic of the
+// current format. fixed holds the bytes already read. It returns
+// ErrNotEncrypted unless the file starts with a salt followed by a record
+// of plausible length. The record prefix that had to be read ahead is kept
+// in the header to be read again.
+func readLegacyHeader(fixed []byte, r io.Reader) (*header, error) {
+	buf := make([]byte, saltSize+recordHeaderSize)
+	n := copy(buf, fixed)
+	if _, err := io.ReadFull(r, buf[n:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrNotEncrypted
+		}
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+
+	ctLen := binary.BigEndian.Uint32(buf[saltSize+nonceSize:])
+	if ctLen < tagSize || ctLen > defaultChunkSize+tagSize {
+		return nil, ErrNotEncrypted
+	}
+
+	return &header{
+		version:   legacyVersion,
+		legacy:    true,
+		kdfSalt:   buf[:saltSize],
+		kdfParams: legacyParams,
+		chunkSize: defaultChunkSize,
+		readAhead: buf[saltSize:],
+	}, nil
+}
+
+// nextLegacyRecord reads the next record of a legacy file. The stream ends
+// at the first record boundary after at least one record where no more data
+// follows. Legacy writers only produced an empty record for an empty file,
+// so an empty record must be the only one.
+func (d *Reader) nextLegacyRecord() (*chunk, error) {
+	nonce, ct, err := readRecord(d.r, d.header.chunkSize+tagSize)
+	if err == io.EOF && d.index > 0 {
+		d.final = true
+		return nil, nil
+	}
+	if err != nil {
+		return nil, recordError(int(d.index), err)
+	}
+
+	c := &chunk{index: d.index, nonce: nonce, data: ct}
+	d.index++
+
+	if len(ct) == tagSize {
+		if c.index > 0 {
+			return nil, recordError(int(c.index), errEmptyChunk)
+		}
+		if err := d.checkEnd(); err != nil {
+			return nil, recordError(int(c.index), errEmptyChunk)
+		}
+		d.final = true
+	}
+
+	return c, nil
+}
+
+// rejectLegacy returns errLegacyAccess if f holds a legacy file, and the
+// error of readHeader if it does not hold an encrypted file at all. It is
+// called before a key is derived for random access.
+func rejectLegacy(f io.ReaderAt, size int64) error {
+	h, err := readHeader(io.NewSectionReader(f, 0, size))
+	if err != nil {
+		return err
+	}
+	if h.legacy {
+		return errLegacyAccess
+	}
+
+	return nil
+}
+
+// MigrateFile re-encrypts a file in the legacy headerless format into the
+// current format. The master key is derived once, with kdf.GetKey, and
+// reused with the legacy salt, so the result opens with the same password;
+// it still gets a fresh file salt, payload key and nonces.
+//
+// The result is written under a temporary name, then decrypted again and
+// compared with the plaintext of the original. Only if they match does it
+// replace outName, which may be the same as inName. UnsafeStreaming is not
+// supported.
+//
+// Args:
+//   - inName: Path to the legacy file
+//   - outName: Path where the migrated file will be written
+//
+// Returns:
+//   - error: An error if the input is not a legacy file, does not decrypt
+//     or the result does not verify
+func MigrateFile(inName, outName string) error {
+	return migrateFile(defaultConfig(), inName, outName)
+}
+
+// migrateFile implements MigrateFile. Progress is reported as the input is
+// read.
+func migrateFile(cfg streamConfig, inName, outName string) error {
+	if cfg.unsafeStreaming {
+		return errors.New("migration always writes through a temporary file and cannot stream")
+	}
+
+	inFile, err := os.Open(inName)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+
+	dec, err := openFileReader(inFile, cfg)
+	if err != nil {
+		return err
+	}
+	if !dec.header.legacy {
+		return fmt.Errorf("%s is already in the current format", inName)
+	}
+
+	outFile, err := cfg.createOutput(outName)
+	if err != nil {
+		return err
+	}
+	defer outFile.abort()
+
+	cfg.progress = nil
+	w, err := newWriter(outFile, dec.key, nil, 0, cfg)
+	if err != nil {
+		return err
+	}
+	want := sha256.New()
+	if _, err := io.Copy(w, io.TeeReader(dec, want)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	if err := verifyMigrated(cfg, outFile.File, dec.key, want.Sum(nil)); err != nil {
+		return fmt.Errorf("verifying migrated file: %w", err)
+	}
+
+	return outFile.commit()
+}
+
+// verifyMigrated decrypts the migrated file f with key and checks that its
+// plaintext has the SHA-256 digest want.
+func verifyMigrated(cfg streamConfig, f *os.File, key *Key, want []byte) error {
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	cfg.keys = keySource{key: key}
+	dec, err := newReader(io.NewSectionReader(f, 0, size), cfg)
+	if err != nil {
+		return err
+	}
+	if dec.header.legacy {
+		return errors.New("the result is not in the current format")
+	}
+
+	got := sha256.New()
+	if _, err := io.Copy(got, dec); err != nil {
+		return err
+	}
+	if !bytes.Equal(got.Sum(nil), want) {
+		return errors.New("the plaintext does not match the original")
+	}
+
+	return nil
+}
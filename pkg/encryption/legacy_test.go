@@ -0,0 +1,151 @@
+package encryption_test
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gigatar/file-encryptor/pkg/encryption"
+	"github.com/gigatar/file-encryptor/pkg/kdf"
+)
+
+// writeLegacyFile writes plaintext in the legacy headerless format, as the
+// first versions of EncryptFile did, with the key from mockGetKey.
+func writeLegacyFile(t *testing.T, name string, plaintext []byte) {
+	t.Helper()
+
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	key, _ := mockGetKey(salt)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := append([]byte{}, salt...)
+	for first := true; first || len(plaintext) > 0; first = false {
+		n := min(len(plaintext), 64*1024)
+		nonce := make([]byte, 12)
+		rand.Read(nonce)
+		ct := gcm.Seal(nil, nonce, plaintext[:n], nil)
+		out = append(out, nonce...)
+		out = binary.BigEndian.AppendUint32(out, uint32(len(ct)))
+		out = append(out, ct...)
+		plaintext = plaintext[n:]
+	}
+
+	if err := os.WriteFile(name, out, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestLegacyDecrypt verifies that files in the legacy headerless format are
+// detected and decrypted, and that they are refused for random access.
+func TestLegacyDecrypt(t *testing.T) {
+	// Save original GetKey function and restore it after the test
+	originalGetKey := kdf.GetKey
+	kdf.GetKey = mockGetKey
+	defer func() { kdf.GetKey = originalGetKey }()
+
+	dir := t.TempDir()
+	plaintext := bytes.Repeat([]byte("legacy format "), 12000)
+	legacyPath := filepath.Join(dir, "old.enc")
+	writeLegacyFile(t, legacyPath, plaintext)
+
+	decryptedPath := filepath.Join(dir, "old.txt")
+	if err := encryption.DecryptFile(legacyPath, decryptedPath); err != nil {
+		t.Fatalf("DecryptFile() failed: %v", err)
+	}
+	if got, _ := os.ReadFile(decryptedPath); !bytes.Equal(got, plaintext) {
+		t.Error("Decrypted legacy content does not match original")
+	}
+	if err := encryption.VerifyFile(legacyPath); err != nil {
+		t.Errorf("VerifyFile() failed: %v", err)
+	}
+
+	info, err := encryption.InspectFile(legacyPath)
+	if err != nil {
+		t.Fatalf("InspectFile() failed: %v", err)
+	}
+	if !info.Legacy || info.Version != 0 || info.PlaintextSize != int64(len(plaintext)) || !info.Complete {
+		t.Errorf("InspectFile() = %+v, want a complete legacy file", info)
+	}
+
+	if err := encryption.DecryptRange(legacyPath, filepath.Join(dir, "range"), 0, 10); err == nil {
+		t.Error("DecryptRange() of a legacy file succeeded, want an error")
+	}
+
+	data, _ := os.ReadFile(legacyPath)
+	truncatedPath := filepath.Join(dir, "truncated.enc")
+	os.WriteFile(truncatedPath, data[:len(data)-100], 0600)
+	if err := encryption.VerifyFile(truncatedPath); !errors.Is(err, encryption.ErrTruncated) {
+		t.Errorf("VerifyFile() of a truncated legacy file returned %v, want ErrTruncated", err)
+	}
+
+	kdf.GetKey = func(salt []byte) ([]byte, error) {
+		return bytes.Repeat([]byte{1}, 32), nil
+	}
+	if err := encryption.VerifyFile(legacyPath); !errors.Is(err, encryption.ErrWrongKey) {
+		t.Errorf("VerifyFile() with the wrong key returned %v, want ErrWrongKey", err)
+	}
+}
+
+// TestMigrateFile verifies that a legacy file is migrated in place into the
+// current format under the same password, and that current files are refused.
+func TestMigrateFile(t *testing.T) {
+	// Save original GetKey function and restore it after the test
+	originalGetKey := kdf.GetKey
+	kdf.GetKey = mockGetKey
+	defer func() { kdf.GetKey = originalGetKey }()
+
+	dir := t.TempDir()
+	for _, size := range []int{0, 1000, 3*64*1024 + 17} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+		path := filepath.Join(dir, "file.enc")
+		writeLegacyFile(t, path, plaintext)
+
+		if err := encryption.MigrateFile(path, path); err != nil {
+			t.Fatalf("MigrateFile() failed for %d bytes: %v", size, err)
+		}
+
+		info, err := encryption.InspectFile(path)
+		if err != nil {
+			t.Fatalf("InspectFile() failed: %v", err)
+		}
+		if info.Legacy || info.Version != 1 {
+			t.Errorf("Migrated file has version %d, legacy %v", info.Version, info.Legacy)
+		}
+
+		var decrypted bytes.Buffer
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = encryption.DecryptStream(&decrypted, f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("DecryptStream() of the migrated file failed: %v", err)
+		}
+		if !bytes.Equal(decrypted.Bytes(), plaintext) {
+			t.Errorf("Migrated content of %d bytes does not match original", size)
+		}
+
+		if err := encryption.MigrateFile(path, path); err == nil {
+			t.Error("MigrateFile() of a current file succeeded, want an error")
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+			t.Errorf("Migration left %d extra files behind", len(entries)-1)
+		}
+	}
+}
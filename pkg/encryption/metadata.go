@@ -0,0 +1,200 @@
+package encryption
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Metadata describes the original file an encrypted file was made from.
+// It is stored in an encrypted record ahead of the file contents so that
+// neither the name nor the attributes of the file leak.
+type Metadata struct {
+	// Name is the base name of the original file.
+	Name string
+
+	// Mode holds the permission bits of the original file.
+	Mode fs.FileMode
+
+	// ModTime is the modification time of the original file.
+	ModTime time.Time
+
+	// Xattrs holds the extended attributes of the original file, if
+	// they were requested when encrypting.
+	Xattrs map[string][]byte
+}
+
+// metadataVersion is the encoding version of the metadata record.
+const metadataVersion = 1
+
+// statMetadata builds the Metadata for the open file f. Extended attributes
+// are only collected when withXattrs is true.
+func statMetadata(f *os.File, withXattrs bool) (*Metadata, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &Metadata{
+		Name:    info.Name(),
+		Mode:    info.Mode().Perm(),
+		ModTime: info.ModTime(),
+	}
+
+	if withXattrs {
+		xattrs, err := readXattrs(f)
+		if err != nil {
+			return nil, fmt.Errorf("reading extended attributes: %w", err)
+		}
+		meta.Xattrs = xattrs
+	}
+
+	return meta, nil
+}
+
+// marshal encodes the metadata as:
+//
+//	[version u8][name length u16][name][mode u32][mtime unix nanoseconds i64]
+//	[xattr count u16]([key length u16][key][value length u32][value])...
+func (m *Metadata) marshal() ([]byte, error) {
+	if len(m.Name) > 0xffff {
+		return nil, errors.New("file name too long")
+	}
+	if len(m.Xattrs) > 0xffff {
+		return nil, errors.New("too many extended attributes")
+	}
+
+	buf := []byte{metadataVersion}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(m.Name)))
+	buf = append(buf, m.Name...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(m.Mode))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(m.ModTime.UnixNano()))
+
+	// Sort keys so that the encoding is deterministic.
+	keys := make([]string, 0, len(m.Xattrs))
+	for k := range m.Xattrs {
+		if len(k) > 0xffff {
+			return nil, errors.New("extended attribute name too long")
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(keys)))
+	for _, k := range keys {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(k)))
+		buf = append(buf, k...)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(m.Xattrs[k])))
+		buf = append(buf, m.Xattrs[k]...)
+	}
+
+	if len(buf)+tagSize > maxMetadataSize {
+		return nil, errors.New("metadata too large")
+	}
+
+	return buf, nil
+}
+
+// unmarshalMetadata decodes a metadata record produced by marshal.
+func unmarshalMetadata(b []byte) (*Metadata, error) {
+	errMalformed := errors.New("malformed metadata")
+
+	take := func(n int) ([]byte, bool) {
+		if len(b) < n {
+			return nil, false
+		}
+		v := b[:n]
+		b = b[n:]
+		return v, true
+	}
+
+	v, ok := take(1)
+	if !ok {
+		return nil, errMalformed
+	}
+	if v[0] != metadataVersion {
+		return nil, fmt.Errorf("unsupported metadata version %d", v[0])
+	}
+
+	v, ok = take(2)
+	if !ok {
+		return nil, errMalformed
+	}
+	name, ok := take(int(binary.BigEndian.Uint16(v)))
+	if !ok {
+		return nil, errMalformed
+	}
+
+	fixed, ok := take(4 + 8 + 2)
+	if !ok {
+		return nil, errMalformed
+	}
+
+	meta := &Metadata{
+		Name:    string(name),
+		Mode:    fs.FileMode(binary.BigEndian.Uint32(fixed[0:4])).Perm(),
+		ModTime: time.Unix(0, int64(binary.BigEndian.Uint64(fixed[4:12]))),
+	}
+
+	count := int(binary.BigEndian.Uint16(fixed[12:14]))
+	if count > 0 {
+		meta.Xattrs = make(map[string][]byte, count)
+	}
+	for i := 0; i < count; i++ {
+		if v, ok = take(2); !ok {
+			return nil, errMalformed
+		}
+		key, ok := take(int(binary.BigEndian.Uint16(v)))
+		if !ok {
+			return nil, errMalformed
+		}
+		if v, ok = take(4); !ok {
+			return nil, errMalformed
+		}
+		value, ok := take(int(binary.BigEndian.Uint32(v)))
+		if !ok {
+			return nil, errMalformed
+		}
+		meta.Xattrs[string(key)] = append([]byte(nil), value...)
+	}
+
+	if len(b) != 0 {
+		return nil, errMalformed
+	}
+
+	return meta, nil
+}
+
+// safeName validates a file name taken from metadata. Only a single, local
+// path element is accepted so that restoring a file can never escape the
+// target directory.
+func safeName(name string) error {
+	if name == "" || name == "." || name == ".." ||
+		filepath.Base(name) != name || !filepath.IsLocal(name) {
+		return fmt.Errorf("unsafe file name %q in metadata", name)
+	}
+
+	return nil
+}
+
+// applyMetadata restores the mode and extended attributes recorded in meta
+// onto the open file f. The modification time is restored separately once
+// the file has been written and closed.
+func applyMetadata(f *os.File, meta *Metadata) error {
+	if err := f.Chmod(meta.Mode); err != nil {
+		return err
+	}
+
+	if len(meta.Xattrs) > 0 {
+		if err := writeXattrs(f, meta.Xattrs); err != nil {
+			return fmt.Errorf("restoring extended attributes: %w", err)
+		}
+	}
+
+	return nil
+}
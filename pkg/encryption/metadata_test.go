@@ -0,0 +1,70 @@
+package encryption
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// TestMetadataRoundTrip verifies that metadata survives marshalling.
+func TestMetadataRoundTrip(t *testing.T) {
+	meta := &Metadata{
+		Name:    "notes.txt",
+		Mode:    0600,
+		ModTime: time.Unix(1700000000, 123456789),
+		Xattrs: map[string][]byte{
+			"user.origin": []byte("laptop"),
+			"user.empty":  {},
+		},
+	}
+
+	b, err := meta.marshal()
+	if err != nil {
+		t.Fatalf("marshal() error = %v", err)
+	}
+
+	got, err := unmarshalMetadata(b)
+	if err != nil {
+		t.Fatalf("unmarshalMetadata() error = %v", err)
+	}
+
+	if got.Name != meta.Name || got.Mode != meta.Mode || !got.ModTime.Equal(meta.ModTime) {
+		t.Errorf("unmarshalMetadata() = %+v, want %+v", got, meta)
+	}
+	for k, v := range meta.Xattrs {
+		if !bytes.Equal(got.Xattrs[k], v) {
+			t.Errorf("xattr %q = %q, want %q", k, got.Xattrs[k], v)
+		}
+	}
+
+	// Every truncation of a valid record must be rejected
+	for i := 0; i < len(b); i++ {
+		if _, err := unmarshalMetadata(b[:i]); err == nil {
+			t.Errorf("unmarshalMetadata() accepted record truncated to %d bytes", i)
+		}
+	}
+}
+
+// TestSafeName verifies that names which could escape the target directory
+// are rejected.
+func TestSafeName(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{name: "file.txt", wantErr: false},
+		{name: ".hidden", wantErr: false},
+		{name: "", wantErr: true},
+		{name: ".", wantErr: true},
+		{name: "..", wantErr: true},
+		{name: "../escape", wantErr: true},
+		{name: "dir/file", wantErr: true},
+		{name: "/etc/passwd", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		if err := safeName(tt.name); (err != nil) != tt.wantErr {
+			t.Errorf("safeName(%q) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// UnsafeStreaming makes the package-level functions write their output
+// directly to its final path as it is produced, instead of to a temporary
+// file that is renamed into place once the operation has succeeded. It is
+// needed to write to pipes and devices, at the cost of leaving partial
+// output behind when an operation fails. Encryptors built while it is set
+// stream as well.
+//
+// Deprecated: Set Options.UnsafeStreaming on an Encryptor instead, which
+// does not affect other users of the package.
+var UnsafeStreaming = false
+
+// tempFiles records the temporary outputs that are still being written, so
+// that RemoveTempFiles can clean them up when the program is interrupted.
+var tempFiles = struct {
+	sync.Mutex
+	paths map[string]struct{}
+}{paths: make(map[string]struct{})}
+
+// addTemp records a temporary output.
+func addTemp(path string) {
+	tempFiles.Lock()
+	defer tempFiles.Unlock()
+
+	tempFiles.paths[path] = struct{}{}
+}
+
+// removeTemp removes a temporary output and forgets it.
+func removeTemp(path string) {
+	os.RemoveAll(path)
+	forgetTemp(path)
+}
+
+// forgetTemp forgets a temporary output that has been moved into place.
+func forgetTemp(path string) {
+	tempFiles.Lock()
+	defer tempFiles.Unlock()
+
+	delete(tempFiles.paths, path)
+}
+
+// RemoveTempFiles removes the temporary outputs of every operation still in
+// progress. It is meant to be called from a signal handler just before the
+// program exits, so that an interrupted operation leaves nothing behind.
+func RemoveTempFiles() {
+	tempFiles.Lock()
+	defer tempFiles.Unlock()
+
+	for path := range tempFiles.paths {
+		os.RemoveAll(path)
+		delete(tempFiles.paths, path)
+	}
+}
+
+// tempName returns a hidden, random name for a temporary output next to name.
+func tempName(name string) (string, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+
+	return "." + name + ".tmp-" + hex.EncodeToString(suffix), nil
+}
+
+// output is a file being written by one of the package-level functions.
+// Unless unsafe streaming is selected it is a temporary file in the target
+// directory that only replaces the target when commit is called.
+type output struct {
+	*os.File
+
+	// name is the final path of the output.
+	name string
+
+	// temp is set when the file is written under a temporary name.
+	temp bool
+}
+
+// createOutput creates the output file for name.
+func (cfg *streamConfig) createOutput(name string) (*output, error) {
+	if cfg.unsafeStreaming {
+		f, err := os.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		return &output{File: f, name: name}, nil
+	}
+
+	if info, err := os.Stat(name); err == nil && !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file; use unsafe streaming to write to it directly", name)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	addTemp(f.Name())
+
+	return &output{File: f, name: name, temp: true}, nil
+}
+
+// commit flushes the output to stable storage and moves it into place.
+func (o *output) commit() error {
+	if !o.temp {
+		return o.Close()
+	}
+
+	if err := o.Sync(); err != nil {
+		o.abort()
+		return err
+	}
+	if err := o.Close(); err != nil {
+		o.abort()
+		return err
+	}
+	if err := os.Rename(o.Name(), o.name); err != nil {
+		o.abort()
+		return err
+	}
+	forgetTemp(o.Name())
+	o.temp = false
+	syncDir(filepath.Dir(o.name))
+
+	return nil
+}
+
+// abort discards the output unless it has been committed. It is safe to
+// call after commit, so that it can be deferred.
+func (o *output) abort() {
+	o.Close()
+	if o.temp {
+		removeTemp(o.Name())
+		o.temp = false
+	}
+}
+
+// createOutputDir creates a temporary directory to extract an archive into
+// before it is moved to name. With unsafe streaming, name itself is created
+// if needed and returned.
+func (cfg *streamConfig) createOutputDir(name string) (string, error) {
+	if cfg.unsafeStreaming {
+		if err := os.Mkdir(name, 0700); err != nil && !errors.Is(err, fs.ErrExist) {
+			return "", err
+		}
+		return name, nil
+	}
+
+	tmp, err := os.MkdirTemp(filepath.Dir(name), "."+filepath.Base(name)+".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	addTemp(tmp)
+
+	return tmp, nil
+}
+
+// commitDir moves a directory created by createOutputDir to name. An
+// existing empty directory at name is replaced.
+func commitDir(tmp, name string) error {
+	if tmp == name {
+		return nil
+	}
+
+	if err := os.Rename(tmp, name); err != nil {
+		removeTemp(tmp)
+		return err
+	}
+	forgetTemp(tmp)
+	syncDir(filepath.Dir(name))
+
+	return nil
+}
+
+// placeNew moves the temporary entry tmp inside dir to name without ever
+// replacing an existing entry.
+func placeNew(dir, tmp, name string) error {
+	oldPath, newPath := filepath.Join(dir, tmp), filepath.Join(dir, name)
+
+	// A hard link fails if the target exists, which makes the check and
+	// the move a single step. Directories, and file systems without hard
+	// links, fall back to a check followed by a rename.
+	if err := os.Link(oldPath, newPath); err == nil {
+		return os.Remove(oldPath)
+	} else if errors.Is(err, fs.ErrExist) {
+		return err
+	}
+
+	if _, err := os.Lstat(newPath); err == nil {
+		return &fs.PathError{Op: "rename", Path: newPath, Err: fs.ErrExist}
+	}
+
+	return os.Rename(oldPath, newPath)
+}
+
+// syncDir flushes a directory so that a rename inside it is durable. Not
+// every platform supports this, so errors are ignored.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+
+	d.Sync()
+}
@@ -0,0 +1,204 @@
+package encryption
+
+import (
+	"io"
+	"sync"
+)
+
+// chunk is a unit of work flowing through a pipeline.
+type chunk struct {
+	index uint64
+	final bool
+	nonce []byte
+
+	// data holds the input of the work function and is replaced by its output.
+	data []byte
+	err  error
+	done chan struct{}
+}
+
+// pipeline processes a stream of chunks on several goroutines while keeping
+// their order:
+//
+//	next (one goroutine) -> work (jobs goroutines) -> emit (calling goroutine)
+//
+// next is called sequentially and returns nil once the stream is exhausted.
+// work transforms a chunk in place and may run concurrently with itself.
+// emit receives the chunks in the order next produced them. At most jobs
+// chunks wait between next and emit, which bounds memory use.
+//
+// The first error from work or emit stops the pipeline and is returned. An
+// error from next is returned once every chunk produced before it has been
+// emitted.
+func pipeline(jobs int, next func() (*chunk, error), work func(*chunk), emit func(*chunk) error) error {
+	quit := make(chan struct{})
+	todo := make(chan *chunk)
+	order := make(chan *chunk, jobs)
+
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range todo {
+				work(c)
+				close(c.done)
+			}
+		}()
+	}
+
+	var nextErr error
+	go func() {
+		defer close(order)
+		defer close(todo)
+		for {
+			c, err := next()
+			if err != nil {
+				nextErr = err
+				return
+			}
+			if c == nil {
+				return
+			}
+			c.done = make(chan struct{})
+
+			select {
+			case order <- c:
+			case <-quit:
+				return
+			}
+			select {
+			case todo <- c:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	var err error
+	for c := range order {
+		if err != nil {
+			// Drain the queue so that the producer can observe quit.
+			continue
+		}
+
+		<-c.done
+		if c.err == nil {
+			c.err = emit(c)
+		}
+		if c.err != nil {
+			err = c.err
+			close(quit)
+		}
+	}
+	wg.Wait()
+
+	if err == nil {
+		err = nextErr
+	}
+
+	return err
+}
+
+// forEach calls fn for every chunk on at most jobs goroutines and waits for
+// all of them to finish.
+func forEach(chunks []*chunk, jobs int, fn func(*chunk)) {
+	if jobs < 2 || len(chunks) < 2 {
+		for _, c := range chunks {
+			fn(c)
+		}
+		return
+	}
+
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for _, c := range chunks {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(c *chunk) {
+			defer wg.Done()
+			fn(c)
+			<-sem
+		}(c)
+	}
+	wg.Wait()
+}
+
+// readFromParallel is the pipelined form of ReadFrom. It seals whole chunks
+// read from r until EOF and leaves a trailing partial chunk in the buffer
+// for Close. Nonces are drawn in chunk order by the reading goroutine, so
+// the output is identical to that of the serial path for the same random
+// source.
+func (w *Writer) readFromParallel(r io.Reader) (int64, error) {
+	pool := sync.Pool{New: func() any { return make([]byte, w.chunkSize) }}
+	var n int64
+
+	next := func() (*chunk, error) {
+		if err := w.canceled(); err != nil {
+			return nil, err
+		}
+
+		buf := pool.Get().([]byte)
+		m, err := io.ReadFull(r, buf)
+		n += int64(m)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			w.buf = append(w.buf[:0], buf[:m]...)
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		nonce, err := newNonce(w.rand)
+		if err != nil {
+			return nil, err
+		}
+
+		c := &chunk{index: w.index, nonce: nonce, data: buf}
+		w.index++
+
+		return c, nil
+	}
+
+	work := func(c *chunk) {
+		pt := c.data
+		c.data = w.sealer.seal(recordData, c.index, c.final, c.nonce, pt)
+		pool.Put(pt)
+	}
+
+	err := pipeline(w.jobs, next, work, w.emit)
+
+	return n, err
+}
+
+// writeToParallel is the pipelined form of WriteTo. Records are read in
+// order by a single goroutine and authenticated concurrently; plaintext is
+// written in order and never past the first chunk that fails.
+func (d *Reader) writeToParallel(w io.Writer) (int64, error) {
+	var n int64
+
+	next := func() (*chunk, error) {
+		if d.final {
+			return nil, nil
+		}
+		return d.nextRecord()
+	}
+
+	work := func(c *chunk) {
+		c.data, c.err = d.open(c)
+	}
+
+	emit := func(c *chunk) error {
+		m, err := w.Write(c.data)
+		n += int64(m)
+		if err != nil {
+			return err
+		}
+		d.advance(m)
+		return nil
+	}
+
+	err := pipeline(d.jobs, next, work, emit)
+
+	return n, err
+}
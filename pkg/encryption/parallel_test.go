@@ -0,0 +1,232 @@
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/gigatar/file-encryptor/pkg/kdf"
+)
+
+// testKey is a fixed master key for internal tests.
+var testKey = &Key{salt: make([]byte, saltSize), key: make([]byte, 32), params: kdf.DefaultParams}
+
+// seededConfig returns a configuration whose random source is deterministic.
+func seededConfig(jobs int) streamConfig {
+	return streamConfig{rand: rand.NewChaCha8([32]byte{1}), jobs: jobs}
+}
+
+// encryptBytes encrypts pt with the given configuration.
+func encryptBytes(t testing.TB, pt []byte, cfg streamConfig) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := newWriter(&buf, testKey, nil, 0, cfg)
+	if err != nil {
+		t.Fatalf("newWriter() error = %v", err)
+	}
+	if _, err := w.ReadFrom(bytes.NewReader(pt)); err != nil {
+		t.Fatalf("ReadFrom() error = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	return buf.Bytes()
+}
+
+// decryptBytes decrypts ct with the given configuration.
+func decryptBytes(ct []byte, cfg streamConfig) ([]byte, error) {
+	r, err := newReader(bytes.NewReader(ct), cfg)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	_, err = r.WriteTo(&buf)
+	return buf.Bytes(), err
+}
+
+// withTestKey makes kdf.GetKey return the master key of testKey.
+func withTestKey(t testing.TB) {
+	t.Helper()
+	original := kdf.GetKey
+	kdf.GetKey = func(salt []byte) ([]byte, error) { return testKey.key, nil }
+	t.Cleanup(func() { kdf.GetKey = original })
+}
+
+// TestParallelMatchesSerial verifies that the pipelined encoder produces
+// byte-identical output to the serial one, and that both decoders agree.
+func TestParallelMatchesSerial(t *testing.T) {
+	withTestKey(t)
+
+	for _, size := range []int{0, 1, defaultChunkSize - 1, defaultChunkSize, 5*defaultChunkSize + 123} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			pt := make([]byte, size)
+			rand.NewChaCha8([32]byte{2}).Read(pt)
+
+			serial := encryptBytes(t, pt, seededConfig(1))
+			parallel := encryptBytes(t, pt, seededConfig(4))
+			if !bytes.Equal(serial, parallel) {
+				t.Fatal("parallel output differs from serial output")
+			}
+
+			for _, jobs := range []int{1, 4} {
+				got, err := decryptBytes(parallel, seededConfig(jobs))
+				if err != nil {
+					t.Fatalf("jobs=%d: decrypt error = %v", jobs, err)
+				}
+				if !bytes.Equal(got, pt) {
+					t.Fatalf("jobs=%d: decrypted data does not match", jobs)
+				}
+			}
+		})
+	}
+}
+
+// TestWritePathMatchesReadFrom verifies that small writes through Write and
+// small reads through Read produce and accept the same stream as the bulk
+// ReadFrom and WriteTo paths.
+func TestWritePathMatchesReadFrom(t *testing.T) {
+	withTestKey(t)
+
+	pt := make([]byte, 3*defaultChunkSize+500)
+	rand.NewChaCha8([32]byte{3}).Read(pt)
+	want := encryptBytes(t, pt, seededConfig(1))
+
+	for _, jobs := range []int{1, 3} {
+		var buf bytes.Buffer
+		w, err := newWriter(&buf, testKey, nil, 0, seededConfig(jobs))
+		if err != nil {
+			t.Fatalf("newWriter() error = %v", err)
+		}
+		for rest := pt; len(rest) > 0; {
+			n := min(len(rest), 1000)
+			if _, err := w.Write(rest[:n]); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			rest = rest[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close() error = %v", err)
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("jobs=%d: Write output differs from ReadFrom output", jobs)
+		}
+
+		r, err := newReader(bytes.NewReader(want), seededConfig(jobs))
+		if err != nil {
+			t.Fatalf("newReader() error = %v", err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("jobs=%d: ReadAll() error = %v", jobs, err)
+		}
+		if !bytes.Equal(got, pt) {
+			t.Errorf("jobs=%d: Read output does not match", jobs)
+		}
+	}
+}
+
+// TestParallelStopsAtBadChunk verifies that the parallel decoder reports the
+// first corrupted chunk and writes nothing beyond it.
+func TestParallelStopsAtBadChunk(t *testing.T) {
+	withTestKey(t)
+
+	pt := make([]byte, 8*defaultChunkSize)
+	ct := encryptBytes(t, pt, seededConfig(1))
+
+	// Corrupt the ciphertext of chunk 3
+	hdrLen := len(encryptBytes(t, nil, seededConfig(1))) - (recordHeaderSize + tagSize)
+	ct[hdrLen+3*(recordHeaderSize+defaultChunkSize+tagSize)+recordHeaderSize] ^= 1
+
+	got, err := decryptBytes(ct, seededConfig(4))
+	if err == nil {
+		t.Fatal("decrypt accepted a corrupted chunk")
+	}
+	var corrupted *ErrCorrupted
+	if !errors.As(err, &corrupted) || corrupted.Chunk != 3 {
+		t.Errorf("error = %v, want ErrCorrupted for chunk 3", err)
+	}
+	if len(got) != 3*defaultChunkSize {
+		t.Errorf("wrote %d bytes before the bad chunk, want %d", len(got), 3*defaultChunkSize)
+	}
+}
+
+// benchmarkSize is the plaintext size used by the throughput benchmarks.
+const benchmarkSize = 64 << 20
+
+// BenchmarkEncrypt measures encryption throughput with and without the
+// chunk pipeline.
+func BenchmarkEncrypt(b *testing.B) {
+	pt := make([]byte, benchmarkSize)
+	for _, jobs := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) {
+			b.SetBytes(benchmarkSize)
+			for i := 0; i < b.N; i++ {
+				w, err := newWriter(io.Discard, testKey, nil, 0, seededConfig(jobs))
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := w.ReadFrom(bytes.NewReader(pt)); err != nil {
+					b.Fatal(err)
+				}
+				if err := w.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDecrypt measures decryption throughput with and without the
+// chunk pipeline.
+func BenchmarkDecrypt(b *testing.B) {
+	withTestKey(b)
+	ct := encryptBytes(b, make([]byte, benchmarkSize), seededConfig(1))
+	for _, jobs := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) {
+			b.SetBytes(benchmarkSize)
+			for i := 0; i < b.N; i++ {
+				r, err := newReader(bytes.NewReader(ct), seededConfig(jobs))
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := r.WriteTo(io.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkChunkSize measures how the chunk size trades throughput against
+// the per-chunk overhead of nonces, length prefixes and tags, which is
+// reported as a percentage of the plaintext size.
+func BenchmarkChunkSize(b *testing.B) {
+	withTestKey(b)
+	pt := make([]byte, benchmarkSize)
+	for _, size := range []int{minChunkSize, 16 << 10, defaultChunkSize, 1 << 20, 4 << 20} {
+		cfg := seededConfig(4)
+		cfg.chunkSize = size
+		ct := encryptBytes(b, pt, cfg)
+		overhead := float64(len(ct)-len(pt)) / float64(len(pt)) * 100
+
+		b.Run(fmt.Sprintf("encrypt/chunk=%dK", size>>10), func(b *testing.B) {
+			b.SetBytes(benchmarkSize)
+			b.ReportMetric(overhead, "%overhead")
+			for i := 0; i < b.N; i++ {
+				encryptBytes(b, pt, cfg)
+			}
+		})
+		b.Run(fmt.Sprintf("decrypt/chunk=%dK", size>>10), func(b *testing.B) {
+			b.SetBytes(benchmarkSize)
+			b.ReportMetric(overhead, "%overhead")
+			for i := 0; i < b.N; i++ {
+				if _, err := decryptBytes(ct, seededConfig(4)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
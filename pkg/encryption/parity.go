@@ -0,0 +1,326 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/gigatar/file-encryptor/pkg/parity"
+)
+
+// Files with parity carry Reed–Solomon parity shards after every group of
+// data records:
+//
+//	[record 0]...[record k-1][shard 0]...[shard m-1][record k]...
+//
+// The shards are computed over the encoded records, nonce and length
+// prefix included, with shorter records padded with zeros, and are as
+// long as the first record of their group. The final group may hold fewer
+// than k records; the missing ones count as zeros. Since every record but
+// the final one is full, the position of any record still follows from
+// its index, and a damaged record can be rebuilt from the other records
+// and the shards of its group without trusting its length prefix.
+//
+// The shards are not authenticated themselves. A rebuilt record is only
+// accepted once it authenticates like any other.
+
+// parityShards returns the number of data and parity shards per group that
+// adds the given percentage of parity: the smallest group for which it is
+// exact.
+func parityShards(percent int) (data, parity int) {
+	g := gcd(percent, 100)
+	return 100 / g, percent / g
+}
+
+// gcd returns the greatest common divisor of a and b.
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// layout returns the layout of new files written with cfg.
+func (cfg *streamConfig) layout() layout {
+	l := layout{chunkSize: int64(cfg.chunkSize), dataShards: 1}
+	if cfg.parityShards > 0 {
+		l.dataShards, l.parityShards = int64(cfg.dataShards), int64(cfg.parityShards)
+	}
+
+	return l
+}
+
+// maxRepairTries bounds the combinations of parity shards that repair
+// tries for a group, so that a badly damaged group cannot take a long time
+// to give up on.
+const maxRepairTries = 256
+
+// errParity reports damage that parity could not repair.
+var errParity = errors.New("too much damage to repair from parity")
+
+// parityWriter computes the parity shards of a file as its records are
+// written.
+type parityWriter struct {
+	code *parity.Code
+
+	// shards holds the parity of the records of the current group, of
+	// which there are n so far.
+	shards [][]byte
+	n      int
+}
+
+// newParityWriter returns a parityWriter for a file with header h, or nil
+// if the file has no parity.
+func newParityWriter(h *header) (*parityWriter, error) {
+	if h.parityShards == 0 {
+		return nil, nil
+	}
+
+	code, err := parity.New(h.dataShards, h.parityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	return &parityWriter{code: code}, nil
+}
+
+// add adds the encoded record rec to the parity of its group. Once the
+// group is complete, or rec is the final record, the parity shards are
+// written to w.
+func (p *parityWriter) add(w io.Writer, rec []byte, final bool) error {
+	if p.n == 0 {
+		p.shards = make([][]byte, p.code.Parity())
+		for i := range p.shards {
+			p.shards[i] = make([]byte, len(rec))
+		}
+	}
+
+	p.code.Encode(p.n, rec, p.shards)
+	p.n++
+	if p.n < p.code.Data() && !final {
+		return nil
+	}
+
+	p.n = 0
+	for _, shard := range p.shards {
+		if _, err := w.Write(shard); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// skipParity discards the parity shards that follow the record of c, of
+// recLen bytes, if it ends a group. It is used when a file with parity is
+// read sequentially, which cannot repair damage.
+func (d *Reader) skipParity(c *chunk, recLen int64) error {
+	k := uint64(d.header.dataShards)
+	if c.index%k == 0 {
+		d.shardLen = recLen
+	}
+	if c.index%k != k-1 && !c.final {
+		return nil
+	}
+
+	n := int64(d.header.parityShards) * d.shardLen
+	if m, err := io.CopyN(io.Discard, d.r, n); err != nil {
+		if err == io.EOF && m < n {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	return nil
+}
+
+// repairedGroup holds the chunks of a group rebuilt from parity, or the
+// reason they could not be.
+type repairedGroup struct {
+	// first is the index of the first chunk of the group.
+	first int64
+
+	once   sync.Once
+	chunks map[int64][]byte
+	err    error
+}
+
+// repair rebuilds the chunk with the given index from the other records
+// and the parity shards of its group and returns its plaintext. The chunks
+// of the most recently repaired group are kept, so that a group is decoded
+// once however many of its chunks are damaged or read concurrently.
+func (r *ReaderAt) repair(index int64) ([]byte, error) {
+	first := index / r.dataShards * r.dataShards
+	r.mu.Lock()
+	g := r.repaired
+	if g == nil || g.first != first {
+		g = &repairedGroup{first: first}
+		r.repaired = g
+	}
+	r.mu.Unlock()
+
+	g.once.Do(func() { g.chunks, g.err = r.repairGroup(first, index) })
+	if g.err != nil {
+		// Only damage is certain to fail again; anything else, such as
+		// an I/O error, is retried by the next read.
+		if !errors.Is(g.err, errParity) {
+			r.mu.Lock()
+			if r.repaired == g {
+				r.repaired = nil
+			}
+			r.mu.Unlock()
+		}
+		return nil, g.err
+	}
+
+	pt, ok := g.chunks[index]
+	if !ok {
+		return nil, errParity
+	}
+
+	return pt, nil
+}
+
+// repairGroup rebuilds the damaged chunks of the group that starts with
+// the chunk first and returns their plaintexts by index. Every record of
+// the group that fails to authenticate, and the record of the chunk with
+// the given index, is treated as missing. Since the shards are not
+// authenticated, different combinations of shards are tried until the
+// rebuilt records authenticate.
+func (r *ReaderAt) repairGroup(first, index int64) (map[int64][]byte, error) {
+	code, err := parity.New(int(r.dataShards), int(r.parityShards))
+	if err != nil {
+		return nil, err
+	}
+
+	k, m := r.dataShards, r.parityShards
+	count := min(k, r.chunks-first)
+	recLen := func(i int64) int64 {
+		return recordHeaderSize + r.chunkLen(r.size, i) + tagSize
+	}
+	shardLen := recLen(first)
+
+	// Read the records of the group, each padded to the shard length, and
+	// note which ones authenticate. Records past the end of the final
+	// group are zeros.
+	shards := make([][]byte, k+m)
+	present := make([]bool, k+m)
+	var missing []int64
+	off := r.dataStart + r.recordPos(first)
+	for j := range k {
+		shards[j] = make([]byte, shardLen)
+		present[j] = true
+		if j >= count {
+			continue
+		}
+
+		i := first + j
+		n := recLen(i)
+		if err := readFullAt(r.f, shards[j][:n], off); err != nil {
+			return nil, err
+		}
+		off += n
+		if i == index || r.openEncoded(i, shards[j][:n]) != nil {
+			present[j] = false
+			missing = append(missing, j)
+		}
+	}
+	if int64(len(missing)) > m {
+		return nil, errParity
+	}
+
+	for j := range m {
+		shards[k+j] = make([]byte, shardLen)
+		if err := readFullAt(r.f, shards[k+j], off+j*shardLen); err != nil {
+			return nil, err
+		}
+	}
+
+	// Any e of the m shards rebuild e missing records, so combinations of
+	// shards are tried in turn until one holds no damaged shard. The
+	// number of tries is bounded, as there may be very many of them.
+	pick := make([]int64, len(missing))
+	for i := range pick {
+		pick[i] = int64(i)
+	}
+	for range maxRepairTries {
+		use := append([]bool(nil), present...)
+		for _, j := range pick {
+			use[k+j] = true
+		}
+		if err := code.Reconstruct(shards, use); err != nil {
+			return nil, err
+		}
+
+		chunks := make(map[int64][]byte, len(missing))
+		for _, j := range missing {
+			i := first + j
+			pt, err := r.openRecord(i, bytes.Clone(shards[j][:recLen(i)]))
+			if err != nil {
+				chunks = nil
+				break
+			}
+			chunks[i] = pt
+		}
+		if chunks != nil {
+			return chunks, nil
+		}
+		if !nextCombination(pick, m) {
+			break
+		}
+	}
+
+	return nil, errParity
+}
+
+// nextCombination advances pick, a combination of distinct increasing
+// indices below n, to the next one in lexicographic order, and reports
+// whether there was one.
+func nextCombination(pick []int64, n int64) bool {
+	for i := len(pick) - 1; i >= 0; i-- {
+		if pick[i] < n-int64(len(pick)-i) {
+			pick[i]++
+			for j := i + 1; j < len(pick); j++ {
+				pick[j] = pick[j-1] + 1
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+// openEncoded reports whether the encoded record rec authenticates as the
+// record of the chunk with the given index, without modifying rec.
+func (r *ReaderAt) openEncoded(index int64, rec []byte) error {
+	_, err := r.openRecord(index, bytes.Clone(rec))
+	return err
+}
+
+// openRecord authenticates and decrypts the encoded record rec of the chunk
+// with the given index in place.
+func (r *ReaderAt) openRecord(index int64, rec []byte) ([]byte, error) {
+	ct := rec[recordHeaderSize:]
+	if got := binary.BigEndian.Uint32(rec[nonceSize:recordHeaderSize]); int(got) != len(ct) {
+		return nil, fmt.Errorf("%w %d", errRecordLength, got)
+	}
+
+	return r.sealer.open(recordData, uint64(index), index == r.chunks-1, rec[:nonceSize], ct)
+}
+
+// readFullAt fills p from f at off, reporting a short read as
+// io.ErrUnexpectedEOF.
+func readFullAt(f io.ReaderAt, p []byte, off int64) error {
+	n, err := f.ReadAt(p, off)
+	if n == len(p) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return err
+}
@@ -0,0 +1,284 @@
+package encryption
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ReaderAt gives random access to the plaintext of an encrypted file.
+//
+// Because every chunk except the last holds exactly one chunk of plaintext,
+// the record holding any plaintext offset can be located without reading
+// the records before it. Only the chunks a read touches are read and
+// authenticated, so reading a few bytes from the end of a large file costs
+// one chunk of work.
+//
+// Chunks are authenticated individually, so the integrity record of files
+// written through File, which detects chunks rolled back to an earlier
+// version, is not checked; use OpenFile or Reader for that.
+//
+// Damaged chunks of files with parity are rebuilt from the rest of their
+// group when they are read.
+//
+// ReadAt is safe for concurrent use; Read and Seek share a single offset
+// and are not.
+type ReaderAt struct {
+	layout
+
+	f      io.ReaderAt
+	header *header
+	sealer *sealer
+	meta   *Metadata
+
+	// key is the master key the file was opened with.
+	key *Key
+
+	// dataStart is the file offset of the first data record.
+	dataStart int64
+
+	// chunks is the number of data records, including the final one.
+	chunks int64
+
+	// size is the plaintext size.
+	size int64
+
+	// offset is the position used by Read and Seek.
+	offset int64
+
+	// onRepair, if set, is called with the index of every chunk rebuilt
+	// from parity.
+	onRepair func(chunk int)
+
+	// mu guards the most recently opened chunk, which makes small
+	// sequential reads cost one decryption per chunk, and the most
+	// recently repaired group.
+	mu          sync.Mutex
+	cacheIndex  int64
+	cacheChunk  []byte
+	cacheFilled bool
+	repaired    *repairedGroup
+}
+
+// OpenReaderAt reads the header and metadata record of an encrypted file and
+// returns a ReaderAt over its plaintext. The layout of the remaining records
+// is derived from size; no record is read until it is needed.
+//
+// Args:
+//   - f: The encrypted file
+//   - size: The size of the encrypted file in bytes
+//   - key: Master key of the file, or nil to derive it with kdf.GetKey
+//
+// Returns:
+//   - *ReaderAt: The plaintext reader
+//   - error: Any error that occurred while reading the header or metadata,
+//     or if size cannot be the size of an encrypted file
+func OpenReaderAt(f io.ReaderAt, size int64, key *Key) (*ReaderAt, error) {
+	return openReaderAt(f, size, keySource{key: key})
+}
+
+// openReaderAt implements OpenReaderAt with the master key from keys.
+func openReaderAt(f io.ReaderAt, size int64, keys keySource) (*ReaderAt, error) {
+	if err := rejectLegacy(f, size); err != nil {
+		return nil, err
+	}
+
+	sr := io.NewSectionReader(f, 0, size)
+	head, err := openStream(sr, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	dataStart, err := sr.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	return newReaderAt(f, size, head, dataStart)
+}
+
+// newReaderAt returns a ReaderAt over the data records of a file of the
+// given size whose header and preceding records, read into head, end at
+// dataStart.
+func newReaderAt(f io.ReaderAt, size int64, head *streamHead, dataStart int64) (*ReaderAt, error) {
+	l := head.header.layout()
+	chunks, plaintextSize, err := l.records(size - dataStart)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReaderAt{
+		layout:    l,
+		f:         f,
+		header:    head.header,
+		sealer:    head.sealer,
+		meta:      head.meta,
+		key:       head.key,
+		dataStart: dataStart,
+		chunks:    chunks,
+		size:      plaintextSize,
+	}, nil
+}
+
+// Metadata returns the decrypted metadata record, or nil if the file has none.
+func (r *ReaderAt) Metadata() *Metadata {
+	return r.meta
+}
+
+// Key returns the master key the file was opened with. Files encrypted
+// under it open with the same password without running the KDF again,
+// which lets related files, such as the entries of a container, share one
+// key derivation.
+func (r *ReaderAt) Key() *Key {
+	return r.key
+}
+
+// Size returns the size of the plaintext in bytes.
+func (r *ReaderAt) Size() int64 {
+	return r.size
+}
+
+// ReadAt decrypts len(p) bytes of plaintext starting at off into p. Like
+// any io.ReaderAt it returns a non-nil error whenever it reads fewer than
+// len(p) bytes, which is io.EOF at the end of the plaintext.
+func (r *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	n := 0
+	for n < len(p) {
+		if off >= r.size {
+			return n, io.EOF
+		}
+
+		pt, err := r.chunk(off / r.chunkSize)
+		if err != nil {
+			return n, err
+		}
+
+		m := copy(p[n:], pt[off%r.chunkSize:])
+		n += m
+		off += int64(m)
+	}
+
+	return n, nil
+}
+
+// Read decrypts up to len(p) bytes from the current offset into p.
+func (r *ReaderAt) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if remaining := r.size - r.offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	n, err := r.ReadAt(p, r.offset)
+	r.offset += int64(n)
+
+	return n, err
+}
+
+// Seek sets the offset for the next Read, interpreted according to whence
+// as described by io.Seeker, and returns the new offset.
+func (r *ReaderAt) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	r.offset = offset
+
+	return offset, nil
+}
+
+// chunk returns the authenticated plaintext of the chunk with the given
+// index. The returned slice must not be modified.
+func (r *ReaderAt) chunk(index int64) ([]byte, error) {
+	r.mu.Lock()
+	if r.cacheFilled && r.cacheIndex == index {
+		pt := r.cacheChunk
+		r.mu.Unlock()
+		return pt, nil
+	}
+	r.mu.Unlock()
+
+	pt, err := r.openChunk(index)
+	if err != nil {
+		return nil, recordError(int(index), err)
+	}
+
+	r.mu.Lock()
+	r.cacheIndex, r.cacheChunk, r.cacheFilled = index, pt, true
+	r.mu.Unlock()
+
+	return pt, nil
+}
+
+// openChunk reads and authenticates the record of the chunk with the given
+// index. In files with parity, a record that is damaged is rebuilt from the
+// rest of its group; if that fails, the original damage is reported, unless
+// the group turns out to be cut short.
+func (r *ReaderAt) openChunk(index int64) ([]byte, error) {
+	final := index == r.chunks-1
+	nonce, ct, err := r.readRecordAt(r.f, r.dataStart, index, r.chunkLen(r.size, index))
+	if err == nil {
+		var pt []byte
+		if pt, err = r.sealer.open(recordData, uint64(index), final, nonce, ct); err == nil {
+			return pt, nil
+		}
+	}
+	if r.parityShards == 0 || !(errors.Is(err, errOpen) || errors.Is(err, errRecordLength)) {
+		return nil, err
+	}
+
+	pt, repairErr := r.repair(index)
+	if errors.Is(repairErr, io.ErrUnexpectedEOF) {
+		return nil, repairErr
+	}
+	if repairErr != nil {
+		return nil, err
+	}
+	if r.onRepair != nil {
+		r.onRepair(int(index))
+	}
+
+	return pt, nil
+}
+
+// readRecordAt reads the data record with the given index from a file whose
+// data records start at dataStart. The record's position follows from the
+// index alone, and a length prefix that disagrees with the expected
+// plaintext length is rejected. A prefix that claims a longer record than
+// the size of the file leaves room for, as when a file is cut inside its
+// final group, is reported as a truncation as well.
+func (l layout) readRecordAt(f io.ReaderAt, dataStart, index, ptLen int64) (nonce, ct []byte, err error) {
+	ctLen := ptLen + tagSize
+	buf := make([]byte, recordHeaderSize+ctLen)
+	n, err := f.ReadAt(buf, dataStart+l.recordPos(index))
+	if n < len(buf) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, nil, err
+	}
+
+	if got := int64(binary.BigEndian.Uint32(buf[nonceSize:recordHeaderSize])); got != ctLen {
+		if got > ctLen && got <= l.chunkSize+tagSize {
+			return nil, nil, fmt.Errorf("%w %d: %w", errRecordLength, got, io.ErrUnexpectedEOF)
+		}
+		return nil, nil, fmt.Errorf("%w %d", errRecordLength, got)
+	}
+
+	return buf[:nonceSize], buf[recordHeaderSize:], nil
+}
@@ -0,0 +1,199 @@
+package encryption_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gigatar/file-encryptor/pkg/encryption"
+	"github.com/gigatar/file-encryptor/pkg/kdf"
+)
+
+// encryptForReaderAt encrypts data with metadata through NewWriter and
+// returns the encrypted bytes.
+func encryptForReaderAt(t *testing.T, key *encryption.Key, data []byte) []byte {
+	t.Helper()
+
+	meta := &encryption.Metadata{Name: "disk.img", Mode: 0600, ModTime: time.Unix(1700000000, 0)}
+	var encrypted bytes.Buffer
+	w, err := encryption.NewWriter(&encrypted, key, &encryption.Options{Metadata: meta})
+	if err != nil {
+		t.Fatalf("NewWriter() failed: %v", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	return encrypted.Bytes()
+}
+
+// TestReaderAt verifies that random reads and seeks through OpenReaderAt
+// return the same bytes as the plaintext, including reads spanning chunk
+// boundaries and reads past the end.
+func TestReaderAt(t *testing.T) {
+	// Save original GetKey function and restore it after the test
+	originalGetKey := kdf.GetKey
+	kdf.GetKey = mockGetKey
+	defer func() { kdf.GetKey = originalGetKey }()
+
+	key, err := encryption.NewKey()
+	if err != nil {
+		t.Fatalf("NewKey() failed: %v", err)
+	}
+
+	rng := rand.New(rand.NewPCG(1, 2))
+	for _, size := range []int{0, 1, 64 * 1024, 64*1024 + 1, 300*1024 + 17} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(rng.Uint32())
+		}
+		encrypted := encryptForReaderAt(t, key, data)
+
+		r, err := encryption.OpenReaderAt(bytes.NewReader(encrypted), int64(len(encrypted)), key)
+		if err != nil {
+			t.Fatalf("size %d: OpenReaderAt() failed: %v", size, err)
+		}
+		if r.Size() != int64(size) {
+			t.Fatalf("size %d: Size() = %d", size, r.Size())
+		}
+		if r.Metadata() == nil || r.Metadata().Name != "disk.img" {
+			t.Errorf("size %d: Metadata() = %+v", size, r.Metadata())
+		}
+
+		for i := 0; i < 50 && size > 0; i++ {
+			off := rng.IntN(size)
+			n := rng.IntN(3 * 64 * 1024)
+			buf := make([]byte, n)
+			got, err := r.ReadAt(buf, int64(off))
+			want := min(n, size-off)
+			if got != want {
+				t.Fatalf("size %d: ReadAt(%d, %d) read %d bytes, want %d", size, n, off, got, want)
+			}
+			if got < n && err != io.EOF {
+				t.Fatalf("size %d: short ReadAt() returned %v, want io.EOF", size, err)
+			}
+			if got == n && err != nil {
+				t.Fatalf("size %d: ReadAt() failed: %v", size, err)
+			}
+			if !bytes.Equal(buf[:got], data[off:off+got]) {
+				t.Fatalf("size %d: ReadAt(%d, %d) returned wrong data", size, n, off)
+			}
+		}
+
+		// The last bytes, read through Seek and Read.
+		tail := min(size, 1000)
+		if _, err := r.Seek(-int64(tail), io.SeekEnd); err != nil {
+			t.Fatalf("size %d: Seek() failed: %v", size, err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("size %d: ReadAll() failed: %v", size, err)
+		}
+		if !bytes.Equal(got, data[size-tail:]) {
+			t.Errorf("size %d: tail does not match original", size)
+		}
+	}
+}
+
+// TestReaderAtTamper verifies that a damaged chunk is reported only by
+// reads that touch it, and that a truncated file is detected.
+func TestReaderAtTamper(t *testing.T) {
+	// Save original GetKey function and restore it after the test
+	originalGetKey := kdf.GetKey
+	kdf.GetKey = mockGetKey
+	defer func() { kdf.GetKey = originalGetKey }()
+
+	key, err := encryption.NewKey()
+	if err != nil {
+		t.Fatalf("NewKey() failed: %v", err)
+	}
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 3*64*1024/16+100)
+	encrypted := encryptForReaderAt(t, key, data)
+
+	// Flip a bit in the middle of the second chunk.
+	damaged := bytes.Clone(encrypted)
+	damaged[len(damaged)-64*1024-100] ^= 1
+	r, err := encryption.OpenReaderAt(bytes.NewReader(damaged), int64(len(damaged)), key)
+	if err != nil {
+		t.Fatalf("OpenReaderAt() failed: %v", err)
+	}
+	buf := make([]byte, 100)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		t.Errorf("ReadAt() of an intact chunk failed: %v", err)
+	}
+	if _, err := r.ReadAt(buf, 2*64*1024+10); err == nil {
+		t.Error("ReadAt() of a damaged chunk succeeded")
+	}
+
+	// Dropping the final chunk leaves a file whose last record is full.
+	truncated := encrypted[:len(encrypted)-16-16-1600]
+	if _, err := encryption.OpenReaderAt(bytes.NewReader(truncated), int64(len(truncated)), key); err == nil {
+		t.Error("OpenReaderAt() accepted a truncated file")
+	}
+
+	// Cutting a full chunk short makes it look final, which fails to authenticate.
+	cut := encrypted[:len(encrypted)-16-16-1600-1000]
+	r, err = encryption.OpenReaderAt(bytes.NewReader(cut), int64(len(cut)), key)
+	if err != nil {
+		t.Fatalf("OpenReaderAt() failed: %v", err)
+	}
+	if _, err := r.ReadAt(buf, r.Size()-10); err == nil {
+		t.Error("ReadAt() of a cut chunk succeeded")
+	}
+}
+
+// TestDecryptRange verifies that DecryptRange writes exactly the requested
+// range, counts negative offsets from the end and clips to the plaintext.
+func TestDecryptRange(t *testing.T) {
+	// Save original GetKey function and restore it after the test
+	originalGetKey := kdf.GetKey
+	kdf.GetKey = mockGetKey
+	defer func() { kdf.GetKey = originalGetKey }()
+
+	tempDir := t.TempDir()
+	inputPath := filepath.Join(tempDir, "app.log")
+	encryptedPath := filepath.Join(tempDir, "app.log.enc")
+	outputPath := filepath.Join(tempDir, "range.log")
+
+	data := bytes.Repeat([]byte("GET /healthz 200\n"), 20000)
+	if err := os.WriteFile(inputPath, data, 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	if err := encryption.EncryptFile(inputPath, encryptedPath); err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+
+	size := int64(len(data))
+	tests := []struct {
+		name           string
+		offset, length int64
+		want           []byte
+	}{
+		{"middle", 100000, 70000, data[100000:170000]},
+		{"rest", 300000, -1, data[300000:]},
+		{"tail", -5000, -1, data[size-5000:]},
+		{"tail longer than file", -size - 10, -1, data},
+		{"past end", size + 10, 10, nil},
+		{"clipped", size - 10, 100, data[size-10:]},
+	}
+	for _, tt := range tests {
+		if err := encryption.DecryptRange(encryptedPath, outputPath, tt.offset, tt.length); err != nil {
+			t.Fatalf("%s: DecryptRange() failed: %v", tt.name, err)
+		}
+		got, err := os.ReadFile(outputPath)
+		if err != nil {
+			t.Fatalf("%s: Failed to read output: %v", tt.name, err)
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got %d bytes, want %d", tt.name, len(got), len(tt.want))
+		}
+	}
+}
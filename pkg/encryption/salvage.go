@@ -0,0 +1,443 @@
+package encryption
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// Salvaging recovers what it can from a damaged file instead of stopping at
+// the first chunk that fails authentication. Every chunk it writes has
+// authenticated, but the output as a whole has not: chunks may be missing,
+// replaced with zeros, and the end of the file may be lost. It is never
+// used unless asked for explicitly.
+//
+// A damaged chunk is first looked for where the framing says the next
+// record starts. If no record authenticates there, the file is scanned
+// byte by byte for a length prefix of a full chunk, or of a short final
+// chunk ending the file, followed by a record that authenticates under a
+// nearby index. This finds the framing again after bytes were overwritten,
+// lost or inserted.
+
+// SalvageReport describes what SalvageFile recovered from a damaged file.
+type SalvageReport struct {
+	// Chunks is the number of chunks that authenticated and were written.
+	Chunks int64 `json:"chunks"`
+
+	// Repaired is the number of those chunks that were rebuilt from
+	// parity.
+	Repaired int64 `json:"repaired"`
+
+	// Written is the number of bytes written to the output, zero fill
+	// included.
+	Written int64 `json:"written"`
+
+	// MetadataDamaged reports that the metadata or integrity record did
+	// not authenticate. The original file name and attributes are lost.
+	MetadataDamaged bool `json:"metadata_damaged"`
+
+	// Complete reports whether the final chunk authenticated, so that the
+	// end of the plaintext is known to be intact.
+	Complete bool `json:"complete"`
+
+	// Damaged lists the ranges of the file that did not authenticate, in
+	// file order.
+	Damaged []DamagedRange `json:"damaged"`
+}
+
+// DamagedRange is a range of an encrypted file that did not authenticate.
+type DamagedRange struct {
+	// FileOffset and FileLength locate the range in the encrypted file.
+	FileOffset int64 `json:"file_offset"`
+	FileLength int64 `json:"file_length"`
+
+	// FirstChunk is the index of the first chunk lost, and Chunks the
+	// number of chunks lost, which is zero if the range held no data, or
+	// -1 if it reaches the end of the file and cannot be estimated.
+	FirstChunk int64 `json:"first_chunk"`
+	Chunks     int64 `json:"chunks"`
+
+	// PlaintextOffset and PlaintextLength locate the lost plaintext in the
+	// original file. PlaintextLength is -1 if it is unknown.
+	PlaintextOffset int64 `json:"plaintext_offset"`
+	PlaintextLength int64 `json:"plaintext_length"`
+}
+
+// SalvageFile decrypts every chunk of a damaged file that still
+// authenticates into outName and reports the ranges that do not. Lost
+// chunks are replaced with zeros of the same length, so that the rest of
+// the plaintext keeps its offsets, or left out with skipDamaged. Damaged
+// chunks of files with parity are repaired first. The key is derived with
+// kdf.GetKey.
+//
+// The output is NOT authenticated as a whole and must not be trusted like
+// the output of DecryptFile: chunks may be missing or zeroed, and the end of
+// the file may be lost. Directory archives cannot be salvaged.
+//
+// Args:
+//   - inName: Path to the damaged encrypted file
+//   - outName: Path where the salvaged plaintext will be written
+//   - skipDamaged: Leave lost chunks out instead of writing zeros
+//
+// Returns:
+//   - *SalvageReport: What was recovered and which ranges were lost
+//   - error: ErrWrongKey if the key does not match; ErrNotEncrypted or
+//     ErrUnsupportedVersion if the header cannot be read; any other error
+//     if the input is unreadable or the output cannot be written
+func SalvageFile(inName, outName string, skipDamaged bool) (*SalvageReport, error) {
+	return salvageFile(defaultConfig(), inName, outName, skipDamaged)
+}
+
+// salvageFile implements SalvageFile. Progress is reported as the output is
+// written.
+func salvageFile(cfg streamConfig, inName, outName string, skipDamaged bool) (*SalvageReport, error) {
+	inFile, err := os.Open(inName)
+	if err != nil {
+		return nil, err
+	}
+	defer inFile.Close()
+
+	info, err := inFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := newSalvager(&cfg, inFile, info.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	outFile, err := cfg.createOutput(outName)
+	if err != nil {
+		return nil, err
+	}
+	defer outFile.abort()
+
+	s.w = &progressWriter{w: outFile, cfg: &cfg}
+	s.skip = skipDamaged
+	if err := s.run(); err != nil {
+		return nil, err
+	}
+
+	// Without a key check value, a file of which nothing authenticates is
+	// most likely opened with the wrong key.
+	if s.h.keyCheck == nil && s.report.Chunks == 0 && (s.report.MetadataDamaged || s.h.flags&flagMetadata == 0) {
+		return nil, ErrWrongKey
+	}
+
+	if err := outFile.commit(); err != nil {
+		return nil, err
+	}
+
+	return s.report, nil
+}
+
+// salvager recovers the data records of a damaged file.
+type salvager struct {
+	cfg    *streamConfig
+	f      io.ReaderAt
+	size   int64
+	h      *header
+	l      layout
+	sealer *sealer
+
+	// ra repairs damaged records of files with parity. It is nil if the
+	// file has none, or if its size no longer matches its layout.
+	ra *ReaderAt
+
+	// dataStart is the file offset of the first data record, or of the
+	// first record that could not be read before it.
+	dataStart int64
+
+	w      io.Writer
+	skip   bool
+	report *SalvageReport
+}
+
+// newSalvager reads the header of f, of the given size, and the records
+// before the data. Only the header must be intact.
+func newSalvager(cfg *streamConfig, f io.ReaderAt, size int64) (*salvager, error) {
+	sr := io.NewSectionReader(f, 0, size)
+	h, err := readHeader(sr)
+	if err != nil {
+		return nil, err
+	}
+	if h.flags&flagArchive != 0 {
+		return nil, errors.New("directory archives cannot be salvaged")
+	}
+
+	masterKey, err := cfg.keys.forHeader(h)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.checkKey(masterKey); err != nil {
+		return nil, err
+	}
+	sealer, err := newSealer(masterKey, h)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &salvager{
+		cfg:    cfg,
+		f:      f,
+		size:   size,
+		h:      h,
+		l:      h.layout(),
+		sealer: sealer,
+		report: &SalvageReport{Damaged: []DamagedRange{}},
+	}
+	if h.legacy {
+		s.dataStart = saltSize
+	} else if s.dataStart, err = sr.Seek(0, io.SeekCurrent); err != nil {
+		return nil, err
+	}
+
+	// A damaged record before the data leaves the start of the data
+	// unknown; it is found again like any other damage.
+	head := &streamHead{header: h, sealer: sealer}
+	if h.flags&flagMetadata != 0 {
+		pt, err := readSealed(sr, sealer, recordMetadata, maxMetadataSize)
+		if err == nil {
+			head.meta, err = unmarshalMetadata(pt)
+		}
+		if err != nil {
+			s.report.MetadataDamaged = true
+			return s, nil
+		}
+	}
+	if h.flags&flagIntegrity != 0 {
+		if _, err := readSealed(sr, sealer, recordIntegrity, integritySize+tagSize); err != nil {
+			s.report.MetadataDamaged = true
+			return s, nil
+		}
+	}
+	if !h.legacy {
+		if s.dataStart, err = sr.Seek(0, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	}
+
+	if h.parityShards > 0 {
+		if ra, err := newReaderAt(f, size, head, s.dataStart); err == nil {
+			s.ra = ra
+		}
+	}
+	if chunks, plaintextSize, err := s.l.records(size - s.dataStart); err == nil && chunks > 0 {
+		cfg.total = plaintextSize
+	}
+
+	return s, nil
+}
+
+// run writes every data record that authenticates, and zeros in place of
+// those that do not, and records the damage in the report.
+func (s *salvager) run() error {
+	pos, index := s.dataStart, int64(0)
+	for pos < s.size {
+		pt, next, final, err := s.openAt(pos, index)
+		if err != nil && s.ra != nil && pos == s.ra.dataStart+s.l.recordPos(index) && index < s.ra.chunks {
+			pt, next, final, err = s.repairAt(pos, index)
+		}
+		if err == nil {
+			if _, err := s.w.Write(pt); err != nil {
+				return err
+			}
+			s.report.Chunks++
+			s.report.Written += int64(len(pt))
+			pos, index = next, index+1
+			if final {
+				s.report.Complete = true
+				break
+			}
+			continue
+		}
+		if !isDamage(err) {
+			return err
+		}
+
+		found, foundIndex, ok, err := s.resync(pos+1, pos, index)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return s.damage(pos, s.size, index, -1)
+		}
+		if err := s.damage(pos, found, index, foundIndex-index); err != nil {
+			return err
+		}
+		pos, index = found, foundIndex
+	}
+
+	// Anything after the final chunk cannot belong to the file.
+	if s.report.Complete && pos < s.size {
+		return s.damage(pos, s.size, index, 0)
+	}
+
+	return nil
+}
+
+// isDamage reports whether err comes from a damaged record rather than
+// from a failure to read the file.
+func isDamage(err error) bool {
+	return errors.Is(err, errOpen) || errors.Is(err, errRecordLength) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// openAt reads and authenticates the record at pos as the chunk with the
+// given index. It returns the plaintext, the offset of the next record and
+// whether the chunk is the final one.
+func (s *salvager) openAt(pos, index int64) (pt []byte, next int64, final bool, err error) {
+	var prefix [recordHeaderSize]byte
+	if err := readFullAt(s.f, prefix[:], pos); err != nil {
+		return nil, 0, false, err
+	}
+	ctLen := int64(binary.BigEndian.Uint32(prefix[nonceSize:]))
+	if ctLen < tagSize || ctLen > s.l.chunkSize+tagSize {
+		return nil, 0, false, errRecordLength
+	}
+
+	recLen := recordHeaderSize + ctLen
+	rec := make([]byte, recLen)
+	if err := readFullAt(s.f, rec, pos); err != nil {
+		return nil, 0, false, err
+	}
+
+	// Legacy files do not mark their final chunk, which can only be told
+	// by its ending the file.
+	final = ctLen < s.l.chunkSize+tagSize
+	if s.h.legacy {
+		final = pos+recLen == s.size
+	}
+	if pt, err = s.sealer.open(recordData, uint64(index), final, rec[:nonceSize], rec[recordHeaderSize:]); err != nil {
+		return nil, 0, false, err
+	}
+
+	return pt, pos + recLen + s.shardsAfter(index, final, recLen), final, nil
+}
+
+// repairAt rebuilds the chunk with the given index, whose record at pos is
+// damaged, from parity.
+func (s *salvager) repairAt(pos, index int64) (pt []byte, next int64, final bool, err error) {
+	if pt, err = s.ra.repair(index); err != nil {
+		return nil, 0, false, err
+	}
+	s.report.Repaired++
+
+	final = index == s.ra.chunks-1
+	recLen := recordHeaderSize + int64(len(pt)) + tagSize
+	return pt, pos + recLen + s.shardsAfter(index, final, recLen), final, nil
+}
+
+// shardsAfter returns the length of the parity shards that follow the
+// record of recLen bytes of the chunk with the given index.
+func (s *salvager) shardsAfter(index int64, final bool, recLen int64) int64 {
+	k := s.l.dataShards
+	if s.l.parityShards == 0 || (index%k != k-1 && !final) {
+		return 0
+	}
+
+	// The shards are as long as the first record of their group, which is
+	// full unless the final record is alone in it.
+	if final && index%k == 0 {
+		return s.l.parityShards * recLen
+	}
+	return s.l.parityShards * s.l.recordSize()
+}
+
+// plausible reports whether a record at pos with a length prefix of ctLen
+// could be a data record: a full chunk that fits in the file, or a short
+// final chunk that ends it, followed only by its parity shards.
+func (s *salvager) plausible(pos, ctLen int64) bool {
+	end := pos + recordHeaderSize + ctLen
+	if ctLen == s.l.chunkSize+tagSize {
+		return end <= s.size
+	}
+	if ctLen < tagSize || ctLen > s.l.chunkSize+tagSize {
+		return false
+	}
+
+	rest, m := s.size-end, s.l.parityShards
+	return rest == 0 || (m > 0 && (rest == m*s.l.recordSize() || rest == m*(recordHeaderSize+ctLen)))
+}
+
+// resync scans the file from offset from for the next record that
+// authenticates, after the chunk with the given index was found damaged
+// at offset damaged. It returns the offset and index of that record, or
+// false if there is none.
+func (s *salvager) resync(from, damaged, index int64) (pos, found int64, ok bool, err error) {
+	// stride is the average number of bytes taken up by each chunk, which
+	// estimates how many chunks a range of the file held.
+	stride := s.l.groupSize() / s.l.dataShards
+
+	const window = 1 << 20
+	buf := make([]byte, window+recordHeaderSize)
+	for base := from; base < s.size; base += window {
+		if err := s.cfg.canceled(); err != nil {
+			return 0, 0, false, err
+		}
+		n, err := s.f.ReadAt(buf[:min(int64(len(buf)), s.size-base)], base)
+		if err != nil && err != io.EOF {
+			return 0, 0, false, err
+		}
+
+		for i := 0; i < window && i+recordHeaderSize <= n; i++ {
+			p := base + int64(i)
+			ctLen := int64(binary.BigEndian.Uint32(buf[i+nonceSize:]))
+			if !s.plausible(p, ctLen) {
+				continue
+			}
+
+			// The record may also hold the damaged chunk itself, if bytes
+			// were inserted before it.
+			estimate := index + (p-damaged)/stride
+			for _, idx := range []int64{estimate, estimate + 1, estimate - 1} {
+				if idx < index {
+					continue
+				}
+				if _, _, _, err := s.openAt(p, idx); err == nil {
+					return p, idx, true, nil
+				}
+			}
+		}
+	}
+
+	return 0, 0, false, nil
+}
+
+// damage records the range of the file from offset from to offset to as
+// damaged, holding the given number of chunks from first on, and writes
+// zeros for their plaintext unless damaged chunks are skipped. A negative
+// number of chunks is estimated from the length of the range, which must
+// reach the end of the file.
+func (s *salvager) damage(from, to, first, chunks int64) error {
+	r := DamagedRange{
+		FileOffset:      from,
+		FileLength:      to - from,
+		FirstChunk:      first,
+		Chunks:          chunks,
+		PlaintextOffset: first * s.l.chunkSize,
+		PlaintextLength: chunks * s.l.chunkSize,
+	}
+	if chunks < 0 {
+		r.PlaintextLength = -1
+		if n, size, err := s.l.records(to - from); err == nil {
+			r.Chunks, r.PlaintextLength = n, size
+		}
+	}
+	s.report.Damaged = append(s.report.Damaged, r)
+
+	if s.skip {
+		return nil
+	}
+	zeros := make([]byte, min(max(r.PlaintextLength, 0), s.l.chunkSize))
+	for left := r.PlaintextLength; left > 0; left -= int64(len(zeros)) {
+		n, err := s.w.Write(zeros[:min(left, int64(len(zeros)))])
+		s.report.Written += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,307 @@
+package encryption_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gigatar/file-encryptor/pkg/encryption"
+	"github.com/gigatar/file-encryptor/pkg/kdf"
+)
+
+// salvageChunk is the chunk size of the files salvaged in tests, and
+// salvageRecord the encoded size of a full record.
+const (
+	salvageChunk  = 4096
+	salvageRecord = 12 + 4 + salvageChunk + 16
+)
+
+// encryptForSalvage encrypts plaintext into a file with 4 KiB chunks and
+// the given number of bytes of parity shards, and returns its contents and
+// the offset of its first data record.
+func encryptForSalvage(t *testing.T, e *encryption.Encryptor, dir string, plaintext []byte, parity int) ([]byte, int) {
+	t.Helper()
+	in := filepath.Join(dir, "plain.bin")
+	out := filepath.Join(dir, "plain.bin.enc")
+	os.Remove(out)
+	if err := os.WriteFile(in, plaintext, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.EncryptFile(context.Background(), in, out); err != nil {
+		t.Fatalf("EncryptFile() failed: %v", err)
+	}
+	encrypted, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	full := len(plaintext) / salvageChunk
+	body := full*salvageRecord + 32 + len(plaintext)%salvageChunk + parity
+	return encrypted, len(encrypted) - body
+}
+
+// TestSalvageFile verifies that SalvageFile writes every chunk that
+// authenticates, after bytes were overwritten, lost or inserted, and
+// reports where the damage is.
+func TestSalvageFile(t *testing.T) {
+	dir := t.TempDir()
+	plaintext := make([]byte, 10*salvageChunk+1000)
+	for i := range plaintext {
+		plaintext[i] = byte(i*7 + 1)
+	}
+	key := newTestKey(t)
+	e, err := encryption.NewEncryptor(&encryption.Options{Key: key, ChunkSize: salvageChunk})
+	if err != nil {
+		t.Fatalf("NewEncryptor() failed: %v", err)
+	}
+	encrypted, dataStart := encryptForSalvage(t, e, dir, plaintext, 0)
+	pos := func(i int) int { return dataStart + i*salvageRecord }
+
+	// zeroed returns the plaintext with the given chunks replaced by zeros.
+	zeroed := func(chunks ...int) []byte {
+		want := bytes.Clone(plaintext)
+		for _, i := range chunks {
+			clear(want[i*salvageChunk : min((i+1)*salvageChunk, len(want))])
+		}
+		return want
+	}
+
+	tests := []struct {
+		name     string
+		damage   func([]byte) []byte
+		skip     bool
+		want     []byte
+		damaged  []encryption.DamagedRange
+		complete bool
+	}{
+		{
+			name: "overwritten chunk",
+			damage: func(b []byte) []byte {
+				b[pos(3)+100] ^= 0xff
+				return b
+			},
+			want:     zeroed(3),
+			damaged:  []encryption.DamagedRange{{FileOffset: int64(pos(3)), FileLength: salvageRecord, FirstChunk: 3, Chunks: 1, PlaintextOffset: 3 * salvageChunk, PlaintextLength: salvageChunk}},
+			complete: true,
+		},
+		{
+			name: "skipped chunk",
+			damage: func(b []byte) []byte {
+				b[pos(3)+100] ^= 0xff
+				return b
+			},
+			skip:     true,
+			want:     append(bytes.Clone(plaintext[:3*salvageChunk]), plaintext[4*salvageChunk:]...),
+			damaged:  []encryption.DamagedRange{{FileOffset: int64(pos(3)), FileLength: salvageRecord, FirstChunk: 3, Chunks: 1, PlaintextOffset: 3 * salvageChunk, PlaintextLength: salvageChunk}},
+			complete: true,
+		},
+		{
+			name: "damaged length prefix",
+			damage: func(b []byte) []byte {
+				b[pos(4)+13] ^= 0x01
+				return b
+			},
+			want:     zeroed(4),
+			damaged:  []encryption.DamagedRange{{FileOffset: int64(pos(4)), FileLength: salvageRecord, FirstChunk: 4, Chunks: 1, PlaintextOffset: 4 * salvageChunk, PlaintextLength: salvageChunk}},
+			complete: true,
+		},
+		{
+			name: "lost bytes",
+			damage: func(b []byte) []byte {
+				return append(b[:pos(5)+200], b[pos(5)+300:]...)
+			},
+			want:     zeroed(5),
+			damaged:  []encryption.DamagedRange{{FileOffset: int64(pos(5)), FileLength: salvageRecord - 100, FirstChunk: 5, Chunks: 1, PlaintextOffset: 5 * salvageChunk, PlaintextLength: salvageChunk}},
+			complete: true,
+		},
+		{
+			name: "inserted bytes",
+			damage: func(b []byte) []byte {
+				return append(b[:pos(7)], append(bytes.Repeat([]byte{0xaa}, 50), b[pos(7):]...)...)
+			},
+			want:     plaintext,
+			damaged:  []encryption.DamagedRange{{FileOffset: int64(pos(7)), FileLength: 50, FirstChunk: 7, Chunks: 0, PlaintextOffset: 7 * salvageChunk}},
+			complete: true,
+		},
+		{
+			name: "damaged final chunk",
+			damage: func(b []byte) []byte {
+				b[len(b)-20] ^= 0xff
+				return b
+			},
+			want:    zeroed(10),
+			damaged: []encryption.DamagedRange{{FileOffset: int64(pos(10)), FileLength: 1032, FirstChunk: 10, Chunks: 1, PlaintextOffset: 10 * salvageChunk, PlaintextLength: 1000}},
+		},
+		{
+			name: "several damaged chunks",
+			damage: func(b []byte) []byte {
+				b[pos(1)+50] ^= 0xff
+				b[pos(2)+50] ^= 0xff
+				b[pos(8)+4000] ^= 0xff
+				return b
+			},
+			want: zeroed(1, 2, 8),
+			damaged: []encryption.DamagedRange{
+				{FileOffset: int64(pos(1)), FileLength: 2 * salvageRecord, FirstChunk: 1, Chunks: 2, PlaintextOffset: salvageChunk, PlaintextLength: 2 * salvageChunk},
+				{FileOffset: int64(pos(8)), FileLength: salvageRecord, FirstChunk: 8, Chunks: 1, PlaintextOffset: 8 * salvageChunk, PlaintextLength: salvageChunk},
+			},
+			complete: true,
+		},
+	}
+
+	ctx := context.Background()
+	damagedName := filepath.Join(dir, "damaged.bin.enc")
+	out := filepath.Join(dir, "salvaged.bin")
+	for _, tt := range tests {
+		if err := os.WriteFile(damagedName, tt.damage(bytes.Clone(encrypted)), 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(out)
+
+		report, err := e.SalvageFile(ctx, damagedName, out, tt.skip)
+		if err != nil {
+			t.Errorf("%s: SalvageFile() failed: %v", tt.name, err)
+			continue
+		}
+		if got, _ := os.ReadFile(out); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: salvaged %d bytes, want %d with the damaged chunks zeroed or skipped", tt.name, len(got), len(tt.want))
+		}
+		if len(report.Damaged) != len(tt.damaged) {
+			t.Errorf("%s: report lists damage %+v, want %+v", tt.name, report.Damaged, tt.damaged)
+			continue
+		}
+		for i := range tt.damaged {
+			if report.Damaged[i] != tt.damaged[i] {
+				t.Errorf("%s: damaged range %d = %+v, want %+v", tt.name, i, report.Damaged[i], tt.damaged[i])
+			}
+		}
+		if report.Complete != tt.complete || report.Written != int64(len(tt.want)) {
+			t.Errorf("%s: report %+v, want complete %v and %d bytes written", tt.name, report, tt.complete, len(tt.want))
+		}
+	}
+
+	// A file cut off in the middle keeps the chunks before the cut.
+	if err := os.WriteFile(damagedName, encrypted[:pos(8)+1000], 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(out)
+	report, err := e.SalvageFile(ctx, damagedName, out, true)
+	if err != nil {
+		t.Fatalf("SalvageFile() of a truncated file failed: %v", err)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, plaintext[:8*salvageChunk]) || report.Complete {
+		t.Errorf("SalvageFile() of a truncated file: %d bytes, report %+v", len(got), report)
+	}
+
+	// The wrong key is reported as such and leaves no output behind.
+	other := newTestKey(t)
+	wrong, err := encryption.NewEncryptor(&encryption.Options{Key: other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(out)
+	if _, err := wrong.SalvageFile(ctx, damagedName, out, false); !errors.Is(err, encryption.ErrWrongKey) {
+		t.Errorf("SalvageFile() with the wrong key returned %v, want ErrWrongKey", err)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Error("SalvageFile() with the wrong key left output behind")
+	}
+}
+
+// TestSalvageFileParity verifies that SalvageFile repairs damaged chunks
+// from parity and gets past a damaged metadata record.
+func TestSalvageFileParity(t *testing.T) {
+	dir := t.TempDir()
+	plaintext := make([]byte, 10*salvageChunk+1000)
+	for i := range plaintext {
+		plaintext[i] = byte(i * 3)
+	}
+	key := newTestKey(t)
+	e, err := encryption.NewEncryptor(&encryption.Options{Key: key, ChunkSize: salvageChunk, Parity: 20})
+	if err != nil {
+		t.Fatalf("NewEncryptor() failed: %v", err)
+	}
+	// Chunks 0-4 and 5-9 are followed by a full shard each, and the final
+	// chunk, alone in its group, by a shard as long as itself.
+	encrypted, dataStart := encryptForSalvage(t, e, dir, plaintext, 2*salvageRecord+1032)
+
+	ctx := context.Background()
+	damagedName := filepath.Join(dir, "damaged.bin.enc")
+	out := filepath.Join(dir, "salvaged.bin")
+
+	damaged := bytes.Clone(encrypted)
+	damaged[dataStart+2*salvageRecord+100] ^= 0xff
+	if err := os.WriteFile(damagedName, damaged, 0600); err != nil {
+		t.Fatal(err)
+	}
+	report, err := e.SalvageFile(ctx, damagedName, out, false)
+	if err != nil {
+		t.Fatalf("SalvageFile() failed: %v", err)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, plaintext) {
+		t.Error("SalvageFile() did not repair the damaged chunk")
+	}
+	if report.Repaired != 1 || len(report.Damaged) != 0 || !report.Complete {
+		t.Errorf("SalvageFile() report = %+v, want one repaired chunk", report)
+	}
+
+	// The metadata record ends just before the data; its ciphertext is
+	// damaged, so the data has to be found again.
+	damaged = bytes.Clone(encrypted)
+	damaged[dataStart-20] ^= 0xff
+	if err := os.WriteFile(damagedName, damaged, 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(out)
+	report, err = e.SalvageFile(ctx, damagedName, out, false)
+	if err != nil {
+		t.Fatalf("SalvageFile() with damaged metadata failed: %v", err)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, plaintext) {
+		t.Error("SalvageFile() with damaged metadata did not recover the data")
+	}
+	if !report.MetadataDamaged || len(report.Damaged) != 1 || report.Damaged[0].Chunks != 0 || !report.Complete {
+		t.Errorf("SalvageFile() with damaged metadata: report = %+v", report)
+	}
+}
+
+// TestSalvageFileLegacy verifies that files in the legacy format can be
+// salvaged too.
+func TestSalvageFileLegacy(t *testing.T) {
+	// Save original GetKey function and restore it after the test
+	originalGetKey := kdf.GetKey
+	kdf.GetKey = mockGetKey
+	defer func() { kdf.GetKey = originalGetKey }()
+
+	dir := t.TempDir()
+	plaintext := bytes.Repeat([]byte("legacy salvage "), 15000)
+	name := filepath.Join(dir, "legacy.enc")
+	writeLegacyFile(t, name, plaintext)
+
+	const record = 12 + 4 + 64*1024 + 16
+	encrypted, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted[16+record+100] ^= 0xff
+	if err := os.WriteFile(name, encrypted, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(dir, "salvaged.bin")
+	report, err := encryption.SalvageFile(name, out, false)
+	if err != nil {
+		t.Fatalf("SalvageFile() failed: %v", err)
+	}
+	want := bytes.Clone(plaintext)
+	clear(want[64*1024 : 128*1024])
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, want) {
+		t.Error("SalvageFile() of a legacy file did not zero exactly the damaged chunk")
+	}
+	if len(report.Damaged) != 1 || report.Damaged[0].FirstChunk != 1 || !report.Complete {
+		t.Errorf("SalvageFile() report = %+v, want chunk 1 damaged", report)
+	}
+}
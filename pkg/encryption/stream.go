@@ -0,0 +1,917 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"runtime"
+
+	"github.com/gigatar/file-encryptor/pkg/archive"
+	"github.com/gigatar/file-encryptor/pkg/kdf"
+)
+
+// CipherAES256GCM names the AEAD that seals every record. It is the only
+// cipher suite supported.
+const CipherAES256GCM = "AES-256-GCM"
+
+// Options configures an Encryptor, Writer or Reader. A nil *Options selects
+// the defaults.
+type Options struct {
+	// Metadata, if non-nil, is encrypted into the metadata record ahead of
+	// the contents. It is only used by NewWriter.
+	Metadata *Metadata
+
+	// Jobs is the number of chunks sealed or opened concurrently. Zero
+	// selects runtime.GOMAXPROCS(0).
+	Jobs int
+
+	// Key, Password, DeriveKey and GetKey select where master keys come
+	// from, in that order of precedence. Key encrypts every file and opens
+	// only files encrypted under it. Password derives keys with the
+	// parameters in KDF for new files and with the parameters recorded in
+	// existing ones, running Argon2id once per distinct salt. DeriveKey is
+	// used like Password, for callers that derive, cache or limit keys
+	// themselves, such as services that open files chosen by others.
+	// GetKey derives keys with the default parameters. If none is set,
+	// kdf.GetKey is used. They are not used by NewWriter, which takes its
+	// key as an argument.
+	Key       *Key
+	Password  []byte
+	DeriveKey kdf.DeriveKeyFunc
+	GetKey    kdf.GetKeyFunc
+
+	// KDF holds the Argon2id parameters of keys derived from Password or
+	// DeriveKey. The zero value selects kdf.DefaultParams.
+	KDF kdf.Params
+
+	// MaxKDF bounds the Argon2id parameters that an existing file may ask
+	// for before a key is derived for it from Password or DeriveKey.
+	// Files asking for more passes, memory or threads are refused with
+	// ErrKDFTooStrong, so that opening a file chosen by someone else
+	// costs no more than the caller allows. The zero value selects the
+	// larger of KDF and kdf.DefaultParams in each parameter. It may not
+	// exceed kdf.MaxParams.
+	MaxKDF kdf.Params
+
+	// Cipher names the cipher suite. Empty selects CipherAES256GCM, which
+	// is the only one supported.
+	Cipher string
+
+	// ChunkSize is the plaintext size of each chunk of new files. It must
+	// be a power of two from 4 KiB to 16 MiB; zero selects the default of
+	// 64 KiB. Larger chunks cost less per byte for large sequential files,
+	// smaller ones make random access cheaper. Existing files are always
+	// read with the chunk size recorded in their header.
+	ChunkSize int
+
+	// Parity, if not zero, adds Reed–Solomon parity to new files, as a
+	// percentage of the size of the data from 1 to 100. Chunks that fail
+	// authentication are then rebuilt from the parity when the file is
+	// decrypted, verified or read at random offsets, as long as no more
+	// than that share of the chunks around them is damaged. Streams that
+	// are read sequentially, such as stdin, skip the parity and cannot be
+	// repaired.
+	Parity int
+
+	// OnRepair, if set, is called with the index of every chunk that was
+	// rebuilt from parity. It may be called from several goroutines at once.
+	OnRepair func(chunk int)
+
+	// Rand is the source of salts and nonces. Nil selects crypto/rand.
+	Rand io.Reader
+
+	// Progress, if set, is called after every chunk with the number of
+	// plaintext bytes processed so far and the total, or -1 if the total
+	// is not known. It is called from the goroutine that writes the output.
+	Progress func(done, total int64)
+
+	// UnsafeStreaming makes the methods of an Encryptor that write to a
+	// path write their output directly to it as it is produced, instead
+	// of to a temporary file renamed into place once the operation has
+	// succeeded. It is needed to write to pipes and devices, at the cost
+	// of leaving partial output behind when an operation fails.
+	UnsafeStreaming bool
+}
+
+// streamConfig holds the settings shared by writers and readers.
+type streamConfig struct {
+	// rand is the source of file salts and nonces.
+	rand io.Reader
+
+	// jobs is the number of chunks sealed or opened concurrently.
+	jobs int
+
+	// chunkSize is the plaintext size of each chunk of new files. Zero
+	// selects defaultChunkSize.
+	chunkSize int
+
+	// dataShards and parityShards select the parity of new files; zero
+	// parityShards writes none.
+	dataShards, parityShards int
+
+	// onRepair, if set, is called with the index of every chunk rebuilt
+	// from parity.
+	onRepair func(chunk int)
+
+	// keys supplies the master keys.
+	keys keySource
+
+	// ctx, if set, is checked before every chunk.
+	ctx context.Context
+
+	// progress, if set, is called with done after every chunk. total is
+	// the expected plaintext size, or -1 if it is not known.
+	progress    func(done, total int64)
+	done, total int64
+
+	// unsafeStreaming writes outputs directly to their final path.
+	unsafeStreaming bool
+}
+
+// defaultConfig returns the configuration used by the package-level functions.
+func defaultConfig() streamConfig {
+	return streamConfig{rand: rand.Reader, jobs: Jobs, chunkSize: defaultChunkSize, total: -1, unsafeStreaming: UnsafeStreaming}
+}
+
+// config returns the configuration selected by opts, or an error if opts
+// asks for a setting that is not supported.
+func (opts *Options) config() (streamConfig, error) {
+	cfg := defaultConfig()
+	cfg.jobs = runtime.GOMAXPROCS(0)
+	if opts == nil {
+		return cfg, nil
+	}
+
+	if opts.Cipher != "" && opts.Cipher != CipherAES256GCM {
+		return cfg, fmt.Errorf("unsupported cipher %q", opts.Cipher)
+	}
+	if opts.ChunkSize != 0 {
+		if err := validateChunkSize(int64(opts.ChunkSize)); err != nil {
+			return cfg, err
+		}
+		cfg.chunkSize = opts.ChunkSize
+	}
+	if opts.Parity != 0 {
+		if opts.Parity < 1 || opts.Parity > 100 {
+			return cfg, fmt.Errorf("parity %d%% is not between 1%% and 100%%", opts.Parity)
+		}
+		cfg.dataShards, cfg.parityShards = parityShards(opts.Parity)
+	}
+	cfg.onRepair = opts.OnRepair
+	if opts.UnsafeStreaming {
+		cfg.unsafeStreaming = true
+	}
+
+	params := opts.KDF
+	if params == (kdf.Params{}) {
+		params = kdf.DefaultParams
+	}
+	if err := params.Validate(); err != nil {
+		return cfg, err
+	}
+	maxParams := opts.MaxKDF
+	if maxParams == (kdf.Params{}) {
+		maxParams = kdf.Params{
+			Time:    max(params.Time, kdf.DefaultParams.Time),
+			Memory:  max(params.Memory, kdf.DefaultParams.Memory),
+			Threads: max(params.Threads, kdf.DefaultParams.Threads),
+		}
+	}
+	if err := maxParams.Validate(); err != nil {
+		return cfg, fmt.Errorf("MaxKDF: %w", err)
+	}
+	if params.Exceeds(maxParams) {
+		return cfg, errors.New("KDF parameters exceed MaxKDF, so new files could not be opened")
+	}
+
+	switch {
+	case opts.Key != nil:
+		cfg.keys.key = opts.Key
+	case opts.Password != nil:
+		cfg.keys.derive = kdf.NewKeyCacheWithParams(bytes.Clone(opts.Password))
+		cfg.keys.params = params
+		cfg.keys.maxParams = maxParams
+	case opts.DeriveKey != nil:
+		cfg.keys.derive = opts.DeriveKey
+		cfg.keys.params = params
+		cfg.keys.maxParams = maxParams
+	default:
+		cfg.keys.getKey = opts.GetKey
+	}
+
+	if opts.Jobs > 0 {
+		cfg.jobs = opts.Jobs
+	}
+	if opts.Rand != nil {
+		cfg.rand = opts.Rand
+	}
+	cfg.progress = opts.Progress
+
+	return cfg, nil
+}
+
+// canceled returns the error of the context, if it is done.
+func (cfg *streamConfig) canceled() error {
+	if cfg.ctx == nil {
+		return nil
+	}
+
+	return cfg.ctx.Err()
+}
+
+// advance records n more bytes of processed plaintext and reports progress.
+func (cfg *streamConfig) advance(n int) {
+	cfg.done += int64(n)
+	if cfg.progress != nil {
+		cfg.progress(cfg.done, cfg.total)
+	}
+}
+
+// metadata returns the metadata selected by opts.
+func (opts *Options) metadata() *Metadata {
+	if opts == nil {
+		return nil
+	}
+
+	return opts.Metadata
+}
+
+// progressWriter passes writes through to w. Before each write it checks
+// the context of cfg, and after it reports the bytes written as progress.
+type progressWriter struct {
+	w   io.Writer
+	cfg *streamConfig
+}
+
+// Write writes p to the underlying writer unless the context is done.
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	if err := pw.cfg.canceled(); err != nil {
+		return 0, err
+	}
+
+	n, err := pw.w.Write(p)
+	pw.cfg.advance(n)
+
+	return n, err
+}
+
+// Writer encrypts everything written to it into the chunked file format.
+//
+// Plaintext is buffered until a whole chunk is available, so the output
+// lags the input by up to one chunk (or one chunk per job). Close must be
+// called to seal the final chunk; without it the stream reads as truncated.
+// Close does not close the underlying writer.
+type Writer struct {
+	streamConfig
+
+	w      io.Writer
+	sealer *sealer
+	index  uint64
+
+	// parity computes the parity shards of files with parity, or is nil.
+	parity *parityWriter
+
+	// buf holds plaintext that has not been sealed yet. Its capacity is
+	// one chunk per job.
+	buf []byte
+
+	// commit, if set, is called by Close once the final chunk has been
+	// written.
+	commit func() error
+
+	err    error
+	closed bool
+}
+
+// NewWriter writes a fresh header to w, followed by the encrypted metadata
+// record if opts has one, and returns a Writer that encrypts the contents
+// under a payload key derived from key.
+//
+// Args:
+//   - w: Destination of the encrypted stream
+//   - key: Master key to derive the payload key from
+//   - opts: Optional settings; nil selects the defaults
+//
+// Returns:
+//   - *Writer: The plaintext writer; Close must be called when done
+//   - error: Any error that occurred while writing the header
+func NewWriter(w io.Writer, key *Key, opts *Options) (*Writer, error) {
+	cfg, err := opts.config()
+	if err != nil {
+		return nil, err
+	}
+
+	return newWriter(w, key, opts.metadata(), 0, cfg)
+}
+
+// newWriter implements NewWriter with explicit header flags.
+func newWriter(w io.Writer, key *Key, meta *Metadata, flags uint8, cfg streamConfig) (*Writer, error) {
+	if meta != nil {
+		flags |= flagMetadata
+	}
+	if cfg.jobs < 1 {
+		cfg.jobs = 1
+	}
+	if cfg.chunkSize == 0 {
+		cfg.chunkSize = defaultChunkSize
+	}
+
+	h, err := newHeader(cfg.rand, key, flags, cfg.layout())
+	if err != nil {
+		return nil, err
+	}
+	pw, err := newParityWriter(h)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := newSealer(key.key, h)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(h.raw); err != nil {
+		return nil, err
+	}
+
+	if meta != nil {
+		pt, err := meta.marshal()
+		if err != nil {
+			return nil, err
+		}
+
+		nonce, err := newNonce(cfg.rand)
+		if err != nil {
+			return nil, err
+		}
+		ct := s.seal(recordMetadata, 0, true, nonce, pt)
+		if err := writeRecord(w, nonce, ct); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Writer{
+		streamConfig: cfg,
+		w:            w,
+		sealer:       s,
+		parity:       pw,
+		buf:          make([]byte, 0, cfg.jobs*cfg.chunkSize),
+	}, nil
+}
+
+// ChunkSize returns the number of plaintext bytes per chunk of the stream,
+// as recorded in its header.
+func (w *Writer) ChunkSize() int {
+	return w.chunkSize
+}
+
+// Write encrypts p. Whole chunks are sealed and written as soon as the
+// internal buffer fills up.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.closed {
+		return 0, errors.New("write to closed encryption writer")
+	}
+
+	n := 0
+	for len(p) > 0 {
+		m := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		p = p[m:]
+		n += m
+
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// ReadFrom encrypts everything read from r until EOF. It is used by
+// io.Copy and, with more than one job, runs the chunk pipeline so that
+// reading, sealing and writing overlap.
+func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.closed {
+		return 0, errors.New("write to closed encryption writer")
+	}
+
+	// Complete a partially filled chunk so that the rest of r can be
+	// read in whole chunks.
+	var n int64
+	if rem := len(w.buf) % w.chunkSize; rem != 0 {
+		m, err := io.ReadFull(r, w.buf[len(w.buf):len(w.buf)+w.chunkSize-rem])
+		w.buf = w.buf[:len(w.buf)+m]
+		n += int64(m)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	if err := w.flush(); err != nil {
+		return n, err
+	}
+
+	if w.jobs > 1 {
+		m, err := w.readFromParallel(r)
+		if err != nil {
+			w.err = err
+		}
+		return n + m, err
+	}
+
+	for {
+		m, err := io.ReadFull(r, w.buf[:w.chunkSize])
+		w.buf = w.buf[:m]
+		n += int64(m)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if err := w.flush(); err != nil {
+			return n, err
+		}
+	}
+}
+
+// flush seals and writes every whole chunk in the buffer and keeps the
+// remainder for later. Whole chunks are never final: the stream always ends
+// with a shorter chunk written by Close.
+func (w *Writer) flush() error {
+	whole := len(w.buf) / w.chunkSize
+	if whole == 0 {
+		return nil
+	}
+
+	chunks := make([][]byte, whole)
+	for i := range chunks {
+		chunks[i] = w.buf[i*w.chunkSize : (i+1)*w.chunkSize]
+	}
+	if err := w.sealChunks(chunks, false); err != nil {
+		w.err = err
+		return err
+	}
+
+	w.buf = w.buf[:copy(w.buf, w.buf[whole*w.chunkSize:])]
+
+	return nil
+}
+
+// sealChunks seals the given plaintext chunks, concurrently when more than
+// one job is configured, and writes them in order. Nonces are drawn in
+// chunk order, so the output does not depend on the number of jobs.
+func (w *Writer) sealChunks(chunks [][]byte, lastFinal bool) error {
+	if err := w.canceled(); err != nil {
+		return err
+	}
+
+	batch := make([]*chunk, len(chunks))
+	for i, pt := range chunks {
+		nonce, err := newNonce(w.rand)
+		if err != nil {
+			return err
+		}
+		batch[i] = &chunk{
+			index: w.index,
+			final: lastFinal && i == len(chunks)-1,
+			nonce: nonce,
+			data:  pt,
+		}
+		w.index++
+	}
+
+	forEach(batch, w.jobs, func(c *chunk) {
+		c.data = w.sealer.seal(recordData, c.index, c.final, c.nonce, c.data)
+	})
+
+	for _, c := range batch {
+		if err := w.emit(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// emit writes the record of a sealed chunk, followed by the parity shards
+// of its group if it completes one, and reports its plaintext as progress.
+func (w *Writer) emit(c *chunk) error {
+	rec := encodeRecord(c.nonce, c.data)
+	if _, err := w.w.Write(rec); err != nil {
+		return err
+	}
+	if w.parity != nil {
+		if err := w.parity.add(w.w, rec, c.final); err != nil {
+			return err
+		}
+	}
+	w.advance(len(c.data) - tagSize)
+
+	return nil
+}
+
+// Close seals any buffered plaintext and the final chunk. It does not close
+// the underlying writer. Calling Close more than once has no effect.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.closed {
+		return nil
+	}
+
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if err := w.sealChunks([][]byte{w.buf}, true); err != nil {
+		w.err = err
+		return err
+	}
+	if w.commit != nil {
+		if err := w.commit(); err != nil {
+			w.err = err
+			return err
+		}
+	}
+	w.closed = true
+
+	return nil
+}
+
+// Reader decrypts and authenticates a stream written by Writer.
+//
+// Every chunk is authenticated before any of its plaintext is returned.
+// Read returns io.EOF only after the final chunk has been authenticated and
+// nothing follows it; a stream that ends early fails with an error instead.
+type Reader struct {
+	streamConfig
+
+	r      io.Reader
+	header *header
+	sealer *sealer
+	meta   *Metadata
+	index  uint64
+
+	// key is the master key the stream was opened with.
+	key *Key
+
+	// integrity is the integrity record of files written through File, and
+	// tagHash accumulates the nonces and tags of the records read so far so
+	// that they can be checked against it after the final chunk.
+	integrity *integrity
+	tagHash   hash.Hash
+
+	// ra, if set, reads and authenticates the data records of a file with
+	// parity at their positions in the file and repairs damaged ones. It is
+	// only set when the stream is a file of known size.
+	ra *ReaderAt
+
+	// shardLen is the length of the parity shards that follow the current
+	// group of records when a file with parity is read sequentially.
+	shardLen int64
+
+	// queue holds authenticated plaintext that has not been read yet.
+	queue [][]byte
+
+	// final is set once the final chunk has been read.
+	final bool
+	err   error
+}
+
+// NewReader reads the header from r, derives the file key from the key
+// source in opts, kdf.GetKey by default, and decrypts the metadata record if the stream has one.
+//
+// Args:
+//   - r: Source of the encrypted stream
+//   - opts: Optional settings; nil selects the defaults
+//
+// Returns:
+//   - *Reader: The plaintext reader
+//   - error: Any error that occurred while reading the header or metadata
+func NewReader(r io.Reader, opts *Options) (*Reader, error) {
+	cfg, err := opts.config()
+	if err != nil {
+		return nil, err
+	}
+
+	return newReader(r, cfg)
+}
+
+// newReader implements NewReader.
+func newReader(r io.Reader, cfg streamConfig) (*Reader, error) {
+	if cfg.jobs < 1 {
+		cfg.jobs = 1
+	}
+
+	head, err := openStream(r, cfg.keys)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Reader{
+		streamConfig: cfg,
+		r:            head.r,
+		header:       head.header,
+		sealer:       head.sealer,
+		meta:         head.meta,
+		key:          head.key,
+		integrity:    head.integrity,
+	}
+	if d.integrity != nil {
+		d.tagHash = sha256.New()
+	}
+
+	return d, nil
+}
+
+// streamHead holds everything that precedes the data records of a file.
+type streamHead struct {
+	header    *header
+	sealer    *sealer
+	meta      *Metadata
+	integrity *integrity
+
+	// key is the master key the file was opened with.
+	key *Key
+
+	// r reads the data records. It differs from the stream passed to
+	// openStream only for legacy files, whose first record was read ahead.
+	r io.Reader
+}
+
+// openStream reads the header, metadata record and integrity record from r
+// and returns a sealer for the rest of the stream, keyed with the master
+// key that keys supplies for the header.
+func openStream(r io.Reader, keys keySource) (*streamHead, error) {
+	h, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	masterKey, err := keys.forHeader(h)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.checkKey(masterKey); err != nil {
+		return nil, err
+	}
+
+	s, err := newSealer(masterKey, h)
+	if err != nil {
+		return nil, err
+	}
+	head := &streamHead{
+		header: h,
+		sealer: s,
+		key:    &Key{salt: h.kdfSalt, key: masterKey, params: h.kdfParams},
+		r:      r,
+	}
+	if h.legacy {
+		head.r = io.MultiReader(bytes.NewReader(h.readAhead), r)
+	}
+
+	if h.flags&flagMetadata != 0 {
+		pt, err := readSealed(r, s, recordMetadata, maxMetadataSize)
+		if errors.Is(err, errOpen) && h.keyCheck == nil {
+			return nil, ErrWrongKey
+		}
+		if err != nil {
+			return nil, fmt.Errorf("metadata: %w", recordError(-1, err))
+		}
+		if head.meta, err = unmarshalMetadata(pt); err != nil {
+			return nil, err
+		}
+	}
+
+	if h.flags&flagIntegrity != 0 {
+		pt, err := readSealed(r, s, recordIntegrity, integritySize+tagSize)
+		if errors.Is(err, errOpen) && h.keyCheck == nil && head.meta == nil {
+			return nil, ErrWrongKey
+		}
+		if err != nil {
+			return nil, fmt.Errorf("integrity record: %w", recordError(-1, err))
+		}
+		if head.integrity, err = unmarshalIntegrity(pt); err != nil {
+			return nil, err
+		}
+	}
+
+	return head, nil
+}
+
+// readSealed reads and authenticates a single record of the given kind
+// that precedes the data records.
+func readSealed(r io.Reader, s *sealer, kind uint8, maxLen int) ([]byte, error) {
+	nonce, ct, err := readRecord(r, maxLen)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return s.open(kind, 0, true, nonce, ct)
+}
+
+// Metadata returns the decrypted metadata record, or nil if the stream has none.
+func (d *Reader) Metadata() *Metadata {
+	return d.meta
+}
+
+// Read decrypts up to len(p) bytes into p.
+func (d *Reader) Read(p []byte) (int, error) {
+	for len(d.queue) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.final {
+			return 0, io.EOF
+		}
+		d.fill()
+	}
+
+	n := copy(p, d.queue[0])
+	d.queue[0] = d.queue[0][n:]
+	if len(d.queue[0]) == 0 {
+		d.queue = d.queue[1:]
+	}
+
+	return n, nil
+}
+
+// WriteTo decrypts the rest of the stream into w. It is used by io.Copy
+// and, with more than one job, runs the chunk pipeline so that reading,
+// opening and writing overlap.
+func (d *Reader) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	for {
+		for len(d.queue) > 0 {
+			m, err := w.Write(d.queue[0])
+			n += int64(m)
+			if err != nil {
+				return n, err
+			}
+			d.queue = d.queue[1:]
+		}
+		if d.err != nil {
+			return n, d.err
+		}
+		if d.final {
+			return n, nil
+		}
+
+		if d.jobs > 1 {
+			m, err := d.writeToParallel(w)
+			if err != nil {
+				d.err = err
+			}
+			return n + m, err
+		}
+		d.fill()
+	}
+}
+
+// fill reads up to one record per job, authenticates them, concurrently
+// when more than one job is configured, and queues their plaintext. Any
+// error is recorded and reported once the chunks before it have been read.
+func (d *Reader) fill() {
+	var batch []*chunk
+	for len(batch) < d.jobs && !d.final {
+		c, err := d.nextRecord()
+		if err != nil {
+			d.err = err
+			break
+		}
+		if c == nil {
+			break
+		}
+		batch = append(batch, c)
+	}
+
+	forEach(batch, d.jobs, func(c *chunk) {
+		c.data, c.err = d.open(c)
+	})
+
+	for _, c := range batch {
+		if c.err != nil {
+			d.err = c.err
+			return
+		}
+		if len(c.data) > 0 {
+			d.queue = append(d.queue, c.data)
+		}
+		d.advance(len(c.data))
+	}
+}
+
+// nextRecord reads the next data record. After the final record it checks
+// that nothing follows. It returns a nil chunk at the end of a legacy file.
+func (d *Reader) nextRecord() (*chunk, error) {
+	if err := d.canceled(); err != nil {
+		return nil, err
+	}
+	if d.header.legacy {
+		return d.nextLegacyRecord()
+	}
+	if d.ra != nil {
+		c := &chunk{index: d.index, final: int64(d.index) == d.ra.chunks-1}
+		d.index++
+		d.final = c.final
+		return c, nil
+	}
+
+	nonce, ct, err := readRecord(d.r, d.header.chunkSize+tagSize)
+	if err != nil {
+		return nil, recordError(int(d.index), err)
+	}
+
+	c := &chunk{index: d.index, final: len(ct)-tagSize < d.header.chunkSize, nonce: nonce, data: ct}
+	d.index++
+	if d.tagHash != nil {
+		d.tagHash.Write(nonce)
+		d.tagHash.Write(ct[len(ct)-tagSize:])
+	}
+	if d.header.parityShards > 0 {
+		if err := d.skipParity(c, recordHeaderSize+int64(len(ct))); err != nil {
+			return nil, recordError(int(c.index), err)
+		}
+	}
+
+	if c.final {
+		d.final = true
+		if err := d.checkEnd(); err != nil {
+			return nil, recordError(int(d.index), err)
+		}
+		if d.integrity != nil && !d.integrity.matches(d.index, d.tagHash) {
+			return nil, recordError(-1, errIntegrity)
+		}
+	}
+
+	return c, nil
+}
+
+// open authenticates and decrypts the record of a data chunk. Records of
+// files with parity that are read through ra are read here, and rebuilt
+// from parity if they are damaged.
+func (d *Reader) open(c *chunk) ([]byte, error) {
+	if d.ra != nil {
+		pt, err := d.ra.openChunk(int64(c.index))
+		if err != nil {
+			return nil, recordError(int(c.index), err)
+		}
+		return pt, nil
+	}
+
+	pt, err := d.sealer.open(recordData, c.index, c.final, c.nonce, c.data)
+	if err != nil {
+		return nil, d.openError(c.index, err)
+	}
+
+	return pt, nil
+}
+
+// openError reports a chunk that failed to authenticate. When it is the
+// first record of a file without a key check, the key is most likely wrong.
+func (d *Reader) openError(index uint64, err error) error {
+	if index == 0 && d.header.keyCheck == nil && d.meta == nil && d.integrity == nil {
+		return ErrWrongKey
+	}
+
+	return recordError(int(index), err)
+}
+
+// checkEnd verifies that nothing follows the final chunk.
+func (d *Reader) checkEnd() error {
+	var extra [1]byte
+	if n, _ := io.ReadFull(d.r, extra[:]); n != 0 {
+		return errTrailing
+	}
+
+	return nil
+}
+
+// isArchive reports whether the stream holds a directory archive.
+func (d *Reader) isArchive() bool {
+	return d.header.flags&flagArchive != 0
+}
+
+// extract decrypts a directory archive into dir, which must exist.
+func (d *Reader) extract(dir string) error {
+	return archive.Extract(d, dir)
+}
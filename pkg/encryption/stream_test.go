@@ -0,0 +1,188 @@
+package encryption_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gigatar/file-encryptor/pkg/encryption"
+	"github.com/gigatar/file-encryptor/pkg/kdf"
+)
+
+// TestWriterReader verifies that data streamed through NewWriter can be read
+// back through NewReader together with its metadata.
+func TestWriterReader(t *testing.T) {
+	// Save original GetKey function and restore it after the test
+	originalGetKey := kdf.GetKey
+	kdf.GetKey = mockGetKey
+	defer func() { kdf.GetKey = originalGetKey }()
+
+	key, err := encryption.NewKey()
+	if err != nil {
+		t.Fatalf("NewKey() failed: %v", err)
+	}
+
+	meta := &encryption.Metadata{Name: "dump.sql", Mode: 0600, ModTime: time.Unix(1700000000, 0)}
+	var encrypted bytes.Buffer
+	w, err := encryption.NewWriter(&encrypted, key, &encryption.Options{Metadata: meta})
+	if err != nil {
+		t.Fatalf("NewWriter() failed: %v", err)
+	}
+
+	testData := bytes.Repeat([]byte("INSERT INTO t VALUES (1);\n"), 10000)
+	if _, err := io.Copy(w, bytes.NewReader(testData)); err != nil {
+		t.Fatalf("Copy() into writer failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	r, err := encryption.NewReader(bytes.NewReader(encrypted.Bytes()), nil)
+	if err != nil {
+		t.Fatalf("NewReader() failed: %v", err)
+	}
+	if got := r.Metadata(); got == nil || got.Name != meta.Name || got.Mode != meta.Mode {
+		t.Errorf("Metadata() = %+v, want %+v", got, meta)
+	}
+
+	var decrypted bytes.Buffer
+	if _, err := io.Copy(&decrypted, r); err != nil {
+		t.Fatalf("Copy() from reader failed: %v", err)
+	}
+	if !bytes.Equal(decrypted.Bytes(), testData) {
+		t.Error("Decrypted stream does not match original")
+	}
+}
+
+// TestReaderWithKey verifies that a Reader given a Key in its Options opens
+// the stream without calling kdf.GetKey and refuses streams encrypted under
+// another key.
+func TestReaderWithKey(t *testing.T) {
+	// Save original GetKey function and restore it after the test
+	originalGetKey := kdf.GetKey
+	kdf.GetKey = mockGetKey
+	defer func() { kdf.GetKey = originalGetKey }()
+
+	key, err := encryption.NewKey()
+	if err != nil {
+		t.Fatalf("NewKey() failed: %v", err)
+	}
+	other, err := encryption.NewKey()
+	if err != nil {
+		t.Fatalf("NewKey() failed: %v", err)
+	}
+
+	var encrypted bytes.Buffer
+	w, err := encryption.NewWriter(&encrypted, key, nil)
+	if err != nil {
+		t.Fatalf("NewWriter() failed: %v", err)
+	}
+	testData := bytes.Repeat([]byte("no password prompt "), 10000)
+	if _, err := w.Write(testData); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	kdf.GetKey = func([]byte) ([]byte, error) {
+		t.Error("kdf.GetKey called for a Reader with a Key")
+		return nil, errors.New("no password")
+	}
+
+	r, err := encryption.NewReader(bytes.NewReader(encrypted.Bytes()), &encryption.Options{Key: key})
+	if err != nil {
+		t.Fatalf("NewReader() failed: %v", err)
+	}
+	decrypted, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll() failed: %v", err)
+	}
+	if !bytes.Equal(decrypted, testData) {
+		t.Error("Decrypted stream does not match original")
+	}
+
+	if _, err := encryption.NewReader(bytes.NewReader(encrypted.Bytes()), &encryption.Options{Key: other}); err == nil {
+		t.Error("NewReader() with another key succeeded")
+	}
+}
+
+// TestWriterWithoutClose verifies that a stream whose Writer was never
+// closed is reported as truncated rather than read as complete.
+func TestWriterWithoutClose(t *testing.T) {
+	// Save original GetKey function and restore it after the test
+	originalGetKey := kdf.GetKey
+	kdf.GetKey = mockGetKey
+	defer func() { kdf.GetKey = originalGetKey }()
+
+	key, err := encryption.NewKey()
+	if err != nil {
+		t.Fatalf("NewKey() failed: %v", err)
+	}
+
+	var encrypted bytes.Buffer
+	w, err := encryption.NewWriter(&encrypted, key, nil)
+	if err != nil {
+		t.Fatalf("NewWriter() failed: %v", err)
+	}
+	if _, err := w.Write(make([]byte, 200*1024)); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+
+	r, err := encryption.NewReader(&encrypted, nil)
+	if err != nil {
+		t.Fatalf("NewReader() failed: %v", err)
+	}
+	if _, err := io.ReadAll(r); err == nil {
+		t.Error("Reading an unclosed stream succeeded")
+	}
+}
+
+// TestEncryptStream verifies that data piped through EncryptStream and
+// EncryptReader can be read back through DecryptStream and DecryptReader.
+func TestEncryptStream(t *testing.T) {
+	// Save original GetKey function and restore it after the test
+	originalGetKey := kdf.GetKey
+	kdf.GetKey = mockGetKey
+	defer func() { kdf.GetKey = originalGetKey }()
+
+	testData := bytes.Repeat([]byte("COPY t FROM stdin;\n"), 20000)
+
+	var encrypted bytes.Buffer
+	if err := encryption.EncryptStream(&encrypted, bytes.NewReader(testData)); err != nil {
+		t.Fatalf("EncryptStream() failed: %v", err)
+	}
+	var decrypted bytes.Buffer
+	if err := encryption.DecryptStream(&decrypted, &encrypted); err != nil {
+		t.Fatalf("DecryptStream() failed: %v", err)
+	}
+	if !bytes.Equal(decrypted.Bytes(), testData) {
+		t.Error("DecryptStream() output does not match original")
+	}
+
+	tempDir := t.TempDir()
+	encryptedPath := filepath.Join(tempDir, "dump.enc")
+	decryptedPath := filepath.Join(tempDir, "dump.sql")
+	if err := encryption.EncryptReader(bytes.NewReader(testData), encryptedPath); err != nil {
+		t.Fatalf("EncryptReader() failed: %v", err)
+	}
+	in, err := os.Open(encryptedPath)
+	if err != nil {
+		t.Fatalf("Failed to open encrypted file: %v", err)
+	}
+	defer in.Close()
+	if err := encryption.DecryptReader(in, decryptedPath); err != nil {
+		t.Fatalf("DecryptReader() failed: %v", err)
+	}
+	got, err := os.ReadFile(decryptedPath)
+	if err != nil {
+		t.Fatalf("Failed to read decrypted file: %v", err)
+	}
+	if !bytes.Equal(got, testData) {
+		t.Error("DecryptReader() output does not match original")
+	}
+}
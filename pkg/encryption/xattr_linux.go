@@ -0,0 +1,62 @@
+//go:build linux
+
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs returns the extended attributes of the open file f.
+func readXattrs(f *os.File) (map[string][]byte, error) {
+	fd := int(f.Fd())
+
+	size, err := unix.Flistxattr(fd, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+
+	names := make([]byte, size)
+	if size, err = unix.Flistxattr(fd, names); err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+
+		n, err := unix.Fgetxattr(fd, string(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, n)
+		if n, err = unix.Fgetxattr(fd, string(name), value); err != nil {
+			return nil, err
+		}
+		xattrs[string(name)] = value[:n]
+	}
+
+	return xattrs, nil
+}
+
+// writeXattrs sets the given extended attributes on the open file f.
+func writeXattrs(f *os.File, xattrs map[string][]byte) error {
+	for name, value := range xattrs {
+		if err := unix.Fsetxattr(int(f.Fd()), name, value, 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
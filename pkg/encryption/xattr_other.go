@@ -0,0 +1,18 @@
+//go:build !linux
+
+package encryption
+
+import (
+	"errors"
+	"os"
+)
+
+// readXattrs reports that extended attributes are not supported on this platform.
+func readXattrs(f *os.File) (map[string][]byte, error) {
+	return nil, errors.New("extended attributes are not supported on this platform")
+}
+
+// writeXattrs reports that extended attributes are not supported on this platform.
+func writeXattrs(f *os.File, xattrs map[string][]byte) error {
+	return errors.New("extended attributes are not supported on this platform")
+}
@@ -4,7 +4,11 @@
 package kdf
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"os"
+	"sync"
 	"syscall"
 
 	"golang.org/x/crypto/argon2"
@@ -23,6 +27,55 @@ const (
 	parallelism = uint32(1)
 )
 
+// Params are the Argon2id cost parameters.
+type Params struct {
+	// Time is the number of passes over memory.
+	Time uint32
+
+	// Memory is the memory usage in KiB.
+	Memory uint32
+
+	// Threads is the number of lanes computed in parallel.
+	Threads uint8
+}
+
+// DefaultParams are the parameters used by DeriveKey.
+var DefaultParams = Params{Time: timeCost, Memory: memoryCost, Threads: uint8(parallelism)}
+
+// Bounds on the parameters accepted by Validate, a small multiple of
+// DefaultParams. Headers are parsed before anything in them can be
+// authenticated, so these bound the work and memory that a crafted file
+// can demand of every reader.
+const (
+	maxTimeCost    = 4 * timeCost
+	maxMemoryCost  = 4 * memoryCost // 256 MiB
+	maxParallelism = 16
+)
+
+// MaxParams are the strongest parameters accepted by Validate.
+var MaxParams = Params{Time: maxTimeCost, Memory: maxMemoryCost, Threads: maxParallelism}
+
+// Exceeds reports whether p asks for more passes, memory or threads than
+// limit.
+func (p Params) Exceeds(limit Params) bool {
+	return p.Time > limit.Time || p.Memory > limit.Memory || p.Threads > limit.Threads
+}
+
+// Validate checks that p can be used with Argon2id and stays within the
+// bounds that every reader accepts.
+func (p Params) Validate() error {
+	switch {
+	case p.Time < 1 || p.Time > maxTimeCost:
+		return fmt.Errorf("Argon2id time cost %d is outside 1..%d", p.Time, maxTimeCost)
+	case p.Threads < 1 || p.Threads > maxParallelism:
+		return fmt.Errorf("Argon2id parallelism %d is outside 1..%d", p.Threads, maxParallelism)
+	case p.Memory < 8*uint32(p.Threads) || p.Memory > maxMemoryCost:
+		return fmt.Errorf("Argon2id memory cost %d KiB is outside %d..%d", p.Memory, 8*uint32(p.Threads), maxMemoryCost)
+	}
+
+	return nil
+}
+
 // DeriveKey derives a cryptographic key from a password and salt using Argon2id.
 // The function uses the following parameters:
 //   - timeCost: 3 iterations
@@ -33,39 +86,153 @@ const (
 // The function is deterministic: the same password and salt will always produce
 // the same key. Different passwords or salts will produce different keys.
 func DeriveKey(password, salt []byte) []byte {
-	return argon2.IDKey(password, salt, timeCost, memoryCost, uint8(parallelism), 32)
+	return DeriveKeyWithParams(password, salt, DefaultParams)
+}
+
+// DeriveKeyWithParams derives a 32-byte key like DeriveKey, but with the
+// given Argon2id parameters, which should have passed Validate.
+func DeriveKeyWithParams(password, salt []byte, p Params) []byte {
+	return argon2.IDKey(password, salt, p.Time, p.Memory, p.Threads, 32)
 }
 
 // GetKeyFunc is the type for the key derivation function that reads a password
-// from stdin and derives a key. This type is used to allow mocking in tests.
+// and derives a key. This type is used to allow mocking in tests.
 type GetKeyFunc func(salt []byte) ([]byte, error)
 
-// DefaultGetKey reads a password from stdin and derives a key using Argon2id.
+// DeriveKeyFunc derives a key for a salt with the given parameters, from a
+// password it already holds.
+type DeriveKeyFunc func(salt []byte, p Params) ([]byte, error)
+
+// DefaultGetKey reads a password from the terminal and derives a key using Argon2id.
 // The password is read securely without echoing to the terminal.
 // The function returns a 32-byte key derived from the password and salt.
 func DefaultGetKey(salt []byte) ([]byte, error) {
-	var password []byte
-	fmt.Print("Enter password: ")
+	password, err := ReadPassword()
+	if err != nil {
+		return nil, err
+	}
+
+	return DeriveKey(password, salt), nil
+}
+
+// ReadPassword prompts for a password and reads it without echoing it.
+//
+// The prompt is written to and the password read from the controlling
+// terminal (/dev/tty) when there is one, so that stdin and stdout remain
+// free to carry data. Without a controlling terminal, stdin is used and the
+// prompt goes to stderr.
+func ReadPassword() ([]byte, error) {
+	return PromptPassword("Enter password: ")
+}
+
+// PromptPassword behaves like ReadPassword but shows prompt instead of the
+// default prompt, such as when both a current and a new password are needed.
+func PromptPassword(prompt string) ([]byte, error) {
+	if tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0); err == nil {
+		defer tty.Close()
+		return readPassword(tty, prompt, int(tty.Fd()))
+	}
+
+	return readPassword(os.Stderr, prompt, int(syscall.Stdin))
+}
+
+// readPassword writes prompt to w and reads the password from the terminal
+// fd, restoring the terminal state afterwards.
+func readPassword(w io.Writer, prompt string, fd int) ([]byte, error) {
+	fmt.Fprint(w, prompt)
 
 	// Set terminal to raw so we don't echo the password
-	state, err := term.MakeRaw(int(syscall.Stdin))
+	state, err := term.MakeRaw(fd)
 	if err != nil {
 		return nil, err
 	}
 
-	if password, err = term.ReadPassword(int(syscall.Stdin)); err != nil {
+	password, err := term.ReadPassword(fd)
+	if restoreErr := term.Restore(fd, state); err == nil {
+		err = restoreErr
+	}
+	if err != nil {
 		return nil, err
 	}
 
-	if restoreErr := term.Restore(int(syscall.Stdin), state); restoreErr != nil {
+	fmt.Fprintln(w)
+
+	return password, nil
+}
+
+// ReadPasswordFile reads a password from the first line of a file, for
+// unattended use. The line ending is not part of the password.
+func ReadPasswordFile(name string) ([]byte, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
 		return nil, err
 	}
 
-	fmt.Println()
+	line, _, _ := bytes.Cut(data, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	if len(line) == 0 {
+		return nil, fmt.Errorf("%s does not contain a password", name)
+	}
 
-	return DeriveKey(password, salt), nil
+	return line, nil
+}
+
+// cacheEntry holds the key derived for one salt and set of parameters.
+type cacheEntry struct {
+	once sync.Once
+	key  []byte
+}
+
+// NewKeyCache returns a GetKeyFunc that derives keys from password and runs
+// Argon2id only once per distinct salt. It lets a batch of files be
+// processed after a single password prompt, and is safe for concurrent use.
+// Keys for different salts are derived in parallel.
+func NewKeyCache(password []byte) GetKeyFunc {
+	derive := NewKeyCacheWithParams(password)
+
+	return func(salt []byte) ([]byte, error) {
+		return derive(salt, DefaultParams)
+	}
+}
+
+// NewKeyCacheWithParams is like NewKeyCache but derives each key with the
+// parameters it is asked for, running Argon2id once per distinct salt and
+// parameters.
+func NewKeyCacheWithParams(password []byte) DeriveKeyFunc {
+	type cacheKey struct {
+		salt   string
+		params Params
+	}
+
+	var mu sync.Mutex
+	entries := make(map[cacheKey]*cacheEntry)
+
+	return func(salt []byte, p Params) ([]byte, error) {
+		if err := p.Validate(); err != nil {
+			return nil, err
+		}
+
+		mu.Lock()
+		k := cacheKey{salt: string(salt), params: p}
+		e, ok := entries[k]
+		if !ok {
+			e = &cacheEntry{}
+			entries[k] = e
+		}
+		mu.Unlock()
+
+		e.once.Do(func() {
+			e.key = DeriveKeyWithParams(password, salt, p)
+		})
+
+		return e.key, nil
+	}
 }
 
 // GetKey is the function used to get the encryption key.
 // It can be replaced in tests to avoid actual password input.
+//
+// Deprecated: Build an encryption.Encryptor with a Key, Password or GetKey
+// in its encryption.Options instead of replacing this hook, which is shared
+// by every package-level function and by Encryptors without a key source.
 var GetKey GetKeyFunc = DefaultGetKey
@@ -3,6 +3,10 @@ package kdf
 
 import (
 	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 )
 
@@ -167,3 +171,121 @@ func TestArgon2Parameters(t *testing.T) {
 		t.Errorf("DeriveKey() key length = %d, want 32", len(key))
 	}
 }
+
+// TestNewKeyCache verifies that the key cache returns the same keys as
+// DeriveKey and is safe for concurrent use.
+func TestNewKeyCache(t *testing.T) {
+	password := []byte("batch-password")
+	getKey := NewKeyCache(password)
+
+	salts := [][]byte{[]byte("salt-one"), []byte("salt-two")}
+	for _, salt := range salts {
+		want := DeriveKey(password, salt)
+
+		var wg sync.WaitGroup
+		keys := make([][]byte, 4)
+		for i := range keys {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				keys[i], _ = getKey(salt)
+			}(i)
+		}
+		wg.Wait()
+
+		for _, key := range keys {
+			if !bytes.Equal(key, want) {
+				t.Errorf("NewKeyCache() key for %q does not match DeriveKey()", salt)
+			}
+		}
+	}
+}
+
+// TestParams verifies that Validate accepts the defaults and rejects
+// parameters outside its bounds, that Exceeds compares every parameter, and
+// that keys derived with different parameters differ.
+func TestParams(t *testing.T) {
+	for _, p := range []Params{DefaultParams, MaxParams} {
+		if err := p.Validate(); err != nil {
+			t.Errorf("%+v.Validate() = %v, want nil", p, err)
+		}
+	}
+
+	invalid := []Params{
+		{Time: 0, Memory: 64, Threads: 1},
+		{Time: maxTimeCost + 1, Memory: 64, Threads: 1},
+		{Time: 1, Memory: 8, Threads: 2},
+		{Time: 1, Memory: maxMemoryCost + 1, Threads: 1},
+		{Time: 1, Memory: 64, Threads: 0},
+		{Time: 1, Memory: maxMemoryCost, Threads: maxParallelism + 1},
+	}
+	for _, p := range invalid {
+		if err := p.Validate(); err == nil {
+			t.Errorf("%+v.Validate() = nil, want an error", p)
+		}
+	}
+
+	if DefaultParams.Exceeds(DefaultParams) {
+		t.Error("DefaultParams.Exceeds(DefaultParams) = true, want false")
+	}
+	for _, p := range []Params{
+		{Time: DefaultParams.Time + 1, Memory: DefaultParams.Memory, Threads: DefaultParams.Threads},
+		{Time: DefaultParams.Time, Memory: DefaultParams.Memory + 1, Threads: DefaultParams.Threads},
+		{Time: DefaultParams.Time, Memory: DefaultParams.Memory, Threads: DefaultParams.Threads + 1},
+	} {
+		if !p.Exceeds(DefaultParams) {
+			t.Errorf("%+v.Exceeds(DefaultParams) = false, want true", p)
+		}
+	}
+
+	password, salt := []byte("password"), []byte("salt-for-params")
+	fast := Params{Time: 1, Memory: 64, Threads: 1}
+	derive := NewKeyCacheWithParams(password)
+	key, err := derive(salt, fast)
+	if err != nil {
+		t.Fatalf("NewKeyCacheWithParams() failed: %v", err)
+	}
+	if !bytes.Equal(key, DeriveKeyWithParams(password, salt, fast)) {
+		t.Error("NewKeyCacheWithParams() key does not match DeriveKeyWithParams()")
+	}
+	other, _ := derive(salt, Params{Time: 2, Memory: 64, Threads: 1})
+	if bytes.Equal(key, other) {
+		t.Error("Keys derived with different parameters are equal")
+	}
+	if _, err := derive(salt, Params{}); err == nil {
+		t.Error("NewKeyCacheWithParams() accepted invalid parameters")
+	}
+}
+
+// TestReadPasswordFile verifies that only the first line of a password file
+// is used and that an empty file is rejected.
+func TestReadPasswordFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"secret", "secret"},
+		{"secret\n", "secret"},
+		{"secret\r\nignored\n", "secret"},
+		{"pass phrase with spaces\n", "pass phrase with spaces"},
+		{"\n", ""},
+	}
+	for i, tt := range tests {
+		name := filepath.Join(dir, fmt.Sprintf("pass%d", i))
+		if err := os.WriteFile(name, []byte(tt.content), 0600); err != nil {
+			t.Fatalf("Failed to write password file: %v", err)
+		}
+
+		got, err := ReadPasswordFile(name)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("ReadPasswordFile(%q) accepted an empty password", tt.content)
+			}
+			continue
+		}
+		if err != nil || string(got) != tt.want {
+			t.Errorf("ReadPasswordFile(%q) = %q, %v; want %q", tt.content, got, err, tt.want)
+		}
+	}
+}
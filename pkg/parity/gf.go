@@ -0,0 +1,69 @@
+package parity
+
+// Arithmetic in GF(2^8) with the reducing polynomial x^8+x^4+x^3+x^2+1
+// (0x11d), for which 2 generates the multiplicative group. Addition is XOR.
+
+// polynomial is the reducing polynomial, without its x^8 term.
+const polynomial = 0x1d
+
+var (
+	// expTable[i] is 2^i. It is doubled in length so that the sum of two
+	// logarithms can index it without a modulo.
+	expTable [510]byte
+
+	// logTable[x] is the discrete logarithm of x to the base 2. logTable[0]
+	// is unused.
+	logTable [256]byte
+
+	// mulTable[a][b] is a*b.
+	mulTable [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x100 | polynomial
+		}
+	}
+
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			mulTable[a][b] = expTable[int(logTable[a])+int(logTable[b])]
+		}
+	}
+}
+
+// mul returns a*b.
+func mul(a, b byte) byte {
+	return mulTable[a][b]
+}
+
+// inv returns the multiplicative inverse of a, which must not be zero.
+func inv(a byte) byte {
+	return expTable[255-int(logTable[a])]
+}
+
+// mulAdd adds f*src to dst element by element. dst must be at least as long
+// as src.
+func mulAdd(dst, src []byte, f byte) {
+	switch f {
+	case 0:
+		return
+	case 1:
+		for i, v := range src {
+			dst[i] ^= v
+		}
+		return
+	}
+
+	t := &mulTable[f]
+	dst = dst[:len(src)]
+	for i, v := range src {
+		dst[i] ^= t[v]
+	}
+}
@@ -0,0 +1,203 @@
+// Package parity implements a systematic Reed–Solomon erasure code over
+// GF(2^8), used to add parity shards to groups of encrypted chunks so that
+// damaged chunks can be rebuilt.
+//
+// A Code with k data shards and m parity shards computes m parity shards
+// from k equally long data shards. Any k of the k+m shards are enough to
+// rebuild the others, so up to m damaged shards can be repaired as long as
+// it is known which ones they are. The parity rows form a Cauchy matrix,
+// every square submatrix of which is invertible.
+//
+// The code does not detect damage by itself: the caller must tell which
+// shards are missing or bad, for example because they fail authentication.
+package parity
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrTooFewShards is returned by Reconstruct when fewer than Data shards
+// are present.
+var ErrTooFewShards = errors.New("too few shards to reconstruct the data")
+
+// Code is a Reed–Solomon code with a fixed number of data and parity
+// shards. It is safe for concurrent use.
+type Code struct {
+	data, parity int
+
+	// matrix holds the Cauchy coefficients, one row per parity shard and
+	// one column per data shard.
+	matrix [][]byte
+}
+
+// New returns a code with the given number of data and parity shards. The
+// total may not exceed 256, the size of the field.
+//
+// Args:
+//   - data: Number of data shards, at least 1
+//   - parity: Number of parity shards, at least 1
+//
+// Returns:
+//   - *Code: The code
+//   - error: An error if the shard counts are out of range
+func New(data, parity int) (*Code, error) {
+	if data < 1 || parity < 1 || data+parity > 256 {
+		return nil, fmt.Errorf("invalid shard counts: %d data and %d parity shards", data, parity)
+	}
+
+	// Cauchy matrix with x_i = data+i and y_j = j, which are all distinct,
+	// so x_i^y_j is never zero.
+	matrix := make([][]byte, parity)
+	for i := range matrix {
+		matrix[i] = make([]byte, data)
+		for j := range matrix[i] {
+			matrix[i][j] = inv(byte(data+i) ^ byte(j))
+		}
+	}
+
+	return &Code{data: data, parity: parity, matrix: matrix}, nil
+}
+
+// Data returns the number of data shards.
+func (c *Code) Data() int {
+	return c.data
+}
+
+// Parity returns the number of parity shards.
+func (c *Code) Parity() int {
+	return c.parity
+}
+
+// Encode adds the contribution of the data shard with the given index to
+// the parity shards. The parity shards must start out zeroed and be at
+// least as long as the shard; a shard that is shorter than the others is
+// treated as if it were padded with zeros. Calling Encode once for every
+// data shard, in any order, leaves the parity of the group in parity.
+//
+// Args:
+//   - index: Index of the data shard, from 0 to Data()-1
+//   - shard: Contents of the data shard
+//   - parity: The Parity() parity shards being computed
+func (c *Code) Encode(index int, shard []byte, parity [][]byte) {
+	for i, p := range parity {
+		mulAdd(p[:len(shard)], shard, c.matrix[i][index])
+	}
+}
+
+// Reconstruct rebuilds the data shards that are not present from the
+// shards that are. shards holds the Data() data shards followed by the
+// Parity() parity shards, all of the same length; present tells which of
+// them hold valid contents. Missing data shards are allocated if they are
+// nil and overwritten otherwise. Missing parity shards are left unchanged.
+//
+// Args:
+//   - shards: The data shards followed by the parity shards
+//   - present: Whether each shard holds valid contents
+//
+// Returns:
+//   - error: ErrTooFewShards if fewer than Data() shards are present
+func (c *Code) Reconstruct(shards [][]byte, present []bool) error {
+	if len(shards) != c.data+c.parity || len(present) != len(shards) {
+		return fmt.Errorf("got %d shards, want %d", len(shards), c.data+c.parity)
+	}
+
+	// Use the present data shards and as many present parity shards as
+	// are needed to make up Data() rows.
+	var rows []int
+	size := -1
+	for i, ok := range present {
+		if !ok || len(rows) == c.data {
+			continue
+		}
+		if size >= 0 && len(shards[i]) != size {
+			return errors.New("shards differ in length")
+		}
+		size = len(shards[i])
+		rows = append(rows, i)
+	}
+	if len(rows) < c.data {
+		return ErrTooFewShards
+	}
+	if rows[len(rows)-1] < c.data {
+		// Every data shard is present.
+		return nil
+	}
+
+	// Each chosen shard is a known combination of the data shards. Invert
+	// that system to express the data shards in terms of the chosen ones.
+	m := make([][]byte, c.data)
+	for r, i := range rows {
+		if i < c.data {
+			m[r] = make([]byte, c.data)
+			m[r][i] = 1
+		} else {
+			m[r] = append([]byte(nil), c.matrix[i-c.data]...)
+		}
+	}
+	decode, err := invert(m)
+	if err != nil {
+		return err
+	}
+
+	for j := 0; j < c.data; j++ {
+		if present[j] {
+			continue
+		}
+		if len(shards[j]) != size {
+			shards[j] = make([]byte, size)
+		} else {
+			clear(shards[j])
+		}
+		for r, i := range rows {
+			mulAdd(shards[j], shards[i], decode[j][r])
+		}
+	}
+
+	return nil
+}
+
+// invert returns the inverse of the square matrix m, which it destroys.
+func invert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	out := make([][]byte, n)
+	for i := range out {
+		out[i] = make([]byte, n)
+		out[i][i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && m[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("singular matrix")
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		out[col], out[pivot] = out[pivot], out[col]
+
+		scale := inv(m[col][col])
+		scaleRow(m[col], scale)
+		scaleRow(out[col], scale)
+
+		for row := 0; row < n; row++ {
+			if row == col || m[row][col] == 0 {
+				continue
+			}
+			f := m[row][col]
+			mulAdd(m[row], m[col], f)
+			mulAdd(out[row], out[col], f)
+		}
+	}
+
+	return out, nil
+}
+
+// scaleRow multiplies every element of row by f.
+func scaleRow(row []byte, f byte) {
+	t := &mulTable[f]
+	for i, v := range row {
+		row[i] = t[v]
+	}
+}
@@ -0,0 +1,137 @@
+package parity
+
+import (
+	"bytes"
+	"errors"
+	"math/rand/v2"
+	"testing"
+)
+
+// TestField verifies the field axioms the code relies on.
+func TestField(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if got := mul(byte(a), inv(byte(a))); got != 1 {
+			t.Fatalf("%d * inv(%d) = %d, want 1", a, a, got)
+		}
+		for b := 0; b < 256; b++ {
+			if mul(byte(a), byte(b)) != mul(byte(b), byte(a)) {
+				t.Fatalf("multiplication of %d and %d is not commutative", a, b)
+			}
+		}
+	}
+
+	// Distributivity over addition for a sample of elements.
+	rng := rand.New(rand.NewPCG(1, 2))
+	for range 10000 {
+		a, b, c := byte(rng.UintN(256)), byte(rng.UintN(256)), byte(rng.UintN(256))
+		if mul(a, b^c) != mul(a, b)^mul(a, c) {
+			t.Fatalf("%d * (%d + %d) is not distributive", a, b, c)
+		}
+	}
+}
+
+// encodeGroup returns data shards of the given length with random
+// contents, followed by their parity.
+func encodeGroup(t *testing.T, c *Code, size int, rng *rand.Rand) [][]byte {
+	t.Helper()
+	shards := make([][]byte, c.Data()+c.Parity())
+	for i := range shards {
+		shards[i] = make([]byte, size)
+	}
+	for i := 0; i < c.Data(); i++ {
+		for j := range shards[i] {
+			shards[i][j] = byte(rng.UintN(256))
+		}
+		c.Encode(i, shards[i], shards[c.Data():])
+	}
+	return shards
+}
+
+// TestReconstruct verifies that any Parity() missing shards can be rebuilt
+// and that more cannot.
+func TestReconstruct(t *testing.T) {
+	rng := rand.New(rand.NewPCG(3, 4))
+	for _, tt := range []struct{ data, parity int }{{1, 1}, {4, 2}, {10, 1}, {20, 5}, {100, 3}, {200, 56}} {
+		c, err := New(tt.data, tt.parity)
+		if err != nil {
+			t.Fatalf("New(%d, %d) error = %v", tt.data, tt.parity, err)
+		}
+		original := encodeGroup(t, c, 257, rng)
+
+		for trial := 0; trial < 20; trial++ {
+			shards := make([][]byte, len(original))
+			present := make([]bool, len(original))
+			for i := range shards {
+				shards[i] = append([]byte(nil), original[i]...)
+				present[i] = true
+			}
+			for _, i := range rng.Perm(len(shards))[:tt.parity] {
+				present[i] = false
+				if i < tt.data {
+					shards[i] = nil
+				}
+			}
+
+			if err := c.Reconstruct(shards, present); err != nil {
+				t.Fatalf("%d+%d: Reconstruct() error = %v", tt.data, tt.parity, err)
+			}
+			for i := 0; i < tt.data; i++ {
+				if !bytes.Equal(shards[i], original[i]) {
+					t.Fatalf("%d+%d: data shard %d was not rebuilt", tt.data, tt.parity, i)
+				}
+			}
+		}
+
+		present := make([]bool, len(original))
+		for i := range present {
+			present[i] = i > tt.parity
+		}
+		if err := c.Reconstruct(original, present); !errors.Is(err, ErrTooFewShards) {
+			t.Errorf("%d+%d: Reconstruct() with too few shards returned %v", tt.data, tt.parity, err)
+		}
+	}
+}
+
+// TestEncodeShortShard verifies that a short data shard is encoded as if
+// it were padded with zeros.
+func TestEncodeShortShard(t *testing.T) {
+	c, err := New(3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	short := []byte{1, 2, 3}
+	padded := []byte{1, 2, 3, 0, 0, 0}
+	a := [][]byte{make([]byte, 6), make([]byte, 6)}
+	b := [][]byte{make([]byte, 6), make([]byte, 6)}
+	c.Encode(2, short, a)
+	c.Encode(2, padded, b)
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			t.Errorf("parity shard %d differs for a short shard", i)
+		}
+	}
+}
+
+// TestNew verifies that invalid shard counts are rejected.
+func TestNew(t *testing.T) {
+	for _, tt := range []struct{ data, parity int }{{0, 1}, {1, 0}, {200, 57}} {
+		if _, err := New(tt.data, tt.parity); err == nil {
+			t.Errorf("New(%d, %d) succeeded, want an error", tt.data, tt.parity)
+		}
+	}
+}
+
+// BenchmarkEncode measures the encoding throughput of a 10% parity code.
+func BenchmarkEncode(b *testing.B) {
+	c, err := New(10, 1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	shard := make([]byte, 64<<10)
+	parity := [][]byte{make([]byte, len(shard))}
+	b.SetBytes(int64(len(shard)))
+	for i := 0; i < b.N; i++ {
+		c.Encode(i%10, shard, parity)
+	}
+}
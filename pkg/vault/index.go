@@ -0,0 +1,111 @@
+package vault
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"time"
+)
+
+// indexVersion is the encoding version of the index.
+const indexVersion = 1
+
+// marshalIndex encodes the entries as:
+//
+//	[version u8][count u32]
+//	([name length u16][name][size u64][mode u32][mtime unix nanoseconds i64]
+//	 [offset u64][length u64][chunk size u32])...
+func marshalIndex(entries []Entry) []byte {
+	buf := []byte{indexVersion}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(entries)))
+	for _, e := range entries {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(e.Name)))
+		buf = append(buf, e.Name...)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(e.Size))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(e.Mode))
+		buf = binary.BigEndian.AppendUint64(buf, uint64(e.ModTime.UnixNano()))
+		buf = binary.BigEndian.AppendUint64(buf, uint64(e.Offset))
+		buf = binary.BigEndian.AppendUint64(buf, uint64(e.Length))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(e.ChunkSize))
+	}
+
+	return buf
+}
+
+// unmarshalIndex decodes an index produced by marshalIndex. The entries
+// must be sorted by name without duplicates, and every name must be valid.
+func unmarshalIndex(b []byte) ([]Entry, error) {
+	errMalformed := errors.New("malformed vault index")
+
+	take := func(n int) ([]byte, bool) {
+		if len(b) < n {
+			return nil, false
+		}
+		v := b[:n]
+		b = b[n:]
+		return v, true
+	}
+
+	v, ok := take(1 + 4)
+	if !ok {
+		return nil, errMalformed
+	}
+	if v[0] != indexVersion {
+		return nil, fmt.Errorf("unsupported vault index version %d", v[0])
+	}
+
+	// Every entry takes at least 2+8+4+8+8+8+4 bytes, which bounds the
+	// allocation for a corrupt count.
+	count := int(binary.BigEndian.Uint32(v[1:]))
+	if count > len(b)/42 {
+		return nil, errMalformed
+	}
+
+	entries := make([]Entry, 0, count)
+	for range count {
+		if v, ok = take(2); !ok {
+			return nil, errMalformed
+		}
+		name, ok := take(int(binary.BigEndian.Uint16(v)))
+		if !ok {
+			return nil, errMalformed
+		}
+		fixed, ok := take(8 + 4 + 8 + 8 + 8 + 4)
+		if !ok {
+			return nil, errMalformed
+		}
+
+		e := Entry{
+			Name:      string(name),
+			Size:      int64(binary.BigEndian.Uint64(fixed[0:8])),
+			Mode:      fs.FileMode(binary.BigEndian.Uint32(fixed[8:12])).Perm(),
+			ModTime:   time.Unix(0, int64(binary.BigEndian.Uint64(fixed[12:20]))),
+			Offset:    int64(binary.BigEndian.Uint64(fixed[20:28])),
+			Length:    int64(binary.BigEndian.Uint64(fixed[28:36])),
+			ChunkSize: int(binary.BigEndian.Uint32(fixed[36:40])),
+		}
+		if err := validName(e.Name); err != nil {
+			return nil, err
+		}
+		if e.Size < 0 || e.Offset < int64(headerSize) || e.Length <= 0 {
+			return nil, errMalformed
+		}
+		entries = append(entries, e)
+	}
+	if len(b) != 0 {
+		return nil, errMalformed
+	}
+
+	if !sort.SliceIsSorted(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name }) {
+		return nil, errMalformed
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Name == entries[i-1].Name {
+			return nil, errMalformed
+		}
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,10 @@
+//go:build !unix && !windows
+
+package vault
+
+import "os"
+
+// lockFile does nothing on platforms without file locking.
+func lockFile(f *os.File, exclusive bool) error {
+	return nil
+}
@@ -0,0 +1,807 @@
+// Package vault implements a single-file container of encrypted files.
+//
+// A vault holds any number of entries, each encrypted as a stream of its
+// own by package encryption, and an encrypted index recording the name,
+// size, mode and modification time of every entry and where its stream
+// lies in the vault. The index and every entry are sealed under one master
+// key, derived once from the password with the salt recorded in the index,
+// so opening a vault runs the KDF once however many entries it holds.
+//
+// File layout:
+//
+//	[magic "FVLT"][version (1 byte)][reserved (3 bytes)][slot 0][slot 1]
+//	[entry stream]...[index stream]...
+//
+// Each slot points at an index stream and has the format:
+//
+//	[generation (8 bytes)][index offset (8 bytes)][index length (8 bytes)][CRC-32 (4 bytes)][reserved (4 bytes)]
+//
+// New entries and a new index are appended to the file, and only become
+// part of the vault once the slot not in use is overwritten to point at the
+// new index with the next generation. The valid slot with the highest
+// generation is the current one, so a crash at any point leaves either the
+// old or the new state intact. Adding an entry never rewrites the others;
+// the space taken by removed entries and old indexes is reclaimed by
+// Compact.
+//
+// Listing a vault reads only its index. Every entry stream records its name
+// in its encrypted metadata, which must match the index when it is opened,
+// so entries cannot be swapped for one another. The slots themselves are
+// not authenticated: pointing a slot at an older index of the same vault
+// rolls it back to that state.
+//
+// Writers take an exclusive lock on the vault file and readers a shared
+// one, so a vault is never modified while another process uses it.
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gigatar/file-encryptor/pkg/encryption"
+)
+
+// Format constants.
+const (
+	// magic identifies a vault file.
+	magic = "FVLT"
+
+	// version is the version of the vault layout.
+	version = 1
+
+	// slotSize is the size of a slot, and headerSize the size of the
+	// header, both slots included.
+	slotSize   = 32
+	headerSize = len(magic) + 4 + 2*slotSize
+)
+
+var (
+	// ErrNotVault is returned when a file is not a vault.
+	ErrNotVault = errors.New("not a vault")
+
+	// ErrLocked is returned when another process holds a conflicting lock
+	// on the vault.
+	ErrLocked = errors.New("vault is in use by another process")
+
+	// ErrNotFound is returned for an entry that the vault does not hold.
+	ErrNotFound = errors.New("no such entry")
+
+	// ErrExists is returned when adding an entry under a name that is
+	// already taken.
+	ErrExists = errors.New("entry already exists")
+
+	// errReadOnly is returned when modifying a vault opened read-only.
+	errReadOnly = errors.New("vault is opened read-only")
+)
+
+// Entry describes a file held in a vault.
+type Entry struct {
+	// Name is the slash-separated path of the entry within the vault.
+	Name string `json:"name"`
+
+	// Size is the plaintext size in bytes.
+	Size int64 `json:"size"`
+
+	// Mode holds the permission bits of the original file.
+	Mode fs.FileMode `json:"mode"`
+
+	// ModTime is the modification time of the original file.
+	ModTime time.Time `json:"mod_time"`
+
+	// Offset and Length locate the encrypted stream of the entry in the
+	// vault. Its chunks, ChunkSize bytes of plaintext each, follow its
+	// header at fixed positions, so any of them can be read directly.
+	Offset    int64 `json:"offset"`
+	Length    int64 `json:"length"`
+	ChunkSize int   `json:"chunk_size"`
+}
+
+// Options configures how a vault is opened.
+type Options struct {
+	// Writable opens the vault for adding and removing entries under an
+	// exclusive lock. Otherwise it is opened read-only under a shared
+	// lock.
+	Writable bool
+
+	// ChunkSize and Jobs are passed on to the encryption.Options of the
+	// Encryptor that seals new entries. Zero selects their defaults.
+	ChunkSize int
+	Jobs      int
+}
+
+// slot is the decoded form of a header slot.
+type slot struct {
+	generation  uint64
+	indexOffset int64
+	indexLength int64
+}
+
+// marshal encodes s with its checksum.
+func (s slot) marshal() []byte {
+	b := make([]byte, slotSize)
+	binary.BigEndian.PutUint64(b[0:], s.generation)
+	binary.BigEndian.PutUint64(b[8:], uint64(s.indexOffset))
+	binary.BigEndian.PutUint64(b[16:], uint64(s.indexLength))
+	binary.BigEndian.PutUint32(b[24:], crc32.ChecksumIEEE(b[:24]))
+	return b
+}
+
+// parseSlot decodes a slot, reporting false if its checksum does not match
+// or it was never written.
+func parseSlot(b []byte) (slot, bool) {
+	if binary.BigEndian.Uint32(b[24:]) != crc32.ChecksumIEEE(b[:24]) {
+		return slot{}, false
+	}
+	s := slot{
+		generation:  binary.BigEndian.Uint64(b[0:]),
+		indexOffset: int64(binary.BigEndian.Uint64(b[8:])),
+		indexLength: int64(binary.BigEndian.Uint64(b[16:])),
+	}
+
+	return s, s.generation > 0
+}
+
+// Vault is an open vault. It is not safe for concurrent use.
+type Vault struct {
+	f    *os.File
+	name string
+	opts Options
+
+	// enc seals new entries and indexes under the master key of the vault,
+	// which every stream in it is sealed under, and opens entries.
+	enc *encryption.Encryptor
+
+	// entries is the index, sorted by name. It includes the changes made
+	// since the last Commit.
+	entries []Entry
+
+	// current is the slot in use and active its position in the header.
+	current slot
+	active  int
+
+	// committed is the size of the file as of the last commit, and end
+	// the offset at which the next stream is appended.
+	committed, end int64
+
+	// dirty is set once the entries differ from the committed index.
+	dirty bool
+}
+
+// Create creates a new, empty vault. Its master key is derived from a fresh
+// salt with the key source of e. It fails if name already exists.
+//
+// Args:
+//   - name: Path of the vault to create
+//   - e: Encryptor holding the key source and KDF settings
+//
+// Returns:
+//   - error: Any error that occurred while writing the vault
+func Create(name string, e *encryption.Encryptor) (err error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		if err != nil {
+			os.Remove(name)
+		}
+	}()
+	if err := lockFile(f, true); err != nil {
+		return err
+	}
+
+	if _, err := f.Seek(int64(headerSize), io.SeekStart); err != nil {
+		return err
+	}
+	cw := &countingWriter{w: f}
+	w, err := e.NewWriter(context.Background(), cw, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(marshalIndex(nil)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	s := slot{generation: 1, indexOffset: int64(headerSize), indexLength: cw.n}
+	if err := writeHeader(f, s); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// writeHeader writes a header whose first slot is s to f.
+func writeHeader(f *os.File, s slot) error {
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	header[len(magic)] = version
+	copy(header[len(magic)+4:], s.marshal())
+
+	_, err := f.WriteAt(header, 0)
+	return err
+}
+
+// Open opens the vault name, locks it and reads its index with the key
+// source of e. Close must be called when done.
+//
+// Args:
+//   - name: Path of the vault
+//   - e: Encryptor holding the key source
+//   - opts: Whether the vault is opened for writing, and the settings of
+//     new entries
+//
+// Returns:
+//   - *Vault: The open vault
+//   - error: ErrLocked if another process holds a conflicting lock;
+//     ErrNotVault if name is not a vault; encryption.ErrWrongKey if the
+//     key does not match; any other error that occurred while reading it
+func Open(name string, e *encryption.Encryptor, opts Options) (*Vault, error) {
+	f, err := openLocked(name, opts.Writable)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := readVault(f, e, opts)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	v.name = name
+
+	return v, nil
+}
+
+// openLocked opens name and locks it. A file that was replaced by Compact
+// while the lock was being taken is opened again.
+func openLocked(name string, exclusive bool) (*os.File, error) {
+	flag := os.O_RDONLY
+	if exclusive {
+		flag = os.O_RDWR
+	}
+
+	for attempt := 0; ; attempt++ {
+		f, err := os.OpenFile(name, flag, 0)
+		if err != nil {
+			return nil, err
+		}
+		if err := lockFile(f, exclusive); err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		opened, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		current, err := os.Stat(name)
+		if err == nil && os.SameFile(opened, current) {
+			return f, nil
+		}
+		f.Close()
+		if attempt == 2 {
+			return nil, fmt.Errorf("%s keeps being replaced", name)
+		}
+	}
+}
+
+// readVault reads the header and index of the vault f and prepares it to
+// be used with opts.
+func readVault(f *os.File, e *encryption.Encryptor, opts Options) (*Vault, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, headerSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		if err == io.EOF {
+			return nil, ErrNotVault
+		}
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(magic)], []byte(magic)) {
+		return nil, ErrNotVault
+	}
+	if header[len(magic)] != version {
+		return nil, fmt.Errorf("%w: vault version %d", encryption.ErrUnsupportedVersion, header[len(magic)])
+	}
+
+	v := &Vault{f: f, opts: opts, active: -1, committed: info.Size(), end: info.Size()}
+	for i := range 2 {
+		off := len(magic) + 4 + i*slotSize
+		s, ok := parseSlot(header[off : off+slotSize])
+		if ok && s.generation > v.current.generation && s.indexOffset >= int64(headerSize) &&
+			s.indexLength > 0 && s.indexOffset+s.indexLength <= info.Size() {
+			v.current, v.active = s, i
+		}
+	}
+	if v.active < 0 {
+		return nil, fmt.Errorf("%w: no valid index slot", ErrNotVault)
+	}
+
+	index, err := e.OpenReaderAt(io.NewSectionReader(f, v.current.indexOffset, v.current.indexLength), v.current.indexLength)
+	if err != nil {
+		return nil, fmt.Errorf("index: %w", err)
+	}
+	if index.Metadata() != nil {
+		return nil, fmt.Errorf("%w: the index slot points at an entry", ErrNotVault)
+	}
+	data, err := io.ReadAll(index)
+	if err != nil {
+		return nil, fmt.Errorf("index: %w", err)
+	}
+	if v.entries, err = unmarshalIndex(data); err != nil {
+		return nil, err
+	}
+	v.enc, err = encryption.NewEncryptor(&encryption.Options{Key: index.Key(), ChunkSize: opts.ChunkSize, Jobs: opts.Jobs})
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// Close releases the lock and closes the vault. Entries added since the
+// last Commit are discarded.
+func (v *Vault) Close() error {
+	if v.dirty && v.opts.Writable {
+		v.f.Truncate(v.committed)
+	}
+
+	return v.f.Close()
+}
+
+// Entries returns the entries of the vault, sorted by name.
+func (v *Vault) Entries() []Entry {
+	return append([]Entry(nil), v.entries...)
+}
+
+// find returns the position of the entry called name in the index and
+// whether it exists.
+func (v *Vault) find(name string) (int, bool) {
+	i := sort.Search(len(v.entries), func(i int) bool { return v.entries[i].Name >= name })
+	return i, i < len(v.entries) && v.entries[i].Name == name
+}
+
+// Stat returns the entry called name.
+func (v *Vault) Stat(name string) (Entry, error) {
+	i, ok := v.find(name)
+	if !ok {
+		return Entry{}, fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+
+	return v.entries[i], nil
+}
+
+// Garbage returns the number of bytes taken up by removed entries, old
+// indexes and anything else that Compact would reclaim.
+func (v *Vault) Garbage() int64 {
+	live := int64(headerSize) + v.current.indexLength
+	for _, e := range v.entries {
+		live += e.Length
+	}
+
+	return max(v.committed-live, 0)
+}
+
+// Add encrypts src into a new entry appended to the vault. The others are
+// left untouched. The entry becomes part of the vault once Commit is called.
+//
+// Args:
+//   - ctx: Stops the copy once it is done
+//   - name: Slash-separated path of the entry, which must be free
+//   - src: Contents of the entry
+//   - mode: Permission bits to record
+//   - modTime: Modification time to record
+//
+// Returns:
+//   - error: ErrExists if the name is taken; any error that occurred while
+//     reading src or writing the vault
+func (v *Vault) Add(ctx context.Context, name string, src io.Reader, mode fs.FileMode, modTime time.Time) (err error) {
+	if !v.opts.Writable {
+		return errReadOnly
+	}
+	if err := validName(name); err != nil {
+		return err
+	}
+	i, ok := v.find(name)
+	if ok {
+		return fmt.Errorf("%s: %w", name, ErrExists)
+	}
+
+	start := v.end
+	defer func() {
+		if err != nil {
+			v.f.Truncate(start)
+		}
+	}()
+	if _, err := v.f.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+
+	cw := &countingWriter{w: v.f}
+	meta := &encryption.Metadata{Name: name, Mode: mode.Perm(), ModTime: modTime}
+	w, err := v.enc.NewWriter(ctx, cw, meta)
+	if err != nil {
+		return err
+	}
+	size, err := io.Copy(w, &contextReader{ctx: ctx, r: src})
+	if err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	entry := Entry{Name: name, Size: size, Mode: mode.Perm(), ModTime: modTime, Offset: start, Length: cw.n, ChunkSize: w.ChunkSize()}
+	v.entries = append(v.entries[:i], append([]Entry{entry}, v.entries[i:]...)...)
+	v.end += cw.n
+	v.dirty = true
+
+	return nil
+}
+
+// AddFile adds the file at path as an entry called name, recording its
+// permissions and modification time.
+func (v *Vault) AddFile(ctx context.Context, path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+
+	return v.Add(ctx, name, f, info.Mode(), info.ModTime())
+}
+
+// Remove removes the entries with the given names from the index. Their
+// streams stay in the file until Compact. The removal takes effect once
+// Commit is called.
+func (v *Vault) Remove(names ...string) error {
+	if !v.opts.Writable {
+		return errReadOnly
+	}
+	for _, name := range names {
+		i, ok := v.find(name)
+		if !ok {
+			return fmt.Errorf("%s: %w", name, ErrNotFound)
+		}
+		v.entries = append(v.entries[:i], v.entries[i+1:]...)
+		v.dirty = true
+	}
+
+	return nil
+}
+
+// Commit appends the index with the changes made since the last commit and
+// switches the vault over to it. Until the header slot is written, which is
+// the only write that is not an append, the vault keeps its previous state.
+func (v *Vault) Commit() error {
+	if !v.dirty {
+		return nil
+	}
+
+	s, err := v.appendIndex(v.f, v.end, v.current.generation+1)
+	if err != nil {
+		v.f.Truncate(v.end)
+		return err
+	}
+	if err := v.f.Sync(); err != nil {
+		return err
+	}
+
+	next := 1 - v.active
+	if _, err := v.f.WriteAt(s.marshal(), int64(len(magic)+4+next*slotSize)); err != nil {
+		return err
+	}
+	if err := v.f.Sync(); err != nil {
+		return err
+	}
+
+	v.current, v.active = s, next
+	v.end += s.indexLength
+	v.committed = v.end
+	v.dirty = false
+
+	return nil
+}
+
+// appendIndex writes the index to f at offset off and returns the slot
+// that points at it with the given generation.
+func (v *Vault) appendIndex(f *os.File, off int64, generation uint64) (slot, error) {
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return slot{}, err
+	}
+
+	cw := &countingWriter{w: f}
+	w, err := v.enc.NewWriter(context.Background(), cw, nil)
+	if err != nil {
+		return slot{}, err
+	}
+	if _, err := w.Write(marshalIndex(v.entries)); err != nil {
+		return slot{}, err
+	}
+	if err := w.Close(); err != nil {
+		return slot{}, err
+	}
+
+	return slot{generation: generation, indexOffset: off, indexLength: cw.n}, nil
+}
+
+// OpenEntry returns a reader over the plaintext of the entry called name,
+// which supports random access. The stream is checked to be the one the
+// index names.
+func (v *Vault) OpenEntry(name string) (*encryption.ReaderAt, error) {
+	e, err := v.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := v.enc.OpenReaderAt(io.NewSectionReader(v.f, e.Offset, e.Length), e.Length)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if meta := r.Metadata(); meta == nil || meta.Name != name || r.Size() != e.Size {
+		return nil, fmt.Errorf("%s: the stream does not match the index", name)
+	}
+
+	return r, nil
+}
+
+// Extract decrypts the entry called name into the directory dir, under its
+// path within the vault, and restores its permissions and modification
+// time. The file is written under a temporary name and renamed into place
+// once it has been authenticated completely.
+//
+// Files are created through an os.Root, and every parent directory must be
+// a real directory rather than a symbolic link, so an entry can never be
+// extracted outside dir. Names that are not local paths on this system,
+// such as those with a drive or a reserved name on Windows, are rejected.
+//
+// Args:
+//   - ctx: Stops the copy once it is done
+//   - name: Name of the entry
+//   - dir: Directory to extract into
+//   - overwrite: Replace an existing file
+//
+// Returns:
+//   - string: Path of the extracted file
+//   - error: Any error that occurred while decrypting or writing the file
+func (v *Vault) Extract(ctx context.Context, name, dir string, overwrite bool) (dest string, err error) {
+	e, err := v.Stat(name)
+	if err != nil {
+		return "", err
+	}
+	local := filepath.FromSlash(name)
+	if !filepath.IsLocal(local) {
+		return "", fmt.Errorf("%s: not a local path on this system", name)
+	}
+	r, err := v.OpenEntry(name)
+	if err != nil {
+		return "", err
+	}
+
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return "", err
+	}
+	defer root.Close()
+
+	dest = filepath.Join(dir, local)
+	if err := makeParents(root, name); err != nil {
+		return "", err
+	}
+	if info, err := root.Lstat(name); err == nil {
+		if !overwrite {
+			return "", fmt.Errorf("%s already exists", dest)
+		}
+		if !info.Mode().IsRegular() {
+			return "", fmt.Errorf("%s exists and is not a regular file", dest)
+		}
+	}
+
+	tmpName := path.Join(path.Dir(name), "."+path.Base(name)+".tmp-"+rand.Text())
+	tmp, err := root.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			root.Remove(tmpName)
+		}
+	}()
+
+	if _, err := io.Copy(tmp, &contextReader{ctx: ctx, r: r}); err != nil {
+		return "", err
+	}
+	if err := tmp.Chmod(e.Mode); err != nil {
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	// os.Root cannot change times or rename, so the parents are checked
+	// again right before the temporary file is renamed by path.
+	if err := makeParents(root, name); err != nil {
+		return "", err
+	}
+	tmpPath := filepath.Join(dir, filepath.FromSlash(tmpName))
+	if err := os.Chtimes(tmpPath, e.ModTime, e.ModTime); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpPath, dest); err != nil {
+		return "", err
+	}
+
+	return dest, nil
+}
+
+// makeParents creates the missing parent directories of name inside root
+// and checks that the existing ones are real directories, so that nothing
+// is extracted through a symbolic link.
+func makeParents(root *os.Root, name string) error {
+	parts := strings.Split(name, "/")
+	for i := 1; i < len(parts); i++ {
+		parent := path.Join(parts[:i]...)
+		if err := root.Mkdir(parent, 0755); err != nil && !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+		info, err := root.Lstat(parent)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s: parent %s is not a directory", name, parent)
+		}
+	}
+
+	return nil
+}
+
+// Compact rewrites the vault without the streams of removed entries and old
+// indexes. The live entry streams are copied as they are, without being
+// decrypted, into a new file that replaces the vault once it is complete.
+// Uncommitted changes are committed first.
+//
+// Returns:
+//   - int64: Number of bytes reclaimed
+//   - error: Any error that occurred while writing the new file; the vault
+//     is left unchanged
+func (v *Vault) Compact(ctx context.Context) (reclaimed int64, err error) {
+	if !v.opts.Writable {
+		return 0, errReadOnly
+	}
+	if err := v.Commit(); err != nil {
+		return 0, err
+	}
+
+	info, err := v.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(v.name), "."+filepath.Base(v.name)+".tmp-*")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if err := lockFile(tmp, true); err != nil {
+		return 0, err
+	}
+
+	entries := append([]Entry(nil), v.entries...)
+	off := int64(headerSize)
+	for i, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		n, err := io.Copy(io.NewOffsetWriter(tmp, off), io.NewSectionReader(v.f, e.Offset, e.Length))
+		if err != nil {
+			return 0, err
+		}
+		entries[i].Offset = off
+		off += n
+	}
+
+	compacted := &Vault{enc: v.enc, entries: entries, opts: v.opts}
+	s, err := compacted.appendIndex(tmp, off, 1)
+	if err != nil {
+		return 0, err
+	}
+	if err := writeHeader(tmp, s); err != nil {
+		return 0, err
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		return 0, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), v.name); err != nil {
+		return 0, err
+	}
+	if d, err := os.Open(filepath.Dir(v.name)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	size := off + s.indexLength
+	v.f.Close()
+	v.f, v.entries, v.current, v.active = tmp, entries, s, 0
+	v.committed, v.end = size, size
+
+	return info.Size() - size, nil
+}
+
+// validName checks that name is a slash-separated relative path without
+// empty, . or .. elements or backslashes, so that extracting it stays
+// inside the target directory on every system.
+func validName(name string) error {
+	if name == "." || !fs.ValidPath(name) || strings.Contains(name, `\`) || len(name) > 0xffff {
+		return fmt.Errorf("invalid entry name %q", name)
+	}
+
+	return nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+// Write writes p to the underlying writer and counts the bytes written.
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// contextReader stops reading once its context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// Read reads from the underlying reader unless the context is done.
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return cr.r.Read(p)
+}
@@ -0,0 +1,393 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gigatar/file-encryptor/pkg/encryption"
+	"github.com/gigatar/file-encryptor/pkg/kdf"
+)
+
+// fastKDF keeps Argon2id cheap in tests.
+var fastKDF = kdf.Params{Time: 1, Memory: 64, Threads: 1}
+
+// newEncryptor returns an Encryptor deriving keys from password.
+func newEncryptor(t *testing.T, password string) *encryption.Encryptor {
+	t.Helper()
+	e, err := encryption.NewEncryptor(&encryption.Options{Password: []byte(password), KDF: fastKDF})
+	if err != nil {
+		t.Fatalf("NewEncryptor() failed: %v", err)
+	}
+	return e
+}
+
+// newVault creates a vault in a temporary directory and returns its path.
+func newVault(t *testing.T, e *encryption.Encryptor) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "test.vault")
+	if err := Create(name, e); err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+	return name
+}
+
+// add adds an entry with the given contents and commits it.
+func add(t *testing.T, v *Vault, name, contents string) {
+	t.Helper()
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := v.Add(context.Background(), name, strings.NewReader(contents), 0640, modTime); err != nil {
+		t.Fatalf("Add(%q) failed: %v", name, err)
+	}
+	if err := v.Commit(); err != nil {
+		t.Fatalf("Commit() failed: %v", err)
+	}
+}
+
+// readEntry returns the plaintext of the entry called name.
+func readEntry(t *testing.T, v *Vault, name string) string {
+	t.Helper()
+	r, err := v.OpenEntry(name)
+	if err != nil {
+		t.Fatalf("OpenEntry(%q) failed: %v", name, err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading %q failed: %v", name, err)
+	}
+	return string(data)
+}
+
+// TestVaultRoundTrip verifies that entries added to a vault survive being
+// reopened, that adding one leaves the bytes of the others untouched and
+// that a removed entry is gone after a commit.
+func TestVaultRoundTrip(t *testing.T) {
+	e := newEncryptor(t, "pw")
+	name := newVault(t, e)
+
+	v, err := Open(name, e, Options{Writable: true, ChunkSize: 4096})
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	big := strings.Repeat("0123456789", 5000)
+	add(t, v, "docs/big.txt", big)
+	add(t, v, "a.txt", "alpha")
+	if err := v.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err = Open(name, newEncryptor(t, "pw"), Options{Writable: true})
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	add(t, v, "b.txt", "beta")
+	v.Close()
+
+	after, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(after[headerSize:len(before)], before[headerSize:]) {
+		t.Error("adding an entry rewrote existing data")
+	}
+
+	v, err = Open(name, newEncryptor(t, "pw"), Options{Writable: true})
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer v.Close()
+
+	var names []string
+	for _, entry := range v.Entries() {
+		names = append(names, entry.Name)
+	}
+	if got := strings.Join(names, ","); got != "a.txt,b.txt,docs/big.txt" {
+		t.Errorf("Entries() = %s, want a.txt,b.txt,docs/big.txt", got)
+	}
+
+	entry, err := v.Stat("docs/big.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Size != int64(len(big)) || entry.Mode != 0640 || entry.ChunkSize != 4096 {
+		t.Errorf("Stat() = %+v", entry)
+	}
+	// Entries added without a chunk size record the one of the stream.
+	if entry, err := v.Stat("b.txt"); err != nil || entry.ChunkSize != 64*1024 {
+		t.Errorf("Stat(b.txt) = %+v, %v; want the default chunk size", entry, err)
+	}
+	if got := readEntry(t, v, "docs/big.txt"); got != big {
+		t.Error("docs/big.txt does not match")
+	}
+
+	if err := v.Remove("a.txt"); err != nil {
+		t.Fatalf("Remove() failed: %v", err)
+	}
+	if err := v.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.OpenEntry("a.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("OpenEntry() of a removed entry error = %v, want ErrNotFound", err)
+	}
+	if err := v.Add(context.Background(), "b.txt", strings.NewReader("x"), 0600, time.Now()); !errors.Is(err, ErrExists) {
+		t.Errorf("Add() of an existing name error = %v, want ErrExists", err)
+	}
+}
+
+// TestVaultUncommitted verifies that entries that were never committed are
+// dropped, leaving the vault as it was.
+func TestVaultUncommitted(t *testing.T) {
+	e := newEncryptor(t, "pw")
+	name := newVault(t, e)
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := Open(name, e, Options{Writable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Add(context.Background(), "a.txt", strings.NewReader("alpha"), 0600, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	v.Close()
+
+	if after, err := os.Stat(name); err != nil || after.Size() != info.Size() {
+		t.Errorf("uncommitted entry was left in the file")
+	}
+	v, err = Open(name, e, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	if len(v.Entries()) != 0 {
+		t.Errorf("Entries() = %v, want none", v.Entries())
+	}
+}
+
+// TestVaultCompact verifies that compacting reclaims the space of removed
+// entries and keeps the others readable.
+func TestVaultCompact(t *testing.T) {
+	e := newEncryptor(t, "pw")
+	name := newVault(t, e)
+
+	v, err := Open(name, e, Options{Writable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	add(t, v, "a.txt", strings.Repeat("a", 10000))
+	add(t, v, "b.txt", "beta")
+	if err := v.Remove("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	reclaimed, err := v.Compact(context.Background())
+	if err != nil {
+		t.Fatalf("Compact() failed: %v", err)
+	}
+	if reclaimed < 10000 {
+		t.Errorf("Compact() reclaimed %d bytes, want at least 10000", reclaimed)
+	}
+	if v.Garbage() != 0 {
+		t.Errorf("Garbage() = %d after Compact, want 0", v.Garbage())
+	}
+	if got := readEntry(t, v, "b.txt"); got != "beta" {
+		t.Errorf("b.txt = %q, want beta", got)
+	}
+
+	// The compacted vault stays writable under the same lock.
+	add(t, v, "c.txt", "gamma")
+	v.Close()
+
+	v, err = Open(name, e, Options{})
+	if err != nil {
+		t.Fatalf("Open() after Compact failed: %v", err)
+	}
+	defer v.Close()
+	if got := readEntry(t, v, "c.txt"); got != "gamma" {
+		t.Errorf("c.txt = %q, want gamma", got)
+	}
+	if len(v.Entries()) != 2 {
+		t.Errorf("Entries() = %v, want b.txt and c.txt", v.Entries())
+	}
+}
+
+// TestVaultExtract verifies that extracting restores the contents, mode and
+// modification time of an entry under its path.
+func TestVaultExtract(t *testing.T) {
+	e := newEncryptor(t, "pw")
+	name := newVault(t, e)
+
+	v, err := Open(name, e, Options{Writable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	add(t, v, "sub/a.txt", "alpha")
+
+	dir := t.TempDir()
+	path, err := v.Extract(context.Background(), "sub/a.txt", dir, false)
+	if err != nil {
+		t.Fatalf("Extract() failed: %v", err)
+	}
+	if path != filepath.Join(dir, "sub", "a.txt") {
+		t.Errorf("Extract() = %s", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "alpha" {
+		t.Errorf("extracted contents = %q, %v", data, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 || !info.ModTime().Equal(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("extracted mode %v, mtime %v", info.Mode(), info.ModTime())
+	}
+
+	if _, err := v.Extract(context.Background(), "sub/a.txt", dir, false); err == nil {
+		t.Error("Extract() over an existing file should fail without overwrite")
+	}
+	if _, err := v.Extract(context.Background(), "sub/a.txt", dir, true); err != nil {
+		t.Errorf("Extract() with overwrite failed: %v", err)
+	}
+
+	// A parent that is a symbolic link is not followed out of dir.
+	outside := t.TempDir()
+	linked := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(linked, "sub")); err != nil {
+		t.Skipf("cannot create symbolic links: %v", err)
+	}
+	if _, err := v.Extract(context.Background(), "sub/a.txt", linked, true); err == nil {
+		t.Error("Extract() through a symbolic link succeeded")
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("Extract() wrote %d file(s) outside the directory", len(entries))
+	}
+}
+
+// TestVaultErrors verifies wrong passwords, locking, invalid names and
+// files that are not vaults.
+func TestVaultErrors(t *testing.T) {
+	e := newEncryptor(t, "pw")
+	name := newVault(t, e)
+
+	if _, err := Open(name, newEncryptor(t, "wrong"), Options{}); !errors.Is(err, encryption.ErrWrongKey) {
+		t.Errorf("Open() with the wrong password error = %v, want ErrWrongKey", err)
+	}
+
+	v, err := Open(name, e, Options{Writable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(name, e, Options{}); !errors.Is(err, ErrLocked) {
+		t.Errorf("Open() of a locked vault error = %v, want ErrLocked", err)
+	}
+	for _, bad := range []string{"", ".", "../x", "/abs", "a//b", "a/./b", `..\..\x`} {
+		if err := v.Add(context.Background(), bad, strings.NewReader("x"), 0600, time.Now()); err == nil {
+			t.Errorf("Add(%q) should fail", bad)
+		}
+	}
+	v.Close()
+
+	r, err := Open(name, e, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Remove("x"); err == nil {
+		t.Error("Remove() on a read-only vault should fail")
+	}
+	r.Close()
+
+	other := filepath.Join(t.TempDir(), "other")
+	if err := os.WriteFile(other, bytes.Repeat([]byte("x"), 200), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(other, e, Options{}); !errors.Is(err, ErrNotVault) {
+		t.Errorf("Open() of a non-vault error = %v, want ErrNotVault", err)
+	}
+	if err := Create(name, e); err == nil {
+		t.Error("Create() over an existing vault should fail")
+	}
+}
+
+// TestVaultTornCommit verifies that a vault whose newest slot was damaged
+// falls back to the previous index.
+func TestVaultTornCommit(t *testing.T) {
+	e := newEncryptor(t, "pw")
+	name := newVault(t, e)
+
+	v, err := Open(name, e, Options{Writable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	add(t, v, "a.txt", "alpha")
+	active := v.active
+	v.Close()
+
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff}, int64(len(magic)+4+active*slotSize+3)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	v, err = Open(name, e, Options{})
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer v.Close()
+	if len(v.Entries()) != 0 {
+		t.Errorf("Entries() = %v, want the empty previous index", v.Entries())
+	}
+}
+
+// TestIndexRejectsMalformed verifies that unmarshalIndex rejects unsorted,
+// duplicate and unsafe entries.
+func TestIndexRejectsMalformed(t *testing.T) {
+	entry := func(name string) Entry {
+		return Entry{Name: name, Size: 1, Offset: int64(headerSize), Length: 10, ChunkSize: 1024}
+	}
+	tests := []struct {
+		name    string
+		entries []Entry
+		wantErr bool
+	}{
+		{"valid", []Entry{entry("a"), entry("b/c")}, false},
+		{"unsorted", []Entry{entry("b"), entry("a")}, true},
+		{"duplicate", []Entry{entry("a"), entry("a")}, true},
+		{"traversal", []Entry{entry("../a")}, true},
+		{"backslash", []Entry{entry(`..\a`)}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := unmarshalIndex(marshalIndex(tt.entries))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unmarshalIndex() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && len(got) != len(tt.entries) {
+				t.Errorf("unmarshalIndex() = %v", got)
+			}
+		})
+	}
+
+	if _, err := unmarshalIndex(marshalIndex([]Entry{entry("a")})[:10]); err == nil {
+		t.Error("unmarshalIndex() of a truncated index should fail")
+	}
+}